@@ -1,6 +1,7 @@
 package azblob
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/url"
@@ -89,10 +90,15 @@ func (s *BackupStoreDriver) updatePath(path string) string {
 
 // List return items that on the backup target including prefixes
 func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
+	return s.ListWithContext(context.Background(), listPath)
+}
+
+// ListWithContext is List that can be cancelled through ctx
+func (s *BackupStoreDriver) ListWithContext(ctx context.Context, listPath string) ([]string, error) {
 	var result []string
 
 	path := s.updatePath(listPath) + "/"
-	contents, err := s.service.listBlobs(path, "/")
+	contents, err := s.service.listBlobs(ctx, path, "/")
 	if err != nil {
 		return result, err
 	}
@@ -116,13 +122,23 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 
 // FileExists checks if file exists on the backup target
 func (s *BackupStoreDriver) FileExists(filePath string) bool {
-	return s.FileSize(filePath) >= 0
+	return s.FileExistsWithContext(context.Background(), filePath)
+}
+
+// FileExistsWithContext is FileExists that can be cancelled through ctx
+func (s *BackupStoreDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return s.FileSizeWithContext(ctx, filePath) >= 0
 }
 
 // FileSize return content length of the filePath on the backup target
 func (s *BackupStoreDriver) FileSize(filePath string) int64 {
+	return s.FileSizeWithContext(context.Background(), filePath)
+}
+
+// FileSizeWithContext is FileSize that can be cancelled through ctx
+func (s *BackupStoreDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
 	path := s.updatePath(filePath)
-	head, err := s.service.getBlobProperties(path)
+	head, err := s.service.getBlobProperties(ctx, path)
 	if err != nil || head.ContentLength == nil {
 		log.WithError(err).Errorf("Failed to get azblob properties: %v", path)
 		return -1
@@ -132,8 +148,13 @@ func (s *BackupStoreDriver) FileSize(filePath string) int64 {
 
 // FileTime returns file last modified time on the backup target
 func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
+	return s.FileTimeWithContext(context.Background(), filePath)
+}
+
+// FileTimeWithContext is FileTime that can be cancelled through ctx
+func (s *BackupStoreDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
 	path := s.updatePath(filePath)
-	blobProp, err := s.service.getBlobProperties(path)
+	blobProp, err := s.service.getBlobProperties(ctx, path)
 	if err != nil || blobProp.ContentLength == nil {
 		log.WithError(err).Errorf("Failed to get azblob properties: %v", path)
 		return time.Time{}
@@ -143,12 +164,65 @@ func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
 
 // Remove deletes files on the backup target
 func (s *BackupStoreDriver) Remove(path string) error {
-	return s.service.deleteBlobs(s.updatePath(path))
+	return s.RemoveWithContext(context.Background(), path)
+}
+
+// RemoveWithContext is Remove that can be cancelled through ctx
+func (s *BackupStoreDriver) RemoveWithContext(ctx context.Context, path string) error {
+	return s.service.deleteBlobs(ctx, s.updatePath(path))
+}
+
+// RemoveMany deletes the files on the backup target with blob batch requests
+func (s *BackupStoreDriver) RemoveMany(paths []string) error {
+	return s.RemoveManyWithContext(context.Background(), paths)
+}
+
+// RemoveManyWithContext is RemoveMany that can be cancelled through ctx
+func (s *BackupStoreDriver) RemoveManyWithContext(ctx context.Context, paths []string) error {
+	blobs := make([]string, 0, len(paths))
+	blobPaths := make(map[string]string, len(paths))
+	for _, path := range paths {
+		blob := s.updatePath(path)
+		blobs = append(blobs, blob)
+		blobPaths[blob] = path
+	}
+	failures, err := s.service.deleteBlobList(ctx, blobs)
+	if err != nil {
+		return err
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	removeErr := &backupstore.RemoveManyError{Failures: map[string]error{}}
+	for blob, err := range failures {
+		removeErr.Failures[blobPaths[blob]] = err
+	}
+	return removeErr
 }
 
 func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return s.ReadWithContext(context.Background(), src)
+}
+
+// ReadWithContext is Read that can be cancelled through ctx
+func (s *BackupStoreDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	path := s.updatePath(src)
+	rc, err := s.service.getBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (s *BackupStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	return s.ReadRangeWithContext(context.Background(), src, offset, length)
+}
+
+// ReadRangeWithContext is ReadRange that can be cancelled through ctx
+func (s *BackupStoreDriver) ReadRangeWithContext(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
 	path := s.updatePath(src)
-	rc, err := s.service.getBlob(path)
+	rc, err := s.service.getBlobRange(ctx, path, offset, length)
 	if err != nil {
 		return nil, err
 	}
@@ -157,12 +231,34 @@ func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
 
 // Write creates a item on the backup target from io stream
 func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return s.WriteWithContext(context.Background(), dst, rs)
+}
+
+// WriteWithContext is Write that can be cancelled through ctx
+func (s *BackupStoreDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
 	path := s.updatePath(dst)
-	return s.service.putBlob(path, rs)
+	return s.service.putBlob(ctx, path, rs)
+}
+
+// WriteStream creates a item on the backup target from a stream, the size is
+// -1 if it's unknown
+func (s *BackupStoreDriver) WriteStream(dst string, r io.Reader, size int64) error {
+	return s.WriteStreamWithContext(context.Background(), dst, r, size)
+}
+
+// WriteStreamWithContext is WriteStream that can be cancelled through ctx
+func (s *BackupStoreDriver) WriteStreamWithContext(ctx context.Context, dst string, r io.Reader, size int64) error {
+	path := s.updatePath(dst)
+	return s.service.putBlobStream(ctx, path, r)
 }
 
 // Upload creates a item on the backup target by opening source file
 func (s *BackupStoreDriver) Upload(src, dst string) error {
+	return s.UploadWithContext(context.Background(), src, dst)
+}
+
+// UploadWithContext is Upload that can be cancelled through ctx
+func (s *BackupStoreDriver) UploadWithContext(ctx context.Context, src, dst string) error {
 	file, err := os.Open(src)
 	if err != nil {
 		log.WithError(err).Warnf("Failed to open file: %v", src)
@@ -172,11 +268,16 @@ func (s *BackupStoreDriver) Upload(src, dst string) error {
 		_ = file.Close()
 	}()
 	path := s.updatePath(dst)
-	return s.service.putBlob(path, file)
+	return s.service.putBlob(ctx, path, file)
 }
 
 // Download gets a item data from the backup target
 func (s *BackupStoreDriver) Download(src, dst string) error {
+	return s.DownloadWithContext(context.Background(), src, dst)
+}
+
+// DownloadWithContext is Download that can be cancelled through ctx
+func (s *BackupStoreDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
 	if _, err := os.Stat(dst); err != nil {
 		_ = os.Remove(dst)
 	}
@@ -194,7 +295,7 @@ func (s *BackupStoreDriver) Download(src, dst string) error {
 	}()
 
 	path := s.updatePath(src)
-	rc, err := s.service.getBlob(path)
+	rc, err := s.service.getBlob(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -6,11 +6,13 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/cockroachdb/errors"
 
@@ -25,6 +27,10 @@ const (
 	blobEndpoint       = "BlobEndpoint=%s;"
 	blobEndpointScheme = "DefaultEndpointsProtocol=%s;"
 	blobEndpointSuffix = "EndpointSuffix=%s;"
+
+	// maxBatchSubRequests is the maximum number of sub-requests of a blob
+	// batch request.
+	maxBatchSubRequests = 256
 )
 
 type service struct {
@@ -85,13 +91,13 @@ func getCustomCerts() []byte {
 	return []byte(certs)
 }
 
-func (s *service) listBlobs(prefix, delimiter string) (*[]string, error) {
+func (s *service) listBlobs(ctx context.Context, prefix, delimiter string) (*[]string, error) {
 	listOptions := &container.ListBlobsHierarchyOptions{Prefix: &prefix}
 	pager := s.ContainerClient.NewListBlobsHierarchyPager(delimiter, listOptions)
 
 	var blobs []string
 	for pager.More() {
-		page, err := pager.NextPage(context.Background())
+		page, err := pager.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -106,10 +112,10 @@ func (s *service) listBlobs(prefix, delimiter string) (*[]string, error) {
 	return &blobs, nil
 }
 
-func (s *service) getBlobProperties(blob string) (*blob.GetPropertiesResponse, error) {
+func (s *service) getBlobProperties(ctx context.Context, blob string) (*blob.GetPropertiesResponse, error) {
 	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
 
-	response, err := blobClient.GetProperties(context.Background(), nil)
+	response, err := blobClient.GetProperties(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -117,10 +123,10 @@ func (s *service) getBlobProperties(blob string) (*blob.GetPropertiesResponse, e
 	return &response, nil
 }
 
-func (s *service) putBlob(blob string, reader io.ReadSeeker) error {
+func (s *service) putBlob(ctx context.Context, blob string, reader io.ReadSeeker) error {
 	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
 
-	_, err := blobClient.Upload(context.Background(), streaming.NopCloser(reader), nil)
+	_, err := blobClient.Upload(ctx, streaming.NopCloser(reader), nil)
 	if err != nil {
 		return err
 	}
@@ -128,10 +134,34 @@ func (s *service) putBlob(blob string, reader io.ReadSeeker) error {
 	return nil
 }
 
-func (s *service) getBlob(blob string) (io.ReadCloser, error) {
+// putBlobStream uploads the blob as blocks staged as they're read.
+func (s *service) putBlobStream(ctx context.Context, blob string, reader io.Reader) error {
+	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
+
+	_, err := blobClient.UploadStream(ctx, reader, nil)
+	return err
+}
+
+func (s *service) getBlob(ctx context.Context, blob string) (io.ReadCloser, error) {
 	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
 
-	response, err := blobClient.DownloadStream(context.Background(), nil)
+	response, err := blobClient.DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (s *service) getBlobRange(ctx context.Context, blobName string, offset, length int64) (io.ReadCloser, error) {
+	blobClient := s.ContainerClient.NewBlockBlobClient(blobName)
+
+	response, err := blobClient.DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{
+			Offset: offset,
+			Count:  length,
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -139,25 +169,61 @@ func (s *service) getBlob(blob string) (io.ReadCloser, error) {
 	return response.Body, nil
 }
 
-func (s *service) deleteBlobs(blob string) error {
-	blobs, err := s.listBlobs(blob, "")
+func (s *service) deleteBlobs(ctx context.Context, blob string) error {
+	blobs, err := s.listBlobs(ctx, blob, "")
 	if err != nil {
 		return errors.Wrapf(err, "failed to list blobs with prefix %v before removing them", blob)
 	}
 
-	var deletionFailures []string
-	for _, blob := range *blobs {
-		blobClient := s.ContainerClient.NewBlockBlobClient(blob)
-		_, err = blobClient.Delete(context.Background(), nil)
-		if err != nil {
+	failures, err := s.deleteBlobList(ctx, *blobs)
+	if err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		deletionFailures := make([]string, 0, len(failures))
+		for blob, err := range failures {
 			log.WithError(err).Errorf("Failed to delete blob object: %v", blob)
 			deletionFailures = append(deletionFailures, blob)
 		}
-	}
-
-	if len(deletionFailures) > 0 {
+		sort.Strings(deletionFailures)
 		return fmt.Errorf("failed to delete blobs %v", deletionFailures)
 	}
 
 	return nil
 }
+
+// deleteBlobList deletes the blobs with blob batch requests, and returns the
+// errors of the blobs that failed to be deleted. A missing blob isn't a
+// failure.
+func (s *service) deleteBlobList(ctx context.Context, blobs []string) (map[string]error, error) {
+	failures := map[string]error{}
+	for start := 0; start < len(blobs); start += maxBatchSubRequests {
+		batch := blobs[start:min(start+maxBatchSubRequests, len(blobs))]
+
+		bb, err := s.ContainerClient.NewBatchBuilder()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create a blob batch")
+		}
+		for _, blob := range batch {
+			if err := bb.Delete(blob, nil); err != nil {
+				return nil, errors.Wrapf(err, "failed to add the deletion of blob %v to a blob batch", blob)
+			}
+		}
+
+		response, err := s.ContainerClient.SubmitBatch(ctx, bb, nil)
+		if err != nil {
+			for _, blob := range batch {
+				failures[blob] = err
+			}
+			continue
+		}
+		for _, item := range response.Responses {
+			if item.Error == nil || bloberror.HasCode(item.Error, bloberror.BlobNotFound) || item.BlobName == nil {
+				continue
+			}
+			failures[*item.BlobName] = item.Error
+		}
+	}
+	return failures, nil
+}
@@ -35,8 +35,14 @@ type BackupBackingImage struct {
 	CompleteTime      string
 	Secret            string
 	SecretNamespace   string
+	// BlockFormatVersion is the backupstore.BLOCK_FORMAT_VERSION of the
+	// blocks
+	BlockFormatVersion int `json:",omitempty"`
 
 	ProcessingBlocks *common.ProcessingBlocks
+	// compressionLevel is the level of the new blocks, parsed from the
+	// parameters once per backup
+	compressionLevel int
 
 	Blocks []common.BlockMapping `json:",omitempty"`
 }
@@ -60,6 +66,13 @@ type BackupOperation interface {
 	UpdateBackupProgress(state string, progress int, backupURL string, err string)
 }
 
+// BackupOperationStopper is implemented by the BackupOperation able to abort
+// the backups running in the background: closing the stop channel cancels the
+// backup.
+type BackupOperationStopper interface {
+	GetStopChan() chan struct{}
+}
+
 type RestoreOperation interface {
 	UpdateRestoreProgress(progress int, err error)
 }
@@ -78,6 +91,15 @@ func getLoggerForBackupBackingImage(config *BackupConfig) *logrus.Entry {
 }
 
 func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBackingImage, backupOperation BackupOperation, mappings *common.Mappings) (err error) {
+	return CreateBackingImageBackupWithContext(context.Background(), config, backupBackingImage, backupOperation, mappings)
+}
+
+// CreateBackingImageBackupWithContext is CreateBackingImageBackup where cancelling ctx
+// aborts the preparation of the backup. The backup then keeps running in the background
+// after the function returns, detached from ctx: it's only aborted, including the requests
+// to the backupstore that are in flight, by closing the stop channel of the
+// BackupOperation implementing BackupOperationStopper.
+func CreateBackingImageBackupWithContext(ctx context.Context, config *BackupConfig, backupBackingImage *BackupBackingImage, backupOperation BackupOperation, mappings *common.Mappings) (err error) {
 	log := getLoggerForBackupBackingImage(config)
 	if config == nil || backupBackingImage == nil || backupOperation == nil || mappings == nil {
 		return fmt.Errorf("invalid parameters: config, backupOperation, backupBackingImage or mappings for backup")
@@ -100,7 +122,7 @@ func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBa
 		return err
 	}
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -109,7 +131,7 @@ func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBa
 		}
 	}()
 
-	exists, err := addBackingImageConfigInBackupStore(bsDriver, backupBackingImage)
+	exists, err := addBackingImageConfigInBackupStore(ctx, bsDriver, backupBackingImage)
 	if err != nil {
 		return err
 	}
@@ -120,18 +142,40 @@ func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBa
 		return nil
 	}
 
-	backupBackingImage, err = loadBackingImageConfigInBackupStore(bsDriver, backupBackingImage.Name)
+	backupBackingImage, err = loadBackingImageConfigInBackupStore(ctx, bsDriver, backupBackingImage.Name)
 	if err != nil {
 		return err
 	}
 
+	compressionLevel, err := backupstore.GetCompressionLevelFromParameters(config.Parameters)
+	if err != nil {
+		return err
+	}
+	if err := util.ValidateCompressionLevel(backupBackingImage.CompressionMethod, compressionLevel); err != nil {
+		return err
+	}
+	backupBackingImage.compressionLevel = compressionLevel
+
 	log.Info("Creating backup backing image")
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 
+	// The caller usually returns once the backup is started
+	backupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if stopper, ok := backupOperation.(BackupOperationStopper); ok {
+		stopChan := stopper.GetStopChan()
+		go func() {
+			select {
+			case <-stopChan:
+				cancel()
+			case <-backupCtx.Done():
+			}
+		}()
+	}
 	go func() {
+		defer cancel()
 		defer backupOperation.CloseFile()
 		defer func() {
 			if unlockErr := lock.Unlock(); unlockErr != nil {
@@ -141,7 +185,7 @@ func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBa
 
 		backupOperation.UpdateBackupProgress(string(common.ProgressStateInProgress), 0, "", "")
 
-		if progress, backupURL, err := performBackup(bsDriver, config, backupBackingImage, backupOperation, mappings); err != nil {
+		if progress, backupURL, err := performBackup(backupCtx, bsDriver, config, backupBackingImage, backupOperation, mappings); err != nil {
 			log.WithError(err).Errorf("Failed to perform backup for backing image %v", backupBackingImage.Name)
 			backupOperation.UpdateBackupProgress(string(common.ProgressStateInProgress), progress, "", err.Error())
 		} else {
@@ -152,13 +196,13 @@ func CreateBackingImageBackup(config *BackupConfig, backupBackingImage *BackupBa
 	return nil
 }
 
-func performBackup(bsDriver backupstore.BackupStoreDriver, config *BackupConfig,
+func performBackup(ctx context.Context, bsDriver backupstore.BackupStoreDriver, config *BackupConfig,
 	backupBackingImage *BackupBackingImage, backupOperation BackupOperation, mappings *common.Mappings) (int, string, error) {
 	log := getLoggerForBackupBackingImage(config)
 	destURL := config.DestURL
 	concurrentLimit := config.ConcurrentLimit
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	totalBlockCounts, err := getTotalBackupBlockCounts(mappings)
@@ -179,6 +223,10 @@ func performBackup(bsDriver backupstore.BackupStoreDriver, config *BackupConfig,
 	}
 	mergedErrChan := common.MergeErrorChannels(ctx, errorChans...)
 	err = <-mergedErrChan
+	if err == nil {
+		// the workers stop silently once the context is cancelled
+		err = ctx.Err()
+	}
 	if err != nil {
 		return progress.Progress, "", errors.Wrapf(err, "failed to backup backing image %v", backupBackingImage.Name)
 	}
@@ -186,9 +234,10 @@ func performBackup(bsDriver backupstore.BackupStoreDriver, config *BackupConfig,
 	backupBackingImage.Blocks = common.SortBackupBlocks(backupBackingImage.Blocks, backupBackingImage.Size, mappings.BlockSize)
 	backupBackingImage.CompleteTime = util.Now()
 	backupBackingImage.BlockCount = totalBlockCounts
+	backupBackingImage.BlockFormatVersion = backupstore.BLOCK_FORMAT_VERSION
 	backupBackingImage.Secret = config.Parameters[lhbackup.LonghornBackupBackingImageParameterSecret]
 	backupBackingImage.SecretNamespace = config.Parameters[lhbackup.LonghornBackupBackingImageParameterSecretNamespace]
-	if err := saveBackingImageConfig(bsDriver, backupBackingImage); err != nil {
+	if err := saveBackingImageConfig(ctx, bsDriver, backupBackingImage); err != nil {
 		return progress.Progress, "", err
 	}
 
@@ -211,7 +260,7 @@ func backupMappings(ctx context.Context, bsDriver backupstore.BackupStoreDriver,
 					return
 				}
 
-				if err := backupMapping(bsDriver, config, backupBackingImage, backupOperation, mapping, progress); err != nil {
+				if err := backupMapping(ctx, bsDriver, config, backupBackingImage, backupOperation, mapping, progress); err != nil {
 					errChan <- err
 					return
 				}
@@ -222,7 +271,7 @@ func backupMappings(ctx context.Context, bsDriver backupstore.BackupStoreDriver,
 	return errChan
 }
 
-func backupMapping(bsDriver backupstore.BackupStoreDriver,
+func backupMapping(ctx context.Context, bsDriver backupstore.BackupStoreDriver,
 	config *BackupConfig, backupBackingImage *BackupBackingImage, backupOperation BackupOperation,
 	mapping common.Mapping, progress *common.Progress) error {
 
@@ -255,17 +304,22 @@ func backupMapping(bsDriver backupstore.BackupStoreDriver,
 
 	// skip if block already exists
 	blkFile := getBackingImageBlockFilePath(checksum)
-	if bsDriver.FileExists(blkFile) {
+	d := backupstore.NewDriverWithContext(bsDriver)
+	if d.FileExistsWithContext(ctx, blkFile) {
 		return nil
 	}
 
 	newBlock = true
-	rs, err := util.CompressData(backupBackingImage.CompressionMethod, block)
+	rs, err := util.CompressDataWithLevel(backupBackingImage.CompressionMethod, backupBackingImage.compressionLevel, block)
+	if err != nil {
+		return err
+	}
+	rs, err = backupstore.AddBlockHeader(rs, backupBackingImage.CompressionMethod, "", int64(len(block)))
 	if err != nil {
 		return err
 	}
 
-	err = bsDriver.Write(blkFile, rs)
+	err = d.WriteWithContext(ctx, blkFile, rs)
 	return err
 }
 
@@ -316,6 +370,12 @@ func updateBlocksAndProgress(backupBackingImage *BackupBackingImage, progress *c
 }
 
 func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOperation) error {
+	return RestoreBackingImageBackupWithContext(context.Background(), config, restoreOperation)
+}
+
+// RestoreBackingImageBackupWithContext is RestoreBackingImageBackup that aborts the restore,
+// including the in-flight requests to the backupstore, once ctx is cancelled.
+func RestoreBackingImageBackupWithContext(ctx context.Context, config *RestoreConfig, restoreOperation RestoreOperation) error {
 	if config == nil || restoreOperation == nil {
 		return fmt.Errorf("invalid empty config or restoreOperation for restore")
 	}
@@ -339,7 +399,7 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 		return err
 	}
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -348,7 +408,7 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 		}
 	}()
 
-	backupBackingImage, err := loadBackingImageConfigInBackupStore(bsDriver, backingImageName)
+	backupBackingImage, err := loadBackingImageConfigInBackupStore(ctx, bsDriver, backingImageName)
 	if err != nil {
 		return errors.Wrapf(err, "backing image %v doesn't exist in backup store", backingImageName)
 	}
@@ -360,6 +420,9 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 	if backupBackingImage.CompleteTime == "" {
 		return fmt.Errorf("BackupBackingImage %v is not completed, please check its status", backupBackingImage.Name)
 	}
+	if err := backupstore.ValidateBlockFormatVersion(backupBackingImage.BlockFormatVersion); err != nil {
+		return errors.Wrapf(err, "cannot restore backing image %v", backupBackingImage.Name)
+	}
 
 	backingImageFile, err := checkBackingImageFile(backingImageFilePath, backupBackingImage)
 	if err != nil {
@@ -372,7 +435,7 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 		}
 	}()
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 
@@ -392,7 +455,7 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 			TotalBlockCounts: int64(len(backupBackingImage.Blocks)),
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
 		blockChan, errChan := common.PopulateBlocksForFullRestore(backupBackingImage.Blocks, backupBackingImage.CompressionMethod)
@@ -403,6 +466,10 @@ func RestoreBackingImageBackup(config *RestoreConfig, restoreOperation RestoreOp
 
 		mergedErrChan := common.MergeErrorChannels(ctx, errorChans...)
 		err = <-mergedErrChan
+		if err == nil {
+			// the workers stop silently once the context is cancelled
+			err = ctx.Err()
+		}
 		if err != nil {
 			restoreOperation.UpdateRestoreProgress(int(progress.ProcessedBlockCounts)*backupstore.DEFAULT_BLOCK_SIZE, err)
 			return
@@ -521,6 +588,19 @@ func restoreBlockToFile(ctx context.Context, bsDriver backupstore.BackupStoreDri
 }
 
 func RemoveBackingImageBackup(backupURL string) (err error) {
+	return RemoveBackingImageBackupWithContext(context.Background(), backupURL)
+}
+
+// RemoveBackingImageBackupWithContext is RemoveBackingImageBackup that aborts the deletion
+// once ctx is cancelled.
+func RemoveBackingImageBackupWithContext(ctx context.Context, backupURL string) (err error) {
+	return RemoveBackingImageBackupWithConfig(ctx, backupURL, nil)
+}
+
+// RemoveBackingImageBackupWithConfig is RemoveBackingImageBackupWithContext
+// with the concurrency and the progress reporting of the garbage collection
+// set by gcConfig, the defaults being used if it's nil.
+func RemoveBackingImageBackupWithConfig(ctx context.Context, backupURL string, gcConfig *backupstore.GCConfig) (err error) {
 	bsDriver, err := backupstore.GetBackupStoreDriver(backupURL)
 	if err != nil {
 		return err
@@ -540,7 +620,7 @@ func RemoveBackingImageBackup(backupURL string) (err error) {
 	if err != nil {
 		return err
 	}
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -550,7 +630,7 @@ func RemoveBackingImageBackup(backupURL string) (err error) {
 	}()
 
 	// If we fail to load the backup we still want to proceed with the deletion of the backup file
-	backupBackingImage, err := loadBackingImageConfigInBackupStore(bsDriver, backingImageName)
+	backupBackingImage, err := loadBackingImageConfigInBackupStore(ctx, bsDriver, backingImageName)
 	if err != nil {
 		log.WithError(err).Warn("Failed to load the backup backing image config, will continue the deletion")
 		backupBackingImage = &BackupBackingImage{
@@ -559,46 +639,46 @@ func RemoveBackingImageBackup(backupURL string) (err error) {
 	}
 
 	// we can delete the requested backupBackingImage immediately before GC starts
-	if err := removeBackupBackingImage(backupBackingImage, bsDriver); err != nil {
+	if err := removeBackupBackingImage(ctx, backupBackingImage, bsDriver); err != nil {
 		return err
 	}
 	log.Info("Removed backup backing image config")
 
-	blockInfos, err := getBlockInfos(bsDriver)
+	blockInfos, err := getBlockInfos(ctx, bsDriver, gcConfig)
 	if err != nil {
 		return err
 	}
 
-	backupBackingImageNames, err := GetAllBackupBackingImageNames(bsDriver)
+	backupBackingImageNames, err := getAllBackupBackingImageNames(ctx, bsDriver)
 	if err != nil {
 		log.WithError(err).Warn("Failed to load backup backing image names, skip block deletion")
 		return nil
 	}
 
-	canDeleteBlocks := checkAndUpdateBlockInfos(log, bsDriver, blockInfos, backupBackingImageNames)
+	canDeleteBlocks := checkAndUpdateBlockInfos(ctx, log, bsDriver, blockInfos, backupBackingImageNames)
 	if !canDeleteBlocks {
 		return nil
 	}
 
 	// check if there have been new backups created while we where processing
 	prevBackupBackingImageNames := backupBackingImageNames
-	backupBackingImageNames, err = GetAllBackupBackingImageNames(bsDriver)
+	backupBackingImageNames, err = getAllBackupBackingImageNames(ctx, bsDriver)
 	if err != nil || !util.UnorderedEqual(prevBackupBackingImageNames, backupBackingImageNames) {
 		log.Info("Found new backup backing image, skip block deletion")
 		return nil
 	}
 
 	// only delete the blocks if it is safe to do so
-	if err := cleanupBlocks(log, bsDriver, blockInfos); err != nil {
+	if err := cleanupBlocks(ctx, log, bsDriver, blockInfos, gcConfig); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func checkAndUpdateBlockInfos(log *logrus.Entry, bsDriver backupstore.BackupStoreDriver, blockInfos map[string]*common.BlockInfo, backupbackingImageNames []string) bool {
+func checkAndUpdateBlockInfos(ctx context.Context, log *logrus.Entry, bsDriver backupstore.BackupStoreDriver, blockInfos map[string]*common.BlockInfo, backupbackingImageNames []string) bool {
 	for _, name := range backupbackingImageNames {
-		backupBackingImage, err := loadBackingImageConfigInBackupStore(bsDriver, name)
+		backupBackingImage, err := loadBackingImageConfigInBackupStore(ctx, bsDriver, name)
 		if err != nil {
 			log.WithError(err).Warn("Failed to load backup backing image, skip block deletion")
 			return false
@@ -614,9 +694,9 @@ func checkAndUpdateBlockInfos(log *logrus.Entry, bsDriver backupstore.BackupStor
 	return true
 }
 
-func getBlockInfos(bsDriver backupstore.BackupStoreDriver) (map[string]*common.BlockInfo, error) {
+func getBlockInfos(ctx context.Context, bsDriver backupstore.BackupStoreDriver, gcConfig *backupstore.GCConfig) (map[string]*common.BlockInfo, error) {
 	blockInfos := make(map[string]*common.BlockInfo)
-	blockNames, err := getAllBlockNames(bsDriver)
+	blockNames, err := getAllBlockNames(ctx, bsDriver, gcConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -631,23 +711,29 @@ func getBlockInfos(bsDriver backupstore.BackupStoreDriver) (map[string]*common.B
 	return blockInfos, nil
 }
 
-func cleanupBlocks(log *logrus.Entry, driver backupstore.BackupStoreDriver, blockMap map[string]*common.BlockInfo) error {
-	var deletionFailures []string
-	deletedBlockCount := int64(0)
+func cleanupBlocks(ctx context.Context, log *logrus.Entry, driver backupstore.BackupStoreDriver, blockMap map[string]*common.BlockInfo, gcConfig *backupstore.GCConfig) error {
+	blockPaths := map[string]string{}
+	var paths []string
 	for _, blk := range blockMap {
 		if common.IsBlockSafeToDelete(blk) {
-			if err := driver.Remove(blk.Path); err != nil {
-				deletionFailures = append(deletionFailures, blk.Checksum)
-				continue
-			}
-			deletedBlockCount++
+			blockPaths[blk.Path] = blk.Checksum
+			paths = append(paths, blk.Path)
+		}
+	}
+
+	err := backupstore.RemoveBlocks(ctx, driver, paths, gcConfig)
+	var deletionFailures []string
+	var removeErr *backupstore.RemoveManyError
+	if errors.As(err, &removeErr) {
+		for _, path := range removeErr.FailedPaths() {
+			deletionFailures = append(deletionFailures, blockPaths[path])
 		}
 	}
 
-	log.Infof("Removed %v blocks", deletedBlockCount)
+	log.Infof("Removed %v blocks", len(paths)-len(deletionFailures))
 
-	if len(deletionFailures) > 0 {
-		return fmt.Errorf("failed to delete blocks: %v", deletionFailures)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete blocks: %v", deletionFailures)
 	}
 	return nil
 }
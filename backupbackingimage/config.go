@@ -1,6 +1,7 @@
 package backupbackingimage
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"path/filepath"
@@ -25,10 +26,10 @@ const (
 	BlkSuffix       = ".blk"
 )
 
-func addBackingImageConfigInBackupStore(driver backupstore.BackupStoreDriver, backupBackingImage *BackupBackingImage) (bool, error) {
+func addBackingImageConfigInBackupStore(ctx context.Context, driver backupstore.BackupStoreDriver, backupBackingImage *BackupBackingImage) (bool, error) {
 	log := backupstore.GetLog().WithFields(logrus.Fields{"type": BackingImageLogType, "name": backupBackingImage.Name})
 
-	if backingImageExists(driver, backupBackingImage.Name) {
+	if backingImageExists(ctx, driver, backupBackingImage.Name) {
 		return true, nil
 	}
 
@@ -36,7 +37,7 @@ func addBackingImageConfigInBackupStore(driver backupstore.BackupStoreDriver, ba
 		return false, fmt.Errorf("invalid backing image name %v", backupBackingImage.Name)
 	}
 
-	if err := saveBackingImageConfig(driver, backupBackingImage); err != nil {
+	if err := saveBackingImageConfig(ctx, driver, backupBackingImage); err != nil {
 		return false, errors.Wrap(err, "failed to add backing image config to backupstore")
 	}
 
@@ -44,19 +45,19 @@ func addBackingImageConfigInBackupStore(driver backupstore.BackupStoreDriver, ba
 	return false, nil
 }
 
-func removeBackupBackingImage(backupBackingImage *BackupBackingImage, driver backupstore.BackupStoreDriver) error {
+func removeBackupBackingImage(ctx context.Context, backupBackingImage *BackupBackingImage, driver backupstore.BackupStoreDriver) error {
 	log := backupstore.GetLog().WithFields(logrus.Fields{"type": BackingImageLogType, "name": backupBackingImage.Name})
 
 	filePath := getBackingImageFilePath(backupBackingImage.Name)
-	if err := driver.Remove(filePath); err != nil {
+	if err := backupstore.NewDriverWithContext(driver).RemoveWithContext(ctx, filePath); err != nil {
 		return err
 	}
 	log.Infof("Removed backing image on backupstore with filePath: %v", filePath)
 	return nil
 }
 
-func backingImageExists(driver backupstore.BackupStoreDriver, backingImageName string) bool {
-	return driver.FileExists(getBackingImageFilePath(backingImageName))
+func backingImageExists(ctx context.Context, driver backupstore.BackupStoreDriver, backingImageName string) bool {
+	return backupstore.NewDriverWithContext(driver).FileExistsWithContext(ctx, getBackingImageFilePath(backingImageName))
 }
 
 func getBackingImageFilePath(backingImageName string) string {
@@ -69,15 +70,15 @@ func getBackingImagePath(backingImageName string) string {
 	return filepath.Join(backupstore.GetBackupstoreBase(), BackingImageDirectory, BackingImageDirectory, backingImageName) + "/"
 }
 
-func saveBackingImageConfig(driver backupstore.BackupStoreDriver, backupBackingImage *BackupBackingImage) error {
-	return backupstore.SaveConfigInBackupStore(driver, getBackingImageFilePath(backupBackingImage.Name), backupBackingImage)
+func saveBackingImageConfig(ctx context.Context, driver backupstore.BackupStoreDriver, backupBackingImage *BackupBackingImage) error {
+	return backupstore.SaveConfigInBackupStoreWithContext(ctx, driver, getBackingImageFilePath(backupBackingImage.Name), backupBackingImage)
 }
 
-func loadBackingImageConfigInBackupStore(driver backupstore.BackupStoreDriver, backingImageName string) (*BackupBackingImage, error) {
+func loadBackingImageConfigInBackupStore(ctx context.Context, driver backupstore.BackupStoreDriver, backingImageName string) (*BackupBackingImage, error) {
 	log := backupstore.GetLog()
 	backupBackingImage := &BackupBackingImage{}
 	path := getBackingImageFilePath(backingImageName)
-	if err := backupstore.LoadConfigInBackupStore(driver, path, backupBackingImage); err != nil {
+	if err := backupstore.LoadConfigInBackupStoreWithContext(ctx, driver, path, backupBackingImage); err != nil {
 		return nil, err
 	}
 	if backupBackingImage.CompressionMethod == "" {
@@ -155,40 +156,21 @@ func DecodeBackupBackingImageURL(backupURL string) (string, string, error) {
 }
 
 func GetAllBackupBackingImageNames(driver backupstore.BackupStoreDriver) ([]string, error) {
+	return getAllBackupBackingImageNames(context.Background(), driver)
+}
+
+func getAllBackupBackingImageNames(ctx context.Context, driver backupstore.BackupStoreDriver) ([]string, error) {
 	result := []string{}
 	backingImageConfigBase := filepath.Join(backupstore.GetBackupstoreBase(), BackingImageDirectory, BackingImageDirectory) + "/"
-	nameList, err := driver.List(backingImageConfigBase)
+	nameList, err := backupstore.NewDriverWithContext(driver).ListWithContext(ctx, backingImageConfigBase)
 	if err != nil {
 		return result, nil
 	}
 	return nameList, nil
 }
 
-func getAllBlockNames(driver backupstore.BackupStoreDriver) ([]string, error) {
-	names := []string{}
-	blockPathBase := getBackingImageBlockPath()
-	lv1Dirs, err := driver.List(blockPathBase)
-	// Directory doesn't exist
-	if err != nil {
-		return names, nil
-	}
-	for _, lv1 := range lv1Dirs {
-		lv1Path := filepath.Join(blockPathBase, lv1)
-		lv2Dirs, err := driver.List(lv1Path)
-		if err != nil {
-			return nil, err
-		}
-		for _, lv2 := range lv2Dirs {
-			lv2Path := filepath.Join(lv1Path, lv2)
-			blockNames, err := driver.List(lv2Path)
-			if err != nil {
-				return nil, err
-			}
-			names = append(names, blockNames...)
-		}
-	}
-
-	return util.ExtractNames(names, "", BlkSuffix), nil
+func getAllBlockNames(ctx context.Context, driver backupstore.BackupStoreDriver, gcConfig *backupstore.GCConfig) ([]string, error) {
+	return backupstore.ListBlockNames(ctx, driver, getBackingImageBlockPath(), gcConfig)
 }
 
 func isBackupInProgress(backupBackingImage *BackupBackingImage) bool {
@@ -218,7 +200,7 @@ func InspectBackupBackingImage(backupURL string) (*BackupInfo, error) {
 		return nil, err
 	}
 
-	backupBackingImage, err := loadBackingImageConfigInBackupStore(bsDriver, backupBackingImageName)
+	backupBackingImage, err := loadBackingImageConfigInBackupStore(context.Background(), bsDriver, backupBackingImageName)
 	if err != nil {
 		return nil, err
 	} else if isBackupInProgress(backupBackingImage) {
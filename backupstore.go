@@ -1,6 +1,7 @@
 package backupstore
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"sync"
@@ -17,12 +18,20 @@ type Volume struct {
 	CreatedTime          string
 	LastBackupName       string
 	LastBackupAt         string
-	BlockCount           int64  `json:",string"`
-	BackingImageName     string `json:",string"`
-	BackingImageChecksum string `json:",string"`
-	CompressionMethod    string `json:",string"`
-	StorageClassName     string `json:",string"`
-	DataEngine           string `json:",string"`
+	BlockCount           int64       `json:",string"`
+	BackingImageName     string      `json:",string"`
+	BackingImageChecksum string      `json:",string"`
+	CompressionMethod    string      `json:",string"`
+	StorageClassName     string      `json:",string"`
+	DataEngine           string      `json:",string"`
+	Encryption           *Encryption `json:",omitempty"`
+	BlockPool            bool        `json:",omitempty"`
+	PackFiles            bool        `json:",omitempty"`
+	// BlockFormatVersion is the latest BLOCK_FORMAT_VERSION of the blocks of
+	// the volume
+	BlockFormatVersion int `json:",omitempty"`
+
+	packs *packStore
 }
 
 type Snapshot struct {
@@ -47,10 +56,25 @@ type Backup struct {
 	Parameters            map[string]string
 	IsIncremental         bool
 	CompressionMethod     string
-	NewlyUploadedDataSize int64 `json:",string"`
-	ReUploadedDataSize    int64 `json:",string"`
+	NewlyUploadedDataSize int64       `json:",string"`
+	ReUploadedDataSize    int64       `json:",string"`
+	Encryption            *Encryption `json:",omitempty"`
+	// BlockFormatVersion is the latest BLOCK_FORMAT_VERSION of the blocks of
+	// the backup, see ValidateBlockFormatVersion
+	BlockFormatVersion int `json:",omitempty"`
 
 	ProcessingBlocks *ProcessingBlocks
+	// The blocks known to be stored when the backup started, see
+	// loadKnownBlocks
+	knownBlocks map[string]bool
+	// The blocks the backup found stored or uploaded, see updateBlockIndex
+	storedBlocks map[string]bool
+	// The blocks repair couldn't repair, the backup uploads them again
+	damagedBlocks map[string]bool
+	// How the new blocks are cut and compressed, parsed from the parameters
+	// once per backup, see performBackup
+	chunkingMethod   string
+	compressionLevel int
 
 	Blocks     []BlockMapping `json:",omitempty"`
 	SingleFile BackupFile     `json:",omitempty"`
@@ -77,8 +101,8 @@ func GetBackupstoreBase() string {
 	return backupstoreBase
 }
 
-func addVolume(driver BackupStoreDriver, volume *Volume) error {
-	if volumeExists(driver, volume.Name) {
+func addVolume(ctx context.Context, driver BackupStoreDriver, volume *Volume) error {
+	if volumeExists(ctx, driver, volume.Name) {
 		return nil
 	}
 
@@ -86,7 +110,7 @@ func addVolume(driver BackupStoreDriver, volume *Volume) error {
 		return fmt.Errorf("invalid volume name %v", volume.Name)
 	}
 
-	if err := saveVolume(driver, volume); err != nil {
+	if err := saveVolume(ctx, driver, volume); err != nil {
 		log.WithError(err).Errorf("Failed to add volume %v", volume.Name)
 		return err
 	}
@@ -95,7 +119,7 @@ func addVolume(driver BackupStoreDriver, volume *Volume) error {
 	return nil
 }
 
-func removeVolume(volumeName string, driver BackupStoreDriver) error {
+func removeVolume(ctx context.Context, volumeName string, driver BackupStoreDriver) error {
 	if !util.ValidateName(volumeName) {
 		return fmt.Errorf("invalid volume name %v", volumeName)
 	}
@@ -104,16 +128,26 @@ func removeVolume(volumeName string, driver BackupStoreDriver) error {
 	volumeBlocksDirectory := getBlockPath(volumeName)
 	volumeBackupsDirectory := getBackupPath(volumeName)
 	volumeLocksDirectory := getLockPath(volumeName)
-	if err := driver.Remove(volumeBackupsDirectory); err != nil {
+	d := NewDriverWithContext(driver)
+	// The blocks of the block pool it referenced are deleted by the next GC
+	// of the pool
+	if err := removeBlockReferences(ctx, driver, volumeName); err != nil {
+		return errors.Wrapf(err, "failed to remove the block references for volume %v", volumeName)
+	}
+	if err := d.RemoveWithContext(ctx, volumeBackupsDirectory); err != nil {
 		return errors.Wrapf(err, "failed to remove all the backups for volume %v", volumeName)
 	}
-	if err := driver.Remove(volumeBlocksDirectory); err != nil {
+	// The object store drivers remove the blocks with batch requests
+	if err := d.RemoveWithContext(ctx, volumeBlocksDirectory); err != nil {
 		return errors.Wrapf(err, "failed to remove all the blocks for volume %v", volumeName)
 	}
-	if err := driver.Remove(volumeLocksDirectory); err != nil {
+	if err := d.RemoveWithContext(ctx, getPackPath(volumeName)); err != nil {
+		return errors.Wrapf(err, "failed to remove all the packs for volume %v", volumeName)
+	}
+	if err := d.RemoveWithContext(ctx, volumeLocksDirectory); err != nil {
 		return errors.Wrapf(err, "failed to remove all the locks for volume %v", volumeName)
 	}
-	if err := driver.Remove(volumeDir); err != nil {
+	if err := d.RemoveWithContext(ctx, volumeDir); err != nil {
 		return errors.Wrapf(err, "failed to remove backup volume %v directory in backupstore", volumeName)
 	}
 
@@ -175,5 +209,5 @@ func LoadVolume(backupURL string) (*Volume, error) {
 	if err != nil {
 		return nil, err
 	}
-	return loadVolume(driver, volumeName)
+	return loadVolume(context.Background(), driver, volumeName)
 }
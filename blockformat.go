@@ -0,0 +1,196 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// A block file starts with a header describing how to read it back:
+//
+//	magic                  6 bytes  "\x00LHBLK"
+//	format version         1 byte   BLOCK_FORMAT_VERSION
+//	compression method     1 byte
+//	encryption method      1 byte
+//	checksum algorithm     1 byte
+//	uncompressed length    8 bytes  big endian
+//	header checksum        4 bytes  CRC-32C of the above, big endian
+//
+// It's followed by the compressed block, encrypted as described by
+// encryptBlock if the block is encrypted. The blocks written before the header
+// was introduced have none, they are still read by guessing their compression
+// method. An uncompressed legacy block may start with the magic too, only a
+// header whose checksum matches is taken for one, so newer versions must keep
+// these fields and add theirs after them.
+//
+// The backups and volumes record the version of their blocks, see
+// ValidateBlockFormatVersion.
+const (
+	BLOCK_FORMAT_VERSION = 1
+
+	blockHeaderSize = 22
+)
+
+var (
+	blockHeaderMagic = []byte("\x00LHBLK")
+
+	// The values are part of the format, they must never change
+	blockCompressionMethods = []string{"none", "gzip", "lz4", "zstd"}
+	blockEncryptionMethods  = []string{"", ENCRYPTION_METHOD_AES_256_GCM}
+	blockChecksumAlgorithms = []string{"", "sha256"}
+
+	// errUnsupportedBlockFormat marks the blocks written by a newer version,
+	// retrying the read of the block cannot fix it.
+	errUnsupportedBlockFormat = errors.New("unsupported block format")
+
+	blockHeaderChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ValidateBlockFormatVersion returns an error if the blocks of a backup, whose
+// config records the version of their format, cannot be read by this version.
+// The backups taken before the version was recorded have none.
+func ValidateBlockFormatVersion(version int) error {
+	if version > BLOCK_FORMAT_VERSION {
+		return errors.Wrapf(errUnsupportedBlockFormat, "the blocks are in format version %v, this version only reads up to version %v, please upgrade", version, BLOCK_FORMAT_VERSION)
+	}
+	return nil
+}
+
+type blockHeader struct {
+	Version           byte
+	CompressionMethod string
+	EncryptionMethod  string
+	ChecksumAlgorithm string
+	UncompressedSize  int64
+}
+
+// AddBlockHeader returns the block file content for the compressed, and
+// possibly encrypted, block.
+func AddBlockHeader(rs io.ReadSeeker, compressionMethod, encryptionMethod string, uncompressedSize int64) (io.ReadSeeker, error) {
+	header := blockHeader{
+		Version:           BLOCK_FORMAT_VERSION,
+		CompressionMethod: compressionMethod,
+		EncryptionMethod:  encryptionMethod,
+		ChecksumAlgorithm: "sha256",
+		UncompressedSize:  uncompressedSize,
+	}
+	encoded, err := header.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(append(encoded, data...)), nil
+}
+
+func (h *blockHeader) encode() ([]byte, error) {
+	compression, err := indexOf(blockCompressionMethods, h.CompressionMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid block compression method")
+	}
+	encryption, err := indexOf(blockEncryptionMethods, h.EncryptionMethod)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid block encryption method")
+	}
+	checksum, err := indexOf(blockChecksumAlgorithms, h.ChecksumAlgorithm)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid block checksum algorithm")
+	}
+
+	buf := make([]byte, 0, blockHeaderSize)
+	buf = append(buf, blockHeaderMagic...)
+	buf = append(buf, h.Version, compression, encryption, checksum)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.UncompressedSize))
+	return binary.BigEndian.AppendUint32(buf, blockHeaderChecksum(buf)), nil
+}
+
+// blockHeaderChecksum returns the checksum of the header starting data.
+func blockHeaderChecksum(data []byte) uint32 {
+	return crc32.Checksum(data[:blockHeaderSize-4], blockHeaderChecksumTable)
+}
+
+// hasBlockHeader tells whether the block file starts with a header, rather
+// than being a legacy block starting with the same bytes.
+func hasBlockHeader(data []byte) bool {
+	return len(data) >= blockHeaderSize && bytes.HasPrefix(data, blockHeaderMagic) &&
+		binary.BigEndian.Uint32(data[blockHeaderSize-4:]) == blockHeaderChecksum(data)
+}
+
+// parseBlockHeader returns the header of the block file and what follows it.
+func parseBlockHeader(data []byte) (*blockHeader, []byte, error) {
+	if !hasBlockHeader(data) {
+		return nil, nil, fmt.Errorf("block has no valid header")
+	}
+	version := data[len(blockHeaderMagic)]
+	if version != BLOCK_FORMAT_VERSION {
+		return nil, nil, errors.Wrapf(errUnsupportedBlockFormat, "version %v", version)
+	}
+
+	fields := data[len(blockHeaderMagic)+1:]
+	header := &blockHeader{
+		Version:          version,
+		UncompressedSize: int64(binary.BigEndian.Uint64(fields[3:11])),
+	}
+	var err error
+	if header.CompressionMethod, err = valueOf(blockCompressionMethods, fields[0]); err != nil {
+		return nil, nil, errors.Wrapf(errUnsupportedBlockFormat, "compression method %v", fields[0])
+	}
+	if header.EncryptionMethod, err = valueOf(blockEncryptionMethods, fields[1]); err != nil {
+		return nil, nil, errors.Wrapf(errUnsupportedBlockFormat, "encryption method %v", fields[1])
+	}
+	if header.ChecksumAlgorithm, err = valueOf(blockChecksumAlgorithms, fields[2]); err != nil || header.ChecksumAlgorithm == "" {
+		return nil, nil, errors.Wrapf(errUnsupportedBlockFormat, "checksum algorithm %v", fields[2])
+	}
+	return header, data[blockHeaderSize:], nil
+}
+
+// decodeBlock returns the content of a block file with a header, the header
+// tells how to decrypt and decompress it.
+func decodeBlock(data []byte, checksum string) (io.Reader, error) {
+	header, payload, err := parseBlockHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.EncryptionMethod != "" {
+		if payload, err = decryptBlock(payload, checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := util.DecompressAndVerify(header.CompressionMethod, bytes.NewReader(payload), checksum)
+	if err != nil {
+		return nil, err
+	}
+	if br, ok := r.(*bytes.Reader); ok && br.Size() != header.UncompressedSize {
+		return nil, fmt.Errorf("block size %v doesn't match the size %v recorded in its header", br.Size(), header.UncompressedSize)
+	}
+	return r, nil
+}
+
+func indexOf(values []string, value string) (byte, error) {
+	for i, v := range values {
+		if v == value {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown value %v", value)
+}
+
+func valueOf(values []string, index byte) (string, error) {
+	if int(index) >= len(values) {
+		return "", fmt.Errorf("unknown value %v", index)
+	}
+	return values[index], nil
+}
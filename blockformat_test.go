@@ -0,0 +1,214 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func writeTestBlock(t *testing.T, m *deltaMockStoreDriver, blkFile string, data []byte) {
+	t.Helper()
+
+	if err := m.Write(blkFile, bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to seed block %v: %v", blkFile, err)
+	}
+}
+
+// resealBlockHeader updates the checksum of the modified block header.
+func resealBlockHeader(data []byte) []byte {
+	binary.BigEndian.PutUint32(data[blockHeaderSize-4:], blockHeaderChecksum(data))
+	return data
+}
+
+func TestBlockHeaderRoundTrip(t *testing.T) {
+	m := newDeltaMockStoreDriver(t)
+	block := bytes.Repeat([]byte("block data "), 100)
+	checksum := util.GetChecksum(block)
+	blkFile := getBlockFilePath(deltaVolumeName, checksum)
+
+	for _, compressionMethod := range []string{"none", "gzip", "lz4", "zstd"} {
+		t.Run(compressionMethod, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rs, err := util.CompressData(compressionMethod, block)
+			assert.NoError(err)
+			rs, err = AddBlockHeader(rs, compressionMethod, "", int64(len(block)))
+			assert.NoError(err)
+			data, err := io.ReadAll(rs)
+			assert.NoError(err)
+			writeTestBlock(t, m, blkFile, data)
+
+			header, _, err := parseBlockHeader(data)
+			assert.NoError(err)
+			assert.Equal(&blockHeader{
+				Version:           BLOCK_FORMAT_VERSION,
+				CompressionMethod: compressionMethod,
+				ChecksumAlgorithm: "sha256",
+				UncompressedSize:  int64(len(block)),
+			}, header)
+
+			// The header wins over the compression method recorded for the
+			// block
+			r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, "gzip", checksum)
+			assert.NoError(err)
+			restored, err := io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(block, restored)
+		})
+	}
+}
+
+func TestLegacyHeaderlessBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	block := bytes.Repeat([]byte("block data "), 100)
+	checksum := util.GetChecksum(block)
+	blkFile := getBlockFilePath(deltaVolumeName, checksum)
+
+	// An uncompressed block is found by its checksum
+	writeTestBlock(t, m, blkFile, block)
+	r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, "lz4", checksum)
+	assert.NoError(err)
+	restored, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(block, restored)
+
+	// Even if it starts like a block header
+	block = append(append([]byte{}, blockHeaderMagic...), block...)
+	checksum = util.GetChecksum(block)
+	blkFile = getBlockFilePath(deltaVolumeName, checksum)
+	writeTestBlock(t, m, blkFile, block)
+	r, err = DecompressAndVerifyWithFallback(context.Background(), m, blkFile, "none", checksum)
+	assert.NoError(err)
+	restored, err = io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(block, restored)
+}
+
+func TestBlockHeaderRejectsUnsupportedFormat(t *testing.T) {
+	block := []byte("block data")
+	checksum := util.GetChecksum(block)
+
+	newBlockFile := func() []byte {
+		rs, err := AddBlockHeader(bytes.NewReader(block), "none", "", int64(len(block)))
+		if err != nil {
+			t.Fatalf("failed to add the block header: %v", err)
+		}
+		data, _ := io.ReadAll(rs)
+		return data
+	}
+
+	testCases := map[string]struct {
+		corrupt             func(data []byte) []byte
+		expectErrorContains string
+		expectNoRetry       bool
+	}{
+		"newer version": {
+			corrupt:             func(data []byte) []byte { data[6] = BLOCK_FORMAT_VERSION + 1; return resealBlockHeader(data) },
+			expectErrorContains: "unsupported block format",
+			expectNoRetry:       true,
+		},
+		"unknown compression method": {
+			corrupt:             func(data []byte) []byte { data[7] = 42; return resealBlockHeader(data) },
+			expectErrorContains: "compression method 42",
+			expectNoRetry:       true,
+		},
+		"unknown checksum algorithm": {
+			corrupt:             func(data []byte) []byte { data[9] = 0; return resealBlockHeader(data) },
+			expectErrorContains: "checksum algorithm 0",
+			expectNoRetry:       true,
+		},
+		"wrong uncompressed length": {
+			corrupt:             func(data []byte) []byte { data[17]++; return resealBlockHeader(data) },
+			expectErrorContains: "doesn't match the size",
+		},
+		"corrupted header": {
+			// The block is taken for a legacy one
+			corrupt:             func(data []byte) []byte { data[7] = 42; return data },
+			expectErrorContains: "block has no valid header",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := newDeltaMockStoreDriver(t)
+			blkFile := getBlockFilePath(deltaVolumeName, checksum)
+			writeTestBlock(t, m, blkFile, testCase.corrupt(newBlockFile()))
+
+			ctx := context.Background()
+			if !testCase.expectNoRetry {
+				// Stop at the first retry
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, backoffDuration[0]/2)
+				defer cancel()
+			}
+			start := time.Now()
+			_, err := DecompressAndVerifyWithFallback(ctx, m, blkFile, "none", checksum)
+			if testCase.expectNoRetry {
+				assert.ErrorContains(t, err, testCase.expectErrorContains)
+				assert.Less(t, time.Since(start), backoffDuration[0])
+				return
+			}
+			assert.Error(t, err)
+
+			_, err = decodeBlock(testCase.corrupt(newBlockFile()), checksum)
+			assert.ErrorContains(t, err, testCase.expectErrorContains)
+		})
+	}
+}
+
+func TestBlockFormatVersionIsRecorded(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(BLOCK_FORMAT_VERSION, volume.BlockFormatVersion)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(BLOCK_FORMAT_VERSION, backup.BlockFormatVersion)
+
+	// A backup taken by a newer version is refused instead of failing on
+	// its first block
+	backup.BlockFormatVersion = BLOCK_FORMAT_VERSION + 1
+	backup.SnapshotName = "snap-1"
+	assert.NoError(saveBackup(context.Background(), m, backup))
+	backupURL := EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)
+
+	_, err = InspectBackup(backupURL)
+	assert.ErrorIs(err, errUnsupportedBlockFormat)
+	_, err = VerifyDeltaBlockBackup(context.Background(), backupURL, 1, nil)
+	assert.ErrorIs(err, errUnsupportedBlockFormat)
+	err = RestoreDeltaBlockBackup(context.Background(), &DeltaRestoreConfig{
+		BackupURL:       backupURL,
+		DeltaOps:        newMockRestoreOps(),
+		Filename:        filepath.Join(t.TempDir(), "restored"),
+		ConcurrentLimit: 1,
+	})
+	assert.ErrorIs(err, errUnsupportedBlockFormat)
+	assert.ErrorContains(err, "please upgrade")
+
+	// While the next backups keep the version of the blocks they share
+	ops := newMockDeltaOps()
+	ops.localSnapshots["snap-1"] = true
+	isIncremental, err := CreateDeltaBlockBackup("backup-2", newDeltaBackupConfig(ops))
+	assert.NoError(err)
+	assert.True(isIncremental)
+	ops.waitForSnapshotClosed(t)
+	backup, err = loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(BLOCK_FORMAT_VERSION+1, backup.BlockFormatVersion)
+	volume, err = loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(BLOCK_FORMAT_VERSION+1, volume.BlockFormatVersion)
+}
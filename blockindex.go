@@ -0,0 +1,161 @@
+package backupstore
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+)
+
+// The block index of a volume lists the blocks known to be stored for it, so
+// that a backup doesn't have to check the existence of each block it finds in
+// the backupstore again, which is one request per block on an object store.
+// A backup loads the index once it holds the lock of the volume and trusts the
+// blocks it lists only, it checks the existence of the other ones. Once done
+// it adds the blocks it found or uploaded to the index as it is then, so that
+// the blocks removed from it meanwhile aren't listed again.
+//
+// The blocks are only deleted by GC under the DELETION_LOCK of the volume,
+// while backups hold its BACKUP_LOCK. GC removes the index before deleting any
+// block and saves the retained blocks once done, so the index never lists a
+// deleted block. Verify and repair remove the index once they find damaged
+// blocks, the index may list them.
+//
+// The damaged blocks repair couldn't repair are listed by the damaged blocks
+// file of the volume, in the format of the index. The backups upload them
+// again whenever they find them in the volume, see addDamagedBlockMappings,
+// and remove them from the file once done.
+const (
+	BLOCK_INDEX_FILE    = "block-index.cfg"
+	DAMAGED_BLOCKS_FILE = "damaged-blocks.cfg"
+)
+
+type blockIndex struct {
+	Checksums []string
+}
+
+func getBlockIndexFilePath(volumeName string) string {
+	return filepath.Join(getVolumePath(volumeName), BLOCK_INDEX_FILE)
+}
+
+func getDamagedBlocksFilePath(volumeName string) string {
+	return filepath.Join(getVolumePath(volumeName), DAMAGED_BLOCKS_FILE)
+}
+
+// loadChecksums returns the blocks listed by the file in the format of the
+// block index, none if it doesn't exist.
+func loadChecksums(ctx context.Context, driver BackupStoreDriver, filePath string) (map[string]bool, error) {
+	checksums := map[string]bool{}
+	if !NewDriverWithContext(driver).FileExistsWithContext(ctx, filePath) {
+		return checksums, ctx.Err()
+	}
+	index := &blockIndex{}
+	if err := LoadConfigInBackupStoreWithContext(ctx, driver, filePath, index); err != nil {
+		return nil, err
+	}
+	for _, checksum := range index.Checksums {
+		checksums[checksum] = true
+	}
+	return checksums, nil
+}
+
+func saveChecksums(ctx context.Context, driver BackupStoreDriver, filePath string, checksums map[string]bool) error {
+	index := &blockIndex{
+		Checksums: make([]string, 0, len(checksums)),
+	}
+	for checksum := range checksums {
+		index.Checksums = append(index.Checksums, checksum)
+	}
+	sort.Strings(index.Checksums)
+	return SaveConfigInBackupStoreWithContext(ctx, driver, filePath, index)
+}
+
+// loadBlockIndex returns the blocks listed by the block index of the volume,
+// none if it doesn't exist.
+func loadBlockIndex(ctx context.Context, driver BackupStoreDriver, volumeName string) (map[string]bool, error) {
+	checksums, err := loadChecksums(ctx, driver, getBlockIndexFilePath(volumeName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load the block index of volume %v", volumeName)
+	}
+	return checksums, nil
+}
+
+// loadKnownBlocks returns the blocks of the volume listed by its block index.
+// The index is a cache, failing to load it only costs the existence checks.
+func loadKnownBlocks(ctx context.Context, driver BackupStoreDriver, volume *Volume) map[string]bool {
+	if volume.PackFiles {
+		// The pack indexes list the blocks already
+		return map[string]bool{}
+	}
+
+	knownBlocks, err := loadBlockIndex(ctx, driver, volume.Name)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to load the block index of volume %v", volume.Name)
+		return map[string]bool{}
+	}
+	return knownBlocks
+}
+
+func saveBlockIndex(ctx context.Context, driver BackupStoreDriver, volumeName string, checksums map[string]bool) error {
+	return saveChecksums(ctx, driver, getBlockIndexFilePath(volumeName), checksums)
+}
+
+// updateBlockIndex adds the blocks the backup found or uploaded to the block
+// index, loaded again since verify or repair may have removed it meanwhile.
+func updateBlockIndex(ctx context.Context, driver BackupStoreDriver, volume *Volume, storedBlocks map[string]bool) {
+	if volume.PackFiles {
+		return
+	}
+
+	checksums, err := loadBlockIndex(ctx, driver, volume.Name)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to load the block index of volume %v, it's replaced", volume.Name)
+		checksums = map[string]bool{}
+	}
+	for checksum := range storedBlocks {
+		checksums[checksum] = true
+	}
+	if err := saveBlockIndex(ctx, driver, volume.Name, checksums); err != nil {
+		log.WithError(err).Warnf("Failed to save the block index of volume %v", volume.Name)
+	}
+}
+
+func removeBlockIndex(ctx context.Context, driver BackupStoreDriver, volumeName string) error {
+	if err := NewDriverWithContext(driver).RemoveWithContext(ctx, getBlockIndexFilePath(volumeName)); err != nil {
+		return errors.Wrapf(err, "failed to remove the block index of volume %v", volumeName)
+	}
+	return nil
+}
+
+// loadDamagedBlocks returns the blocks listed by the damaged blocks file of the
+// volume.
+func loadDamagedBlocks(ctx context.Context, driver BackupStoreDriver, volumeName string) (map[string]bool, error) {
+	checksums, err := loadChecksums(ctx, driver, getDamagedBlocksFilePath(volumeName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load the damaged blocks of volume %v", volumeName)
+	}
+	return checksums, nil
+}
+
+// updateDamagedBlocks updates the blocks listed by the damaged blocks file of
+// the volume, which is removed once it lists none.
+func updateDamagedBlocks(ctx context.Context, driver BackupStoreDriver, volumeName string, update func(checksums map[string]bool)) error {
+	checksums, err := loadDamagedBlocks(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	update(checksums)
+
+	damagedBlocksFile := getDamagedBlocksFilePath(volumeName)
+	if len(checksums) == 0 {
+		if err := NewDriverWithContext(driver).RemoveWithContext(ctx, damagedBlocksFile); err != nil {
+			return errors.Wrapf(err, "failed to remove the damaged blocks of volume %v", volumeName)
+		}
+		return nil
+	}
+	if err := saveChecksums(ctx, driver, damagedBlocksFile, checksums); err != nil {
+		return errors.Wrapf(err, "failed to save the damaged blocks of volume %v", volumeName)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package backupstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	lhbackup "github.com/longhorn/go-common-libs/backup"
+)
+
+func TestBlockIndexSkipsExistenceChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+
+	index := &blockIndex{}
+	assert.NoError(LoadConfigInBackupStoreWithContext(context.Background(), m, getBlockIndexFilePath(deltaVolumeName), index))
+	blockNames, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.ElementsMatch(blockNames, index.Checksums)
+
+	// The blocks of the index are trusted, a block missing behind the back of
+	// the backups isn't noticed
+	missingBlock := getBlockFilePath(deltaVolumeName, blockNames[0])
+	assert.NoError(m.fs.Remove(missingBlock))
+	createTestBackup(t, deltaVolumeName, "backup-2", nil, nil)
+	exists, err := afero.Exists(m.fs, missingBlock)
+	assert.NoError(err)
+	assert.False(exists)
+
+	// Unlike by a full backup, which checks every block
+	createTestBackup(t, deltaVolumeName, "backup-3", nil, map[string]string{
+		lhbackup.LonghornBackupParameterBackupMode: string(lhbackup.LonghornBackupModeFull),
+	})
+	exists, err = afero.Exists(m.fs, missingBlock)
+	assert.NoError(err)
+	assert.True(exists)
+}
+
+func TestBlockIndexUpdatedByGC(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	indexFile := getBlockIndexFilePath(deltaVolumeName)
+	assert.NoError(SaveConfigInBackupStoreWithContext(context.Background(), m, indexFile, &blockIndex{
+		Checksums: []string{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+	}))
+
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)))
+	index := &blockIndex{}
+	assert.NoError(LoadConfigInBackupStoreWithContext(context.Background(), m, indexFile, index))
+	assert.Empty(index.Checksums)
+}
+
+func TestBlockIndexRemovedByVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	createIncrementalBackup := func(backupName, snapshotName, lastSnapshotName string) {
+		ops := newMockDeltaOps()
+		ops.localSnapshots[lastSnapshotName] = true
+		config := newDeltaBackupConfig(ops)
+		config.Snapshot.Name = snapshotName
+		isIncremental, err := CreateDeltaBlockBackup(backupName, config)
+		assert.NoError(err)
+		assert.True(isIncremental)
+		ops.waitForSnapshotClosed(t)
+		assert.Empty(ops.getLastStatus(t).errMessage)
+	}
+	createIncrementalBackup("backup-2", "snap-3", deltaSnapshotName)
+	backup, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	assert.Zero(backup.NewlyUploadedDataSize)
+
+	// The block referenced by the last backup is uploaded again once verify
+	// finds it missing
+	missingBlock := getBlockFilePath(deltaVolumeName, backup.Blocks[0].BlockChecksum)
+	assert.NoError(m.fs.Remove(missingBlock))
+	report, err := Verify(&VerifyConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName})
+	assert.NoError(err)
+	assert.Len(report.Volumes[deltaVolumeName].MissingBlocks, 2)
+	assert.False(m.FileExists(getBlockIndexFilePath(deltaVolumeName)))
+
+	createIncrementalBackup("backup-3", "snap-4", "snap-3")
+	exists, err := afero.Exists(m.fs, missingBlock)
+	assert.NoError(err)
+	assert.True(exists)
+	backup, err = loadBackup(context.Background(), m, "backup-3", deltaVolumeName)
+	assert.NoError(err)
+	assert.NotZero(backup.NewlyUploadedDataSize)
+
+	// Along with the blocks found stored, in the new block index
+	index, err := loadBlockIndex(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(index, 2)
+}
+
+func TestBlockIndexUpdateKeepsRemovedBlocksOut(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	volume := &Volume{Name: deltaVolumeName}
+	checksums := []string{
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+	}
+	assert.NoError(saveBlockIndex(context.Background(), m, deltaVolumeName, map[string]bool{checksums[0]: true}))
+
+	// The index removed while the backup ran isn't restored
+	assert.NoError(removeBlockIndex(context.Background(), m, deltaVolumeName))
+	updateBlockIndex(context.Background(), m, volume, map[string]bool{checksums[1]: true})
+	index, err := loadBlockIndex(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{checksums[1]: true}, index)
+}
@@ -0,0 +1,365 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+// The volumes using the block pool share their blocks under
+// block-pool/blocks instead of keeping them in their own directory, so
+// identical blocks of different volumes are stored once. Each of them lists
+// the blocks its backups reference in block-pool/references/<volume>.cfg, a
+// block of the pool is only deleted once no volume references it anymore.
+//
+// The backups of the volumes hold a BACKUP_LOCK on the block pool, so that the
+// blocks they find in the pool aren't deleted before they reference them. The
+// deletion of the blocks holds a DELETION_LOCK on it.
+const (
+	BLOCK_POOL_DIRECTORY       = "block-pool"
+	BLOCK_REFERENCES_DIRECTORY = "references"
+)
+
+// blockReferences lists the blocks of the pool referenced by the backups of a
+// volume.
+type blockReferences struct {
+	VolumeName string
+	Checksums  []string
+}
+
+func getBlockPoolPath() string {
+	return filepath.Join(backupstoreBase, BLOCK_POOL_DIRECTORY) + "/"
+}
+
+func getPoolBlockPath() string {
+	return filepath.Join(getBlockPoolPath(), BLOCKS_DIRECTORY) + "/"
+}
+
+func getPoolBlockFilePath(checksum string) string {
+	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
+	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
+	path := filepath.Join(getPoolBlockPath(), blockSubDirLayer1, blockSubDirLayer2)
+	fileName := checksum + BLK_SUFFIX
+
+	return filepath.Join(path, fileName)
+}
+
+func getBlockReferencesPath() string {
+	return filepath.Join(getBlockPoolPath(), BLOCK_REFERENCES_DIRECTORY) + "/"
+}
+
+func getBlockReferencesFilePath(volumeName string) string {
+	return filepath.Join(getBlockReferencesPath(), volumeName+CFG_SUFFIX)
+}
+
+// getVolumeBlockFilePath returns the path of the block of the volume, in the
+// block pool or in the volume directory.
+func getVolumeBlockFilePath(volume *Volume, checksum string) string {
+	if volume.BlockPool {
+		return getPoolBlockFilePath(checksum)
+	}
+	return getBlockFilePath(volume.Name, checksum)
+}
+
+// prepareVolumeBlockPool decides whether a new backup volume uses the block
+// pool, given by BackupParameterBlockPool. The existing volumes keep their
+// layout, see MigrateVolumeToBlockPool.
+func prepareVolumeBlockPool(ctx context.Context, driver BackupStoreDriver, volume *Volume, parameters map[string]string) error {
+	useBlockPool := false
+	if value := parameters[BackupParameterBlockPool]; value != "" {
+		var err error
+		if useBlockPool, err = strconv.ParseBool(value); err != nil {
+			return errors.Wrapf(err, "invalid value %v of parameter %v", value, BackupParameterBlockPool)
+		}
+	}
+
+	if volumeExists(ctx, driver, volume.Name) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if useBlockPool && volume.Encryption != nil {
+		// The blocks are encrypted with the key of their volume
+		return fmt.Errorf("encrypted backup volume %v cannot use the block pool", volume.Name)
+	}
+	volume.BlockPool = useBlockPool
+	return nil
+}
+
+// lockBlockPool locks the block pool for the volume, the lock is nil if the
+// volume doesn't use the block pool.
+func lockBlockPool(ctx context.Context, driver BackupStoreDriver, volume *Volume, lockType LockType) (*FileLock, error) {
+	if !volume.BlockPool {
+		return nil, nil
+	}
+	lock, err := New(driver, types.BlockPoolLockName, lockType)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.LockWithContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to lock the block pool")
+	}
+	return lock, nil
+}
+
+func unlockBlockPool(lock *FileLock) {
+	if lock == nil {
+		return
+	}
+	if err := lock.Unlock(); err != nil {
+		log.WithError(err).Warn("Failed to unlock the block pool")
+	}
+}
+
+func loadBlockReferences(ctx context.Context, driver BackupStoreDriver, volumeName string) (*blockReferences, error) {
+	refs := &blockReferences{}
+	if err := LoadConfigInBackupStoreWithContext(ctx, driver, getBlockReferencesFilePath(volumeName), refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func saveBlockReferences(ctx context.Context, driver BackupStoreDriver, volumeName string, checksums map[string]bool) error {
+	refs := &blockReferences{
+		VolumeName: volumeName,
+		Checksums:  make([]string, 0, len(checksums)),
+	}
+	for checksum := range checksums {
+		refs.Checksums = append(refs.Checksums, checksum)
+	}
+	return SaveConfigInBackupStoreWithContext(ctx, driver, getBlockReferencesFilePath(volumeName), refs)
+}
+
+func removeBlockReferences(ctx context.Context, driver BackupStoreDriver, volumeName string) error {
+	return NewDriverWithContext(driver).RemoveWithContext(ctx, getBlockReferencesFilePath(volumeName))
+}
+
+// addBlockReferences adds the blocks to the ones referenced by the volume. It's
+// done before the backup referencing them is saved, so the references of a
+// volume may include blocks no backup references, but never miss one.
+func addBlockReferences(ctx context.Context, driver BackupStoreDriver, volumeName string, blocks []BlockMapping) error {
+	checksums := map[string]bool{}
+	if !NewDriverWithContext(driver).FileExistsWithContext(ctx, getBlockReferencesFilePath(volumeName)) {
+		// The references would be overwritten with the new blocks only
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	} else {
+		refs, err := loadBlockReferences(ctx, driver, volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load the block references of volume %v", volumeName)
+		}
+		for _, checksum := range refs.Checksums {
+			checksums[checksum] = true
+		}
+	}
+	for _, blk := range blocks {
+		checksums[blk.BlockChecksum] = true
+	}
+	return saveBlockReferences(ctx, driver, volumeName, checksums)
+}
+
+// getOtherVolumesBlockReferences returns the blocks of the pool referenced by
+// the volumes other than volumeName.
+func getOtherVolumesBlockReferences(ctx context.Context, driver BackupStoreDriver, volumeName string) (map[string]bool, error) {
+	fileList, err := NewDriverWithContext(driver).ListWithContext(ctx, getBlockReferencesPath())
+	if err != nil {
+		// path doesn't exist
+		fileList = []string{}
+	}
+
+	checksums := map[string]bool{}
+	for _, name := range util.ExtractNames(fileList, "", CFG_SUFFIX) {
+		if name == volumeName {
+			continue
+		}
+		refs, err := loadBlockReferences(ctx, driver, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load the block references of volume %v", name)
+		}
+		for _, checksum := range refs.Checksums {
+			checksums[checksum] = true
+		}
+	}
+	return checksums, nil
+}
+
+// cleanupPoolBlocks is cleanupBlocks for the volumes using the block pool, the
+// blockMap lists the whole pool. The blocks referenced by the other volumes
+// are retained.
+func cleanupPoolBlocks(ctx context.Context, driver BackupStoreDriver, blockMap map[string]*BlockInfo, volume *Volume, gcConfig *GCConfig) error {
+	lock, err := lockBlockPool(ctx, driver, volume, DELETION_LOCK)
+	if err != nil {
+		// The unreferenced blocks are deleted by the next GC of the pool
+		log.WithError(err).Warn("Failed to lock the block pool, skip block deletion")
+		return nil
+	}
+	defer unlockBlockPool(lock)
+
+	checksums := map[string]bool{}
+	for _, blk := range blockMap {
+		if isBlockReferenced(blk) {
+			checksums[blk.checksum] = true
+		}
+	}
+	if err := saveBlockReferences(ctx, driver, volume.Name, checksums); err != nil {
+		return errors.Wrapf(err, "failed to save the block references of volume %v", volume.Name)
+	}
+
+	otherChecksums, err := getOtherVolumesBlockReferences(ctx, driver, volume.Name)
+	if err != nil {
+		return err
+	}
+	for checksum := range otherChecksums {
+		if blk, ok := blockMap[checksum]; ok && !isBlockReferenced(blk) {
+			delete(blockMap, checksum)
+		}
+	}
+	return cleanupBlocks(ctx, driver, blockMap, volume.Name, gcConfig)
+}
+
+func MigrateVolumeToBlockPool(volumeURL string) error {
+	return MigrateVolumeToBlockPoolWithContext(context.Background(), volumeURL)
+}
+
+// MigrateVolumeToBlockPoolWithContext moves the blocks of the backup volume
+// into the block pool, the volume uses the block pool from then on.
+// Cancelling ctx aborts the migration, the volume keeps its blocks then.
+func MigrateVolumeToBlockPoolWithContext(ctx context.Context, volumeURL string) (err error) {
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return err
+	}
+	migrateLog := log.WithFields(logrus.Fields{
+		LogFieldVolume: volumeName,
+	})
+	defer func() {
+		if err != nil {
+			migrateLog.WithError(err).Error("Failed to migrate backup volume to the block pool")
+		}
+	}()
+	if !volumeExists(ctx, driver, volumeName) {
+		return fmt.Errorf("cannot find backup volume %v in backupstore", volumeName)
+	}
+
+	// Neither backups nor deletions may change the blocks of the volume in
+	// the meantime
+	lock, err := New(driver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.LockWithContext(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			migrateLog.WithError(unlockErr).Warn("Failed to unlock")
+		}
+	}()
+
+	volume, err := loadVolume(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	if volume.BlockPool {
+		migrateLog.Info("Backup volume already uses the block pool")
+		return nil
+	}
+	if volume.Encryption != nil {
+		return fmt.Errorf("encrypted backup volume %v cannot use the block pool", volumeName)
+	}
+	if volume.PackFiles {
+		return fmt.Errorf("backup volume %v using pack files cannot use the block pool", volumeName)
+	}
+
+	// The blocks added to the pool must not be deleted before the volume
+	// references them
+	volume.BlockPool = true
+	poolLock, err := lockBlockPool(ctx, driver, volume, BACKUP_LOCK)
+	if err != nil {
+		return err
+	}
+	defer unlockBlockPool(poolLock)
+
+	checksums := map[string]bool{}
+	backupNames, err := getBackupNamesForVolume(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, name := range backupNames {
+		backup, err := loadBackup(ctx, driver, name, volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load backup %v", name)
+		}
+		for _, blk := range backup.Blocks {
+			checksums[blk.BlockChecksum] = true
+		}
+	}
+
+	blockNames, err := getBlockNamesForVolume(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	d := NewDriverWithContext(driver)
+	copied := 0
+	for _, checksum := range blockNames {
+		poolBlkFile := getPoolBlockFilePath(checksum)
+		if d.FileExistsWithContext(ctx, poolBlkFile) {
+			continue
+		}
+		if err := copyBlock(ctx, driver, getBlockFilePath(volumeName, checksum), poolBlkFile); err != nil {
+			return err
+		}
+		copied++
+	}
+	migrateLog.Infof("Copied %v of %v blocks to the block pool", copied, len(blockNames))
+
+	if err := saveBlockReferences(ctx, driver, volumeName, checksums); err != nil {
+		return errors.Wrapf(err, "failed to save the block references of volume %v", volumeName)
+	}
+	if err := saveVolume(ctx, driver, volume); err != nil {
+		return err
+	}
+	if err := d.RemoveWithContext(ctx, getBlockPath(volumeName)); err != nil {
+		// The volume doesn't read them anymore
+		migrateLog.WithError(err).Warn("Failed to remove the blocks of the volume")
+	}
+
+	migrateLog.Info("Migrated backup volume to the block pool")
+	return nil
+}
+
+func copyBlock(ctx context.Context, driver BackupStoreDriver, src, dst string) error {
+	d := NewDriverWithContext(driver)
+	rc, err := d.ReadWithContext(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block %v", src)
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block %v", src)
+	}
+	if err := d.WriteWithContext(ctx, dst, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "failed to write block %v", dst)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package backupstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockPoolSharesBlocksAcrossVolumes(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	poolParameters := map[string]string{BackupParameterBlockPool: "true"}
+	otherVolumeName := "pvc-delta-2"
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, poolParameters)
+	createTestBackup(t, otherVolumeName, "backup-2", nil, poolParameters)
+
+	poolBlocks, err := ListBlockNames(context.Background(), m, getPoolBlockPath(), nil)
+	assert.NoError(err)
+	assert.Len(poolBlocks, 2)
+	for _, volumeName := range []string{deltaVolumeName, otherVolumeName} {
+		volume, err := loadVolume(context.Background(), m, volumeName)
+		assert.NoError(err)
+		assert.True(volume.BlockPool)
+
+		blockNames, err := getBlockNamesForVolume(context.Background(), m, volumeName)
+		assert.NoError(err)
+		assert.Empty(blockNames)
+
+		refs, err := loadBlockReferences(context.Background(), m, volumeName)
+		assert.NoError(err)
+		assert.ElementsMatch(poolBlocks, refs.Checksums)
+	}
+
+	// The other volume still references the blocks
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)))
+	blockNames, err := ListBlockNames(context.Background(), m, getPoolBlockPath(), nil)
+	assert.NoError(err)
+	assert.ElementsMatch(poolBlocks, blockNames)
+	refs, err := loadBlockReferences(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Empty(refs.Checksums)
+
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-2", otherVolumeName, deltaDriverURL)))
+	blockNames, err = ListBlockNames(context.Background(), m, getPoolBlockPath(), nil)
+	assert.NoError(err)
+	assert.Empty(blockNames)
+}
+
+func TestBlockPoolRejectsEncryptedVolumes(t *testing.T) {
+	useCheapKDF(t)
+
+	newDeltaMockStoreDriver(t)
+	config := newDeltaBackupConfig(newMockDeltaOps())
+	config.Parameters[BackupParameterBlockPool] = "true"
+	config.Parameters[BackupParameterEncryptionPassphrase] = testPassphrase
+
+	_, err := CreateDeltaBlockBackup("backup-1", config)
+	assert.ErrorContains(t, err, "cannot use the block pool")
+}
+
+func TestMigrateVolumeToBlockPool(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	volumeBlocks, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(volumeBlocks, 2)
+
+	volumeURL := EncodeBackupURL("", deltaVolumeName, deltaDriverURL)
+	assert.NoError(MigrateVolumeToBlockPool(volumeURL))
+	// Migrating again is a no-op
+	assert.NoError(MigrateVolumeToBlockPool(volumeURL))
+
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.True(volume.BlockPool)
+	blockNames, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Empty(blockNames)
+	refs, err := loadBlockReferences(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.ElementsMatch(volumeBlocks, refs.Checksums)
+
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	for _, blk := range backup.Blocks {
+		_, err := DecompressAndVerifyWithFallback(context.Background(), m, getVolumeBlockFilePath(volume, blk.BlockChecksum), backup.CompressionMethod, blk.BlockChecksum)
+		assert.NoError(err)
+	}
+
+	// The next backups find the blocks in the pool
+	createTestBackup(t, deltaVolumeName, "backup-2", nil, nil)
+	backup, err = loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	assert.Zero(backup.NewlyUploadedDataSize)
+	exists, err := afero.DirExists(m.fs, getBlockPath(deltaVolumeName))
+	assert.NoError(err)
+	assert.False(exists)
+}
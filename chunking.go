@@ -0,0 +1,314 @@
+package backupstore
+
+import (
+	"context"
+	"math/bits"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
+	"github.com/longhorn/backupstore/types"
+)
+
+// With CHUNKING_METHOD_CDC the volume data is cut where its content matches a
+// pattern rather than at every block size, the way FastCDC does it: a gear
+// hash rolls over the data and a chunk ends once the hash matches a mask. The
+// mask is stricter before the average chunk size than after it, which keeps
+// the chunk sizes close to the average. The cut points move along with the
+// data, so data shifted inside a volume, or between similar volumes, is still
+// cut into the same chunks and deduplicated.
+//
+// A chunk is stored and referenced by the backup like a block is, the backup
+// records its size in BlockMapping.Size.
+
+var gearTable = newGearTable()
+
+// newGearTable returns the random values the gear hash mixes in for every
+// byte. Changing them moves the cut points, so the chunks backed up before
+// wouldn't be deduplicated anymore.
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	seed := uint64(0x6c6f6e67686f726e)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// minChunkAvgSize is the smallest average chunk size, the mask after the
+// average size needs at least one bit.
+const minChunkAvgSize = 8
+
+type chunker struct {
+	minSize int
+	avgSize int
+	maxSize int
+	// maskS is used before the average size and maskL after it
+	maskS uint64
+	maskL uint64
+}
+
+// newChunker returns a chunker cutting chunks of avgSize bytes on average. The
+// masks select the cut points by the bits of the hash, so the average size
+// must be a power of two, of at least minChunkAvgSize bytes.
+func newChunker(avgSize int64) (*chunker, error) {
+	if avgSize < minChunkAvgSize || avgSize&(avgSize-1) != 0 {
+		return nil, errors.Errorf("invalid block size %v for chunking method %v, it must be a power of two of at least %v bytes",
+			avgSize, CHUNKING_METHOD_CDC, minChunkAvgSize)
+	}
+	avgBits := bits.Len64(uint64(avgSize)) - 1
+	return &chunker{
+		minSize: int(avgSize / 4),
+		avgSize: int(avgSize),
+		maxSize: int(avgSize * 4),
+		// The hash is shifted left as the bytes come in, its upper bits depend
+		// on the last 64 bytes.
+		maskS: ^uint64(0) << (64 - (avgBits + 2)),
+		maskL: ^uint64(0) << (64 - (avgBits - 2)),
+	}, nil
+}
+
+// cut returns the length of the chunk data starts with. The data is the rest
+// of the extent being chunked, or at least maxSize bytes of it.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normalSize := min(c.avgSize, n)
+
+	var hash uint64
+	i := c.minSize
+	for ; i < normalSize; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// hasChunks tells whether the backup has blocks of their own size, cut by
+// CHUNKING_METHOD_CDC.
+func (backup *Backup) hasChunks() bool {
+	for _, blk := range backup.Blocks {
+		if blk.Size != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getBackupSize returns the size of the data referenced by the blocks.
+func getBackupSize(blocks []BlockMapping, blockSize int64) int64 {
+	size := int64(0)
+	for _, blk := range blocks {
+		size += blk.getSize(blockSize)
+	}
+	return size
+}
+
+// getChunkExtents returns the parts of the volume to cut into chunks for the
+// changed mappings. A block of the last backup that changed, even partly, is
+// cut again as a whole, so that the new chunks replace the last blocks
+// exactly.
+func getChunkExtents(mappings []types.Mapping, lastBackup *Backup, lastBlockSize int64) []types.Mapping {
+	var lastBlocks []BlockMapping
+	if lastBackup != nil {
+		lastBlocks = lastBackup.Blocks
+	}
+
+	extents := []types.Mapping{}
+	for _, mapping := range mappings {
+		start, end := mapping.Offset, mapping.Offset+mapping.Size
+		i := sort.Search(len(lastBlocks), func(i int) bool {
+			return lastBlocks[i].Offset+lastBlocks[i].getSize(lastBlockSize) > mapping.Offset
+		})
+		for ; i < len(lastBlocks) && lastBlocks[i].Offset < mapping.Offset+mapping.Size; i++ {
+			start = min(start, lastBlocks[i].Offset)
+			end = max(end, lastBlocks[i].Offset+lastBlocks[i].getSize(lastBlockSize))
+		}
+		extents = append(extents, types.Mapping{Offset: start, Size: end - start})
+	}
+
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].Offset < extents[j].Offset
+	})
+	merged := []types.Mapping{}
+	for _, extent := range extents {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if extent.Offset <= last.Offset+last.Size {
+				last.Size = max(last.Size, extent.Offset+extent.Size-last.Offset)
+				continue
+			}
+		}
+		merged = append(merged, extent)
+	}
+	return merged
+}
+
+// backupChunks cuts the extent of the snapshot into chunks and backs them up.
+func backupChunks(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaBackupConfig,
+	deltaBackup *Backup, blockSize int64, extent types.Mapping, progress *progress) error {
+	volume := config.Volume
+	snapshot := config.Snapshot
+	deltaOps := config.DeltaOps
+
+	chunker, err := newChunker(blockSize)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, blockSize)
+	buf := make([]byte, 0, int64(chunker.maxSize)+blockSize)
+
+	end := extent.Offset + extent.Size
+	offset, readOffset := extent.Offset, extent.Offset
+	for offset < end {
+		// The snapshot is read by whole blocks, while the extents start at the
+		// chunk boundaries of the last backup.
+		for len(buf) < chunker.maxSize && readOffset < end {
+			blockOffset := readOffset - readOffset%blockSize
+			if err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, blockOffset, block); err != nil {
+				logrus.WithError(err).Errorf("Failed to read volume %v snapshot %v block at offset %v size %v",
+					volume.Name, snapshot.Name, blockOffset, len(block))
+				return err
+			}
+			blockEnd := min(blockSize, end-blockOffset)
+			buf = append(buf, block[readOffset-blockOffset:blockEnd]...)
+			readOffset = blockOffset + blockEnd
+		}
+
+		n := chunker.cut(buf)
+		log.Tracef("Backup for %v: extent %+v, chunk at offset %v size %v", snapshot.Name, extent, offset, n)
+		if err := backupBlock(ctx, bsDriver, config, deltaBackup, offset, buf[:n], progress); err != nil {
+			logrus.WithError(err).Errorf("Failed to back up volume %v snapshot %v chunk at offset %v size %v",
+				volume.Name, snapshot.Name, offset, n)
+			return err
+		}
+		buf = buf[:copy(buf, buf[n:])]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// mergeChunkMaps adds the blocks of the last backup outside of the extents to
+// the chunks cut from them. The delta backup is returned with the merged
+// blocks, the rest of it is kept as is.
+func mergeChunkMaps(deltaBackup, lastBackup *Backup, extents []types.Mapping, blockSize, lastBlockSize int64) *Backup {
+	sort.Slice(deltaBackup.Blocks, func(i, j int) bool {
+		return deltaBackup.Blocks[i].Offset < deltaBackup.Blocks[j].Offset
+	})
+	if lastBackup == nil {
+		return deltaBackup
+	}
+
+	blocks := deltaBackup.Blocks
+	e := 0
+	for _, blk := range lastBackup.Blocks {
+		for e < len(extents) && extents[e].Offset+extents[e].Size <= blk.Offset {
+			e++
+		}
+		if e < len(extents) && extents[e].Offset <= blk.Offset {
+			// replaced by the chunks of the extent
+			continue
+		}
+		if blk.Size == 0 && lastBlockSize != blockSize {
+			blk.Size = lastBlockSize
+		}
+		blocks = append(blocks, blk)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	deltaBackup.Blocks = blocks
+
+	log.WithFields(logrus.Fields{
+		LogFieldEvent:      LogEventBackup,
+		LogFieldObject:     LogObjectBackup,
+		LogFieldBackup:     deltaBackup.Name,
+		LogFieldLastBackup: lastBackup.Name,
+	}).Info("Merge backup chunks")
+	return deltaBackup
+}
+
+// populateChunksForIncrementalRestore is populateBlocksForIncrementalRestore
+// for the backups with chunks, whose blocks don't line up at the same offsets.
+func populateChunksForIncrementalRestore(lastBackup, backup *Backup, blockSize int64) (<-chan *Block, <-chan error) {
+	blockChan := make(chan *Block, 10)
+	errChan := make(chan error, 1)
+
+	type blockKey struct {
+		offset   int64
+		size     int64
+		checksum string
+	}
+
+	go func() {
+		defer close(blockChan)
+		defer close(errChan)
+
+		unchanged := map[blockKey]bool{}
+		for _, blk := range lastBackup.Blocks {
+			unchanged[blockKey{blk.Offset, blk.getSize(blockSize), blk.BlockChecksum}] = true
+		}
+		for _, blk := range backup.Blocks {
+			size := blk.getSize(blockSize)
+			if unchanged[blockKey{blk.Offset, size, blk.BlockChecksum}] {
+				continue
+			}
+			blockChan <- &Block{
+				offset:            blk.Offset,
+				size:              size,
+				blockChecksum:     blk.BlockChecksum,
+				compressionMethod: blk.getCompressionMethod(backup.CompressionMethod),
+			}
+		}
+
+		// The data of the last backup which isn't in the backup anymore
+		b := 0
+		for _, lB := range lastBackup.Blocks {
+			start, end := lB.Offset, lB.Offset+lB.getSize(blockSize)
+			for b < len(backup.Blocks) && backup.Blocks[b].Offset+backup.Blocks[b].getSize(blockSize) <= start {
+				b++
+			}
+			for i := b; i < len(backup.Blocks) && backup.Blocks[i].Offset < end; i++ {
+				bB := backup.Blocks[i]
+				if bB.Offset > start {
+					blockChan <- &Block{
+						offset:      start,
+						size:        bB.Offset - start,
+						isZeroBlock: true,
+					}
+				}
+				start = max(start, bB.Offset+bB.getSize(blockSize))
+			}
+			if start < end {
+				blockChan <- &Block{
+					offset:      start,
+					size:        end - start,
+					isZeroBlock: true,
+				}
+			}
+		}
+	}()
+
+	return blockChan, errChan
+}
@@ -0,0 +1,206 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	lhbackup "github.com/longhorn/go-common-libs/backup"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func cutChunks(c *chunker, data []byte) [][]byte {
+	chunks := [][]byte{}
+	for len(data) > 0 {
+		n := c.cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestChunkerFindsShiftedData(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := newChunker(deltaBlockSize)
+	assert.NoError(err)
+	data := randomData(1, 256*int(deltaBlockSize))
+	chunks := cutChunks(c, data)
+	assert.Greater(len(chunks), 32)
+
+	checksums := map[string]bool{}
+	for i, chunk := range chunks {
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(len(chunk), c.minSize)
+		}
+		assert.LessOrEqual(len(chunk), c.maxSize)
+		checksums[util.GetChecksum(chunk)] = true
+	}
+	// The chunks depend on the content only
+	assert.Equal(chunks, cutChunks(c, data))
+
+	// Only the chunks around the inserted data change
+	shifted := append(append(append([]byte{}, data[:len(data)/2]...), randomData(2, 100)...), data[len(data)/2:]...)
+	newChunks := 0
+	for _, chunk := range cutChunks(c, shifted) {
+		if !checksums[util.GetChecksum(chunk)] {
+			newChunks++
+		}
+	}
+	assert.LessOrEqual(newChunks, 3)
+}
+
+func TestNewChunkerValidatesBlockSize(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, avgSize := range []int64{0, 4, 3 * deltaBlockSize} {
+		_, err := newChunker(avgSize)
+		assert.ErrorContains(err, "invalid block size", "average size %v", avgSize)
+	}
+	_, err := newChunker(minChunkAvgSize)
+	assert.NoError(err)
+
+	// The backup fails before it starts
+	ops := newMockDeltaOps()
+	config := newDeltaBackupConfig(ops)
+	config.Parameters[BackupParameterChunkingMethod] = CHUNKING_METHOD_CDC
+	config.Parameters[lhbackup.LonghornBackupParameterBackupBlockSize] = fmt.Sprint(3 * deltaBlockSize)
+	_, err = CreateDeltaBlockBackup("backup-1", config)
+	assert.ErrorContains(err, "invalid block size")
+}
+
+func TestGetChunkExtents(t *testing.T) {
+	assert := assert.New(t)
+
+	lastBackup := &Backup{
+		Blocks: []BlockMapping{
+			{Offset: 0, Size: 3000},
+			{Offset: 3000, Size: 6000},
+			{Offset: 9000, Size: 5000},
+			{Offset: 16384, Size: 6000},
+		},
+	}
+	mappings := []types.Mapping{
+		{Offset: 4096, Size: 4096},
+		{Offset: 8192, Size: 4096},
+		{Offset: 20480, Size: 4096},
+	}
+	assert.Equal([]types.Mapping{
+		{Offset: 3000, Size: 11000},
+		{Offset: 16384, Size: 8192},
+	}, getChunkExtents(mappings, lastBackup, deltaBlockSize))
+	assert.Equal(mappings[:1], getChunkExtents(mappings[:1], nil, deltaBlockSize))
+}
+
+func TestContentDefinedChunkingBackupAndRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	volumeSize := 64 * deltaBlockSize
+
+	ops := newMockDeltaOps()
+	ops.content = randomData(1, int(volumeSize))
+	ops.mappings = &types.Mappings{
+		BlockSize: deltaBlockSize,
+		Mappings:  []types.Mapping{{Offset: 0, Size: volumeSize}},
+	}
+	config := newDeltaBackupConfig(ops)
+	config.Volume.Size = volumeSize
+	config.Parameters[BackupParameterChunkingMethod] = CHUNKING_METHOD_CDC
+
+	_, err := CreateDeltaBlockBackup("backup-1", config)
+	assert.NoError(err)
+	ops.waitForSnapshotClosed(t)
+	assert.Empty(ops.getLastStatus(t).errMessage)
+
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.True(backup.hasChunks())
+	assert.Equal(volumeSize, backup.Size)
+	offset := int64(0)
+	for _, blk := range backup.Blocks {
+		assert.Equal(offset, blk.Offset)
+		offset += blk.Size
+	}
+	assert.Equal(volumeSize, offset)
+
+	assert.True(bytes.Equal(ops.content, restoreTestBackup(t, "backup-1")))
+
+	// Data inserted in the middle of the volume shifts everything behind it,
+	// the chunks are found again nonetheless
+	shiftedOps := newMockDeltaOps()
+	shifted := append(append([]byte{}, ops.content[:volumeSize/2]...), randomData(2, 100)...)
+	shiftedOps.content = append(shifted, ops.content[volumeSize/2:volumeSize-100]...)
+	shiftedOps.mappings = &types.Mappings{
+		BlockSize: deltaBlockSize,
+		Mappings:  []types.Mapping{{Offset: volumeSize / 2, Size: volumeSize / 2}},
+	}
+	config = newDeltaBackupConfig(shiftedOps)
+	config.Snapshot.Name = "snap-3"
+	config.Volume.Size = volumeSize
+	config.Parameters[BackupParameterChunkingMethod] = CHUNKING_METHOD_CDC
+
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	blockCount := volume.BlockCount
+
+	isIncremental, err := CreateDeltaBlockBackup("backup-2", config)
+	assert.NoError(err)
+	assert.True(isIncremental)
+	shiftedOps.waitForSnapshotClosed(t)
+	assert.Empty(shiftedOps.getLastStatus(t).errMessage)
+
+	volume, err = loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.LessOrEqual(volume.BlockCount-blockCount, int64(4))
+
+	assert.True(bytes.Equal(shiftedOps.content, restoreTestBackup(t, "backup-2")))
+}
+
+func TestPopulateChunksForIncrementalRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	lastBackup := &Backup{
+		Blocks: []BlockMapping{
+			{Offset: 0, Size: 3000, BlockChecksum: "a"},
+			{Offset: 3000, Size: 6000, BlockChecksum: "b"},
+			{Offset: 12000, Size: 4000, BlockChecksum: "c"},
+		},
+	}
+	backup := &Backup{
+		CompressionMethod: LEGACY_COMPRESSION_METHOD,
+		Blocks: []BlockMapping{
+			{Offset: 0, Size: 3000, BlockChecksum: "a"},
+			{Offset: 3000, Size: 2000, BlockChecksum: "d"},
+			{Offset: 6000, Size: 2000, BlockChecksum: "e"},
+			{Offset: 13000, Size: 1000, BlockChecksum: "f"},
+		},
+	}
+
+	blockChan, _ := populateChunksForIncrementalRestore(lastBackup, backup, deltaBlockSize)
+	blocks := []Block{}
+	for block := range blockChan {
+		blocks = append(blocks, *block)
+	}
+	assert.Equal([]Block{
+		{offset: 3000, size: 2000, blockChecksum: "d", compressionMethod: LEGACY_COMPRESSION_METHOD},
+		{offset: 6000, size: 2000, blockChecksum: "e", compressionMethod: LEGACY_COMPRESSION_METHOD},
+		{offset: 13000, size: 1000, blockChecksum: "f", compressionMethod: LEGACY_COMPRESSION_METHOD},
+		{offset: 5000, size: 1000, isZeroBlock: true},
+		{offset: 8000, size: 1000, isZeroBlock: true},
+		{offset: 12000, size: 1000, isZeroBlock: true},
+		{offset: 14000, size: 2000, isZeroBlock: true},
+	}, blocks)
+}
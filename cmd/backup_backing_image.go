@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
@@ -94,8 +95,11 @@ func inspectBackupBackingImageConfig(c *cli.Context) error {
 
 func BackupBackingImageRemoveCmd() cli.Command {
 	return cli.Command{
-		Name:   "rm-backing-image",
-		Usage:  "remove a backup backing image in objectstore",
+		Name:  "rm-backing-image",
+		Usage: "remove a backup backing image in objectstore",
+		Flags: []cli.Flag{
+			gcConcurrentLimitFlag,
+		},
 		Action: cmdBackupBackingImageRemove,
 	}
 }
@@ -116,6 +120,6 @@ func doBackupBackingImageRemove(c *cli.Context) error {
 	}
 
 	destURL = util.UnescapeURL(destURL)
-	err := backupbackingimage.RemoveBackingImageBackup(destURL)
+	err := backupbackingimage.RemoveBackingImageBackupWithConfig(context.Background(), destURL, getGCConfig(c))
 	return err
 }
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func MigrateToBlockPoolCmd() cli.Command {
+	return cli.Command{
+		Name:   "migrate-to-block-pool",
+		Usage:  "move the blocks of a backup volume into the block pool shared by the volumes: migrate-to-block-pool <volume>",
+		Action: cmdMigrateToBlockPool,
+	}
+}
+
+func cmdMigrateToBlockPool(c *cli.Context) {
+	if err := doMigrateToBlockPool(c); err != nil {
+		panic(err)
+	}
+}
+
+func doMigrateToBlockPool(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("volume URL")
+	}
+	volumeURL := c.Args()[0]
+	if volumeURL == "" {
+		return RequiredMissingError("volume URL")
+	}
+	volumeURL = util.UnescapeURL(volumeURL)
+
+	return backupstore.MigrateVolumeToBlockPool(volumeURL)
+}
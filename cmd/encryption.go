@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func RotateVolumeKeyCmd() cli.Command {
+	return cli.Command{
+		Name:  "rotate-volume-key",
+		Usage: "rotate the encryption key of a backup volume: rotate-volume-key <volume>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "old-key",
+				Usage:  "base64 encoded encryption key the volume is currently encrypted with",
+				EnvVar: "OLD_BACKUP_ENCRYPTION_KEY",
+			},
+			cli.StringFlag{
+				Name:   "old-passphrase",
+				Usage:  "passphrase the volume is currently encrypted with",
+				EnvVar: "OLD_BACKUP_ENCRYPTION_PASSPHRASE",
+			},
+			cli.StringFlag{
+				Name:   "new-key",
+				Usage:  "base64 encoded encryption key to encrypt the volume with",
+				EnvVar: "NEW_BACKUP_ENCRYPTION_KEY",
+			},
+			cli.StringFlag{
+				Name:   "new-passphrase",
+				Usage:  "passphrase to encrypt the volume with",
+				EnvVar: "NEW_BACKUP_ENCRYPTION_PASSPHRASE",
+			},
+		},
+		Action: cmdRotateVolumeKey,
+	}
+}
+
+func cmdRotateVolumeKey(c *cli.Context) {
+	if err := doRotateVolumeKey(c); err != nil {
+		panic(err)
+	}
+}
+
+func doRotateVolumeKey(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("volume URL")
+	}
+	volumeURL := c.Args()[0]
+	if volumeURL == "" {
+		return RequiredMissingError("volume URL")
+	}
+	volumeURL = util.UnescapeURL(volumeURL)
+
+	oldSecret := backupstore.EncryptionSecret{
+		Key:        c.String("old-key"),
+		Passphrase: c.String("old-passphrase"),
+	}
+	newSecret := backupstore.EncryptionSecret{
+		Key:        c.String("new-key"),
+		Passphrase: c.String("new-passphrase"),
+	}
+	return backupstore.RotateVolumeKey(volumeURL, oldSecret, newSecret)
+}
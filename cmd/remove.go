@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
 	"github.com/longhorn/backupstore"
@@ -18,6 +21,11 @@ func BackupRemoveCmd() cli.Command {
 				Name:  "volume",
 				Usage: "volume name, only use it when deleting a backup volume with dest URL",
 			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "report the blocks the deletion of a backup would garbage collect, without deleting anything",
+			},
+			gcConcurrentLimitFlag,
 		},
 		Action: cmdBackupRemove,
 	}
@@ -41,16 +49,46 @@ func doBackupRemove(c *cli.Context) error {
 	volumeName := c.String("volume")
 	if volumeName == "" {
 		destURL = util.UnescapeURL(destURL)
-		if err := backupstore.DeleteDeltaBlockBackup(destURL); err != nil {
+		if c.Bool("dry-run") {
+			report, err := backupstore.DeleteDeltaBlockBackupDryRunWithConfig(context.Background(), destURL, getGCConfig(c))
+			if err != nil {
+				return err
+			}
+			data, err := ResponseOutput(report)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+		if err := backupstore.DeleteDeltaBlockBackupWithConfig(context.Background(), destURL, getGCConfig(c)); err != nil {
 			return err
 		}
 	} else {
 		if !util.ValidateName(volumeName) {
 			return fmt.Errorf("invalid backup volume name %v", volumeName)
 		}
+		if c.Bool("dry-run") {
+			return fmt.Errorf("dry run is only supported for the deletion of a backup")
+		}
 		if err := backupstore.DeleteBackupVolume(volumeName, destURL); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+var gcConcurrentLimitFlag = cli.IntFlag{
+	Name:  "gc-concurrent-limit",
+	Usage: "number of requests in flight while garbage collecting the blocks",
+	Value: backupstore.DefaultGCConcurrentLimit,
+}
+
+func getGCConfig(c *cli.Context) *backupstore.GCConfig {
+	return &backupstore.GCConfig{
+		ConcurrentLimit: int32(c.Int(gcConcurrentLimitFlag.Name)),
+		Progress: func(progress backupstore.GCProgress) {
+			logrus.Debugf("GC %v: %v/%v", progress.Stage, progress.Done, progress.Total)
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func RepairCmd() cli.Command {
+	return cli.Command{
+		Name:  "repair",
+		Usage: "replace the missing or corrupted blocks of a backup volume with intact copies: repair --volume <volume> <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name",
+			},
+			cli.StringSliceFlag{
+				Name:  "source",
+				Usage: "URL of another backup target to look the blocks up in, can be repeated",
+			},
+			cli.BoolFlag{
+				Name:  "check-block-data",
+				Usage: "read every block referenced by the backups to repair the corrupted ones too",
+			},
+			cli.IntFlag{
+				Name:  "concurrent-limit",
+				Usage: "number of requests in flight while verifying and repairing the blocks",
+				Value: backupstore.DefaultGCConcurrentLimit,
+			},
+		},
+		Action: cmdRepair,
+	}
+}
+
+func cmdRepair(c *cli.Context) {
+	if err := doRepair(c); err != nil {
+		panic(err)
+	}
+}
+
+func doRepair(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	destURL = util.UnescapeURL(destURL)
+
+	volumeName := c.String("volume")
+	if volumeName == "" {
+		return RequiredMissingError("volume")
+	}
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid backup volume name %v", volumeName)
+	}
+	var sourceURLs []string
+	for _, sourceURL := range c.StringSlice("source") {
+		sourceURLs = append(sourceURLs, util.UnescapeURL(sourceURL))
+	}
+
+	report, err := backupstore.Repair(&backupstore.RepairConfig{
+		DestURL:         destURL,
+		VolumeName:      volumeName,
+		SourceURLs:      sourceURLs,
+		CheckBlockData:  c.Bool("check-block-data"),
+		ConcurrentLimit: int32(c.Int("concurrent-limit")),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := ResponseOutput(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
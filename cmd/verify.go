@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func VerifyCmd() cli.Command {
+	return cli.Command{
+		Name:  "verify",
+		Usage: "verify the backups of the backup volumes in objectstore without restoring them: verify <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name, all the backup volumes are verified if not set",
+			},
+			cli.BoolFlag{
+				Name:  "check-block-data",
+				Usage: "read every block referenced by the backups and verify its checksum",
+			},
+			cli.IntFlag{
+				Name:  "concurrent-limit",
+				Usage: "number of requests in flight while verifying the blocks",
+				Value: backupstore.DefaultGCConcurrentLimit,
+			},
+		},
+		Action: cmdVerify,
+	}
+}
+
+func cmdVerify(c *cli.Context) {
+	if err := doVerify(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVerify(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	destURL = util.UnescapeURL(destURL)
+
+	volumeName := c.String("volume")
+	if volumeName != "" && !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid backup volume name %v", volumeName)
+	}
+
+	report, err := backupstore.Verify(&backupstore.VerifyConfig{
+		DestURL:         destURL,
+		VolumeName:      volumeName,
+		CheckBlockData:  c.Bool("check-block-data"),
+		ConcurrentLimit: int32(c.Int("concurrent-limit")),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := ResponseOutput(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func VerifyBackupCmd() cli.Command {
+	return cli.Command{
+		Name:  "verify-backup",
+		Usage: "read every block of a backup the way a restore does, without restoring it: verify-backup <backup>",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "concurrent-limit",
+				Usage: "number of blocks read in parallel",
+				Value: backupstore.DefaultGCConcurrentLimit,
+			},
+		},
+		Action: cmdVerifyBackup,
+	}
+}
+
+func cmdVerifyBackup(c *cli.Context) {
+	if err := doVerifyBackup(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVerifyBackup(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+
+	report, err := backupstore.VerifyDeltaBlockBackup(context.Background(), backupURL, int32(c.Int("concurrent-limit")),
+		func(backupName string, verifyProgress int, err error) {
+			logrus.Debugf("Verifying backup %v: %v%%", backupName, verifyProgress)
+		})
+	if err != nil {
+		return err
+	}
+	data, err := ResponseOutput(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -1,10 +1,10 @@
 package backupstore
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -39,10 +39,18 @@ func getBackupConfigName(id string) string {
 }
 
 func LoadConfigInBackupStore(driver BackupStoreDriver, filePath string, v interface{}) error {
-	if !driver.FileExists(filePath) {
+	return LoadConfigInBackupStoreWithContext(context.Background(), driver, filePath, v)
+}
+
+func LoadConfigInBackupStoreWithContext(ctx context.Context, driver BackupStoreDriver, filePath string, v interface{}) error {
+	d := NewDriverWithContext(driver)
+	if !d.FileExistsWithContext(ctx, filePath) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return fmt.Errorf("cannot find %v in backupstore", filePath)
 	}
-	rc, err := driver.Read(filePath)
+	rc, err := d.ReadWithContext(ctx, filePath)
 	if err != nil {
 		return err
 	}
@@ -71,10 +79,16 @@ func LoadConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 }
 
 func SaveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interface{}) error {
-	j, err := json.Marshal(v)
-	if err != nil {
-		return err
-	}
+	return SaveConfigInBackupStoreWithContext(context.Background(), driver, filePath, v)
+}
+
+// SaveConfigInBackupStoreWithContext saves v as JSON, written through
+// WriteStreamWithContext as it's encoded, so its size is unknown to the driver.
+// Only the drivers uploading such a stream as it's read keep the config out of
+// memory. The ones without the streaming capability are given the whole config
+// in memory, and so is the s3 driver for the configs up to 64 MiB, which it
+// puts with a single request.
+func SaveConfigInBackupStoreWithContext(ctx context.Context, driver BackupStoreDriver, filePath string, v interface{}) error {
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonStart,
 		LogFieldObject:   LogObjectConfig,
@@ -82,7 +96,14 @@ func SaveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 		LogFieldFilepath: filePath,
 	}).Info("Saving config in backupstore")
 
-	if err := driver.Write(filePath, bytes.NewReader(j)); err != nil {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(json.NewEncoder(pw).Encode(v))
+	}()
+	err := WriteStreamWithContext(ctx, driver, filePath, pr, -1)
+	// Stops the encoder if the driver gave up on the stream
+	_ = pr.CloseWithError(errors.New("config write aborted"))
+	if err != nil {
 		return err
 	}
 
@@ -96,6 +117,10 @@ func SaveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 }
 
 func SaveLocalFileToBackupStore(localFilePath, backupStoreFilePath string, driver BackupStoreDriver) error {
+	return SaveLocalFileToBackupStoreWithContext(context.Background(), localFilePath, backupStoreFilePath, driver)
+}
+
+func SaveLocalFileToBackupStoreWithContext(ctx context.Context, localFilePath, backupStoreFilePath string, driver BackupStoreDriver) error {
 	log := log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonStart,
 		LogFieldObject:   LogObjectConfig,
@@ -105,11 +130,40 @@ func SaveLocalFileToBackupStore(localFilePath, backupStoreFilePath string, drive
 	})
 	log.Debug()
 
-	if driver.FileExists(backupStoreFilePath) {
+	d := NewDriverWithContext(driver)
+	if d.FileExistsWithContext(ctx, backupStoreFilePath) {
+		return fmt.Errorf("%v already exists", backupStoreFilePath)
+	}
+
+	if err := d.UploadWithContext(ctx, localFilePath, backupStoreFilePath); err != nil {
+		return err
+	}
+
+	log.WithField(LogFieldReason, LogReasonComplete).Debug()
+	return nil
+}
+
+func SaveStreamToBackupStore(r io.Reader, size int64, backupStoreFilePath string, driver BackupStoreDriver) error {
+	return SaveStreamToBackupStoreWithContext(context.Background(), r, size, backupStoreFilePath, driver)
+}
+
+// SaveStreamToBackupStoreWithContext is SaveLocalFileToBackupStoreWithContext
+// for content read from r instead of a local file, the size is -1 if it's
+// unknown.
+func SaveStreamToBackupStoreWithContext(ctx context.Context, r io.Reader, size int64, backupStoreFilePath string, driver BackupStoreDriver) error {
+	log := log.WithFields(logrus.Fields{
+		LogFieldReason:  LogReasonStart,
+		LogFieldObject:  LogObjectConfig,
+		LogFieldKind:    driver.Kind(),
+		LogFieldDestURL: backupStoreFilePath,
+	})
+	log.Debug()
+
+	if NewDriverWithContext(driver).FileExistsWithContext(ctx, backupStoreFilePath) {
 		return fmt.Errorf("%v already exists", backupStoreFilePath)
 	}
 
-	if err := driver.Upload(localFilePath, backupStoreFilePath); err != nil {
+	if err := WriteStreamWithContext(ctx, driver, backupStoreFilePath, r, size); err != nil {
 		return err
 	}
 
@@ -118,6 +172,10 @@ func SaveLocalFileToBackupStore(localFilePath, backupStoreFilePath string, drive
 }
 
 func SaveBackupStoreToLocalFile(driver BackupStoreDriver, backupStoreFileURL, localFilePath string) error {
+	return SaveBackupStoreToLocalFileWithContext(context.Background(), driver, backupStoreFileURL, localFilePath)
+}
+
+func SaveBackupStoreToLocalFileWithContext(ctx context.Context, driver BackupStoreDriver, backupStoreFileURL, localFilePath string) error {
 	log := log.WithFields(logrus.Fields{
 		LogFieldReason:    LogReasonStart,
 		LogFieldObject:    LogObjectConfig,
@@ -127,7 +185,7 @@ func SaveBackupStoreToLocalFile(driver BackupStoreDriver, backupStoreFileURL, lo
 	})
 	log.Debug()
 
-	if err := driver.Download(backupStoreFileURL, localFilePath); err != nil {
+	if err := NewDriverWithContext(driver).DownloadWithContext(ctx, backupStoreFileURL, localFilePath); err != nil {
 		return err
 	}
 
@@ -138,18 +196,18 @@ func SaveBackupStoreToLocalFile(driver BackupStoreDriver, backupStoreFileURL, lo
 	return nil
 }
 
-func volumeExists(driver BackupStoreDriver, volumeName string) bool {
-	return driver.FileExists(getVolumeFilePath(volumeName))
+func volumeExists(ctx context.Context, driver BackupStoreDriver, volumeName string) bool {
+	return NewDriverWithContext(driver).FileExistsWithContext(ctx, getVolumeFilePath(volumeName))
 }
 
 // volumeFolderExists checks if volume folder exists on backupstore
 // by listing all the backup volume name based on the folders on the backupstore
 // since s3 does not support checking folder exist.
-func volumeFolderExists(driver BackupStoreDriver, volumeName string) (bool, error) {
+func volumeFolderExists(ctx context.Context, driver BackupStoreDriver, volumeName string) (bool, error) {
 	jobQueues := workerpool.New(runtime.NumCPU() * 16)
 	defer jobQueues.StopWait()
 
-	volumeNames, err := getVolumeNames(jobQueues, driver)
+	volumeNames, err := getVolumeNames(ctx, jobQueues, driver)
 	if err != nil {
 		return false, err
 	}
@@ -177,10 +235,11 @@ func getVolumeFilePath(volumeName string) string {
 }
 
 // getVolumeNames returns all volume names based on the folders on the backupstore
-func getVolumeNames(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver) ([]string, error) {
+func getVolumeNames(ctx context.Context, jobQueues *workerpool.WorkerPool, driver BackupStoreDriver) ([]string, error) {
 	names := []string{}
+	d := NewDriverWithContext(driver)
 	volumePathBase := filepath.Join(backupstoreBase, VOLUME_DIRECTORY)
-	lv1Dirs, err := driver.List(volumePathBase)
+	lv1Dirs, err := d.ListWithContext(ctx, volumePathBase)
 	if err != nil {
 		log.WithError(err).Warnf("Failed to list first level dirs for path %v", volumePathBase)
 		return names, err
@@ -200,8 +259,8 @@ func getVolumeNames(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver)
 		path := filepath.Join(volumePathBase, lv1Dir)
 		jobQueues.Submit(func() {
 			lv2Paths := make([]string, 0)
-			err := runner.Run(context.TODO(), func(_ context.Context) error {
-				lv2Dirs, err := driver.List(path)
+			err := runner.Run(ctx, func(ctx context.Context) error {
+				lv2Dirs, err := d.ListWithContext(ctx, path)
 				if err != nil {
 					logrus.WithError(err).Warnf("Failed to list second level dirs for path %v", path)
 					return errors.Wrapf(err, "failed to list second level dirs for path %v", path)
@@ -240,8 +299,8 @@ func getVolumeNames(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver)
 			path := lv2Path
 			jobQueues.Submit(func() {
 				var volumeNames []string
-				err := runner.Run(context.TODO(), func(_ context.Context) error {
-					volumeNames, err = driver.List(path)
+				err := runner.Run(ctx, func(ctx context.Context) error {
+					volumeNames, err = d.ListWithContext(ctx, path)
 					if err != nil {
 						logrus.WithError(err).Warnf("Failed to list volume names for path %v", path)
 						return errors.Wrapf(err, "failed to list second level dirs for path %v", path)
@@ -280,10 +339,10 @@ func getVolumeNames(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver)
 	return names, nil
 }
 
-func loadVolume(driver BackupStoreDriver, volumeName string) (*Volume, error) {
+func loadVolume(ctx context.Context, driver BackupStoreDriver, volumeName string) (*Volume, error) {
 	v := &Volume{}
 	file := getVolumeFilePath(volumeName)
-	if err := LoadConfigInBackupStore(driver, file, v); err != nil {
+	if err := loadConfigMaybeEncrypted(ctx, driver, volumeName, file, v); err != nil {
 		return nil, err
 	}
 	// Backward compatibility
@@ -297,13 +356,13 @@ func loadVolume(driver BackupStoreDriver, volumeName string) (*Volume, error) {
 	return v, nil
 }
 
-func saveVolume(driver BackupStoreDriver, v *Volume) error {
-	return SaveConfigInBackupStore(driver, getVolumeFilePath(v.Name), v)
+func saveVolume(ctx context.Context, driver BackupStoreDriver, v *Volume) error {
+	return saveConfigMaybeEncrypted(ctx, driver, getVolumeFilePath(v.Name), v.Encryption, v)
 }
 
-func getBackupNamesForVolume(driver BackupStoreDriver, volumeName string) ([]string, error) {
+func getBackupNamesForVolume(ctx context.Context, driver BackupStoreDriver, volumeName string) ([]string, error) {
 	result := []string{}
-	fileList, err := driver.List(getBackupPath(volumeName))
+	fileList, err := NewDriverWithContext(driver).ListWithContext(ctx, getBackupPath(volumeName))
 	if err != nil {
 		// path doesn't exist
 		return result, nil
@@ -325,9 +384,9 @@ func isBackupInProgress(backup *Backup) bool {
 	return backup != nil && backup.CreatedTime == ""
 }
 
-func loadBackup(bsDriver BackupStoreDriver, backupName, volumeName string) (*Backup, error) {
+func loadBackup(ctx context.Context, bsDriver BackupStoreDriver, backupName, volumeName string) (*Backup, error) {
 	backup := &Backup{}
-	if err := LoadConfigInBackupStore(bsDriver, getBackupConfigPath(backupName, volumeName), backup); err != nil {
+	if err := loadConfigMaybeEncrypted(ctx, bsDriver, volumeName, getBackupConfigPath(backupName, volumeName), backup); err != nil {
 		return nil, err
 	}
 	// Backward compatibility
@@ -338,17 +397,17 @@ func loadBackup(bsDriver BackupStoreDriver, backupName, volumeName string) (*Bac
 	return backup, nil
 }
 
-func saveBackup(bsDriver BackupStoreDriver, backup *Backup) error {
+func saveBackup(ctx context.Context, bsDriver BackupStoreDriver, backup *Backup) error {
 	if backup.VolumeName == "" {
 		return fmt.Errorf("missing volume specifier for backup: %v", backup.Name)
 	}
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
-	return SaveConfigInBackupStore(bsDriver, filePath, backup)
+	return saveConfigMaybeEncrypted(ctx, bsDriver, filePath, backup.Encryption, backup)
 }
 
-func removeBackup(backup *Backup, bsDriver BackupStoreDriver) error {
+func removeBackup(ctx context.Context, backup *Backup, bsDriver BackupStoreDriver) error {
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
-	if err := bsDriver.Remove(filePath); err != nil {
+	if err := NewDriverWithContext(bsDriver).RemoveWithContext(ctx, filePath); err != nil {
 		return err
 	}
 	log.Infof("Removed %v on backupstore", filePath)
@@ -0,0 +1,377 @@
+// Package conformance checks that a backupstore driver honours the contract
+// the core relies on. The drivers talk to very different backends, and the
+// subtle parts of BackupStoreDriver (List of a missing directory, Remove
+// behaving like "rm -rf", FileTime in UTC, trailing slashes) are easy to get
+// wrong. Any driver, including the ones registered from outside this module
+// via backupstore.RegisterDriver, can run the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+//			driver, err := backupstore.GetBackupStoreDriver(newTestTarget(t))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return driver
+//		})
+//	}
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+// NewDriverFunc returns the driver under test. It is called once per check,
+// and is expected to return a driver on an empty backup target every time.
+type NewDriverFunc func(t *testing.T) backupstore.BackupStoreDriver
+
+// Run runs every conformance check against the drivers returned by newDriver,
+// each one as a subtest of t.
+func Run(t *testing.T, newDriver NewDriverFunc) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, driver backupstore.BackupStoreDriver)
+	}{
+		{"ReadWriteRoundTrip", testReadWriteRoundTrip},
+		{"ReadRange", testReadRange},
+		{"WriteOverwrites", testWriteOverwrites},
+		{"WriteStream", testWriteStream},
+		{"MissingFile", testMissingFile},
+		{"DirectoryIsNotAFile", testDirectoryIsNotAFile},
+		{"FileTimeInUTC", testFileTimeInUTC},
+		{"ListBehavesLikeLs", testListBehavesLikeLs},
+		{"ListMissingDirectory", testListMissingDirectory},
+		{"RemoveIsRecursive", testRemoveIsRecursive},
+		{"RemoveMissingPath", testRemoveMissingPath},
+		{"RemoveFile", testRemoveFile},
+		{"RemoveMany", testRemoveMany},
+		{"UploadAndDownload", testUploadAndDownload},
+		{"CancelledContext", testCancelledContext},
+	}
+
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			c.check(t, newDriver(t))
+		})
+	}
+}
+
+// path returns the path of name below the backupstore base, which is where
+// the core keeps everything. Drivers cleaning up emptied parent directories
+// stop there. A trailing slash is kept, since the drivers have to cope with
+// both forms.
+func path(name string) string {
+	p := filepath.Join(backupstore.GetBackupstoreBase(), "conformance", name)
+	if strings.HasSuffix(name, "/") {
+		p += "/"
+	}
+	return p
+}
+
+func write(t *testing.T, driver backupstore.BackupStoreDriver, name string, data []byte) {
+	t.Helper()
+	if err := driver.Write(path(name), bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to write %v: %v", name, err)
+	}
+}
+
+func read(t *testing.T, driver backupstore.BackupStoreDriver, name string) []byte {
+	t.Helper()
+	rc, err := driver.Read(path(name))
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", name, err)
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", name, err)
+	}
+	return data
+}
+
+func testReadWriteRoundTrip(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	payload := []byte("backup block payload")
+	write(t, driver, "volumes/vol-1/volume.cfg", payload)
+	assert.True(driver.FileExists(path("volumes/vol-1/volume.cfg")))
+	assert.Equal(int64(len(payload)), driver.FileSize(path("volumes/vol-1/volume.cfg")))
+	assert.Equal(payload, read(t, driver, "volumes/vol-1/volume.cfg"))
+
+	// Empty files exist as well
+	write(t, driver, "volumes/vol-1/empty.cfg", nil)
+	assert.True(driver.FileExists(path("volumes/vol-1/empty.cfg")))
+	assert.Equal(int64(0), driver.FileSize(path("volumes/vol-1/empty.cfg")))
+	assert.Empty(read(t, driver, "volumes/vol-1/empty.cfg"))
+}
+
+func testReadRange(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/packs/pack-1.pack", []byte("0123456789"))
+	readRange := func(offset, length int64) []byte {
+		rc, err := backupstore.ReadRangeWithContext(context.Background(), driver, path("volumes/vol-1/packs/pack-1.pack"), offset, length)
+		if !assert.NoError(err) {
+			return nil
+		}
+		defer func() {
+			_ = rc.Close()
+		}()
+		data, err := io.ReadAll(rc)
+		assert.NoError(err)
+		return data
+	}
+	assert.Equal([]byte("0123"), readRange(0, 4))
+	assert.Equal([]byte("567"), readRange(5, 3))
+	// The range stops at the end of the file
+	assert.Equal([]byte("89"), readRange(8, 4))
+
+	_, err := backupstore.ReadRangeWithContext(context.Background(), driver, path("volumes/vol-1/packs/pack-2.pack"), 0, 4)
+	assert.Error(err)
+}
+
+func testWriteOverwrites(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("a longer original content"))
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("updated"))
+	assert.Equal(int64(len("updated")), driver.FileSize(path("volumes/vol-1/volume.cfg")))
+	assert.Equal([]byte("updated"), read(t, driver, "volumes/vol-1/volume.cfg"))
+
+	// No temporary file is left behind
+	names, err := driver.List(path("volumes/vol-1"))
+	assert.NoError(err)
+	assert.Equal([]string{"volume.cfg"}, names)
+}
+
+func testWriteStream(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	payload := bytes.Repeat([]byte("backup config payload "), 1024)
+	for _, size := range []int64{int64(len(payload)), -1} {
+		// The stream can't seek
+		r := io.MultiReader(bytes.NewReader(payload))
+		assert.NoError(backupstore.WriteStreamWithContext(context.Background(), driver, path("volumes/vol-1/volume.cfg"), r, size))
+		assert.Equal(int64(len(payload)), driver.FileSize(path("volumes/vol-1/volume.cfg")))
+		assert.Equal(payload, read(t, driver, "volumes/vol-1/volume.cfg"))
+	}
+
+	// Nothing is published if the stream fails
+	r := io.MultiReader(bytes.NewReader(payload), iotest.ErrReader(errors.New("stream failed")))
+	assert.Error(backupstore.WriteStreamWithContext(context.Background(), driver, path("volumes/vol-1/backups/backup_a.cfg"), r, -1))
+	assert.False(driver.FileExists(path("volumes/vol-1/backups/backup_a.cfg")))
+}
+
+func testMissingFile(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("x"))
+
+	for _, name := range []string{"volumes/vol-1/missing.cfg", "volumes/missing/volume.cfg"} {
+		assert.False(driver.FileExists(path(name)), name)
+		assert.Equal(int64(-1), driver.FileSize(path(name)), name)
+		assert.True(driver.FileTime(path(name)).IsZero(), name)
+
+		_, err := driver.Read(path(name))
+		assert.Error(err, name)
+		assert.Error(driver.Download(path(name), filepath.Join(t.TempDir(), "dst")), name)
+	}
+}
+
+func testDirectoryIsNotAFile(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/backups/backup_a.cfg", []byte("x"))
+
+	for _, name := range []string{"volumes/vol-1/backups", "volumes/vol-1/backups/"} {
+		assert.False(driver.FileExists(path(name)), name)
+		assert.Equal(int64(-1), driver.FileSize(path(name)), name)
+		assert.True(driver.FileTime(path(name)).IsZero(), name)
+	}
+}
+
+func testFileTimeInUTC(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	before := time.Now()
+	write(t, driver, "volumes/vol-1/locks/lock-1.lck", []byte("{}"))
+
+	fileTime := driver.FileTime(path("volumes/vol-1/locks/lock-1.lck"))
+	assert.False(fileTime.IsZero())
+	assert.Equal(time.UTC, fileTime.Location())
+	// The locks compare the file times with the local clock, so they must
+	// refer to the same instant, not just to the same wall clock in another
+	// time zone. The backends have their own clock though, only a skew that
+	// would break the locks is a failure.
+	assert.WithinDuration(before, fileTime, backupstore.LOCK_DURATION)
+}
+
+func testListBehavesLikeLs(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/backups/backup_b.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-10/volume.cfg",
+	} {
+		write(t, driver, name, []byte("x"))
+	}
+
+	// Only the direct children are listed, by name, with or without a
+	// trailing slash
+	for _, name := range []string{"volumes/vol-1", "volumes/vol-1/"} {
+		names, err := driver.List(path(name))
+		assert.NoError(err, name)
+		assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names, name)
+	}
+
+	names, err := driver.List(path("volumes/vol-1/backups"))
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup_a.cfg", "backup_b.cfg"}, names)
+
+	names, err = driver.List(path("volumes"))
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"vol-1", "vol-10"}, names)
+}
+
+func testListMissingDirectory(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("x"))
+
+	for _, name := range []string{"volumes/missing", "volumes/missing/", "volumes/missing/deeper"} {
+		names, err := driver.List(path(name))
+		assert.NoError(err, name)
+		assert.Empty(names, name)
+	}
+}
+
+func testRemoveIsRecursive(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-10/volume.cfg",
+		"volumes/vol-2/volume.cfg",
+	} {
+		write(t, driver, name, []byte("x"))
+	}
+
+	// The core removes the directories with a trailing slash
+	assert.NoError(driver.Remove(path("volumes/vol-1/")))
+	assert.False(driver.FileExists(path("volumes/vol-1/volume.cfg")))
+	assert.False(driver.FileExists(path("volumes/vol-1/blocks/aa/bb/aabb.blk")))
+	names, err := driver.List(path("volumes/vol-1"))
+	assert.NoError(err)
+	assert.Empty(names)
+
+	// The directories sharing the same prefix are left alone
+	assert.True(driver.FileExists(path("volumes/vol-10/volume.cfg")))
+	names, err = driver.List(path("volumes"))
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"vol-10", "vol-2"}, names)
+}
+
+func testRemoveMissingPath(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("x"))
+
+	// Removing something that is already gone is not an error, just like "rm -rf"
+	assert.NoError(driver.Remove(path("volumes/vol-1/missing.cfg")))
+	assert.NoError(driver.Remove(path("volumes/missing/")))
+	assert.True(driver.FileExists(path("volumes/vol-1/volume.cfg")))
+}
+
+func testRemoveFile(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/backups/backup_a.cfg", []byte("x"))
+	write(t, driver, "volumes/vol-1/backups/backup_b.cfg", []byte("x"))
+
+	assert.NoError(driver.Remove(path("volumes/vol-1/backups/backup_a.cfg")))
+	assert.False(driver.FileExists(path("volumes/vol-1/backups/backup_a.cfg")))
+	names, err := driver.List(path("volumes/vol-1/backups"))
+	assert.NoError(err)
+	assert.Equal([]string{"backup_b.cfg"}, names)
+}
+
+func testRemoveMany(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	var paths []string
+	for _, name := range []string{"aa/bb/blk-1.blk", "aa/cc/blk-2.blk", "dd/ee/blk-3.blk", "dd/ee/blk-4.blk"} {
+		write(t, driver, "volumes/vol-1/blocks/"+name, []byte("x"))
+		paths = append(paths, path("volumes/vol-1/blocks/"+name))
+	}
+
+	// A missing file is not a failure
+	assert.NoError(backupstore.RemoveManyWithContext(context.Background(), driver,
+		append(paths[:3:3], path("volumes/vol-1/blocks/ff/ff/missing.blk"))))
+	for _, p := range paths[:3] {
+		assert.False(driver.FileExists(p), p)
+	}
+	assert.True(driver.FileExists(paths[3]))
+}
+
+func testUploadAndDownload(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("file content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(driver.Upload(src, path("backing-images/image.cfg")))
+	assert.Equal(int64(len("file content")), driver.FileSize(path("backing-images/image.cfg")))
+
+	dst := filepath.Join(dir, "dst")
+	assert.NoError(driver.Download(path("backing-images/image.cfg"), dst))
+	data, err := os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal([]byte("file content"), data)
+
+	// Downloading replaces what was there
+	if err := os.WriteFile(dst, []byte("a longer stale content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(driver.Download(path("backing-images/image.cfg"), dst))
+	data, err = os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal([]byte("file content"), data)
+}
+
+func testCancelledContext(t *testing.T, driver backupstore.BackupStoreDriver) {
+	assert := assert.New(t)
+
+	write(t, driver, "volumes/vol-1/volume.cfg", []byte("x"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := backupstore.NewDriverWithContext(driver)
+
+	// Nothing is published once the context is done
+	assert.Error(d.WriteWithContext(ctx, path("volumes/vol-1/backups/backup_a.cfg"), strings.NewReader("x")))
+	assert.False(driver.FileExists(path("volumes/vol-1/backups/backup_a.cfg")))
+
+	assert.Error(d.RemoveWithContext(ctx, path("volumes/vol-1/")))
+	assert.True(driver.FileExists(path("volumes/vol-1/volume.cfg")))
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -36,6 +35,18 @@ func (config *DeltaBackupConfig) getBackupBlockSize() (int64, error) {
 	return getBlockSizeFromParameters(config.Parameters)
 }
 
+// getCompressionLevel returns the compression level of the new blocks from
+// the DeltaBackupConfig.
+func (config *DeltaBackupConfig) getCompressionLevel() (int, error) {
+	return GetCompressionLevelFromParameters(config.Parameters)
+}
+
+// getChunkingMethod returns how the volume data is cut into blocks from the
+// DeltaBackupConfig.
+func (config *DeltaBackupConfig) getChunkingMethod() (string, error) {
+	return getChunkingMethodFromParameters(config.Parameters)
+}
+
 type DeltaRestoreConfig struct {
 	BackupURL       string
 	DeltaOps        DeltaRestoreOperations
@@ -47,10 +58,35 @@ type DeltaRestoreConfig struct {
 type BlockMapping struct {
 	Offset        int64
 	BlockChecksum string
+	// CompressionMethod overrides the compression method of the backup for
+	// the block, it's set for the blocks stored uncompressed because they
+	// don't compress well.
+	CompressionMethod string `json:",omitempty"`
+	// Size is the size of the chunks cut by CHUNKING_METHOD_CDC, the other
+	// blocks have the block size of their backup.
+	Size int64 `json:",omitempty"`
+}
+
+// getCompressionMethod returns the compression method of the block, given the
+// one of its backup.
+func (blk BlockMapping) getCompressionMethod(backupCompressionMethod string) string {
+	if blk.CompressionMethod != "" {
+		return blk.CompressionMethod
+	}
+	return backupCompressionMethod
+}
+
+// getSize returns the size of the block, given the block size of its backup.
+func (blk BlockMapping) getSize(backupBlockSize int64) int64 {
+	if blk.Size != 0 {
+		return blk.Size
+	}
+	return backupBlockSize
 }
 
 type Block struct {
 	offset            int64
+	size              int64
 	blockChecksum     string
 	compressionMethod string
 	isZeroBlock       bool
@@ -115,6 +151,13 @@ type DeltaBlockBackupOperations interface {
 	UpdateBackupStatus(id, volumeID string, backupState string, backupProgress int, backupURL string, err string) error
 }
 
+// DeltaBlockBackupStopper is implemented by the DeltaBlockBackupOperations able
+// to abort the backups running in the background: closing the stop channel
+// cancels the backup.
+type DeltaBlockBackupStopper interface {
+	GetStopChan() chan struct{}
+}
+
 type DeltaRestoreOperations interface {
 	OpenVolumeDev(volDevName string) (*os.File, string, error)
 	CloseVolumeDev(volDev *os.File) error
@@ -125,6 +168,15 @@ type DeltaRestoreOperations interface {
 
 // CreateDeltaBlockBackup creates a delta block backup for the given volume and snapshot.
 func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isIncremental bool, err error) {
+	return CreateDeltaBlockBackupWithContext(context.Background(), backupName, config)
+}
+
+// CreateDeltaBlockBackupWithContext creates a delta block backup for the given volume and snapshot.
+// Cancelling ctx aborts the preparation of the backup. The backup then keeps running in the
+// background after the function returns, detached from ctx: it's only aborted, including the
+// requests to the backupstore that are in flight, by closing the stop channel of the
+// DeltaBlockBackupOperations implementing DeltaBlockBackupStopper.
+func CreateDeltaBlockBackupWithContext(ctx context.Context, backupName string, config *DeltaBackupConfig) (isIncremental bool, err error) {
 	createLog := log
 	defer func() {
 		if err != nil {
@@ -154,6 +206,19 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 	if err != nil {
 		return false, err
 	}
+	chunkingMethod, err := config.getChunkingMethod()
+	if err != nil {
+		return false, err
+	}
+	if chunkingMethod == CHUNKING_METHOD_CDC {
+		if _, err := newChunker(blockSize); err != nil {
+			return false, err
+		}
+	}
+	packSize, err := getPackFileSizeFromParameters(config.Parameters)
+	if err != nil {
+		return false, err
+	}
 
 	defer func() {
 		if err != nil {
@@ -178,16 +243,28 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 			createLog.WithError(unlockErr).Warn("Failed to unlock")
 		}
 	}()
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return false, err
 	}
 
-	if err := addVolume(bsDriver, volume); err != nil {
+	releaseKey, err := prepareVolumeEncryption(ctx, bsDriver, volume, config.Parameters)
+	if err != nil {
+		return false, err
+	}
+	defer releaseKey()
+	if err := prepareVolumeBlockPool(ctx, bsDriver, volume, config.Parameters); err != nil {
+		return false, err
+	}
+	if err := prepareVolumePackFiles(ctx, bsDriver, volume, config.Parameters); err != nil {
+		return false, err
+	}
+
+	if err := addVolume(ctx, bsDriver, volume); err != nil {
 		return false, err
 	}
 
 	// Update volume from backupstore
-	loadedVolume, err := loadVolume(bsDriver, volume.Name)
+	loadedVolume, err := loadVolume(ctx, bsDriver, volume.Name)
 	if err != nil {
 		return false, err
 	}
@@ -195,11 +272,33 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 
 	config.Volume.CompressionMethod = volume.CompressionMethod
 	config.Volume.DataEngine = volume.DataEngine
+	config.Volume.Encryption = volume.Encryption
+	config.Volume.BlockPool = volume.BlockPool
+	config.Volume.PackFiles = volume.PackFiles
+	if err := loadVolumePacks(ctx, bsDriver, config.Volume); err != nil {
+		return false, err
+	}
+	if config.Volume.PackFiles {
+		config.Volume.packs.size = packSize
+	}
+	compressionLevel, err := config.getCompressionLevel()
+	if err != nil {
+		return false, err
+	}
+	if err := util.ValidateCompressionLevel(volume.CompressionMethod, compressionLevel); err != nil {
+		return false, err
+	}
 	createLog = createLog.WithFields(logrus.Fields{
 		LogFieldCompressionMethod: volume.CompressionMethod,
 		LogFieldDataEngine:        volume.DataEngine,
 	})
 
+	poolLock, err := lockBlockPool(ctx, bsDriver, volume, BACKUP_LOCK)
+	if err != nil {
+		return false, err
+	}
+	defer unlockBlockPool(poolLock)
+
 	if err := deltaOps.OpenSnapshot(snapshot.Name, volume.Name); err != nil {
 		return false, err
 	}
@@ -210,7 +309,7 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 		createLog = createLog.WithFields(logrus.Fields{
 			LogFieldLastBackup: lastBackupName,
 		})
-		if lastBackup, err := loadBackup(bsDriver, lastBackupName, volume.Name); err != nil {
+		if lastBackup, err := loadBackup(ctx, bsDriver, lastBackupName, volume.Name); err != nil {
 			createLog = createLog.WithFields(logrus.Fields{
 				LogFieldLastBackup: "",
 			})
@@ -238,6 +337,12 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 					LogFieldReason: LogReasonFallback,
 					LogFieldObject: LogObjectSnapshot,
 				}).Infof("Cannot find last snapshot %s in local storage", lastBackup.SnapshotName)
+			} else if chunkingMethod == CHUNKING_METHOD_FIXED && lastBackup.hasChunks() {
+				// The blocks have to line up with the ones of the last backup
+				createLog.WithFields(logrus.Fields{
+					LogFieldReason: LogReasonFallback,
+					LogFieldObject: LogObjectBackup,
+				}).Infof("Cannot back up fixed size blocks on top of the chunks of previous backup %s", lastBackupName)
 			} else {
 				backupRequest.lastBackup = lastBackup
 			}
@@ -277,20 +382,52 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 		VolumeName:        volume.Name,
 		SnapshotName:      snapshot.Name,
 		CompressionMethod: volume.CompressionMethod,
+		Encryption:        volume.Encryption.reference(),
 		Blocks:            []BlockMapping{},
 		ProcessingBlocks: &ProcessingBlocks{
 			blocks: map[string][]*BlockMapping{},
 		},
+		storedBlocks: map[string]bool{},
 	}
 
 	// keep lock alive for async go routine.
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		if closeErr := deltaOps.CloseSnapshot(snapshot.Name, volume.Name); closeErr != nil {
 			err = errors.Wrapf(err, "during handling err %+v, close snapshot returns err %+v", err, closeErr)
 		}
 		return backupRequest.isIncrementalBackup(), err
 	}
+	if poolLock != nil {
+		if err := poolLock.LockWithContext(ctx); err != nil {
+			if unlockErr := lock.Unlock(); unlockErr != nil {
+				createLog.WithError(unlockErr).Warn("Failed to unlock")
+			}
+			if closeErr := deltaOps.CloseSnapshot(snapshot.Name, volume.Name); closeErr != nil {
+				err = errors.Wrapf(err, "during handling err %+v, close snapshot returns err %+v", err, closeErr)
+			}
+			return backupRequest.isIncrementalBackup(), err
+		}
+	}
+	// keep the data key held for async go routine.
+	releaseBackupKey := func() {}
+	if volume.Encryption != nil {
+		releaseBackupKey = holdKeyring(volume.Encryption.dataKeyID())
+	}
+	// The caller usually returns once the backup is started
+	backupCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if stopper, ok := deltaOps.(DeltaBlockBackupStopper); ok {
+		stopChan := stopper.GetStopChan()
+		go func() {
+			select {
+			case <-stopChan:
+				cancel()
+			case <-backupCtx.Done():
+			}
+		}()
+	}
 	go func() {
+		defer cancel()
+		defer releaseBackupKey()
 		defer func() {
 			if closeErr := deltaOps.CloseSnapshot(snapshot.Name, volume.Name); closeErr != nil {
 				createLog.WithError(closeErr).Warn("Failed to close snapshot")
@@ -301,6 +438,7 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 				createLog.WithError(unlockErr).Warn("Failed to unlock")
 			}
 		}()
+		defer unlockBlockPool(poolLock)
 
 		if updateErr := deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), 0, "", ""); updateErr != nil {
 			createLog.WithError(updateErr).Error("Failed to update backup status")
@@ -308,7 +446,7 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 
 		createLog.Info("Performing delta block backup")
 
-		if progress, backup, err := performBackup(bsDriver, config, delta, deltaBackup, backupRequest.lastBackup); err != nil {
+		if progress, backup, err := performBackup(backupCtx, bsDriver, config, delta, deltaBackup, backupRequest.lastBackup); err != nil {
 			createLog.WithError(err).Errorf("Failed to perform backup for volume %v snapshot %v", volume.Name, snapshot.Name)
 			if updateErr := deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), progress, "", err.Error()); updateErr != nil {
 				createLog.WithError(updateErr).Warn("Failed to update backup status")
@@ -342,7 +480,7 @@ func getProgress(total, processed int64) int {
 	return int((float64(processed+1) / float64(total)) * PROGRESS_PERCENTAGE_BACKUP_SNAPSHOT)
 }
 
-func isBlockBeingProcessed(deltaBackup *Backup, offset int64, checksum string) bool {
+func isBlockBeingProcessed(deltaBackup *Backup, offset, size int64, checksum string) bool {
 	processingBlocks := deltaBackup.ProcessingBlocks
 
 	processingBlocks.Lock()
@@ -351,6 +489,7 @@ func isBlockBeingProcessed(deltaBackup *Backup, offset int64, checksum string) b
 	blockInfo := &BlockMapping{
 		Offset:        offset,
 		BlockChecksum: checksum,
+		Size:          size,
 	}
 	if _, ok := processingBlocks.blocks[checksum]; ok {
 		processingBlocks.blocks[checksum] = append(processingBlocks.blocks[checksum], blockInfo)
@@ -361,7 +500,7 @@ func isBlockBeingProcessed(deltaBackup *Backup, offset int64, checksum string) b
 	return false
 }
 
-func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum string, newBlock bool) {
+func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum, compressionMethod string, newBlock bool) {
 	processingBlocks := deltaBackup.ProcessingBlocks
 
 	processingBlocks.Lock()
@@ -370,6 +509,9 @@ func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum s
 	// Update deltaBackup.Blocks
 	blocks := processingBlocks.blocks[checksum]
 	for _, block := range blocks {
+		if compressionMethod != deltaBackup.CompressionMethod {
+			block.CompressionMethod = compressionMethod
+		}
 		deltaBackup.Blocks = append(deltaBackup.Blocks, *block)
 	}
 
@@ -381,27 +523,45 @@ func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum s
 		if newBlock {
 			progress.newBlockCounts++
 		}
-		progress.processedBlockCounts += int64(len(blocks))
+		for _, block := range blocks {
+			// The progress of the chunks is counted in bytes, see performBackup
+			if block.Size != 0 {
+				progress.processedBlockCounts += block.Size
+			} else {
+				progress.processedBlockCounts++
+			}
+		}
 		progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
 	}()
 
 	delete(processingBlocks.blocks, checksum)
 }
 
-func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
+func backupBlock(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 	deltaBackup *Backup, offset int64, block []byte, progress *progress) error {
 	var err error
 	newBlock := false
+	// Whether the block was found stored or uploaded, see updateBlockIndex
+	stored := false
+	// The existing blocks are assumed to be compressed like the backup, see
+	// DecompressAndVerifyWithFallback
+	compressionMethod := deltaBackup.CompressionMethod
 	volume := config.Volume
 	snapshot := config.Snapshot
 	deltaOps := config.DeltaOps
 
+	// The chunks record their size, the block size is only their average size
+	size := int64(0)
+	if deltaBackup.chunkingMethod == CHUNKING_METHOD_CDC {
+		size = int64(len(block))
+	}
+
 	checksum := util.GetChecksum(block)
 
 	// This prevents multiple goroutines from trying to upload blocks that contain identical contents
 	// with the same checksum but different offsets).
 	// After uploading, `bsDriver.FileExists(blkFile)` is used to avoid repeat uploading.
-	if isBlockBeingProcessed(deltaBackup, offset, checksum) {
+	if isBlockBeingProcessed(deltaBackup, offset, size, checksum) {
 		return nil
 	}
 
@@ -411,16 +571,31 @@ func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 		}
 		deltaBackup.Lock()
 		defer deltaBackup.Unlock()
-		updateBlocksAndProgress(deltaBackup, progress, checksum, newBlock)
+		if stored {
+			deltaBackup.storedBlocks[checksum] = true
+		}
+		updateBlocksAndProgress(deltaBackup, progress, checksum, compressionMethod, newBlock)
 		if updateErr := deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), progress.progress, "", ""); updateErr != nil {
 			logrus.WithError(updateErr).Warn("Failed to update backup status")
 		}
 	}()
 
-	blkFile := getBlockFilePath(volume.Name, checksum)
+	blkFile := getVolumeBlockFilePath(volume, checksum)
+	// The damaged blocks are uploaded again like by a full backup
+	trustStored := !isFullBackup(config) && !deltaBackup.damagedBlocks[checksum]
+	if deltaBackup.knownBlocks[checksum] && trustStored {
+		log.Debugf("Found known block matching at %v", blkFile)
+		return nil
+	}
 	reUpload := false
-	if bsDriver.FileExists(blkFile) {
-		if !isFullBackup(config) {
+	d := NewDriverWithContext(bsDriver)
+	exists, err := volumeBlockExists(ctx, bsDriver, volume, checksum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if trustStored {
+			stored = true
 			log.Debugf("Found existing block matching at %v", blkFile)
 			return nil
 		}
@@ -430,9 +605,9 @@ func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 
 	log.Tracef("Uploading block file at %v", blkFile)
 	newBlock = !reUpload
-	rs, err := util.CompressData(deltaBackup.CompressionMethod, block)
+	rs, compressionMethod, err := encodeBlock(block, checksum, deltaBackup.CompressionMethod, deltaBackup.compressionLevel, deltaBackup.Encryption)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "failed to encode block %v", blkFile)
 	}
 
 	dataSize, err := getTransferDataSize(rs)
@@ -440,16 +615,44 @@ func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 		return errors.Wrapf(err, "failed to get transfer data size during saving blocks")
 	}
 
-	err = bsDriver.Write(blkFile, rs)
+	if volume.PackFiles {
+		err = volume.packs.add(ctx, checksum, rs)
+	} else {
+		err = d.WriteWithContext(ctx, blkFile, rs)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "failed to write data during saving blocks")
 	}
+	stored = true
 
 	updateUploadDataSize(reUpload, deltaBackup, dataSize)
 
 	return nil
 }
 
+// encodeBlock returns the content of the block as it's stored: compressed,
+// encrypted if the volume is, and prefixed with its header. The compression
+// method is "none" for the blocks that don't compress well.
+func encodeBlock(block []byte, checksum, compressionMethod string, compressionLevel int, encryption *Encryption) (io.ReadSeeker, string, error) {
+	rs, compressionMethod, err := util.CompressBlock(compressionMethod, compressionLevel, block)
+	if err != nil {
+		return nil, "", err
+	}
+	encryptionMethod := ""
+	if encryption != nil {
+		rs, err = encryptBlock(encryption, rs, checksum)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to encrypt block")
+		}
+		encryptionMethod = encryption.Method
+	}
+	rs, err = AddBlockHeader(rs, compressionMethod, encryptionMethod, int64(len(block)))
+	if err != nil {
+		return nil, "", err
+	}
+	return rs, compressionMethod, nil
+}
+
 func getTransferDataSize(rs io.ReadSeeker) (int64, error) {
 	size, err := rs.Seek(0, io.SeekEnd)
 	if err != nil {
@@ -475,12 +678,16 @@ func updateUploadDataSize(reUpload bool, deltaBackup *Backup, dataSize int64) {
 	}
 }
 
-func backupMapping(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
+func backupMapping(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 	deltaBackup *Backup, blockSize int64, mapping types.Mapping, progress *progress) error {
 	volume := config.Volume
 	snapshot := config.Snapshot
 	deltaOps := config.DeltaOps
 
+	if deltaBackup.chunkingMethod == CHUNKING_METHOD_CDC {
+		return backupChunks(ctx, bsDriver, config, deltaBackup, blockSize, mapping, progress)
+	}
+
 	block := make([]byte, blockSize)
 	blkCounts := mapping.Size / blockSize
 
@@ -493,7 +700,7 @@ func backupMapping(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 			return err
 		}
 
-		if err := backupBlock(bsDriver, config, deltaBackup, offset, block, progress); err != nil {
+		if err := backupBlock(ctx, bsDriver, config, deltaBackup, offset, block, progress); err != nil {
 			logrus.WithError(err).Errorf("Failed to back up volume %v snapshot %v block at offset %v size %v",
 				volume.Name, snapshot.Name, offset, len(block))
 			return err
@@ -518,7 +725,7 @@ func backupMappings(ctx context.Context, bsDriver BackupStoreDriver, config *Del
 					return
 				}
 
-				if err := backupMapping(bsDriver, config, deltaBackup, blockSize, mapping, progress); err != nil {
+				if err := backupMapping(ctx, bsDriver, config, deltaBackup, blockSize, mapping, progress); err != nil {
 					errChan <- err
 					return
 				}
@@ -542,18 +749,18 @@ func getTotalBackupBlockCounts(delta *types.Mappings) (int64, error) {
 }
 
 func sortBackupBlocks(blocks []BlockMapping, volumeSize, blockSize int64) []BlockMapping {
-	sortedBlocks := make([]string, volumeSize/blockSize)
-	for _, block := range blocks {
-		i := block.Offset / blockSize
-		sortedBlocks[i] = block.BlockChecksum
+	sortedBlocks := make([]*BlockMapping, volumeSize/blockSize)
+	for i := range blocks {
+		sortedBlocks[blocks[i].Offset/blockSize] = &blocks[i]
 	}
 
 	blockMappings := []BlockMapping{}
-	for i, checksum := range sortedBlocks {
-		if checksum != "" {
+	for i, block := range sortedBlocks {
+		if block != nil && block.BlockChecksum != "" {
 			blockMappings = append(blockMappings, BlockMapping{
-				Offset:        int64(i) * blockSize,
-				BlockChecksum: checksum,
+				Offset:            int64(i) * blockSize,
+				BlockChecksum:     block.BlockChecksum,
+				CompressionMethod: block.CompressionMethod,
 			})
 		}
 	}
@@ -562,7 +769,7 @@ func sortBackupBlocks(blocks []BlockMapping, volumeSize, blockSize int64) []Bloc
 }
 
 // performBackup if lastBackup is present we will do an incremental backup
-func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta *types.Mappings, deltaBackup *Backup, lastBackup *Backup) (int, string, error) {
+func performBackup(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta *types.Mappings, deltaBackup *Backup, lastBackup *Backup) (int, string, error) {
 	volume := config.Volume
 	snapshot := config.Snapshot
 	destURL := config.DestURL
@@ -575,18 +782,40 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 	}
 
 	// create an in progress backup config file
-	if err := saveBackup(bsDriver, &Backup{
+	if err := saveBackup(ctx, bsDriver, &Backup{
 		Name:              deltaBackup.Name,
 		VolumeName:        deltaBackup.VolumeName,
 		CompressionMethod: volume.CompressionMethod,
+		Encryption:        volume.Encryption.reference(),
 		CreatedTime:       "",
 	}); err != nil {
 		return 0, "", err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	deltaBackup.knownBlocks = loadKnownBlocks(ctx, bsDriver, volume)
+	damagedBlocks, err := loadDamagedBlocks(ctx, bsDriver, volume.Name)
+	if err != nil {
+		return 0, "", err
+	}
+	deltaBackup.damagedBlocks = damagedBlocks
+	if lastBackup != nil && len(damagedBlocks) > 0 {
+		lastBlockSize, err := lastBackup.GetBlockSize()
+		if err != nil {
+			return 0, "", err
+		}
+		delta = addDamagedBlockMappings(delta, lastBackup, damagedBlocks, lastBlockSize, volume.Size)
+	}
+
+	if deltaBackup.chunkingMethod, err = config.getChunkingMethod(); err != nil {
+		return 0, "", err
+	}
+	if deltaBackup.compressionLevel, err = config.getCompressionLevel(); err != nil {
+		return 0, "", err
+	}
+
 	totalBlockCounts, err := getTotalBackupBlockCounts(delta)
 	if err != nil {
 		return 0, "", err
@@ -598,7 +827,26 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 		totalBlockCounts: totalBlockCounts,
 	}
 
-	mappingChan, errChan := populateMappings(delta)
+	mappings := delta
+	lastBlockSize := blockSize
+	if deltaBackup.chunkingMethod == CHUNKING_METHOD_CDC {
+		if lastBackup != nil {
+			if lastBlockSize, err = lastBackup.GetBlockSize(); err != nil {
+				return 0, "", err
+			}
+		}
+		mappings = &types.Mappings{
+			Mappings:  getChunkExtents(delta.Mappings, lastBackup, lastBlockSize),
+			BlockSize: delta.BlockSize,
+		}
+		// The chunks don't fill whole blocks, their progress is counted in bytes
+		progress.totalBlockCounts = 0
+		for _, extent := range mappings.Mappings {
+			progress.totalBlockCounts += extent.Size
+		}
+	}
+
+	mappingChan, errChan := populateMappings(mappings)
 
 	errorChans := []<-chan error{errChan}
 	for i := 0; i < int(concurrentLimit); i++ {
@@ -608,6 +856,10 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 
 	mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 	err = <-mergedErrChan
+	if err == nil {
+		// the workers stop silently once the context is cancelled
+		err = ctx.Err()
+	}
 
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to backup volume %v snapshot %v", volume.Name, snapshot.Name)
@@ -623,24 +875,54 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 	}).Infof("Created snapshot changed blocks: %v mappings, %v blocks and %v new blocks",
 		len(delta.Mappings), progress.totalBlockCounts, progress.newBlockCounts)
 
-	deltaBackup.Blocks = sortBackupBlocks(deltaBackup.Blocks, volume.Size, delta.BlockSize)
-
-	backup := mergeSnapshotMap(deltaBackup, lastBackup)
+	var backup *Backup
+	if deltaBackup.chunkingMethod == CHUNKING_METHOD_CDC {
+		backup = mergeChunkMaps(deltaBackup, lastBackup, mappings.Mappings, blockSize, lastBlockSize)
+	} else {
+		deltaBackup.Blocks = sortBackupBlocks(deltaBackup.Blocks, volume.Size, delta.BlockSize)
+		backup = mergeSnapshotMap(deltaBackup, lastBackup)
+	}
 	backup.SnapshotName = snapshot.Name
 	backup.SnapshotCreatedAt = snapshot.CreatedTime
 	backup.CreatedTime = util.Now()
-	backup.Size = int64(len(backup.Blocks)) * blockSize
+	backup.Size = getBackupSize(backup.Blocks, blockSize)
 	backup.Labels = config.Labels
-	backup.Parameters = config.Parameters
+	backup.Parameters = withoutEncryptionSecrets(config.Parameters)
 	backup.IsIncremental = lastBackup != nil
 	backup.NewlyUploadedDataSize = deltaBackup.NewlyUploadedDataSize
 	backup.ReUploadedDataSize = deltaBackup.ReUploadedDataSize
+	// The blocks of the last backup may be newer
+	backup.BlockFormatVersion = BLOCK_FORMAT_VERSION
+	if lastBackup != nil && lastBackup.BlockFormatVersion > backup.BlockFormatVersion {
+		backup.BlockFormatVersion = lastBackup.BlockFormatVersion
+	}
 
-	if err := saveBackup(bsDriver, backup); err != nil {
+	if volume.PackFiles {
+		if err := volume.packs.flush(ctx); err != nil {
+			return progress.progress, "", err
+		}
+	}
+	if volume.BlockPool {
+		if err := addBlockReferences(ctx, bsDriver, volume.Name, backup.Blocks); err != nil {
+			return progress.progress, "", errors.Wrapf(err, "failed to add the block references of volume %v", volume.Name)
+		}
+	}
+
+	if err := saveBackup(ctx, bsDriver, backup); err != nil {
 		return progress.progress, "", err
 	}
+	updateBlockIndex(ctx, bsDriver, volume, deltaBackup.storedBlocks)
+	if len(damagedBlocks) > 0 {
+		if err := updateDamagedBlocks(ctx, bsDriver, volume.Name, func(checksums map[string]bool) {
+			for checksum := range deltaBackup.storedBlocks {
+				delete(checksums, checksum)
+			}
+		}); err != nil {
+			log.WithError(err).Warnf("Failed to update the damaged blocks of volume %v", volume.Name)
+		}
+	}
 
-	loadedVolume, err := loadVolume(bsDriver, volume.Name)
+	loadedVolume, err := loadVolume(ctx, bsDriver, volume.Name)
 	if err != nil {
 		return progress.progress, "", err
 	}
@@ -657,8 +939,11 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 	volume.CompressionMethod = config.Volume.CompressionMethod
 	volume.StorageClassName = config.Volume.StorageClassName
 	volume.DataEngine = config.Volume.DataEngine
+	if volume.BlockFormatVersion < backup.BlockFormatVersion {
+		volume.BlockFormatVersion = backup.BlockFormatVersion
+	}
 
-	if err := saveVolume(bsDriver, volume); err != nil {
+	if err := saveVolume(ctx, bsDriver, volume); err != nil {
 		return progress.progress, "", err
 	}
 
@@ -674,6 +959,7 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 		VolumeName:        deltaBackup.VolumeName,
 		SnapshotName:      deltaBackup.SnapshotName,
 		CompressionMethod: deltaBackup.CompressionMethod,
+		Encryption:        deltaBackup.Encryption,
 		Blocks:            []BlockMapping{},
 	}
 	var d, l int
@@ -760,11 +1046,11 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 			restoreLog.WithError(unlockErr).Warn("Failed to unlock")
 		}
 	}()
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 
-	vol, err := loadVolume(bsDriver, srcVolumeName)
+	vol, err := loadVolume(ctx, bsDriver, srcVolumeName)
 	if err != nil {
 		return generateError(logrus.Fields{
 			LogFieldSrcVolume: srcVolumeName,
@@ -775,6 +1061,9 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 	if vol.Size == 0 {
 		return fmt.Errorf("invalid volume size %v", vol.Size)
 	}
+	if err := loadVolumePacks(ctx, bsDriver, vol); err != nil {
+		return err
+	}
 	restoreLog = restoreLog.WithFields(logrus.Fields{
 		LogFieldCompressionMethod: vol.CompressionMethod,
 		LogFieldDataEngine:        vol.DataEngine,
@@ -797,10 +1086,13 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 		return err
 	}
 
-	backup, err := loadBackup(bsDriver, srcBackupName, srcVolumeName)
+	backup, err := loadBackup(ctx, bsDriver, srcBackupName, srcVolumeName)
 	if err != nil {
 		return err
 	}
+	if err := ValidateBlockFormatVersion(backup.BlockFormatVersion); err != nil {
+		return errors.Wrapf(err, "cannot restore backup %v", srcBackupName)
+	}
 
 	backupBlockSize, err := backup.GetBlockSize()
 	if err != nil {
@@ -819,7 +1111,7 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 	}).Info("Restoring delta block backup")
 
 	// keep lock alive for async go routine.
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 
@@ -859,11 +1151,15 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 
 		errorChans := []<-chan error{errChan}
 		for i := 0; i < int(concurrentLimit); i++ {
-			errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, srcVolumeName, blockChan, backupBlockSize, progress))
+			errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, vol, blockChan, backupBlockSize, progress))
 		}
 
 		mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 		err = <-mergedErrChan
+		if err == nil {
+			// the workers stop silently once the context is cancelled
+			err = ctx.Err()
+		}
 		if err != nil {
 			currentProgress = progress.progress
 			restoreLog.WithError(err).Errorf("Failed to delta restore volume %v backup %v", srcVolumeName, backup.Name)
@@ -875,9 +1171,9 @@ func RestoreDeltaBlockBackup(ctx context.Context, config *DeltaRestoreConfig) (e
 	return nil
 }
 
-func restoreBlockToFile(ctx context.Context, bsDriver BackupStoreDriver, volumeName string, volDev *os.File, decompression string, blockSize int64, blk BlockMapping) error {
-	blkFile := getBlockFilePath(volumeName, blk.BlockChecksum)
-	r, err := DecompressAndVerifyWithFallback(ctx, bsDriver, blkFile, decompression, blk.BlockChecksum)
+func restoreBlockToFile(ctx context.Context, bsDriver BackupStoreDriver, volume *Volume, volDev *os.File, decompression string, blockSize int64, blk BlockMapping) error {
+	blkFile := getVolumeBlockFilePath(volume, blk.BlockChecksum)
+	r, err := decompressAndVerifyVolumeBlock(ctx, bsDriver, volume, decompression, blk.BlockChecksum)
 	if err != nil {
 		return errors.Wrapf(err, "failed to decompress and verify block %v with checksum %v", blkFile, blk.BlockChecksum)
 	}
@@ -886,7 +1182,7 @@ func restoreBlockToFile(ctx context.Context, bsDriver BackupStoreDriver, volumeN
 		return errors.Wrapf(err, "failed to seek to offset %v for decompressed block %v", blk.Offset, blkFile)
 	}
 	_, err = io.CopyN(volDev, r, blockSize)
-	return errors.Wrapf(err, "failed to write decompressed block %v to volume %v", blkFile, volumeName)
+	return errors.Wrapf(err, "failed to write decompressed block %v to volume %v", blkFile, volume.Name)
 }
 
 func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRestoreConfig) (err error) {
@@ -934,7 +1230,7 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 		return err
 	}
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -943,7 +1239,7 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 		}
 	}()
 
-	vol, err := loadVolume(bsDriver, srcVolumeName)
+	vol, err := loadVolume(ctx, bsDriver, srcVolumeName)
 	if err != nil {
 		return generateError(logrus.Fields{
 			LogFieldVolume:    srcVolumeName,
@@ -955,6 +1251,9 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
 		return fmt.Errorf("read invalid volume size %v", vol.Size)
 	}
+	if err := loadVolumePacks(ctx, bsDriver, vol); err != nil {
+		return err
+	}
 
 	// check lastBackupName
 	if !util.ValidateName(lastBackupName) {
@@ -987,14 +1286,17 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 		return err
 	}
 
-	lastBackup, err := loadBackup(bsDriver, lastBackupName, srcVolumeName)
+	lastBackup, err := loadBackup(ctx, bsDriver, lastBackupName, srcVolumeName)
 	if err != nil {
 		return err
 	}
-	backup, err := loadBackup(bsDriver, srcBackupName, srcVolumeName)
+	backup, err := loadBackup(ctx, bsDriver, srcBackupName, srcVolumeName)
 	if err != nil {
 		return err
 	}
+	if err := ValidateBlockFormatVersion(backup.BlockFormatVersion); err != nil {
+		return errors.Wrapf(err, "cannot restore backup %v", srcBackupName)
+	}
 
 	lastBackupBlockSize, err := lastBackup.GetBlockSize()
 	if err != nil {
@@ -1017,7 +1319,7 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 		LogFieldObject: LogFieldSnapshot,
 	}).Infof("Started incrementally restoring from %v to %v", lastBackup, backup)
 	// keep lock alive for async go routine.
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	go func() {
@@ -1049,7 +1351,7 @@ func RestoreDeltaBlockBackupIncrementally(ctx context.Context, config *DeltaRest
 			}
 		}
 
-		err = performIncrementalRestore(ctx, bsDriver, config, srcVolumeName, volDevPath, lastBackup, backup, backupBlockSize)
+		err = performIncrementalRestore(ctx, bsDriver, config, vol, volDevPath, lastBackup, backup, backupBlockSize)
 		if err != nil {
 			return
 		}
@@ -1080,7 +1382,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 				blockChan <- &Block{
 					offset:            backup.Blocks[b].Offset,
 					blockChecksum:     backup.Blocks[b].BlockChecksum,
-					compressionMethod: backup.CompressionMethod,
+					compressionMethod: backup.Blocks[b].getCompressionMethod(backup.CompressionMethod),
 				}
 				b++
 				continue
@@ -1093,7 +1395,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 					blockChan <- &Block{
 						offset:            bB.Offset,
 						blockChecksum:     bB.BlockChecksum,
-						compressionMethod: backup.CompressionMethod,
+						compressionMethod: bB.getCompressionMethod(backup.CompressionMethod),
 					}
 				}
 				b++
@@ -1102,7 +1404,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 				blockChan <- &Block{
 					offset:            bB.Offset,
 					blockChecksum:     bB.BlockChecksum,
-					compressionMethod: backup.CompressionMethod,
+					compressionMethod: bB.getCompressionMethod(backup.CompressionMethod),
 				}
 				b++
 			} else {
@@ -1129,8 +1431,9 @@ func populateBlocksForFullRestore(bsDriver BackupStoreDriver, backup *Backup) (<
 		for _, block := range backup.Blocks {
 			blockChan <- &Block{
 				offset:            block.Offset,
+				size:              block.Size,
 				blockChecksum:     block.BlockChecksum,
-				compressionMethod: backup.CompressionMethod,
+				compressionMethod: block.getCompressionMethod(backup.CompressionMethod),
 			}
 		}
 	}()
@@ -1138,28 +1441,31 @@ func populateBlocksForFullRestore(bsDriver BackupStoreDriver, backup *Backup) (<
 	return blockChan, errChan
 }
 
-func restoreBlock(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volumeName string, volDev *os.File, block *Block, blockSize int64, progress *progress) error {
+func restoreBlock(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volume *Volume, volDev *os.File, block *Block, blockSize int64, progress *progress) error {
 	defer func() {
 		progress.Lock()
 		defer progress.Unlock()
 
 		progress.processedBlockCounts++
 		progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
-		deltaOps.UpdateRestoreStatus(volumeName, progress.progress, nil)
+		deltaOps.UpdateRestoreStatus(volume.Name, progress.progress, nil)
 	}()
 
+	if block.size != 0 {
+		blockSize = block.size
+	}
 	if block.isZeroBlock {
 		return fillZeros(volDev, block.offset, blockSize)
 	}
 
-	return restoreBlockToFile(ctx, bsDriver, volumeName, volDev, block.compressionMethod, blockSize,
+	return restoreBlockToFile(ctx, bsDriver, volume, volDev, block.compressionMethod, blockSize,
 		BlockMapping{
 			Offset:        block.offset,
 			BlockChecksum: block.blockChecksum,
 		})
 }
 
-func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volDevPath, volumeName string, in <-chan *Block, blockSize int64, progress *progress) <-chan error {
+func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volDevPath string, volume *Volume, in <-chan *Block, blockSize int64, progress *progress) <-chan error {
 	errChan := make(chan error, 1)
 
 	go func() {
@@ -1181,17 +1487,17 @@ func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps Del
 		for {
 			select {
 			case <-ctx.Done():
-				err = fmt.Errorf(types.ErrorMsgRestoreCancelled+" since server stop for volume %v", volumeName)
+				err = fmt.Errorf(types.ErrorMsgRestoreCancelled+" since server stop for volume %v", volume.Name)
 				return
 			case <-deltaOps.GetStopChan():
-				err = fmt.Errorf(types.ErrorMsgRestoreCancelled+" since received stop signal for volume %v", volumeName)
+				err = fmt.Errorf(types.ErrorMsgRestoreCancelled+" since received stop signal for volume %v", volume.Name)
 				return
 			case block, open := <-in:
 				if !open {
 					return
 				}
 
-				err = restoreBlock(ctx, bsDriver, deltaOps, volumeName, volDev, block, blockSize, progress)
+				err = restoreBlock(ctx, bsDriver, deltaOps, volume, volDev, block, blockSize, progress)
 				if err != nil {
 					return
 				}
@@ -1204,7 +1510,7 @@ func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps Del
 
 // performIncrementalRestore assumes the block sizes are identical between lastBackup and backup.
 func performIncrementalRestore(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaRestoreConfig,
-	srcVolumeName, volDevPath string, lastBackup *Backup, backup *Backup, blockSize int64) error {
+	vol *Volume, volDevPath string, lastBackup *Backup, backup *Backup, blockSize int64) error {
 	var err error
 	concurrentLimit := config.ConcurrentLimit
 
@@ -1212,17 +1518,27 @@ func performIncrementalRestore(ctx context.Context, bsDriver BackupStoreDriver,
 		totalBlockCounts: int64(len(backup.Blocks) + len(lastBackup.Blocks)),
 	}
 
-	blockChan, errChan := populateBlocksForIncrementalRestore(bsDriver, lastBackup, backup)
+	var blockChan <-chan *Block
+	var errChan <-chan error
+	if lastBackup.hasChunks() || backup.hasChunks() {
+		blockChan, errChan = populateChunksForIncrementalRestore(lastBackup, backup, blockSize)
+	} else {
+		blockChan, errChan = populateBlocksForIncrementalRestore(bsDriver, lastBackup, backup)
+	}
 
 	errorChans := []<-chan error{errChan}
 	for i := 0; i < int(concurrentLimit); i++ {
-		errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, srcVolumeName, blockChan, blockSize, progress))
+		errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, vol, blockChan, blockSize, progress))
 	}
 
 	mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 	err = <-mergedErrChan
+	if err == nil {
+		// the workers stop silently once the context is cancelled
+		err = ctx.Err()
+	}
 	if err != nil {
-		logrus.WithError(err).Errorf("Failed to incrementally restore volume %v backup %v", srcVolumeName, backup.Name)
+		logrus.WithError(err).Errorf("Failed to incrementally restore volume %v backup %v", vol.Name, backup.Name)
 	}
 
 	return err
@@ -1233,6 +1549,10 @@ func fillZeros(volDev *os.File, offset, length int64) error {
 }
 
 func DeleteBackupVolume(volumeName string, destURL string) (err error) {
+	return DeleteBackupVolumeWithContext(context.Background(), volumeName, destURL)
+}
+
+func DeleteBackupVolumeWithContext(ctx context.Context, volumeName string, destURL string) (err error) {
 	deleteLog := log.WithFields(logrus.Fields{
 		LogFieldVolume:  volumeName,
 		LogFieldDestURL: destURL,
@@ -1248,7 +1568,7 @@ func DeleteBackupVolume(volumeName string, destURL string) (err error) {
 		return err
 	}
 
-	backupVolumeFolderExists, err := volumeFolderExists(bsDriver, volumeName)
+	backupVolumeFolderExists, err := volumeFolderExists(ctx, bsDriver, volumeName)
 	if err != nil {
 		return err
 	}
@@ -1263,7 +1583,7 @@ func DeleteBackupVolume(volumeName string, destURL string) (err error) {
 		return err
 	}
 
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -1271,7 +1591,7 @@ func DeleteBackupVolume(volumeName string, destURL string) (err error) {
 			deleteLog.WithError(unlockErr).Warn("Failed to unlock")
 		}
 	}()
-	return removeVolume(volumeName, bsDriver)
+	return removeVolume(ctx, volumeName, bsDriver)
 }
 
 func checkBlockReferenceCount(blockInfos map[string]*BlockInfo, backup *Backup, volumeName string, driver BackupStoreDriver) {
@@ -1317,6 +1637,19 @@ func getLatestBackup(backup *Backup, lastBackup *LastBackupInfo) error {
 }
 
 func DeleteDeltaBlockBackup(backupURL string) (err error) {
+	return DeleteDeltaBlockBackupWithContext(context.Background(), backupURL)
+}
+
+// DeleteDeltaBlockBackupWithContext deletes the backup and garbage collects the blocks no
+// longer referenced by the remaining backups of the volume. Cancelling ctx aborts the deletion.
+func DeleteDeltaBlockBackupWithContext(ctx context.Context, backupURL string) (err error) {
+	return DeleteDeltaBlockBackupWithConfig(ctx, backupURL, nil)
+}
+
+// DeleteDeltaBlockBackupWithConfig is DeleteDeltaBlockBackupWithContext with
+// the concurrency and the progress reporting of the garbage collection set by
+// gcConfig, the defaults being used if it's nil.
+func DeleteDeltaBlockBackupWithConfig(ctx context.Context, backupURL string, gcConfig *GCConfig) (err error) {
 	deleteLog := log.WithFields(logrus.Fields{
 		LogFieldBackupURL: backupURL,
 	})
@@ -1344,7 +1677,7 @@ func DeleteDeltaBlockBackup(backupURL string) (err error) {
 	if err != nil {
 		return err
 	}
-	if err := lock.Lock(); err != nil {
+	if err := lock.LockWithContext(ctx); err != nil {
 		return err
 	}
 	defer func() {
@@ -1354,7 +1687,7 @@ func DeleteDeltaBlockBackup(backupURL string) (err error) {
 	}()
 
 	// If we fail to load the backup we still want to proceed with the deletion of the backup file
-	backupToBeDeleted, err := loadBackup(bsDriver, backupName, volumeName)
+	backupToBeDeleted, err := loadBackup(ctx, bsDriver, backupName, volumeName)
 	if err != nil {
 		deleteLog.WithError(err).Warn("Failed to load to be deleted backup")
 		backupToBeDeleted = &Backup{
@@ -1364,12 +1697,12 @@ func DeleteDeltaBlockBackup(backupURL string) (err error) {
 	}
 
 	// we can delete the requested backupToBeDeleted immediately before GC starts
-	if err := removeBackup(backupToBeDeleted, bsDriver); err != nil {
+	if err := removeBackup(ctx, backupToBeDeleted, bsDriver); err != nil {
 		return err
 	}
 	deleteLog.Info("Removed backup for volume")
 
-	v, err := loadVolume(bsDriver, volumeName)
+	v, err := loadVolume(ctx, bsDriver, volumeName)
 	if err != nil {
 		return errors.Wrap(err, "cannot find volume in backupstore")
 	}
@@ -1381,143 +1714,191 @@ func DeleteDeltaBlockBackup(backupURL string) (err error) {
 	}
 
 	deleteLog.Info("GC started")
-	deleteBlocks := true
-	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	refs, err := countVolumeBlockRefs(ctx, bsDriver, v, "", updateLastBackup, gcConfig, deleteLog, nil)
 	if err != nil {
-		deleteLog.WithError(err).Warn("Failed to load backup names, skip block deletion")
+		return err
+	}
+	blockInfos := refs.blockInfos
+	deleteBlocks := refs.skipReason == ""
+	if updateLastBackup {
+		if deleteBlocks {
+			v.LastBackupName = refs.lastBackup.Name
+			v.LastBackupAt = refs.lastBackup.SnapshotCreatedAt
+		}
+		if err := saveVolume(ctx, bsDriver, v); err != nil {
+			return err
+		}
+	}
+
+	// check if there have been new backups created while we where processing
+	backupNames, err := getBackupNamesForVolume(ctx, bsDriver, volumeName)
+	if err != nil || !util.UnorderedEqual(refs.backupNames, backupNames) {
+		deleteLog.Info("Found new backups for volume, skip block deletion")
 		deleteBlocks = false
 	}
 
-	blockInfos := make(map[string]*BlockInfo)
-	blockNames, err := getBlockNamesForVolume(bsDriver, volumeName)
+	// only delete the blocks if it is safe to do so
+	if deleteBlocks {
+		if v.BlockPool {
+			return cleanupPoolBlocks(ctx, bsDriver, blockInfos, v, gcConfig)
+		}
+		if v.PackFiles {
+			return cleanupPackedBlocks(ctx, bsDriver, blockInfos, v)
+		}
+		if err := cleanupBlocks(ctx, bsDriver, blockInfos, volumeName, gcConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeBlockRefs are the blocks of a volume and their reference counts by
+// the backups of the volume.
+type volumeBlockRefs struct {
+	blockInfos  map[string]*BlockInfo
+	backupNames []string
+	lastBackup  *LastBackupInfo
+	// skipReason tells why the blocks mustn't be deleted, if they mustn't
+	skipReason string
+}
+
+// countVolumeBlockRefs lists the blocks of the volume and counts the references
+// to them by the backups of the volume but excludedBackup, calling visit with
+// each backup once counted if set. The latest of the backups is found if findLastBackup is
+// set.
+func countVolumeBlockRefs(ctx context.Context, driver BackupStoreDriver, v *Volume, excludedBackup string, findLastBackup bool,
+	gcConfig *GCConfig, gcLog logrus.FieldLogger, visit func(backup *Backup, blockInfos map[string]*BlockInfo)) (*volumeBlockRefs, error) {
+	refs := &volumeBlockRefs{
+		blockInfos: map[string]*BlockInfo{},
+		lastBackup: &LastBackupInfo{},
+	}
+	skip := func(err error, reason string) {
+		if err != nil {
+			reason = fmt.Sprintf("%v: %v", reason, err)
+		}
+		gcLog.Warnf("%v, skip block deletion", reason)
+		refs.skipReason = reason
+	}
+
+	backupNames, err := getBackupNamesForVolume(ctx, driver, v.Name)
 	if err != nil {
-		return err
+		skip(err, "Failed to load backup names")
+	}
+	for _, name := range backupNames {
+		if name != excludedBackup {
+			refs.backupNames = append(refs.backupNames, name)
+		}
+	}
+
+	var blockNames []string
+	if v.BlockPool {
+		blockNames, err = ListBlockNames(ctx, driver, getPoolBlockPath(), gcConfig)
+	} else if v.PackFiles {
+		if err = loadVolumePacks(ctx, driver, v); err == nil {
+			for checksum := range v.packs.locations {
+				blockNames = append(blockNames, checksum)
+			}
+		}
+	} else {
+		blockNames, err = ListBlockNames(ctx, driver, getBlockPath(v.Name), gcConfig)
+	}
+	if err != nil {
+		return nil, err
 	}
 	for _, name := range blockNames {
-		blockInfos[name] = &BlockInfo{
+		refs.blockInfos[name] = &BlockInfo{
 			checksum: name,
-			path:     getBlockFilePath(volumeName, name),
+			path:     getVolumeBlockFilePath(v, name),
 			refcount: 0,
 		}
 	}
 
-	lastBackup := &LastBackupInfo{}
-	for _, name := range backupNames {
-		deleteLog = deleteLog.WithField("backup", name)
-		backup, err := loadBackup(bsDriver, name, volumeName)
+	for _, name := range refs.backupNames {
+		backup, err := loadBackup(ctx, driver, name, v.Name)
 		if err != nil {
-			deleteLog.WithError(err).Warn("Failed to load backup, skip block deletion")
-			deleteBlocks = false
+			skip(err, fmt.Sprintf("Failed to load backup %v", name))
 			break
 		}
 
 		if isBackupInProgress(backup) {
-			deleteLog.Info("Found in progress backup, skip block deletion")
-			deleteBlocks = false
+			skip(nil, fmt.Sprintf("Found in progress backup %v", name))
 			break
 		}
 
 		// Each volume backup is most likely to reference the same block in the
 		// storage target. Reference check single backup metas at a time.
 		// https://github.com/longhorn/longhorn/issues/2339
-		checkBlockReferenceCount(blockInfos, backup, volumeName, bsDriver)
+		checkBlockReferenceCount(refs.blockInfos, backup, v.Name, driver)
+		if visit != nil {
+			visit(backup, refs.blockInfos)
+		}
 
-		if updateLastBackup {
-			err := getLatestBackup(backup, lastBackup)
-			if err != nil {
-				deleteLog.WithError(err).Warn("Failed to find last backup, skip block deletion")
-				deleteBlocks = false
+		if findLastBackup {
+			if err := getLatestBackup(backup, refs.lastBackup); err != nil {
+				skip(err, "Failed to find last backup")
 				break
 			}
 		}
 	}
-	if updateLastBackup {
-		if deleteBlocks {
-			v.LastBackupName = lastBackup.Name
-			v.LastBackupAt = lastBackup.SnapshotCreatedAt
-		}
-		if err := saveVolume(bsDriver, v); err != nil {
-			return err
-		}
-	}
-
-	// check if there have been new backups created while we where processing
-	prevBackupNames := backupNames
-	backupNames, err = getBackupNamesForVolume(bsDriver, volumeName)
-	if err != nil || !util.UnorderedEqual(prevBackupNames, backupNames) {
-		deleteLog.Info("Found new backups for volume, skip block deletion")
-		deleteBlocks = false
-	}
+	return refs, nil
+}
 
-	// only delete the blocks if it is safe to do so
-	if deleteBlocks {
-		if err := cleanupBlocks(bsDriver, blockInfos, volumeName); err != nil {
-			return err
-		}
+func cleanupBlocks(ctx context.Context, driver BackupStoreDriver, blockMap map[string]*BlockInfo, volume string, gcConfig *GCConfig) error {
+	// The block index mustn't list the blocks being deleted
+	if err := removeBlockIndex(ctx, driver, volume); err != nil {
+		return err
 	}
-	return nil
-}
 
-func cleanupBlocks(driver BackupStoreDriver, blockMap map[string]*BlockInfo, volume string) error {
-	var deletionFailures []string
 	activeBlockCount := int64(0)
-	deletedBlockCount := int64(0)
+	blockPaths := map[string]string{}
+	var paths []string
 	for _, blk := range blockMap {
 		if isBlockSafeToDelete(blk) {
-			if err := driver.Remove(blk.path); err != nil {
-				deletionFailures = append(deletionFailures, blk.checksum)
-				continue
-			}
-			log.Debugf("Deleted block %v for volume %v", blk.checksum, volume)
-			deletedBlockCount++
+			blockPaths[blk.path] = blk.checksum
+			paths = append(paths, blk.path)
 		} else if isBlockReferenced(blk) && isBlockPresent(blk) {
 			activeBlockCount++
 		}
 	}
 
-	if len(deletionFailures) > 0 {
-		return fmt.Errorf("failed to delete backup blocks: %v", deletionFailures)
+	if err := RemoveBlocks(ctx, driver, paths, gcConfig); err != nil {
+		var deletionFailures []string
+		var removeErr *RemoveManyError
+		if errors.As(err, &removeErr) {
+			for _, path := range removeErr.FailedPaths() {
+				deletionFailures = append(deletionFailures, blockPaths[path])
+			}
+		}
+		return errors.Wrapf(err, "failed to delete backup blocks: %v", deletionFailures)
 	}
+	deletedBlockCount := len(paths)
 
 	log.Infof("Retained %v blocks for volume %v", activeBlockCount, volume)
 	log.Infof("Removed %v unused blocks for volume %v", deletedBlockCount, volume)
 	log.Info("GC completed")
 
-	v, err := loadVolume(driver, volume)
+	retainedBlocks := map[string]bool{}
+	for _, blk := range blockMap {
+		if isBlockReferenced(blk) && isBlockPresent(blk) {
+			retainedBlocks[blk.checksum] = true
+		}
+	}
+	if err := saveBlockIndex(ctx, driver, volume, retainedBlocks); err != nil {
+		log.WithError(err).Warnf("Failed to save the block index of volume %v", volume)
+	}
+
+	v, err := loadVolume(ctx, driver, volume)
 	if err != nil {
 		return err
 	}
 
 	// update the block count to what we actually have on disk that is in use
 	v.BlockCount = activeBlockCount
-	return saveVolume(driver, v)
+	return saveVolume(ctx, driver, v)
 }
 
-func getBlockNamesForVolume(driver BackupStoreDriver, volumeName string) ([]string, error) {
-	names := []string{}
-	blockPathBase := getBlockPath(volumeName)
-	lv1Dirs, err := driver.List(blockPathBase)
-	// Directory doesn't exist
-	if err != nil {
-		return names, nil
-	}
-	for _, lv1 := range lv1Dirs {
-		lv1Path := filepath.Join(blockPathBase, lv1)
-		lv2Dirs, err := driver.List(lv1Path)
-		if err != nil {
-			return nil, err
-		}
-		for _, lv2 := range lv2Dirs {
-			lv2Path := filepath.Join(lv1Path, lv2)
-			blockNames, err := driver.List(lv2Path)
-			if err != nil {
-				return nil, err
-			}
-			names = append(names, blockNames...)
-		}
-	}
-
-	return util.ExtractNames(names, "", BLK_SUFFIX), nil
+func getBlockNamesForVolume(ctx context.Context, driver BackupStoreDriver, volumeName string) ([]string, error) {
+	return ListBlockNames(ctx, driver, getBlockPath(volumeName), nil)
 }
 
 func isFullBackup(config *DeltaBackupConfig) bool {
@@ -1,8 +1,12 @@
 package backupstore
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -38,18 +42,50 @@ type deltaMockStoreDriver struct {
 func newDeltaMockStoreDriver(t *testing.T) *deltaMockStoreDriver {
 	t.Helper()
 
-	m := &deltaMockStoreDriver{fs: afero.NewMemMapFs()}
-	if err := RegisterDriver(deltaDriverName, func(destURL string) (BackupStoreDriver, error) {
+	return registerDeltaMockStoreDriver(t, deltaDriverName, afero.NewMemMapFs())
+}
+
+// registerDeltaMockStoreDriver registers the mock driver for the URLs of kind
+// driverName.
+func registerDeltaMockStoreDriver(t *testing.T, driverName string, fs afero.Fs) *deltaMockStoreDriver {
+	t.Helper()
+
+	m := &deltaMockStoreDriver{fs: fs}
+	if err := RegisterDriver(driverName, func(destURL string) (BackupStoreDriver, error) {
 		return m, nil
 	}); err != nil {
 		t.Fatalf("failed to register the mock driver: %v", err)
 	}
 	t.Cleanup(func() {
-		_ = unregisterDriver(deltaDriverName)
+		_ = unregisterDriver(driverName)
 	})
 	return m
 }
 
+// clone registers another backup target for the URLs of kind driverName,
+// holding a copy of the files of this one.
+func (m *deltaMockStoreDriver) clone(t *testing.T, driverName string) *deltaMockStoreDriver {
+	t.Helper()
+
+	fs := afero.NewMemMapFs()
+	for path := range listFiles(t, m.fs) {
+		data, err := afero.ReadFile(m.fs, path)
+		if err == nil {
+			err = afero.WriteFile(fs, path, data, 0644)
+		}
+		if err != nil {
+			t.Fatalf("failed to copy %v to the cloned backup target: %v", path, err)
+		}
+	}
+	return registerDeltaMockStoreDriver(t, driverName, fs)
+}
+
+// lockCheckWaitTime implements lockCheckWaiter, the locks don't wait for other
+// clients to write theirs since the tests share the process.
+func (m *deltaMockStoreDriver) lockCheckWaitTime() time.Duration {
+	return time.Millisecond
+}
+
 func (m *deltaMockStoreDriver) Kind() string {
 	return deltaDriverName
 }
@@ -132,7 +168,7 @@ func (m *deltaMockStoreDriver) Download(src, dst string) error {
 func (m *deltaMockStoreDriver) seedVolume(t *testing.T, volume *Volume) {
 	t.Helper()
 
-	if err := saveVolume(m, volume); err != nil {
+	if err := saveVolume(context.Background(), m, volume); err != nil {
 		t.Fatalf("failed to seed volume %v: %v", volume.Name, err)
 	}
 }
@@ -140,7 +176,7 @@ func (m *deltaMockStoreDriver) seedVolume(t *testing.T, volume *Volume) {
 func (m *deltaMockStoreDriver) seedBackup(t *testing.T, backup *Backup) {
 	t.Helper()
 
-	if err := saveBackup(m, backup); err != nil {
+	if err := saveBackup(context.Background(), m, backup); err != nil {
 		t.Fatalf("failed to seed backup %v: %v", backup.Name, err)
 	}
 }
@@ -164,6 +200,10 @@ type mockDeltaOps struct {
 	mappings       *types.Mappings
 	openErr        error
 	compareErr     error
+	// incompressible makes the snapshot content random
+	incompressible bool
+	// content is the snapshot content if set
+	content []byte
 
 	// recorded calls
 	openCount  int
@@ -222,6 +262,14 @@ func (ops *mockDeltaOps) OpenSnapshot(id, volumeID string) error {
 func (ops *mockDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
 	// Give every offset distinct content so that each block gets its own checksum, otherwise
 	// the backup would deduplicate them into a single block file.
+	if ops.content != nil {
+		copy(data, ops.content[start:])
+		return nil
+	}
+	if ops.incompressible {
+		_, _ = rand.New(rand.NewSource(start + 1)).Read(data)
+		return nil
+	}
 	for i := range data {
 		data[i] = byte(start/deltaBlockSize) + 1
 	}
@@ -320,6 +368,111 @@ func newDeltaBackupConfig(ops *mockDeltaOps) *DeltaBackupConfig {
 	}
 }
 
+// createTestBackup creates a backup of the volume and waits for it to succeed.
+// The snapshot has the content of the mock engine if content is nil, and the
+// given content otherwise, in which case the snapshot is named after the
+// backup so that the backup is a full one.
+func createTestBackup(t *testing.T, volumeName, backupName string, content []byte, parameters map[string]string) *mockDeltaOps {
+	t.Helper()
+
+	ops := newMockDeltaOps()
+	config := newDeltaBackupConfig(ops)
+	config.Volume.Name = volumeName
+	if content != nil {
+		ops.content = content
+		ops.mappings = &types.Mappings{
+			BlockSize: deltaBlockSize,
+			Mappings:  []types.Mapping{{Offset: 0, Size: int64(len(content))}},
+		}
+		config.Snapshot.Name = backupName
+		config.Volume.Size = int64(len(content))
+	}
+	for k, v := range parameters {
+		config.Parameters[k] = v
+	}
+	if _, err := CreateDeltaBlockBackup(backupName, config); err != nil {
+		t.Fatalf("failed to create backup %v of volume %v: %v", backupName, volumeName, err)
+	}
+	ops.waitForSnapshotClosed(t)
+	if status := ops.getLastStatus(t); status.errMessage != "" {
+		t.Fatalf("failed to create backup %v of volume %v: %v", backupName, volumeName, status.errMessage)
+	}
+	return ops
+}
+
+// mockRestoreOps restores into a regular file and reports the final status of
+// the restore on done.
+type mockRestoreOps struct {
+	stopChan chan struct{}
+	done     chan error
+}
+
+func newMockRestoreOps() *mockRestoreOps {
+	return &mockRestoreOps{
+		stopChan: make(chan struct{}),
+		done:     make(chan error, 1),
+	}
+}
+
+func (ops *mockRestoreOps) OpenVolumeDev(volDevName string) (*os.File, string, error) {
+	f, err := os.OpenFile(volDevName, os.O_RDWR|os.O_CREATE, 0644)
+	return f, volDevName, err
+}
+
+func (ops *mockRestoreOps) CloseVolumeDev(volDev *os.File) error {
+	return volDev.Close()
+}
+
+func (ops *mockRestoreOps) UpdateRestoreStatus(snapshot string, restoreProgress int, err error) {
+	if err != nil || restoreProgress == PROGRESS_PERCENTAGE_BACKUP_TOTAL {
+		ops.done <- err
+	}
+}
+
+func (ops *mockRestoreOps) Stop() {
+	close(ops.stopChan)
+}
+
+func (ops *mockRestoreOps) GetStopChan() chan struct{} {
+	return ops.stopChan
+}
+
+func (ops *mockRestoreOps) waitForRestore(t *testing.T) {
+	t.Helper()
+
+	select {
+	case err := <-ops.done:
+		if err != nil {
+			t.Fatalf("failed to restore: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for the restore")
+	}
+}
+
+// restoreTestBackup restores the backup of the test volume and returns its
+// content.
+func restoreTestBackup(t *testing.T, backupName string) []byte {
+	t.Helper()
+
+	restoreOps := newMockRestoreOps()
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreDeltaBlockBackup(context.Background(), &DeltaRestoreConfig{
+		BackupURL:       EncodeBackupURL(backupName, deltaVolumeName, deltaDriverURL),
+		DeltaOps:        restoreOps,
+		Filename:        restored,
+		ConcurrentLimit: 2,
+	}); err != nil {
+		t.Fatalf("failed to restore backup %v: %v", backupName, err)
+	}
+	restoreOps.waitForRestore(t)
+	data, err := os.ReadFile(restored)
+	if err != nil {
+		t.Fatalf("failed to read restored backup %v: %v", backupName, err)
+	}
+	return data
+}
+
 func TestCreateDeltaBlockBackupRejectsInvalidConfig(t *testing.T) {
 	testCases := map[string]struct {
 		newConfig func(ops *mockDeltaOps) *DeltaBackupConfig
@@ -418,7 +571,7 @@ func TestCreateDeltaBlockBackupCreatesFullBackup(t *testing.T) {
 	assert.Equal(EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL), lastStatus.url)
 	assert.Empty(lastStatus.errMessage)
 
-	backup, err := loadBackup(m, "backup-1", deltaVolumeName)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
 	assert.NoError(err)
 	assert.False(backup.IsIncremental)
 	assert.Equal(deltaSnapshotName, backup.SnapshotName)
@@ -426,7 +579,7 @@ func TestCreateDeltaBlockBackupCreatesFullBackup(t *testing.T) {
 	assert.Equal(2*deltaBlockSize, backup.Size)
 
 	// The volume config is what a later backup reads to decide whether it can be incremental.
-	volume, err := loadVolume(m, deltaVolumeName)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
 	assert.NoError(err)
 	assert.Equal("backup-1", volume.LastBackupName)
 	assert.Equal(int64(2), volume.BlockCount)
@@ -470,7 +623,7 @@ func TestCreateDeltaBlockBackupCreatesIncrementalBackup(t *testing.T) {
 	// The last backup's snapshot is the baseline the volume engine diffs against.
 	assert.Equal([]string{"snap-1"}, ops.getCompareIDs())
 
-	backup, err := loadBackup(m, "backup-2", deltaVolumeName)
+	backup, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
 	assert.NoError(err)
 	assert.True(backup.IsIncremental)
 	// The unchanged block is not re-uploaded but it still has to appear in the new backup,
@@ -480,7 +633,7 @@ func TestCreateDeltaBlockBackupCreatesIncrementalBackup(t *testing.T) {
 		{Offset: 2 * deltaBlockSize, BlockChecksum: backup.Blocks[1].BlockChecksum},
 	}, backup.Blocks)
 
-	volume, err := loadVolume(m, deltaVolumeName)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
 	assert.NoError(err)
 	assert.Equal("backup-2", volume.LastBackupName)
 	// Only the changed block was newly uploaded.
@@ -524,6 +677,15 @@ func TestCreateDeltaBlockBackupFallsBackToFullBackup(t *testing.T) {
 			localSnapshots: []string{deltaSnapshotName, "snap-1"},
 			fullBackupMode: true,
 		},
+		// Fixed size blocks cannot be merged with content-defined chunks.
+		"last backup has chunks": {
+			lastBackup: &Backup{
+				Name: "backup-1", VolumeName: deltaVolumeName, SnapshotName: "snap-1",
+				CreatedTime: "2026-08-19T00:00:00Z", CompressionMethod: LEGACY_COMPRESSION_METHOD,
+				Blocks: []BlockMapping{{Offset: 0, BlockChecksum: util.GetChecksum([]byte("chunk")), Size: 1000}},
+			},
+			localSnapshots: []string{deltaSnapshotName, "snap-1"},
+		},
 	}
 
 	for name, testCase := range testCases {
@@ -561,7 +723,7 @@ func TestCreateDeltaBlockBackupFallsBackToFullBackup(t *testing.T) {
 			// Falling back means diffing against nothing, not failing the backup.
 			assert.Equal([]string{""}, ops.getCompareIDs())
 
-			backup, err := loadBackup(m, "backup-2", deltaVolumeName)
+			backup, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
 			assert.NoError(err)
 			assert.False(backup.IsIncremental)
 			assert.Len(backup.Blocks, 2)
@@ -635,3 +797,267 @@ func TestCreateDeltaBlockBackupReportsLoadVolumeFailure(t *testing.T) {
 	assert.Equal(deltaSnapshotName, lastStatus.snapshotName)
 	assert.Equal(string(types.ProgressStateError), lastStatus.state)
 }
+
+func TestCreateDeltaBlockBackupWithContextStopsOnCancelledContext(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := newMockDeltaOps()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The mock driver does not implement BackupStoreDriverWithContext, so this also covers the
+	// adapter that makes legacy drivers honor the cancellation.
+	isIncremental, err := CreateDeltaBlockBackupWithContext(ctx, "backup-1", newDeltaBackupConfig(ops))
+	assert.ErrorIs(err, context.Canceled)
+	assert.False(isIncremental)
+	assert.Equal(0, ops.getOpenCount())
+	assert.False(m.FileExists(getVolumeFilePath(deltaVolumeName)))
+
+	lastStatus := ops.getLastStatus(t)
+	assert.Equal(string(types.ProgressStateError), lastStatus.state)
+}
+
+// stoppableDeltaOps holds the reads of the snapshot until released, and
+// aborts the backup once stopped.
+type stoppableDeltaOps struct {
+	*mockDeltaOps
+	stopChan chan struct{}
+	release  chan struct{}
+}
+
+func newStoppableDeltaOps() *stoppableDeltaOps {
+	return &stoppableDeltaOps{
+		mockDeltaOps: newMockDeltaOps(),
+		stopChan:     make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+}
+
+func (ops *stoppableDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	<-ops.release
+	return ops.mockDeltaOps.ReadSnapshot(id, volumeID, start, data)
+}
+
+func (ops *stoppableDeltaOps) GetStopChan() chan struct{} {
+	return ops.stopChan
+}
+
+func TestCreateDeltaBlockBackupWithContextOutlivesContext(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := newStoppableDeltaOps()
+	config := newDeltaBackupConfig(ops.mockDeltaOps)
+	config.DeltaOps = ops
+
+	// The caller returns once the backup is started
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := CreateDeltaBlockBackupWithContext(ctx, "backup-1", config)
+	assert.NoError(err)
+	cancel()
+	close(ops.release)
+
+	ops.waitForSnapshotClosed(t)
+	assert.Empty(ops.getLastStatus(t).errMessage)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(backup.Blocks, 2)
+}
+
+func TestCreateDeltaBlockBackupWithContextStopsOnStopChan(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := newStoppableDeltaOps()
+	config := newDeltaBackupConfig(ops.mockDeltaOps)
+	config.DeltaOps = ops
+
+	_, err := CreateDeltaBlockBackupWithContext(context.Background(), "backup-1", config)
+	assert.NoError(err)
+	close(ops.stopChan)
+	close(ops.release)
+
+	ops.waitForSnapshotClosed(t)
+	assert.Contains(ops.getLastStatus(t).errMessage, context.Canceled.Error())
+	// The blocks weren't taken for uploaded ones
+	blockNames, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Empty(blockNames)
+	assert.Empty(getLocksForVolume(context.Background(), deltaVolumeName, m))
+}
+
+func TestDecompressAndVerifyWithFallbackStopsOnCancelledContext(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	block := []byte("block data")
+	checksum := util.GetChecksum(block)
+	blkFile := getBlockFilePath(deltaVolumeName, checksum)
+	rs, err := util.CompressData("lz4", block)
+	if err != nil {
+		t.Fatalf("failed to compress the block: %v", err)
+	}
+	if err := m.Write(blkFile, rs); err != nil {
+		t.Fatalf("failed to seed the block: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A cancelled restore must not sit in the retry backoff, which would keep the volume
+	// device open for minutes after the engine gave up on it.
+	start := time.Now()
+	r, err := DecompressAndVerifyWithFallback(ctx, m, blkFile, "lz4", checksum)
+	assert.ErrorIs(err, context.Canceled)
+	assert.Nil(r)
+	assert.Less(time.Since(start), backoffDuration[0])
+
+	r, err = DecompressAndVerifyWithFallback(context.Background(), m, blkFile, "lz4", checksum)
+	assert.NoError(err)
+	data, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(block, data)
+}
+
+func TestCreateDeltaBlockBackupWithZstd(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := newMockDeltaOps()
+	config := newDeltaBackupConfig(ops)
+	config.Volume.CompressionMethod = "zstd"
+	config.Parameters[BackupParameterCompressionLevel] = "19"
+
+	_, err := CreateDeltaBlockBackup("backup-1", config)
+	assert.NoError(err)
+	ops.waitForSnapshotClosed(t)
+	assert.Empty(ops.getLastStatus(t).errMessage)
+
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal("zstd", backup.CompressionMethod)
+
+	snapshot := make([]byte, deltaBlockSize)
+	for _, blk := range backup.Blocks {
+		blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+		data, err := afero.ReadFile(m.fs, blkFile)
+		assert.NoError(err)
+		header, payload, err := parseBlockHeader(data)
+		assert.NoError(err)
+		assert.Equal("zstd", header.CompressionMethod)
+		assert.Equal("zstd", util.DetectCompressionMethod(payload))
+
+		r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, backup.CompressionMethod, blk.BlockChecksum)
+		assert.NoError(err)
+		restored, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.NoError(ops.ReadSnapshot(deltaSnapshotName, deltaVolumeName, blk.Offset, snapshot))
+		assert.Equal(snapshot, restored)
+	}
+}
+
+func TestCreateDeltaBlockBackupRejectsInvalidCompressionLevel(t *testing.T) {
+	testCases := map[string]struct {
+		level               string
+		expectErrorContains string
+	}{
+		"unparsable level": {
+			level:               "fast",
+			expectErrorContains: "invalid compression level fast",
+		},
+		"level out of range": {
+			level:               "19",
+			expectErrorContains: "invalid compression level 19 for compression method gzip",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			newDeltaMockStoreDriver(t)
+			ops := newMockDeltaOps()
+			config := newDeltaBackupConfig(ops)
+			config.Parameters[BackupParameterCompressionLevel] = testCase.level
+
+			_, err := CreateDeltaBlockBackup("backup-1", config)
+			assert.ErrorContains(err, testCase.expectErrorContains)
+			assert.Equal(0, ops.getOpenCount())
+		})
+	}
+}
+
+func TestDecompressAndVerifyWithFallbackDetectsCompressionMethod(t *testing.T) {
+	m := newDeltaMockStoreDriver(t)
+	block := bytes.Repeat([]byte("block data "), 100)
+	checksum := util.GetChecksum(block)
+	blkFile := getBlockFilePath(deltaVolumeName, checksum)
+
+	for _, compressionMethod := range []string{"gzip", "lz4", "zstd"} {
+		rs, err := util.CompressData(compressionMethod, block)
+		if err != nil {
+			t.Fatalf("failed to compress the block: %v", err)
+		}
+		if err := m.Write(blkFile, rs); err != nil {
+			t.Fatalf("failed to seed the block: %v", err)
+		}
+
+		// The block is read whatever the method recorded for it
+		for _, recordedMethod := range []string{"gzip", "lz4", "zstd"} {
+			r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, recordedMethod, checksum)
+			assert.NoError(t, err, "compressed with %v, recorded %v", compressionMethod, recordedMethod)
+			if err != nil {
+				continue
+			}
+			data, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, block, data)
+		}
+	}
+}
+
+func TestCreateDeltaBlockBackupStoresIncompressibleBlocksRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := newMockDeltaOps()
+	ops.incompressible = true
+
+	_, err := CreateDeltaBlockBackup("backup-1", newDeltaBackupConfig(ops))
+	assert.NoError(err)
+	ops.waitForSnapshotClosed(t)
+	assert.Empty(ops.getLastStatus(t).errMessage)
+
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(LEGACY_COMPRESSION_METHOD, backup.CompressionMethod)
+	assert.Len(backup.Blocks, 2)
+
+	blockChan, _ := populateBlocksForFullRestore(m, backup)
+	snapshot := make([]byte, deltaBlockSize)
+	for _, blk := range backup.Blocks {
+		assert.Equal("none", blk.CompressionMethod)
+		assert.Equal("none", (<-blockChan).compressionMethod)
+
+		blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+		data, err := afero.ReadFile(m.fs, blkFile)
+		assert.NoError(err)
+		header, payload, err := parseBlockHeader(data)
+		assert.NoError(err)
+		assert.Equal("none", header.CompressionMethod)
+		assert.NoError(ops.ReadSnapshot(deltaSnapshotName, deltaVolumeName, blk.Offset, snapshot))
+		assert.Equal(snapshot, payload)
+
+		// Nor does the block need its marker to be restored, a block found
+		// by its checksum only is assumed to be compressed like its backup
+		for _, decompression := range []string{blk.getCompressionMethod(backup.CompressionMethod), backup.CompressionMethod} {
+			r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, decompression, blk.BlockChecksum)
+			assert.NoError(err)
+			restored, err := io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(snapshot, restored)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package backupstore
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/url"
+	"sort"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/sirupsen/logrus"
 
 	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
@@ -27,6 +31,291 @@ type BackupStoreDriver interface {
 	Download(src, dst string) error
 }
 
+// BackupStoreDriverWithContext is the context-aware variant of BackupStoreDriver.
+// Drivers talking to remote services should implement it, so that cancelling
+// the context of a backup, restore or deletion aborts the requests in flight
+// instead of waiting for them to time out. Use NewDriverWithContext to get one
+// out of any registered driver.
+type BackupStoreDriverWithContext interface {
+	BackupStoreDriver
+
+	FileExistsWithContext(ctx context.Context, filePath string) bool
+	FileSizeWithContext(ctx context.Context, filePath string) int64
+	FileTimeWithContext(ctx context.Context, filePath string) time.Time // Needs to be returned in UTC
+	RemoveWithContext(ctx context.Context, path string) error           // Behavior like "rm -rf"
+	ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error)
+	WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error
+	ListWithContext(ctx context.Context, path string) ([]string, error) // Behavior like "ls", not like "find"
+	UploadWithContext(ctx context.Context, src, dst string) error
+	DownloadWithContext(ctx context.Context, src, dst string) error
+}
+
+// BackupStoreDriverRangeReader is an optional capability of the drivers able
+// to read a byte range of a file without reading the whole file. Use
+// ReadRangeWithContext to read a range with any driver.
+type BackupStoreDriverRangeReader interface {
+	ReadRange(src string, offset, length int64) (io.ReadCloser, error) // Caller needs to close
+}
+
+// BackupStoreDriverRangeReaderWithContext is the context-aware variant of
+// BackupStoreDriverRangeReader.
+type BackupStoreDriverRangeReaderWithContext interface {
+	BackupStoreDriverRangeReader
+
+	ReadRangeWithContext(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ReadRangeWithContext reads length bytes at offset of the file, or up to its
+// end if it's shorter. The drivers without the BackupStoreDriverRangeReader
+// capability read the file from its start and skip the bytes before offset.
+func ReadRangeWithContext(ctx context.Context, driver BackupStoreDriver, src string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range of %v bytes at offset %v of %v", length, offset, src)
+	}
+	if d, ok := driver.(*legacyDriver); ok {
+		driver = d.BackupStoreDriver
+	}
+
+	switch d := driver.(type) {
+	case BackupStoreDriverRangeReaderWithContext:
+		return d.ReadRangeWithContext(ctx, src, offset, length)
+	case BackupStoreDriverRangeReader:
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return d.ReadRange(src, offset, length)
+	}
+
+	rc, err := NewDriverWithContext(driver).ReadWithContext(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && err != io.EOF {
+		_ = rc.Close()
+		return nil, err
+	}
+	return &rangeReadCloser{io.LimitReader(rc, length), rc}, nil
+}
+
+// rangeReadCloser reads a range of a file and closes the file.
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// BackupStoreDriverStreamWriter is an optional capability of the drivers able
+// to write a file from a stream, without the whole content in memory or a
+// local file. The size is -1 if it's unknown. Use WriteStreamWithContext to
+// write a stream with any driver.
+type BackupStoreDriverStreamWriter interface {
+	WriteStream(dst string, r io.Reader, size int64) error
+}
+
+// BackupStoreDriverStreamWriterWithContext is the context-aware variant of
+// BackupStoreDriverStreamWriter.
+type BackupStoreDriverStreamWriterWithContext interface {
+	BackupStoreDriverStreamWriter
+
+	WriteStreamWithContext(ctx context.Context, dst string, r io.Reader, size int64) error
+}
+
+// WriteStreamWithContext writes the file from the stream, whose size is -1 if
+// it's unknown. The drivers without the BackupStoreDriverStreamWriter
+// capability are given the whole content in memory, unless the stream is an
+// io.ReadSeeker already.
+func WriteStreamWithContext(ctx context.Context, driver BackupStoreDriver, dst string, r io.Reader, size int64) error {
+	if d, ok := driver.(*legacyDriver); ok {
+		driver = d.BackupStoreDriver
+	}
+
+	switch d := driver.(type) {
+	case BackupStoreDriverStreamWriterWithContext:
+		return d.WriteStreamWithContext(ctx, dst, r, size)
+	case BackupStoreDriverStreamWriter:
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return d.WriteStream(dst, r, size)
+	}
+
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		rs = bytes.NewReader(data)
+	}
+	return NewDriverWithContext(driver).WriteWithContext(ctx, dst, rs)
+}
+
+// BackupStoreDriverBatchRemover is an optional capability of the drivers able
+// to remove many files with a few requests. Unlike Remove, RemoveMany removes
+// the given files only, not the ones under a directory, and a missing file
+// isn't a failure. The error lists the files that failed to be removed. Use
+// RemoveManyWithContext to remove files with any driver.
+type BackupStoreDriverBatchRemover interface {
+	RemoveMany(paths []string) error
+}
+
+// BackupStoreDriverBatchRemoverWithContext is the context-aware variant of
+// BackupStoreDriverBatchRemover.
+type BackupStoreDriverBatchRemoverWithContext interface {
+	BackupStoreDriverBatchRemover
+
+	RemoveManyWithContext(ctx context.Context, paths []string) error
+}
+
+// RemoveManyError reports the files that failed to be removed, the other ones
+// were removed.
+type RemoveManyError struct {
+	Failures map[string]error
+}
+
+func (e *RemoveManyError) Error() string {
+	paths := e.FailedPaths()
+	if len(paths) == 0 {
+		return "failed to remove files"
+	}
+	return fmt.Sprintf("failed to remove files %v: %v", paths, e.Failures[paths[0]])
+}
+
+// FailedPaths returns the sorted paths of the files that failed to be removed.
+func (e *RemoveManyError) FailedPaths() []string {
+	paths := make([]string, 0, len(e.Failures))
+	for path := range e.Failures {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// RemoveManyWithContext removes the files, and returns a *RemoveManyError
+// listing the files it failed to remove if any. The drivers without the
+// BackupStoreDriverBatchRemover capability remove the files one by one.
+func RemoveManyWithContext(ctx context.Context, driver BackupStoreDriver, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if d, ok := driver.(*legacyDriver); ok {
+		driver = d.BackupStoreDriver
+	}
+
+	var err error
+	switch d := driver.(type) {
+	case BackupStoreDriverBatchRemoverWithContext:
+		err = d.RemoveManyWithContext(ctx, paths)
+	case BackupStoreDriverBatchRemover:
+		if err = ctx.Err(); err == nil {
+			err = d.RemoveMany(paths)
+		}
+	default:
+		failures := map[string]error{}
+		dc := NewDriverWithContext(driver)
+		for _, path := range paths {
+			if err := dc.RemoveWithContext(ctx, path); err != nil {
+				failures[path] = err
+			}
+		}
+		if len(failures) > 0 {
+			err = &RemoveManyError{Failures: failures}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	// A driver failing as a whole failed to remove any of the files
+	var removeErr *RemoveManyError
+	if errors.As(err, &removeErr) {
+		return err
+	}
+	failures := make(map[string]error, len(paths))
+	for _, path := range paths {
+		failures[path] = err
+	}
+	return &RemoveManyError{Failures: failures}
+}
+
+// legacyDriver adapts a BackupStoreDriver that does not know about contexts.
+// An operation already handed over to the driver cannot be interrupted, but no
+// new operation is started once the context is done.
+type legacyDriver struct {
+	BackupStoreDriver
+}
+
+// NewDriverWithContext returns the driver itself if it is context-aware, or
+// wraps it into an adapter otherwise.
+func NewDriverWithContext(driver BackupStoreDriver) BackupStoreDriverWithContext {
+	if d, ok := driver.(BackupStoreDriverWithContext); ok {
+		return d
+	}
+	return &legacyDriver{driver}
+}
+
+func (d *legacyDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return d.FileExists(filePath)
+}
+
+func (d *legacyDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	if ctx.Err() != nil {
+		return -1
+	}
+	return d.FileSize(filePath)
+}
+
+func (d *legacyDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
+	return d.FileTime(filePath)
+}
+
+func (d *legacyDriver) RemoveWithContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Remove(path)
+}
+
+func (d *legacyDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.Read(src)
+}
+
+func (d *legacyDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Write(dst, rs)
+}
+
+func (d *legacyDriver) ListWithContext(ctx context.Context, path string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.List(path)
+}
+
+func (d *legacyDriver) UploadWithContext(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Upload(src, dst)
+}
+
+func (d *legacyDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Download(src, dst)
+}
+
 var (
 	initializers map[string]InitFunc
 )
@@ -0,0 +1,792 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gammazero/workerpool"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+const (
+	// BackupParameterEncryptionKey is the DeltaBackupConfig parameter carrying
+	// a base64 encoded 256-bit key, e.g. one handed out by a KMS.
+	BackupParameterEncryptionKey = "backup-encryption-key"
+	// BackupParameterEncryptionPassphrase is the DeltaBackupConfig parameter
+	// carrying a passphrase the key is derived from.
+	BackupParameterEncryptionPassphrase = "backup-encryption-passphrase"
+
+	ENCRYPTION_METHOD_AES_256_GCM = "aes-256-gcm"
+
+	ENCRYPTION_KDF_NONE          = "none"
+	ENCRYPTION_KDF_PBKDF2_SHA256 = "pbkdf2-sha256"
+
+	encryptionKeySize  = 32
+	encryptionSaltSize = 16
+	encryptionKeyIDLen = 16
+
+	// dataKeyAdditionalData is authenticated along with the wrapped data key
+	dataKeyAdditionalData = "longhorn-backupstore-data-key"
+)
+
+var (
+	// blockEncryptionMagic starts every encrypted block, it's followed by the
+	// ID of the key and the nonce.
+	blockEncryptionMagic = []byte("\x00LHBENC\x01")
+
+	// encryptionKDFIterations is the PBKDF2 work factor for new volumes, the
+	// existing ones keep the one recorded in their metadata.
+	encryptionKDFIterations = 600000
+
+	// errBlockDecryption marks the errors that retrying the read of a block
+	// cannot fix.
+	errBlockDecryption = errors.New("failed to decrypt block")
+
+	// keyring keeps the keys that have been derived so far, by key ID. It
+	// allows decrypting the blocks without deriving the key again for each of
+	// them, the block only records the ID of its key. See getFromKeyring for
+	// who gets them.
+	keyringMutex sync.Mutex
+	keyring      = map[string]*keyringEntry{}
+)
+
+// Encryption describes how the blocks and configs of a backup volume are
+// encrypted. It's stored in the clear next to the encrypted configs, so it
+// must never contain anything allowing to recover a key without the secret.
+//
+// The blocks and configs are encrypted with a random data key, which is
+// wrapped by the master key derived from the secret. Rotating the secret only
+// rewraps the data key, see RotateVolumeKey. The volumes encrypted before the
+// data keys were introduced use the master key directly, they have no
+// WrappedKey.
+//
+// Note that the blocks are still named after the checksum of their plain
+// content, to keep the deduplication working.
+type Encryption struct {
+	Method     string
+	KDF        string `json:",omitempty"`
+	Salt       []byte `json:",omitempty"`
+	Iterations int    `json:",omitempty"`
+	// KeyID identifies the master key, it allows telling a wrong secret
+	// apart from corrupted data.
+	KeyID      string `json:",omitempty"`
+	WrappedKey []byte `json:",omitempty"`
+	DataKeyID  string `json:",omitempty"`
+}
+
+// encryptionSecret is what the user provides, either the key itself or a
+// passphrase to derive it from.
+type encryptionSecret struct {
+	key        []byte
+	passphrase string
+}
+
+type encryptionKey struct {
+	id   string
+	raw  []byte
+	aead cipher.AEAD
+}
+
+type keyringEntry struct {
+	key *encryptionKey
+	// secretIDs are the fingerprints of the secrets the key was unwrapped
+	// with
+	secretIDs map[string]bool
+	// holders counts the operations given a secret of their own using the
+	// key, see holdKeyring
+	holders int
+}
+
+// encryptedConfig is how the configs of an encrypted backup volume are stored,
+// only what is needed to find the key is left in the clear.
+type encryptedConfig struct {
+	Encryption *Encryption
+	Ciphertext []byte
+}
+
+// getEncryptionSecret returns the secret given in the parameters of the
+// backup, falling back to the one configured for the backup target. It
+// returns nil if there is none.
+func getEncryptionSecret(parameters map[string]string) (*encryptionSecret, error) {
+	key, passphrase := parameters[BackupParameterEncryptionKey], parameters[BackupParameterEncryptionPassphrase]
+	if key == "" && passphrase == "" {
+		key, passphrase = os.Getenv(types.BackupEncryptionKey), os.Getenv(types.BackupEncryptionPassphrase)
+	}
+	return parseEncryptionSecret(key, passphrase)
+}
+
+// getConfiguredSecretID returns the fingerprint of the secret configured for
+// the backup target, or "" if there is none.
+func getConfiguredSecretID() string {
+	secret, err := getEncryptionSecret(nil)
+	if err != nil || secret == nil {
+		return ""
+	}
+	return secret.id()
+}
+
+func parseEncryptionSecret(key, passphrase string) (*encryptionSecret, error) {
+	switch {
+	case key != "" && passphrase != "":
+		return nil, fmt.Errorf("only one of the encryption key and passphrase can be set")
+	case key != "":
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encryption key, it must be base64 encoded")
+		}
+		if len(decoded) != encryptionKeySize {
+			return nil, fmt.Errorf("invalid encryption key size %v, it must be %v bytes", len(decoded), encryptionKeySize)
+		}
+		return &encryptionSecret{key: decoded}, nil
+	case passphrase != "":
+		return &encryptionSecret{passphrase: passphrase}, nil
+	}
+	return nil, nil
+}
+
+// withoutEncryptionSecrets returns the parameters minus the encryption
+// secrets, which must not end up in the backup configs.
+func withoutEncryptionSecrets(parameters map[string]string) map[string]string {
+	if parameters == nil {
+		return nil
+	}
+	result := map[string]string{}
+	for k, v := range parameters {
+		if k == BackupParameterEncryptionKey || k == BackupParameterEncryptionPassphrase {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// id returns the fingerprint of the secret, it's only kept in memory.
+func (s *encryptionSecret) id() string {
+	mac := hmac.New(sha256.New, []byte("longhorn-backupstore-secret-id"))
+	if s.key != nil {
+		_, _ = mac.Write([]byte("key:"))
+		_, _ = mac.Write(s.key)
+	} else {
+		_, _ = mac.Write([]byte("passphrase:"))
+		_, _ = mac.Write([]byte(s.passphrase))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newEncryption sets up the encryption of a new backup volume with the secret.
+func newEncryption(secret *encryptionSecret) (*Encryption, error) {
+	raw := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, errors.Wrap(err, "failed to generate the data key")
+	}
+	dataKey, err := newEncryptionKey(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption, err := wrapDataKey(secret, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	addToKeyring(dataKey, secret)
+	return encryption, nil
+}
+
+// wrapDataKey returns the encryption of a backup volume whose data key is
+// wrapped by a new master key derived from the secret.
+func wrapDataKey(secret *encryptionSecret, dataKey *encryptionKey) (*Encryption, error) {
+	encryption := &Encryption{
+		Method: ENCRYPTION_METHOD_AES_256_GCM,
+		KDF:    ENCRYPTION_KDF_NONE,
+	}
+	if secret.passphrase != "" {
+		encryption.KDF = ENCRYPTION_KDF_PBKDF2_SHA256
+		encryption.Iterations = encryptionKDFIterations
+		encryption.Salt = make([]byte, encryptionSaltSize)
+		if _, err := rand.Read(encryption.Salt); err != nil {
+			return nil, errors.Wrap(err, "failed to generate the encryption salt")
+		}
+	}
+
+	masterKey, err := secret.deriveKey(encryption)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := masterKey.seal(dataKey.raw, []byte(dataKeyAdditionalData))
+	if err != nil {
+		return nil, err
+	}
+	encryption.KeyID = masterKey.id
+	encryption.WrappedKey = wrappedKey
+	encryption.DataKeyID = dataKey.id
+	return encryption, nil
+}
+
+// unwrapDataKey returns the key the blocks and configs of the backup volume
+// are encrypted with.
+func (s *encryptionSecret) unwrapDataKey(encryption *Encryption) (*encryptionKey, error) {
+	masterKey, err := s.deriveKey(encryption)
+	if err != nil {
+		return nil, err
+	}
+	if encryption.WrappedKey == nil {
+		return masterKey, nil
+	}
+
+	raw, err := masterKey.open(encryption.WrappedKey, []byte(dataKeyAdditionalData))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unwrap the data key")
+	}
+	dataKey, err := newEncryptionKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey.id != encryption.DataKeyID {
+		return nil, fmt.Errorf("the unwrapped data key doesn't match the one of the backup volume")
+	}
+	return dataKey, nil
+}
+
+// deriveKey returns the master key of the encryption.
+func (s *encryptionSecret) deriveKey(encryption *Encryption) (*encryptionKey, error) {
+	if encryption.Method != ENCRYPTION_METHOD_AES_256_GCM {
+		return nil, fmt.Errorf("unsupported encryption method: %v", encryption.Method)
+	}
+
+	var raw []byte
+	switch encryption.KDF {
+	case ENCRYPTION_KDF_NONE:
+		if s.key == nil {
+			return nil, fmt.Errorf("the backup volume is encrypted with a key, not with a passphrase")
+		}
+		raw = s.key
+	case ENCRYPTION_KDF_PBKDF2_SHA256:
+		if s.passphrase == "" {
+			return nil, fmt.Errorf("the backup volume is encrypted with a passphrase, not with a key")
+		}
+		var err error
+		raw, err = pbkdf2.Key(sha256.New, s.passphrase, encryption.Salt, encryption.Iterations, encryptionKeySize)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to derive the encryption key")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption key derivation function: %v", encryption.KDF)
+	}
+
+	key, err := newEncryptionKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if encryption.KeyID != "" && encryption.KeyID != key.id {
+		return nil, fmt.Errorf("the encryption key doesn't match the one of the backup volume")
+	}
+	return key, nil
+}
+
+func newEncryptionKey(raw []byte) (*encryptionKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, raw)
+	_, _ = mac.Write([]byte("longhorn-backupstore-key-id"))
+	return &encryptionKey{
+		id:   hex.EncodeToString(mac.Sum(nil)[:encryptionKeyIDLen]),
+		raw:  raw,
+		aead: aead,
+	}, nil
+}
+
+// dataKeyID returns the ID of the key the blocks and configs are encrypted
+// with.
+func (e *Encryption) dataKeyID() string {
+	if e.DataKeyID == "" {
+		return e.KeyID
+	}
+	return e.DataKeyID
+}
+
+// reference returns the encryption minus the wrapped data key, which is
+// only kept in the volume config so that rotating the key of the volume
+// doesn't leave copies of it wrapped by the former key around.
+func (e *Encryption) reference() *Encryption {
+	if e == nil {
+		return nil
+	}
+	return &Encryption{
+		Method:    e.Method,
+		DataKeyID: e.dataKeyID(),
+	}
+}
+
+// addToKeyring keeps the key unwrapped with the secret.
+func addToKeyring(key *encryptionKey, secret *encryptionSecret) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	entry := keyring[key.id]
+	if entry == nil {
+		entry = &keyringEntry{key: key, secretIDs: map[string]bool{}}
+		keyring[key.id] = entry
+	}
+	entry.secretIDs[secret.id()] = true
+}
+
+// holdKeyring keeps the key with the ID available to everyone until the
+// returned function is called, whatever the secret of the backup target. It's
+// for the operations given a secret of their own, e.g. in the parameters of a
+// backup.
+func holdKeyring(id string) (release func()) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	entry := keyring[id]
+	if entry == nil {
+		return func() {}
+	}
+	entry.holders++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			keyringMutex.Lock()
+			defer keyringMutex.Unlock()
+			entry.holders--
+		})
+	}
+}
+
+// getFromKeyring returns the key with the ID if it was unwrapped with the
+// secret configured for the backup target, or is held by an operation. The
+// keys unwrapped with another secret are dropped, so that changing or
+// removing the secret of the backup target takes effect at once.
+func getFromKeyring(id string) *encryptionKey {
+	secretID := getConfiguredSecretID()
+
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	entry := keyring[id]
+	if entry == nil {
+		return nil
+	}
+	if entry.holders == 0 && !entry.secretIDs[secretID] {
+		delete(keyring, id)
+		return nil
+	}
+	return entry.key
+}
+
+// getEncryptionKey returns the data key described by the encryption,
+// unwrapping it with the secret configured for the backup target if it's not
+// known yet.
+func getEncryptionKey(encryption *Encryption) (*encryptionKey, error) {
+	if key := getFromKeyring(encryption.dataKeyID()); key != nil {
+		return key, nil
+	}
+	if encryption.KDF == "" {
+		return nil, fmt.Errorf("encryption key %v is not loaded", encryption.dataKeyID())
+	}
+
+	secret, err := getEncryptionSecret(nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("the backup volume is encrypted but no encryption key is configured")
+	}
+	key, err := secret.unwrapDataKey(encryption)
+	if err != nil {
+		return nil, err
+	}
+	addToKeyring(key, secret)
+	return key, nil
+}
+
+// loadEncryption returns how the config is encrypted, or nil if it's not.
+func loadEncryption(ctx context.Context, driver BackupStoreDriver, filePath string) (*Encryption, error) {
+	config := &encryptedConfig{}
+	if err := LoadConfigInBackupStoreWithContext(ctx, driver, filePath, config); err != nil {
+		return nil, err
+	}
+	if config.Ciphertext == nil {
+		return nil, nil
+	}
+	return config.Encryption, nil
+}
+
+// prepareVolumeEncryption makes sure the secret of the backup, if any, is the
+// one of the backup volume, and sets up the encryption of the volume if it
+// doesn't exist yet. The data key is held in the keyring until release is
+// called, the secret of the backup may not be the one of the backup target.
+func prepareVolumeEncryption(ctx context.Context, driver BackupStoreDriver, volume *Volume, parameters map[string]string) (release func(), err error) {
+	secret, err := getEncryptionSecret(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if !volumeExists(ctx, driver, volume.Name) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			// A lost secret must not turn the new volumes of an encrypted
+			// backup target into plaintext ones
+			encrypted, err := hasEncryptedVolume(ctx, driver)
+			if err != nil {
+				return nil, err
+			}
+			if encrypted {
+				return nil, fmt.Errorf("backup target has encrypted backup volumes but no encryption key is configured for the new backup volume %v", volume.Name)
+			}
+			return func() {}, nil
+		}
+		if volume.Encryption, err = newEncryption(secret); err != nil {
+			return nil, err
+		}
+		return holdKeyring(volume.Encryption.dataKeyID()), nil
+	}
+
+	encryption, err := loadEncryption(ctx, driver, getVolumeFilePath(volume.Name))
+	if err != nil {
+		return nil, err
+	}
+	if encryption == nil {
+		// The secret of the backup target doesn't apply to the volumes backed
+		// up before it was configured
+		if parameters[BackupParameterEncryptionKey] != "" || parameters[BackupParameterEncryptionPassphrase] != "" {
+			return nil, fmt.Errorf("backup volume %v is not encrypted", volume.Name)
+		}
+		return func() {}, nil
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("backup volume %v is encrypted but no encryption key is configured", volume.Name)
+	}
+	key, err := secret.unwrapDataKey(encryption)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot encrypt the backup of volume %v", volume.Name)
+	}
+	addToKeyring(key, secret)
+	return holdKeyring(key.id), nil
+}
+
+// hasEncryptedVolume returns whether any backup volume of the backup target is
+// encrypted. It stops at the first one found, so it only lists all the volumes
+// of the targets that are not encrypted.
+func hasEncryptedVolume(ctx context.Context, driver BackupStoreDriver) (bool, error) {
+	if !NewDriverWithContext(driver).FileExistsWithContext(ctx, filepath.Join(backupstoreBase, VOLUME_DIRECTORY)) {
+		return false, ctx.Err()
+	}
+
+	jobQueues := workerpool.New(runtime.NumCPU() * 16)
+	defer jobQueues.StopWait()
+
+	volumeNames, err := getVolumeNames(ctx, jobQueues, driver)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check whether the backup target is encrypted")
+	}
+	for _, name := range volumeNames {
+		encryption, err := loadEncryption(ctx, driver, getVolumeFilePath(name))
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+			// The volume may be being created or deleted
+			log.WithError(err).Warnf("Failed to load the config of backup volume %v", name)
+			continue
+		}
+		if encryption != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadConfigMaybeEncrypted loads a config of the backup volume. Only the
+// volume config records how to unwrap the data key, the other ones are
+// decrypted with the key it provides.
+func loadConfigMaybeEncrypted(ctx context.Context, driver BackupStoreDriver, volumeName, filePath string, v interface{}) error {
+	var raw json.RawMessage
+	if err := LoadConfigInBackupStoreWithContext(ctx, driver, filePath, &raw); err != nil {
+		return err
+	}
+
+	config := &encryptedConfig{}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return err
+	}
+	if config.Ciphertext == nil || config.Encryption == nil {
+		return json.Unmarshal(raw, v)
+	}
+
+	key, err := getConfigKey(ctx, driver, volumeName, config.Encryption)
+	if err != nil {
+		return errors.Wrapf(err, "cannot decrypt %v", filePath)
+	}
+	plaintext, err := key.open(config.Ciphertext, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decrypt %v", filePath)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func getConfigKey(ctx context.Context, driver BackupStoreDriver, volumeName string, encryption *Encryption) (*encryptionKey, error) {
+	if key := getFromKeyring(encryption.dataKeyID()); key != nil {
+		return key, nil
+	}
+
+	volumeEncryption := encryption
+	if encryption.KDF == "" {
+		var err error
+		volumeEncryption, err = loadEncryption(ctx, driver, getVolumeFilePath(volumeName))
+		if err != nil {
+			return nil, err
+		}
+		if volumeEncryption == nil {
+			return nil, fmt.Errorf("backup volume %v is not encrypted", volumeName)
+		}
+	}
+	key, err := getEncryptionKey(volumeEncryption)
+	if err != nil {
+		return nil, err
+	}
+	if key.id != encryption.dataKeyID() {
+		return nil, fmt.Errorf("encryption key %v is not the one of backup volume %v", encryption.dataKeyID(), volumeName)
+	}
+	return key, nil
+}
+
+func saveConfigMaybeEncrypted(ctx context.Context, driver BackupStoreDriver, filePath string, encryption *Encryption, v interface{}) error {
+	if encryption == nil {
+		return SaveConfigInBackupStoreWithContext(ctx, driver, filePath, v)
+	}
+
+	key, err := getEncryptionKey(encryption)
+	if err != nil {
+		return errors.Wrapf(err, "cannot encrypt %v", filePath)
+	}
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := key.seal(plaintext, nil)
+	if err != nil {
+		return err
+	}
+	return SaveConfigInBackupStoreWithContext(ctx, driver, filePath, &encryptedConfig{
+		Encryption: encryption,
+		Ciphertext: ciphertext,
+	})
+}
+
+// seal returns the nonce followed by the ciphertext.
+func (k *encryptionKey) seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(plaintext)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate the nonce")
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (k *encryptionKey) open(data, additionalData []byte) ([]byte, error) {
+	if len(data) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce, ciphertext := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// encryptBlock encrypts the compressed block. The checksum of the block is
+// authenticated along with it, so that a block cannot be passed for another.
+func encryptBlock(encryption *Encryption, rs io.ReadSeeker, checksum string) (io.ReadSeeker, error) {
+	key, err := getEncryptionKey(encryption)
+	if err != nil {
+		return nil, err
+	}
+	id, err := hex.DecodeString(key.id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, blockEncryptionMagic...), id...)
+	sealed, err := key.seal(data, append(append([]byte{}, header...), checksum...))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(append(header, sealed...)), nil
+}
+
+// decryptBlock returns the compressed block out of an encrypted one, using the
+// keys loaded along with the backup volume.
+func decryptBlock(data []byte, checksum string) ([]byte, error) {
+	headerLen := len(blockEncryptionMagic) + encryptionKeyIDLen
+	if len(data) < headerLen {
+		return nil, errors.Wrap(errBlockDecryption, "encrypted block is too short")
+	}
+	header := data[:headerLen]
+	id := hex.EncodeToString(header[len(blockEncryptionMagic):])
+
+	key := getFromKeyring(id)
+	if key == nil {
+		return nil, errors.Wrapf(errBlockDecryption, "encryption key %v is not loaded", id)
+	}
+	plaintext, err := key.open(data[headerLen:], append(append([]byte{}, header...), checksum...))
+	if err != nil {
+		return nil, errors.Wrapf(errBlockDecryption, "%v", err)
+	}
+	return plaintext, nil
+}
+
+// EncryptionSecret is the secret a backup volume is encrypted with, either a
+// base64 encoded 256-bit key or a passphrase, like
+// BackupParameterEncryptionKey and BackupParameterEncryptionPassphrase.
+type EncryptionSecret struct {
+	Key        string
+	Passphrase string
+}
+
+// RotateVolumeKey replaces the secret of an encrypted backup volume.
+//
+// Only the data key is rewrapped, the blocks and the backups are left as they
+// are. Before the volume config is updated, the data key unwrapped by the new
+// secret is checked to be the one every backup config of the volume decrypts
+// with.
+func RotateVolumeKey(volumeURL string, oldSecret, newSecret EncryptionSecret) error {
+	return RotateVolumeKeyWithContext(context.Background(), volumeURL, oldSecret, newSecret)
+}
+
+// RotateVolumeKeyWithContext is RotateVolumeKey, cancelling ctx aborts the
+// rotation.
+func RotateVolumeKeyWithContext(ctx context.Context, volumeURL string, oldSecret, newSecret EncryptionSecret) (err error) {
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return err
+	}
+	if !volumeExists(ctx, driver, volumeName) {
+		return fmt.Errorf("cannot find backup volume %v in backupstore", volumeName)
+	}
+
+	from, err := parseEncryptionSecret(oldSecret.Key, oldSecret.Passphrase)
+	if err != nil {
+		return errors.Wrap(err, "invalid old encryption key")
+	}
+	to, err := parseEncryptionSecret(newSecret.Key, newSecret.Passphrase)
+	if err != nil {
+		return errors.Wrap(err, "invalid new encryption key")
+	}
+	if from == nil || to == nil {
+		return fmt.Errorf("both the old and the new encryption keys are required")
+	}
+	if from.id() == to.id() {
+		return fmt.Errorf("the new encryption key is the same as the old one")
+	}
+
+	// The backups save the volume config as well, they must not overwrite
+	// the new key with the one they loaded
+	lock, err := New(driver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.LockWithContext(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			log.WithError(unlockErr).Warnf("Failed to unlock backup volume %v", volumeName)
+		}
+	}()
+
+	encryption, err := loadEncryption(ctx, driver, getVolumeFilePath(volumeName))
+	if err != nil {
+		return err
+	}
+	if encryption == nil {
+		return fmt.Errorf("backup volume %v is not encrypted", volumeName)
+	}
+	if encryption.WrappedKey == nil {
+		return fmt.Errorf("backup volume %v is encrypted without a data key, its key cannot be rotated", volumeName)
+	}
+	dataKey, err := from.unwrapDataKey(encryption)
+	if err != nil {
+		return errors.Wrapf(err, "cannot unwrap the data key of backup volume %v", volumeName)
+	}
+	addToKeyring(dataKey, from)
+	release := holdKeyring(dataKey.id)
+	defer release()
+
+	volume, err := loadVolume(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	rotated, err := wrapDataKey(to, dataKey)
+	if err != nil {
+		return err
+	}
+	if err := verifyVolumeKey(ctx, driver, volumeName, dataKey, rotated, to); err != nil {
+		return errors.Wrapf(err, "the key of backup volume %v was not rotated", volumeName)
+	}
+
+	volume.Encryption = rotated
+	if err := saveVolume(ctx, driver, volume); err != nil {
+		return err
+	}
+	log.Infof("Rotated the encryption key of backup volume %v", volumeName)
+	return nil
+}
+
+// verifyVolumeKey makes sure that the secret unwraps the data key out of the
+// encryption, and that the configs of all the backups of the volume decrypt
+// with it. The blocks are not read, the data key they are encrypted with
+// doesn't change.
+func verifyVolumeKey(ctx context.Context, driver BackupStoreDriver, volumeName string, dataKey *encryptionKey, encryption *Encryption, secret *encryptionSecret) error {
+	unwrapped, err := secret.unwrapDataKey(encryption)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(unwrapped.raw, dataKey.raw) {
+		return fmt.Errorf("the data key unwrapped with the new encryption key doesn't match")
+	}
+
+	backupNames, err := getBackupNamesForVolume(ctx, driver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(ctx, driver, backupName, volumeName)
+		if err != nil {
+			return err
+		}
+		if isBackupInProgress(backup) {
+			continue
+		}
+		if backup.Encryption == nil || backup.Encryption.dataKeyID() != dataKey.id {
+			return fmt.Errorf("backup %v is not encrypted with the data key of the volume", backupName)
+		}
+	}
+	return ctx.Err()
+}
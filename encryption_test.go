@@ -0,0 +1,437 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+const (
+	testPassphrase = "correct horse battery staple"
+)
+
+// useCheapKDF keeps the tests fast, the key derivation is deliberately slow
+// otherwise. It also starts every test with an empty keyring, as a new process
+// would.
+func useCheapKDF(t *testing.T) {
+	iterations := encryptionKDFIterations
+	encryptionKDFIterations = 1000
+	resetKeyring()
+	t.Cleanup(func() {
+		encryptionKDFIterations = iterations
+		resetKeyring()
+	})
+}
+
+func resetKeyring() {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	keyring = map[string]*keyringEntry{}
+}
+
+func TestEncryptedBackupRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	ops := createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+	assert.Empty(ops.getLastStatus(t).errMessage)
+
+	// Nothing but the encryption header is readable without the key
+	for _, file := range []string{getVolumeFilePath(deltaVolumeName), getBackupConfigPath("backup-1", deltaVolumeName)} {
+		data, err := afero.ReadFile(m.fs, file)
+		assert.NoError(err)
+		assert.Contains(string(data), "Ciphertext")
+		assert.NotContains(string(data), "LastBackupName")
+		assert.NotContains(string(data), "Blocks")
+		assert.NotContains(string(data), testPassphrase)
+	}
+
+	// A restore runs in a process which knows the passphrase through the
+	// backup target only
+	resetKeyring()
+	_, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.ErrorContains(err, "no encryption key is configured")
+
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal("backup-1", volume.LastBackupName)
+	assert.Equal(ENCRYPTION_METHOD_AES_256_GCM, volume.Encryption.Method)
+	assert.Equal(ENCRYPTION_KDF_PBKDF2_SHA256, volume.Encryption.KDF)
+
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(backup.Blocks, 2)
+	// The secret doesn't end up in the backup parameters
+	assert.NotContains(backup.Parameters, BackupParameterEncryptionPassphrase)
+	assert.NotEmpty(backup.Parameters)
+
+	snapshot := make([]byte, deltaBlockSize)
+	for _, blk := range backup.Blocks {
+		blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+		data, err := afero.ReadFile(m.fs, blkFile)
+		assert.NoError(err)
+		header, payload, err := parseBlockHeader(data)
+		assert.NoError(err)
+		assert.Equal(ENCRYPTION_METHOD_AES_256_GCM, header.EncryptionMethod)
+		assert.True(bytes.HasPrefix(payload, blockEncryptionMagic))
+
+		r, err := DecompressAndVerifyWithFallback(context.Background(), m, blkFile, backup.CompressionMethod, blk.BlockChecksum)
+		assert.NoError(err)
+		restored, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.NoError(ops.ReadSnapshot(deltaSnapshotName, deltaVolumeName, blk.Offset, snapshot))
+		assert.Equal(snapshot, restored)
+	}
+}
+
+func TestEncryptedBackupWithKey(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, encryptionKeySize))
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionKey: key,
+	})
+
+	resetKeyring()
+	t.Setenv(types.BackupEncryptionKey, key)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(ENCRYPTION_KDF_NONE, volume.Encryption.KDF)
+	assert.Empty(volume.Encryption.Salt)
+
+	// The next backups are encrypted with the same key
+	createTestBackup(t, deltaVolumeName, "backup-2", nil, map[string]string{
+		BackupParameterEncryptionKey: key,
+	})
+	backup, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(volume.Encryption.DataKeyID, backup.Encryption.DataKeyID)
+	// Only the volume config carries the wrapped data key
+	assert.Nil(backup.Encryption.WrappedKey)
+	assert.NotNil(volume.Encryption.WrappedKey)
+}
+
+func TestEncryptedBackupRejectsWrongSecret(t *testing.T) {
+	useCheapKDF(t)
+
+	newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+
+	testCases := map[string]struct {
+		parameters          map[string]string
+		expectErrorContains string
+	}{
+		"wrong passphrase": {
+			parameters:          map[string]string{BackupParameterEncryptionPassphrase: "wrong"},
+			expectErrorContains: "doesn't match",
+		},
+		"key instead of passphrase": {
+			parameters: map[string]string{
+				BackupParameterEncryptionKey: base64.StdEncoding.EncodeToString(make([]byte, encryptionKeySize)),
+			},
+			expectErrorContains: "encrypted with a passphrase",
+		},
+		"no secret": {
+			parameters:          map[string]string{},
+			expectErrorContains: "no encryption key is configured",
+		},
+		"invalid key": {
+			parameters:          map[string]string{BackupParameterEncryptionKey: "dG9vIHNob3J0"},
+			expectErrorContains: "invalid encryption key size",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ops := newMockDeltaOps()
+			config := newDeltaBackupConfig(ops)
+			for k, v := range testCase.parameters {
+				config.Parameters[k] = v
+			}
+			_, err := CreateDeltaBlockBackup("backup-2", config)
+			assert.ErrorContains(t, err, testCase.expectErrorContains)
+			assert.Equal(t, 0, ops.getOpenCount())
+		})
+	}
+}
+
+func TestKeyringFollowsTheConfiguredSecret(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+
+	// The secret given to the backup isn't left behind for the next
+	// operations
+	_, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.ErrorContains(err, "no encryption key is configured")
+
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	blk := backup.Blocks[0]
+	blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+	_, err = DecompressAndVerifyWithFallback(context.Background(), m, blkFile, backup.CompressionMethod, blk.BlockChecksum)
+	assert.NoError(err)
+
+	// Nor are the keys unwrapped with the secret of another backup target
+	t.Setenv(types.BackupEncryptionPassphrase, "")
+	_, err = DecompressAndVerifyWithFallback(context.Background(), m, blkFile, backup.CompressionMethod, blk.BlockChecksum)
+	assert.ErrorContains(err, "is not loaded")
+	t.Setenv(types.BackupEncryptionPassphrase, "another passphrase")
+	_, err = loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.ErrorContains(err, "doesn't match")
+}
+
+func TestEncryptionCannotBeAddedToExistingVolume(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+
+	ops := newMockDeltaOps()
+	config := newDeltaBackupConfig(ops)
+	config.Parameters[BackupParameterEncryptionPassphrase] = testPassphrase
+	_, err := CreateDeltaBlockBackup("backup-2", config)
+	assert.ErrorContains(err, "is not encrypted")
+
+	// A passphrase configured for the backup target only applies to the new
+	// volumes, the existing ones can still be backed up
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	createTestBackup(t, deltaVolumeName, "backup-2", nil, nil)
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Nil(volume.Encryption)
+	assert.Equal("backup-2", volume.LastBackupName)
+}
+
+func TestNewVolumeIsNotBackedUpInTheClearWithoutTheSecret(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	// A backup target without any encrypted volume takes plaintext backups
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	createTestBackup(t, "encrypted-volume", "backup-2", nil, nil)
+
+	// Losing the secret of the backup target must not create new plaintext
+	// volumes next to the encrypted ones
+	t.Setenv(types.BackupEncryptionPassphrase, "")
+	ops := newMockDeltaOps()
+	config := newDeltaBackupConfig(ops)
+	config.Volume.Name = "new-volume"
+	_, err := CreateDeltaBlockBackup("backup-3", config)
+	assert.ErrorContains(err, "no encryption key is configured for the new backup volume")
+	assert.Equal(0, ops.getOpenCount())
+	assert.False(volumeExists(context.Background(), m, "new-volume"))
+}
+
+func TestDecompressAndVerifyWithFallbackDoesNotRetryDecryption(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	blk := backup.Blocks[0]
+	blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+
+	// A block cannot be passed for another one
+	other := getBlockFilePath(deltaVolumeName, backup.Blocks[1].BlockChecksum)
+	data, err := afero.ReadFile(m.fs, other)
+	assert.NoError(err)
+	assert.NoError(m.Write(blkFile, bytes.NewReader(data)))
+
+	start := time.Now()
+	_, err = DecompressAndVerifyWithFallback(context.Background(), m, blkFile, backup.CompressionMethod, blk.BlockChecksum)
+	assert.ErrorIs(err, errBlockDecryption)
+	assert.Less(time.Since(start), backoffDuration[0])
+
+	// Nor be decrypted without loading its volume first
+	resetKeyring()
+	_, err = DecompressAndVerifyWithFallback(context.Background(), m, other, backup.CompressionMethod, backup.Blocks[1].BlockChecksum)
+	assert.ErrorContains(err, "is not loaded")
+	assert.Less(time.Since(start), backoffDuration[0])
+}
+
+func TestRotateVolumeKey(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+	createTestBackup(t, deltaVolumeName, "backup-2", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	blocks := map[string][]byte{}
+	for _, blk := range backup.Blocks {
+		blkFile := getBlockFilePath(deltaVolumeName, blk.BlockChecksum)
+		blocks[blkFile], err = afero.ReadFile(m.fs, blkFile)
+		assert.NoError(err)
+	}
+
+	volumeURL := EncodeBackupURL("", deltaVolumeName, deltaDriverURL)
+	oldKey := EncryptionSecret{Passphrase: testPassphrase}
+	newKey := EncryptionSecret{
+		Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x24}, encryptionKeySize)),
+	}
+
+	err = RotateVolumeKey(volumeURL, EncryptionSecret{Passphrase: "wrong"}, newKey)
+	assert.ErrorContains(err, "doesn't match")
+	err = RotateVolumeKey(volumeURL, oldKey, EncryptionSecret{})
+	assert.ErrorContains(err, "both the old and the new encryption keys are required")
+	err = RotateVolumeKey(volumeURL, oldKey, oldKey)
+	assert.ErrorContains(err, "the new encryption key is the same as the old one")
+
+	assert.NoError(RotateVolumeKey(volumeURL, oldKey, newKey))
+
+	// The blocks are left untouched
+	for blkFile, data := range blocks {
+		rotated, err := afero.ReadFile(m.fs, blkFile)
+		assert.NoError(err)
+		assert.Equal(data, rotated)
+	}
+
+	// The former secret doesn't unwrap the data key anymore
+	resetKeyring()
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	_, err = loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.ErrorContains(err, "encrypted with a key, not with a passphrase")
+
+	// While the new one restores all the backups
+	resetKeyring()
+	t.Setenv(types.BackupEncryptionPassphrase, "")
+	t.Setenv(types.BackupEncryptionKey, newKey.Key)
+	for _, backupName := range []string{"backup-1", "backup-2"} {
+		backup, err := loadBackup(context.Background(), m, backupName, deltaVolumeName)
+		assert.NoError(err)
+		for _, blk := range backup.Blocks {
+			_, err := DecompressAndVerifyWithFallback(context.Background(), m, getBlockFilePath(deltaVolumeName, blk.BlockChecksum), backup.CompressionMethod, blk.BlockChecksum)
+			assert.NoError(err)
+		}
+	}
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(ENCRYPTION_KDF_NONE, volume.Encryption.KDF)
+	assert.Equal(backup.Encryption.DataKeyID, volume.Encryption.DataKeyID)
+
+	// And backs the volume up again
+	createTestBackup(t, deltaVolumeName, "backup-3", nil, nil)
+	volume, err = loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal("backup-3", volume.LastBackupName)
+}
+
+func TestRotateVolumeKeyVerifiesBackups(t *testing.T) {
+	testCases := map[string]struct {
+		damage              func(t *testing.T, m *deltaMockStoreDriver)
+		expectErrorContains string
+	}{
+		"backup config not decrypting": {
+			damage: func(t *testing.T, m *deltaMockStoreDriver) {
+				backupFile := getBackupConfigPath("backup-1", deltaVolumeName)
+				data, err := afero.ReadFile(m.fs, backupFile)
+				assert.NoError(t, err)
+				config := &encryptedConfig{}
+				assert.NoError(t, json.Unmarshal(data, config))
+				config.Ciphertext[len(config.Ciphertext)-1] ^= 0xff
+				data, err = json.Marshal(config)
+				assert.NoError(t, err)
+				assert.NoError(t, afero.WriteFile(m.fs, backupFile, data, 0644))
+			},
+			expectErrorContains: "failed to decrypt",
+		},
+		"backup of another volume": {
+			damage: func(t *testing.T, m *deltaMockStoreDriver) {
+				createTestBackup(t, "another-volume", "backup-2", nil, map[string]string{
+					BackupParameterEncryptionPassphrase: testPassphrase,
+				})
+				data, err := afero.ReadFile(m.fs, getBackupConfigPath("backup-2", "another-volume"))
+				assert.NoError(t, err)
+				assert.NoError(t, afero.WriteFile(m.fs, getBackupConfigPath("backup-2", deltaVolumeName), data, 0644))
+			},
+			expectErrorContains: "is not the one of backup volume",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			useCheapKDF(t)
+
+			m := newDeltaMockStoreDriver(t)
+			createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+				BackupParameterEncryptionPassphrase: testPassphrase,
+			})
+			testCase.damage(t, m)
+
+			volumeFile := getVolumeFilePath(deltaVolumeName)
+			before, err := afero.ReadFile(m.fs, volumeFile)
+			assert.NoError(err)
+
+			volumeURL := EncodeBackupURL("", deltaVolumeName, deltaDriverURL)
+			err = RotateVolumeKey(volumeURL,
+				EncryptionSecret{Passphrase: testPassphrase},
+				EncryptionSecret{Passphrase: "new passphrase"})
+			assert.ErrorContains(err, testCase.expectErrorContains)
+
+			after, err := afero.ReadFile(m.fs, volumeFile)
+			assert.NoError(err)
+			assert.Equal(before, after)
+		})
+	}
+}
+
+func TestRotateVolumeKeyDoesNotReadTheBlocks(t *testing.T) {
+	assert := assert.New(t)
+	useCheapKDF(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, map[string]string{
+		BackupParameterEncryptionPassphrase: testPassphrase,
+	})
+	t.Setenv(types.BackupEncryptionPassphrase, testPassphrase)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	// The data key the blocks are encrypted with doesn't change, verify or
+	// repair are the ones to tell about the damaged blocks
+	assert.NoError(m.fs.Remove(getBlockFilePath(deltaVolumeName, backup.Blocks[0].BlockChecksum)))
+
+	volumeURL := EncodeBackupURL("", deltaVolumeName, deltaDriverURL)
+	assert.NoError(RotateVolumeKey(volumeURL,
+		EncryptionSecret{Passphrase: testPassphrase},
+		EncryptionSecret{Passphrase: "new passphrase"}))
+}
@@ -0,0 +1,462 @@
+package fault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "fault"})
+
+	// mutex guards the registered drivers as well as the rules
+	mutex   sync.Mutex
+	drivers = map[string]*Driver{}
+)
+
+const (
+	KIND = "fault"
+)
+
+type Operation string
+
+const (
+	OperationFileExists = Operation("FileExists")
+	OperationFileSize   = Operation("FileSize")
+	OperationFileTime   = Operation("FileTime")
+	OperationRemove     = Operation("Remove")
+	OperationRead       = Operation("Read")
+	OperationWrite      = Operation("Write")
+	OperationList       = Operation("List")
+	OperationUpload     = Operation("Upload")
+	OperationDownload   = Operation("Download")
+)
+
+// Rule describes a fault and the calls it is injected into. A call matches
+// the rule if both its operation and its path match, and the fault is
+// injected into the matching calls after the first Skip ones, at most Times
+// times.
+type Rule struct {
+	// Operations limits the rule to these operations, all of them if empty
+	Operations []Operation
+	// Path limits the rule to the paths it matches, all of them if nil
+	Path *regexp.Regexp
+	// Skip is the number of matching calls that pass untouched first
+	Skip int
+	// Times limits how often the fault is injected, 0 means no limit
+	Times int
+
+	// Err fails the call. FileExists, FileSize and FileTime report a missing
+	// file instead, since they have no way to return an error.
+	Err error
+	// Latency delays the call
+	Latency time.Duration
+	// PartialWrite makes Write and Upload store only the first
+	// PartialWriteSize bytes. The call still fails with Err if it's set, and
+	// succeeds otherwise the same way a torn write would.
+	PartialWrite     bool
+	PartialWriteSize int64
+	// StaleList makes List keep returning what it returned for the path the
+	// first time the rule was injected.
+	StaleList bool
+	// ClockSkew is added to the times returned by FileTime
+	ClockSkew time.Duration
+
+	matched  int
+	injected int
+	listings map[string][]string
+}
+
+// Injected returns how many times the fault has been injected.
+func (r *Rule) Injected() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return r.injected
+}
+
+func (r *Rule) matches(op Operation, path string) bool {
+	if len(r.Operations) != 0 {
+		found := false
+		for _, o := range r.Operations {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.Path == nil || r.Path.MatchString(path)
+}
+
+// Driver wraps any backupstore driver and injects the faults described by its
+// rules into the calls going through it, e.g. to check that the callers cope
+// with a flaky backup target.
+type Driver struct {
+	driver  backupstore.BackupStoreDriverWithContext
+	destURL string
+	rules   []*Rule
+}
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	d, exists := drivers[u.Host]
+	if !exists {
+		return nil, fmt.Errorf("no fault injection driver registered as %v", u.Host)
+	}
+	return d, nil
+}
+
+// NewDriver wraps the driver, injecting the faults described by the rules.
+func NewDriver(driver backupstore.BackupStoreDriver, rules ...*Rule) *Driver {
+	return &Driver{
+		driver:  backupstore.NewDriverWithContext(driver),
+		destURL: driver.GetURL(),
+		rules:   rules,
+	}
+}
+
+// Register makes the driver available as fault://name/, for the functions
+// that get their driver from a backup target URL. It returns that URL.
+func Register(name string, d *Driver) (string, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, exists := drivers[name]; exists {
+		return "", fmt.Errorf("fault injection driver %v has already been registered", name)
+	}
+	drivers[name] = d
+	d.destURL = KIND + "://" + name + "/"
+	return d.destURL, nil
+}
+
+// Unregister removes the driver registered as name.
+func Unregister(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(drivers, name)
+}
+
+// AddRules adds the rules after the existing ones.
+func (d *Driver) AddRules(rules ...*Rule) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	d.rules = append(d.rules, rules...)
+}
+
+// ClearRules removes all the rules, the calls go through untouched afterwards.
+func (d *Driver) ClearRules() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	d.rules = nil
+}
+
+// inject returns the rules to be injected into the call, after waiting for
+// their latency, and the error the call has to fail with.
+func (d *Driver) inject(ctx context.Context, op Operation, path string) ([]*Rule, error) {
+	var (
+		rules   []*Rule
+		latency time.Duration
+		err     error
+	)
+
+	mutex.Lock()
+	for _, r := range d.rules {
+		if !r.matches(op, path) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip || (r.Times > 0 && r.injected >= r.Times) {
+			continue
+		}
+		r.injected++
+		rules = append(rules, r)
+		latency += r.Latency
+		if err == nil && r.Err != nil {
+			err = r.Err
+		}
+	}
+	mutex.Unlock()
+
+	if len(rules) != 0 {
+		log.Debugf("Injecting %v faults into %v of %v", len(rules), op, path)
+	}
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return rules, ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	return rules, err
+}
+
+func partialWrite(rules []*Rule) (bool, int64) {
+	for _, r := range rules {
+		if r.PartialWrite {
+			return true, r.PartialWriteSize
+		}
+	}
+	return false, 0
+}
+
+func (d *Driver) Kind() string {
+	return KIND
+}
+
+func (d *Driver) GetURL() string {
+	return d.destURL
+}
+
+func (d *Driver) FileExists(filePath string) bool {
+	return d.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (d *Driver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	if _, err := d.inject(ctx, OperationFileExists, filePath); err != nil {
+		return false
+	}
+	return d.driver.FileExistsWithContext(ctx, filePath)
+}
+
+func (d *Driver) FileSize(filePath string) int64 {
+	return d.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (d *Driver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	if _, err := d.inject(ctx, OperationFileSize, filePath); err != nil {
+		return -1
+	}
+	return d.driver.FileSizeWithContext(ctx, filePath)
+}
+
+func (d *Driver) FileTime(filePath string) time.Time {
+	return d.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (d *Driver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	rules, err := d.inject(ctx, OperationFileTime, filePath)
+	if err != nil {
+		return time.Time{}
+	}
+	t := d.driver.FileTimeWithContext(ctx, filePath)
+	if t.IsZero() {
+		return t
+	}
+	for _, r := range rules {
+		t = t.Add(r.ClockSkew)
+	}
+	return t
+}
+
+func (d *Driver) Remove(path string) error {
+	return d.RemoveWithContext(context.Background(), path)
+}
+
+func (d *Driver) RemoveWithContext(ctx context.Context, path string) error {
+	if _, err := d.inject(ctx, OperationRemove, path); err != nil {
+		return err
+	}
+	return d.driver.RemoveWithContext(ctx, path)
+}
+
+func (d *Driver) RemoveMany(paths []string) error {
+	return d.RemoveManyWithContext(context.Background(), paths)
+}
+
+// RemoveManyWithContext injects the faults of OperationRemove for each file,
+// and removes the other files with the capability of the wrapped driver if it
+// has it.
+func (d *Driver) RemoveManyWithContext(ctx context.Context, paths []string) error {
+	failures := map[string]error{}
+	remaining := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if _, err := d.inject(ctx, OperationRemove, path); err != nil {
+			failures[path] = err
+			continue
+		}
+		remaining = append(remaining, path)
+	}
+
+	err := backupstore.RemoveManyWithContext(ctx, d.driver, remaining)
+	if len(failures) == 0 {
+		return err
+	}
+	if removeErr, ok := err.(*backupstore.RemoveManyError); ok {
+		for path, err := range removeErr.Failures {
+			failures[path] = err
+		}
+	}
+	return &backupstore.RemoveManyError{Failures: failures}
+}
+
+func (d *Driver) Read(src string) (io.ReadCloser, error) {
+	return d.ReadWithContext(context.Background(), src)
+}
+
+func (d *Driver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	if _, err := d.inject(ctx, OperationRead, src); err != nil {
+		return nil, err
+	}
+	return d.driver.ReadWithContext(ctx, src)
+}
+
+func (d *Driver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	return d.ReadRangeWithContext(context.Background(), src, offset, length)
+}
+
+// ReadRangeWithContext injects the faults of OperationRead, and reads the
+// range with the capability of the wrapped driver if it has it.
+func (d *Driver) ReadRangeWithContext(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
+	if _, err := d.inject(ctx, OperationRead, src); err != nil {
+		return nil, err
+	}
+	return backupstore.ReadRangeWithContext(ctx, d.driver, src, offset, length)
+}
+
+func (d *Driver) Write(dst string, rs io.ReadSeeker) error {
+	return d.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (d *Driver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	rules, err := d.inject(ctx, OperationWrite, dst)
+	partial, size := partialWrite(rules)
+	if !partial {
+		if err != nil {
+			return err
+		}
+		return d.driver.WriteWithContext(ctx, dst, rs)
+	}
+	return d.writePartially(ctx, dst, rs, size, err)
+}
+
+func (d *Driver) WriteStream(dst string, r io.Reader, size int64) error {
+	return d.WriteStreamWithContext(context.Background(), dst, r, size)
+}
+
+// WriteStreamWithContext injects the faults of OperationWrite, and writes the
+// stream with the capability of the wrapped driver if it has it.
+func (d *Driver) WriteStreamWithContext(ctx context.Context, dst string, r io.Reader, size int64) error {
+	rules, err := d.inject(ctx, OperationWrite, dst)
+	partial, partialSize := partialWrite(rules)
+	if !partial {
+		if err != nil {
+			return err
+		}
+		return backupstore.WriteStreamWithContext(ctx, d.driver, dst, r, size)
+	}
+	return d.writePartially(ctx, dst, r, partialSize, err)
+}
+
+func (d *Driver) writePartially(ctx context.Context, dst string, r io.Reader, size int64, injectedErr error) error {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if err := d.driver.WriteWithContext(ctx, dst, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return injectedErr
+}
+
+func (d *Driver) List(path string) ([]string, error) {
+	return d.ListWithContext(context.Background(), path)
+}
+
+func (d *Driver) ListWithContext(ctx context.Context, path string) ([]string, error) {
+	rules, err := d.inject(ctx, OperationList, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale *Rule
+	for _, r := range rules {
+		if r.StaleList {
+			stale = r
+			break
+		}
+	}
+	if stale != nil {
+		mutex.Lock()
+		names, cached := stale.listings[path]
+		mutex.Unlock()
+		if cached {
+			return append([]string{}, names...), nil
+		}
+	}
+
+	names, err := d.driver.ListWithContext(ctx, path)
+	if err != nil || stale == nil {
+		return names, err
+	}
+
+	mutex.Lock()
+	if stale.listings == nil {
+		stale.listings = map[string][]string{}
+	}
+	stale.listings[path] = append([]string{}, names...)
+	mutex.Unlock()
+	return names, nil
+}
+
+func (d *Driver) Upload(src, dst string) error {
+	return d.UploadWithContext(context.Background(), src, dst)
+}
+
+func (d *Driver) UploadWithContext(ctx context.Context, src, dst string) error {
+	rules, err := d.inject(ctx, OperationUpload, dst)
+	partial, size := partialWrite(rules)
+	if !partial {
+		if err != nil {
+			return err
+		}
+		return d.driver.UploadWithContext(ctx, src, dst)
+	}
+
+	file, openErr := os.Open(src)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return d.writePartially(ctx, dst, file, size, err)
+}
+
+func (d *Driver) Download(src, dst string) error {
+	return d.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (d *Driver) DownloadWithContext(ctx context.Context, src, dst string) error {
+	if _, err := d.inject(ctx, OperationDownload, src); err != nil {
+		return err
+	}
+	return d.driver.DownloadWithContext(ctx, src, dst)
+}
@@ -0,0 +1,491 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	lhbackup "github.com/longhorn/go-common-libs/backup"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/mem"
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	testVolumeName = "pvc-fault-1"
+	testBlockSize  = int64(4096)
+)
+
+var errInjected = errors.New("injected fault")
+
+// newTestDriver wraps an in-memory backupstore, reachable through the returned
+// fault:// URL.
+func newTestDriver(t *testing.T, rules ...*Rule) (*Driver, backupstore.BackupStoreDriver, string) {
+	t.Helper()
+
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	memURL := "mem://" + name + "/"
+	inner, err := backupstore.GetBackupStoreDriver(memURL)
+	if err != nil {
+		t.Fatalf("failed to initialize the in-memory driver: %v", err)
+	}
+
+	d := NewDriver(inner, rules...)
+	destURL, err := Register(name, d)
+	if err != nil {
+		t.Fatalf("failed to register the fault injection driver: %v", err)
+	}
+	t.Cleanup(func() {
+		Unregister(name)
+		_ = mem.DeleteStore(memURL)
+	})
+	return d, inner, destURL
+}
+
+func TestRuleMatching(t *testing.T) {
+	assert := assert.New(t)
+
+	rule := &Rule{
+		Operations: []Operation{OperationRead},
+		Path:       regexp.MustCompile(`\.blk$`),
+		Skip:       1,
+		Times:      2,
+		Err:        errInjected,
+	}
+	d, _, _ := newTestDriver(t, rule)
+	assert.NoError(d.Write("blocks/a.blk", strings.NewReader("a")))
+	assert.NoError(d.Write("volume.cfg", strings.NewReader("{}")))
+
+	// Other paths and operations are left alone
+	_, err := d.Read("volume.cfg")
+	assert.NoError(err)
+	assert.True(d.FileExists("blocks/a.blk"))
+
+	var errs []error
+	for i := 0; i < 4; i++ {
+		_, err := d.Read("blocks/a.blk")
+		errs = append(errs, err)
+	}
+	assert.NoError(errs[0])
+	assert.ErrorIs(errs[1], errInjected)
+	assert.ErrorIs(errs[2], errInjected)
+	assert.NoError(errs[3])
+	assert.Equal(2, rule.Injected())
+
+	d.ClearRules()
+	d.AddRules(&Rule{Err: errInjected})
+	assert.False(d.FileExists("volume.cfg"))
+	assert.Equal(int64(-1), d.FileSize("volume.cfg"))
+	assert.True(d.FileTime("volume.cfg").IsZero())
+	assert.ErrorIs(d.Remove("volume.cfg"), errInjected)
+}
+
+func TestLatencyHonoursContext(t *testing.T) {
+	assert := assert.New(t)
+
+	d, _, _ := newTestDriver(t, &Rule{Operations: []Operation{OperationList}, Latency: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := d.ListWithContext(ctx, "")
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	d.ClearRules()
+	d.AddRules(&Rule{Operations: []Operation{OperationList}, Latency: 50 * time.Millisecond})
+	start := time.Now()
+	_, err = d.List("")
+	assert.NoError(err)
+	assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+}
+
+func TestPartialWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	d, inner, _ := newTestDriver(t,
+		&Rule{Path: regexp.MustCompile(`torn`), PartialWrite: true, PartialWriteSize: 3},
+		&Rule{Path: regexp.MustCompile(`failed`), PartialWrite: true, PartialWriteSize: 3, Err: errInjected},
+	)
+
+	// A torn write looks successful
+	assert.NoError(d.Write("torn.cfg", strings.NewReader("0123456789")))
+	assert.Equal(int64(3), inner.FileSize("torn.cfg"))
+
+	assert.ErrorIs(d.Write("failed.cfg", strings.NewReader("0123456789")), errInjected)
+	assert.Equal(int64(3), inner.FileSize("failed.cfg"))
+
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NoError(os.WriteFile(src, []byte("0123456789"), 0600))
+	assert.NoError(d.Upload(src, "torn.img"))
+	assert.Equal(int64(3), inner.FileSize("torn.img"))
+}
+
+func TestStaleList(t *testing.T) {
+	assert := assert.New(t)
+
+	d, _, _ := newTestDriver(t, &Rule{Operations: []Operation{OperationList}, StaleList: true})
+	assert.NoError(d.Write("backups/backup_a.cfg", strings.NewReader("{}")))
+
+	names, err := d.List("backups")
+	assert.NoError(err)
+	assert.Equal([]string{"backup_a.cfg"}, names)
+
+	assert.NoError(d.Write("backups/backup_b.cfg", strings.NewReader("{}")))
+	assert.NoError(d.Remove("backups/backup_a.cfg"))
+	names, err = d.List("backups")
+	assert.NoError(err)
+	assert.Equal([]string{"backup_a.cfg"}, names)
+
+	d.ClearRules()
+	names, err = d.List("backups")
+	assert.NoError(err)
+	assert.Equal([]string{"backup_b.cfg"}, names)
+}
+
+func TestClockSkew(t *testing.T) {
+	d, inner, _ := newTestDriver(t, &Rule{Operations: []Operation{OperationFileTime}, ClockSkew: -time.Hour})
+	assert.NoError(t, d.Write("locks/lock-1.lck", strings.NewReader("{}")))
+
+	assert.Equal(t, inner.FileTime("locks/lock-1.lck").Add(-time.Hour), d.FileTime("locks/lock-1.lck"))
+	// Missing files stay missing
+	assert.True(t, d.FileTime("locks/missing.lck").IsZero())
+}
+
+func TestReadRange(t *testing.T) {
+	assert := assert.New(t)
+
+	d, _, _ := newTestDriver(t, &Rule{Operations: []Operation{OperationRead}, Times: 1, Err: errInjected})
+	assert.NoError(d.Write("packs/pack-1.pack", strings.NewReader("0123456789")))
+
+	_, err := d.ReadRange("packs/pack-1.pack", 2, 3)
+	assert.ErrorIs(err, errInjected)
+
+	rc, err := d.ReadRange("packs/pack-1.pack", 2, 3)
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal([]byte("234"), data)
+}
+
+func TestRemoveManyReportsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	rule := &Rule{Operations: []Operation{OperationRemove}, Path: regexp.MustCompile(`blk-2`), Err: errInjected}
+	d, inner, _ := newTestDriver(t, rule)
+	paths := []string{"blocks/blk-1.blk", "blocks/blk-2.blk", "blocks/blk-3.blk"}
+	for _, path := range paths {
+		assert.NoError(d.Write(path, strings.NewReader("block")))
+	}
+
+	err := d.RemoveMany(append(paths, "blocks/missing.blk"))
+	var removeErr *backupstore.RemoveManyError
+	assert.ErrorAs(err, &removeErr)
+	assert.Equal([]string{"blocks/blk-2.blk"}, removeErr.FailedPaths())
+	assert.ErrorIs(removeErr.Failures["blocks/blk-2.blk"], errInjected)
+
+	assert.False(inner.FileExists("blocks/blk-1.blk"))
+	assert.True(inner.FileExists("blocks/blk-2.blk"))
+	assert.False(inner.FileExists("blocks/blk-3.blk"))
+}
+
+func TestRegisterExposesDriverByURL(t *testing.T) {
+	assert := assert.New(t)
+
+	d, _, destURL := newTestDriver(t)
+	assert.Equal(destURL, d.GetURL())
+
+	driver, err := backupstore.GetBackupStoreDriver(destURL)
+	assert.NoError(err)
+	assert.Same(d, driver)
+
+	_, err = Register(strings.TrimSuffix(strings.TrimPrefix(destURL, KIND+"://"), "/"), d)
+	assert.Error(err)
+
+	_, err = backupstore.GetBackupStoreDriver("fault://unknown/")
+	assert.ErrorContains(err, "no fault injection driver")
+}
+
+func TestBlockReadIsRetried(t *testing.T) {
+	assert := assert.New(t)
+
+	rule := &Rule{Operations: []Operation{OperationRead}, Times: 1, Err: errInjected}
+	d, _, _ := newTestDriver(t, rule)
+
+	data := []byte(strings.Repeat("block", 100))
+	rs, err := util.CompressData("lz4", data)
+	assert.NoError(err)
+	assert.NoError(d.Write("blocks/a.blk", rs))
+
+	r, err := backupstore.DecompressAndVerifyWithFallback(context.Background(), d, "blocks/a.blk", "lz4", util.GetChecksum(data))
+	assert.NoError(err)
+	restored, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(data, restored)
+	assert.Equal(1, rule.Injected())
+}
+
+func TestBlockReadRetryStopsOnCancelledContext(t *testing.T) {
+	d, _, _ := newTestDriver(t, &Rule{Operations: []Operation{OperationRead}, Err: errInjected})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := backupstore.DecompressAndVerifyWithFallback(ctx, d, "blocks/a.blk", "lz4", "checksum")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// testDeltaOps backs up a volume of 4 blocks, of which the snapshot changed
+// the first and the third one.
+type testDeltaOps struct {
+	fill byte
+
+	mutex        sync.Mutex
+	lastURL      string
+	lastErrorMsg string
+	closed       chan struct{}
+}
+
+func (ops *testDeltaOps) HasSnapshot(id, volumeID string) bool {
+	return true
+}
+
+func (ops *testDeltaOps) CompareSnapshot(id, compareID, volumeID string, blockSize int64) (*types.Mappings, error) {
+	return &types.Mappings{
+		BlockSize: testBlockSize,
+		Mappings: []types.Mapping{
+			{Offset: 0, Size: testBlockSize},
+			{Offset: 2 * testBlockSize, Size: testBlockSize},
+		},
+	}, nil
+}
+
+func (ops *testDeltaOps) OpenSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (ops *testDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	for i := range data {
+		data[i] = ops.fill + byte(start/testBlockSize)
+	}
+	return nil
+}
+
+func (ops *testDeltaOps) CloseSnapshot(id, volumeID string) error {
+	close(ops.closed)
+	return nil
+}
+
+func (ops *testDeltaOps) UpdateBackupStatus(id, volumeID string, backupState string, backupProgress int, backupURL string, errMessage string) error {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	ops.lastURL = backupURL
+	ops.lastErrorMsg = errMessage
+	return nil
+}
+
+// createBackup creates a backup and waits for it to finish, returning the
+// backup URL or the error message it ended with.
+func createBackup(t *testing.T, destURL, snapshotName string, fill byte) (string, string) {
+	t.Helper()
+
+	ops := &testDeltaOps{fill: fill, closed: make(chan struct{})}
+	config := &backupstore.DeltaBackupConfig{
+		Volume: &backupstore.Volume{
+			Name:              testVolumeName,
+			Size:              4 * testBlockSize,
+			CompressionMethod: "lz4",
+			DataEngine:        string(backupstore.DataEngineV1),
+		},
+		Snapshot: &backupstore.Snapshot{
+			Name:        snapshotName,
+			CreatedTime: util.Now(),
+		},
+		DestURL:         destURL,
+		DeltaOps:        ops,
+		ConcurrentLimit: 1,
+		Parameters: map[string]string{
+			lhbackup.LonghornBackupParameterBackupBlockSize: fmt.Sprint(testBlockSize),
+		},
+	}
+	if _, err := backupstore.CreateDeltaBlockBackup(util.GenerateName("backup"), config); err != nil {
+		return "", err.Error()
+	}
+
+	select {
+	case <-ops.closed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for the backup to finish")
+	}
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	return ops.lastURL, ops.lastErrorMsg
+}
+
+// countFiles counts the files with the suffix below the path.
+func countFiles(t *testing.T, driver backupstore.BackupStoreDriver, path, suffix string) int {
+	t.Helper()
+
+	if driver.FileExists(path) {
+		if strings.HasSuffix(path, suffix) {
+			return 1
+		}
+		return 0
+	}
+	names, err := driver.List(path)
+	if err != nil {
+		t.Fatalf("failed to list %v: %v", path, err)
+	}
+	count := 0
+	for _, name := range names {
+		count += countFiles(t, driver, filepath.Join(path, name), suffix)
+	}
+	return count
+}
+
+// setupBackups creates 2 backups of the volume, which don't share any block.
+func setupBackups(t *testing.T, destURL string) (string, string) {
+	t.Helper()
+
+	backupURL1, errMsg := createBackup(t, destURL, "snap-1", 1)
+	if errMsg != "" {
+		t.Fatalf("failed to create the first backup: %v", errMsg)
+	}
+	backupURL2, errMsg := createBackup(t, destURL, "snap-2", 11)
+	if errMsg != "" {
+		t.Fatalf("failed to create the second backup: %v", errMsg)
+	}
+	return backupURL1, backupURL2
+}
+
+func TestBackupFailsOnBlockWriteFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	d, inner, destURL := newTestDriver(t)
+	d.AddRules(&Rule{Operations: []Operation{OperationWrite}, Path: regexp.MustCompile(`\.blk$`), Err: errInjected})
+
+	backupURL, errMsg := createBackup(t, destURL, "snap-1", 1)
+	assert.Empty(backupURL)
+	assert.Contains(errMsg, errInjected.Error())
+
+	// The lock is released, while the backup stays behind in progress
+	assert.Equal(0, countFiles(t, inner, "backupstore", backupstore.LOCK_SUFFIX))
+	assert.Equal(1, countFiles(t, inner, "backupstore", ".cfg")-countFiles(t, inner, "backupstore", backupstore.VOLUME_CONFIG_FILE))
+
+	// The target recovers
+	d.ClearRules()
+	backupURL, errMsg = createBackup(t, destURL, "snap-1", 1)
+	assert.Empty(errMsg)
+	assert.NotEmpty(backupURL)
+	assert.Equal(2, countFiles(t, inner, "backupstore", ".blk"))
+}
+
+func TestDeleteBackupRemovesUnreferencedBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	_, inner, destURL := newTestDriver(t)
+	backupURL1, backupURL2 := setupBackups(t, destURL)
+	assert.Equal(4, countFiles(t, inner, "backupstore", ".blk"))
+
+	assert.NoError(backupstore.DeleteDeltaBlockBackup(backupURL1))
+	assert.Equal(2, countFiles(t, inner, "backupstore", ".blk"))
+
+	_, err := backupstore.InspectBackup(backupURL2)
+	assert.NoError(err)
+}
+
+func TestGCSafetyChecks(t *testing.T) {
+	testCases := map[string]struct {
+		rule *Rule
+
+		expectErrorContains string
+		expectBlockCount    int
+	}{
+		"listing the backups fails": {
+			rule:             &Rule{Operations: []Operation{OperationList}, Path: regexp.MustCompile(`/backups/?$`), Times: 1, Err: errInjected},
+			expectBlockCount: 4,
+		},
+		"the backups change during GC": {
+			// The second listing is the one checking for new backups
+			rule:             &Rule{Operations: []Operation{OperationList}, Path: regexp.MustCompile(`/backups/?$`), Skip: 1, Times: 1, Err: errInjected},
+			expectBlockCount: 4,
+		},
+		"a remaining backup can't be loaded": {
+			rule:             &Rule{Operations: []Operation{OperationRead}, Path: regexp.MustCompile(`/backups/backup_`), Err: errInjected},
+			expectBlockCount: 4,
+		},
+		"removing a block fails": {
+			rule:                &Rule{Operations: []Operation{OperationRemove}, Path: regexp.MustCompile(`\.blk$`), Times: 1, Err: errInjected},
+			expectErrorContains: "failed to delete backup blocks",
+			expectBlockCount:    3,
+		},
+		"the target is slow": {
+			rule:             &Rule{Latency: time.Millisecond},
+			expectBlockCount: 2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// Every lock takes a while to acquire
+			t.Parallel()
+			assert := assert.New(t)
+
+			d, inner, destURL := newTestDriver(t)
+			backupURL1, backupURL2 := setupBackups(t, destURL)
+
+			d.AddRules(tc.rule)
+			err := backupstore.DeleteDeltaBlockBackup(backupURL1)
+			if tc.expectErrorContains != "" {
+				assert.ErrorContains(err, tc.expectErrorContains)
+			} else {
+				assert.NoError(err)
+			}
+			assert.Equal(tc.expectBlockCount, countFiles(t, inner, "backupstore", ".blk"))
+
+			// The blocks of the remaining backup must survive whatever happened
+			d.ClearRules()
+			_, err = backupstore.InspectBackup(backupURL2)
+			assert.NoError(err)
+			assert.Equal(0, countFiles(t, inner, "backupstore", backupstore.LOCK_SUFFIX))
+		})
+	}
+}
+
+func TestLockToleratesClockSkew(t *testing.T) {
+	testCases := map[string]time.Duration{
+		"server clock ahead":  time.Hour,
+		"server clock behind": -backupstore.LOCK_DURATION / 2,
+	}
+
+	for name, skew := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+
+			d, _, _ := newTestDriver(t)
+			d.AddRules(&Rule{Operations: []Operation{OperationFileTime}, ClockSkew: skew})
+
+			deletionLock, err := backupstore.New(d, testVolumeName, backupstore.DELETION_LOCK)
+			assert.NoError(err)
+			assert.NoError(deletionLock.Lock())
+			defer func() {
+				_ = deletionLock.Unlock()
+			}()
+
+			backupLock, err := backupstore.New(d, testVolumeName, backupstore.BACKUP_LOCK)
+			assert.NoError(err)
+			assert.ErrorContains(backupLock.Lock(), "failed to acquire lock")
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package fsops
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
@@ -34,6 +35,13 @@ func (f *FileSystemOperator) preparePath(file string) error {
 }
 
 func (f *FileSystemOperator) FileSize(filePath string) int64 {
+	return f.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (f *FileSystemOperator) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	if ctx.Err() != nil {
+		return -1
+	}
 	file := f.LocalPath(filePath)
 	st, err := os.Stat(file)
 	if err != nil || st.IsDir() {
@@ -43,6 +51,13 @@ func (f *FileSystemOperator) FileSize(filePath string) int64 {
 }
 
 func (f *FileSystemOperator) FileTime(filePath string) time.Time {
+	return f.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (f *FileSystemOperator) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
 	file := f.LocalPath(filePath)
 	st, err := os.Stat(file)
 	if err != nil || st.IsDir() {
@@ -53,10 +68,21 @@ func (f *FileSystemOperator) FileTime(filePath string) time.Time {
 }
 
 func (f *FileSystemOperator) FileExists(filePath string) bool {
-	return f.FileSize(filePath) >= 0
+	return f.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (f *FileSystemOperator) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return f.FileSizeWithContext(ctx, filePath) >= 0
 }
 
 func (f *FileSystemOperator) Remove(path string) error {
+	return f.RemoveWithContext(context.Background(), path)
+}
+
+func (f *FileSystemOperator) RemoveWithContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := os.RemoveAll(f.LocalPath(path)); err != nil {
 		return err
 	}
@@ -77,6 +103,13 @@ func (f *FileSystemOperator) Remove(path string) error {
 }
 
 func (f *FileSystemOperator) Read(src string) (io.ReadCloser, error) {
+	return f.ReadWithContext(context.Background(), src)
+}
+
+func (f *FileSystemOperator) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	file, err := os.Open(f.LocalPath(src))
 	if err != nil {
 		return nil, err
@@ -84,7 +117,44 @@ func (f *FileSystemOperator) Read(src string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+func (f *FileSystemOperator) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	return f.ReadRangeWithContext(context.Background(), src, offset, length)
+}
+
+func (f *FileSystemOperator) ReadRangeWithContext(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(f.LocalPath(src))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
 func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
+	return f.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (f *FileSystemOperator) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	return f.WriteStreamWithContext(ctx, dst, rs, -1)
+}
+
+func (f *FileSystemOperator) WriteStream(dst string, r io.Reader, size int64) error {
+	return f.WriteStreamWithContext(context.Background(), dst, r, size)
+}
+
+func (f *FileSystemOperator) WriteStreamWithContext(ctx context.Context, dst string, r io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	// we append the timestamp to the tmp files so that we should never have 2 backups using the same tmp file
 	tmpFile := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
 	if err := f.preparePath(dst); err != nil {
@@ -95,9 +165,10 @@ func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
 		return err
 	}
 
-	_, err = io.Copy(file, rs)
+	_, err = io.Copy(file, r)
 	if err != nil {
 		_ = file.Close()
+		_ = os.Remove(f.LocalPath(tmpFile))
 		return err
 	}
 
@@ -107,11 +178,21 @@ func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
 		return err
 	}
 
+	// don't publish the file if the write got cancelled in the meantime
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(f.LocalPath(tmpFile))
+		return err
+	}
+
 	return os.Rename(f.LocalPath(tmpFile), f.LocalPath(dst))
 }
 
 func (f *FileSystemOperator) List(path string) ([]string, error) {
-	out, err := util.Execute("ls", []string{"-1", f.LocalPath(path)})
+	return f.ListWithContext(context.Background(), path)
+}
+
+func (f *FileSystemOperator) ListWithContext(ctx context.Context, path string) ([]string, error) {
+	out, err := util.ExecuteWithContext(ctx, "ls", []string{"-1", f.LocalPath(path)})
 	if err != nil &&
 		!strings.Contains(err.Error(), "No such file or directory") &&
 		!strings.Contains(err.Error(), "cannot open directory") {
@@ -126,24 +207,32 @@ func (f *FileSystemOperator) List(path string) ([]string, error) {
 }
 
 func (f *FileSystemOperator) Upload(src, dst string) error {
+	return f.UploadWithContext(context.Background(), src, dst)
+}
+
+func (f *FileSystemOperator) UploadWithContext(ctx context.Context, src, dst string) error {
 	tmpDst := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
-	if f.FileExists(tmpDst) {
-		if err := f.Remove(tmpDst); err != nil {
+	if f.FileExistsWithContext(ctx, tmpDst) {
+		if err := f.RemoveWithContext(ctx, tmpDst); err != nil {
 			logrus.WithError(err).Warnf("Failed to remove tmp file %s", tmpDst)
 		}
 	}
 	if err := f.preparePath(dst); err != nil {
 		return err
 	}
-	_, err := util.Execute("cp", []string{src, f.LocalPath(tmpDst)})
+	_, err := util.ExecuteWithContext(ctx, "cp", []string{src, f.LocalPath(tmpDst)})
 	if err != nil {
 		return err
 	}
-	_, err = util.Execute("mv", []string{f.LocalPath(tmpDst), f.LocalPath(dst)})
+	_, err = util.ExecuteWithContext(ctx, "mv", []string{f.LocalPath(tmpDst), f.LocalPath(dst)})
 	return err
 }
 
 func (f *FileSystemOperator) Download(src, dst string) error {
-	_, err := util.Execute("cp", []string{f.LocalPath(src), dst})
+	return f.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (f *FileSystemOperator) DownloadWithContext(ctx context.Context, src, dst string) error {
+	_, err := util.ExecuteWithContext(ctx, "cp", []string{f.LocalPath(src), dst})
 	return err
 }
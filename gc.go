@@ -0,0 +1,244 @@
+package backupstore
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gammazero/workerpool"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// DefaultGCConcurrentLimit is the number of listing and removal requests
+	// GC keeps in flight by default.
+	DefaultGCConcurrentLimit = 16
+
+	// gcRemoveBatchSize is the number of blocks removed per request by the
+	// drivers with the BackupStoreDriverBatchRemover capability, the limit of
+	// an S3 multi-object delete.
+	gcRemoveBatchSize = 1000
+)
+
+type GCStage string
+
+const (
+	GCStageList   = GCStage("list")
+	GCStageRemove = GCStage("remove")
+)
+
+// GCProgress reports the progress of a stage of the garbage collection of the
+// blocks. Done and Total count the block directories while listing them, and
+// the blocks while removing them.
+type GCProgress struct {
+	Stage GCStage
+	Done  int
+	Total int
+}
+
+// GCConfig configures the garbage collection of the blocks no longer referenced
+// by any backup.
+type GCConfig struct {
+	// ConcurrentLimit bounds the requests in flight, DefaultGCConcurrentLimit
+	// if not set
+	ConcurrentLimit int32
+	// Progress is called as the blocks are listed and removed, if set. The
+	// calls are serialized.
+	Progress func(progress GCProgress)
+}
+
+func (c *GCConfig) concurrentLimit() int32 {
+	if c == nil {
+		return 0
+	}
+	return c.ConcurrentLimit
+}
+
+// boundedWorkers runs jobs on a worker pool of bounded size and keeps the
+// first error, the jobs submitted after it are skipped.
+type boundedWorkers struct {
+	mutex sync.Mutex
+	pool  *workerpool.WorkerPool
+	err   error
+}
+
+// newBoundedWorkers returns workers running up to concurrentLimit jobs at
+// once, DefaultGCConcurrentLimit if not set.
+func newBoundedWorkers(concurrentLimit int32) *boundedWorkers {
+	if concurrentLimit <= 0 {
+		concurrentLimit = DefaultGCConcurrentLimit
+	}
+	return &boundedWorkers{
+		pool: workerpool.New(int(concurrentLimit)),
+	}
+}
+
+// submit runs job unless a job failed already.
+func (w *boundedWorkers) submit(ctx context.Context, job func() error) {
+	w.pool.Submit(func() {
+		if w.failed() {
+			return
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = job()
+		}
+		if err != nil {
+			w.mutex.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mutex.Unlock()
+		}
+	})
+}
+
+func (w *boundedWorkers) failed() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err != nil
+}
+
+// wait waits for the jobs submitted so far and returns the first error.
+func (w *boundedWorkers) wait() error {
+	w.pool.StopWait()
+	return w.err
+}
+
+// gcTracker runs the jobs of a GC stage on bounded workers and reports the
+// progress.
+type gcTracker struct {
+	*boundedWorkers
+	config   *GCConfig
+	progress GCProgress
+}
+
+func newGCTracker(config *GCConfig, stage GCStage, total int) *gcTracker {
+	return &gcTracker{
+		boundedWorkers: newBoundedWorkers(config.concurrentLimit()),
+		config:         config,
+		progress: GCProgress{
+			Stage: stage,
+			Total: total,
+		},
+	}
+}
+
+// done records the progress of the jobs, the callback is called under the
+// lock so that the calls are serialized.
+func (t *gcTracker) done(count int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Done += count
+	if t.config != nil && t.config.Progress != nil {
+		t.config.Progress(t.progress)
+	}
+}
+
+// ListBlockNames returns the checksums of the blocks stored under
+// blockPathBase in its two levels of directories, listing the directories in
+// parallel.
+func ListBlockNames(ctx context.Context, driver BackupStoreDriver, blockPathBase string, config *GCConfig) ([]string, error) {
+	names := []string{}
+	d := NewDriverWithContext(driver)
+	lv1Dirs, err := d.ListWithContext(ctx, blockPathBase)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// Directory doesn't exist
+		return names, nil
+	}
+
+	var mutex sync.Mutex
+	var lv2Paths []string
+	tracker := newGCTracker(config, GCStageList, 0)
+	for _, lv1 := range lv1Dirs {
+		lv1Path := filepath.Join(blockPathBase, lv1)
+		tracker.submit(ctx, func() error {
+			lv2Dirs, err := d.ListWithContext(ctx, lv1Path)
+			if err != nil {
+				return errors.Wrapf(err, "failed to list block dirs for path %v", lv1Path)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, lv2 := range lv2Dirs {
+				lv2Paths = append(lv2Paths, filepath.Join(lv1Path, lv2))
+			}
+			return nil
+		})
+	}
+	if err := tracker.wait(); err != nil {
+		return nil, err
+	}
+
+	tracker = newGCTracker(config, GCStageList, len(lv2Paths))
+	for _, lv2Path := range lv2Paths {
+		tracker.submit(ctx, func() error {
+			blockNames, err := d.ListWithContext(ctx, lv2Path)
+			if err != nil {
+				return errors.Wrapf(err, "failed to list blocks for path %v", lv2Path)
+			}
+			mutex.Lock()
+			names = append(names, blockNames...)
+			mutex.Unlock()
+			tracker.done(1)
+			return nil
+		})
+	}
+	if err := tracker.wait(); err != nil {
+		return nil, err
+	}
+
+	return util.ExtractNames(names, "", BLK_SUFFIX), nil
+}
+
+// RemoveBlocks removes the block files in parallel, in batches with the drivers
+// having the BackupStoreDriverBatchRemover capability. Like
+// RemoveManyWithContext it returns a *RemoveManyError listing the blocks it
+// failed to remove, unless the context is done first.
+func RemoveBlocks(ctx context.Context, driver BackupStoreDriver, paths []string, config *GCConfig) error {
+	batchSize := 1
+	if canRemoveMany(driver) {
+		batchSize = gcRemoveBatchSize
+	}
+
+	failures := map[string]error{}
+	tracker := newGCTracker(config, GCStageRemove, len(paths))
+	for start := 0; start < len(paths); start += batchSize {
+		batch := paths[start:min(start+batchSize, len(paths))]
+		tracker.submit(ctx, func() error {
+			var removeErr *RemoveManyError
+			if err := RemoveManyWithContext(ctx, driver, batch); errors.As(err, &removeErr) {
+				tracker.mutex.Lock()
+				for path, err := range removeErr.Failures {
+					failures[path] = err
+				}
+				tracker.mutex.Unlock()
+			}
+			tracker.done(len(batch))
+			return nil
+		})
+	}
+	if err := tracker.wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		return &RemoveManyError{Failures: failures}
+	}
+	return nil
+}
+
+func canRemoveMany(driver BackupStoreDriver) bool {
+	if d, ok := driver.(*legacyDriver); ok {
+		driver = d.BackupStoreDriver
+	}
+	_, ok := driver.(BackupStoreDriverBatchRemover)
+	return ok
+}
@@ -0,0 +1,84 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+type gcProgressRecorder struct {
+	sync.Mutex
+	progress map[GCStage][]GCProgress
+}
+
+func (r *gcProgressRecorder) record(progress GCProgress) {
+	r.Lock()
+	defer r.Unlock()
+	r.progress[progress.Stage] = append(r.progress[progress.Stage], progress)
+}
+
+func (r *gcProgressRecorder) last(stage GCStage) GCProgress {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.progress[stage]) == 0 {
+		return GCProgress{}
+	}
+	return r.progress[stage][len(r.progress[stage])-1]
+}
+
+func TestListAndRemoveBlocksInParallel(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	var paths []string
+	var checksums []string
+	for i := 0; i < 100; i++ {
+		checksum := fmt.Sprintf("%064x", i*1009)
+		checksums = append(checksums, checksum)
+		paths = append(paths, getBlockFilePath(deltaVolumeName, checksum))
+		assert.NoError(afero.WriteFile(m.fs, paths[i], []byte("block"), 0644))
+	}
+
+	recorder := &gcProgressRecorder{progress: map[GCStage][]GCProgress{}}
+	config := &GCConfig{ConcurrentLimit: 4, Progress: recorder.record}
+	blockNames, err := ListBlockNames(context.Background(), m, getBlockPath(deltaVolumeName), config)
+	assert.NoError(err)
+	assert.ElementsMatch(checksums, blockNames)
+	listed := recorder.last(GCStageList)
+	assert.Equal(listed.Total, listed.Done)
+	assert.Len(recorder.progress[GCStageList], listed.Total)
+
+	assert.NoError(RemoveBlocks(context.Background(), m, paths[:60], config))
+	assert.Equal(GCProgress{Stage: GCStageRemove, Done: 60, Total: 60}, recorder.last(GCStageRemove))
+	blockNames, err = ListBlockNames(context.Background(), m, getBlockPath(deltaVolumeName), nil)
+	assert.NoError(err)
+	assert.ElementsMatch(checksums[60:], blockNames)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(RemoveBlocks(ctx, m, paths[60:], config), context.Canceled)
+	_, err = ListBlockNames(ctx, m, getBlockPath(deltaVolumeName), config)
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestDeleteBackupReportsGCProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	blockNames, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.NotEmpty(blockNames)
+
+	recorder := &gcProgressRecorder{progress: map[GCStage][]GCProgress{}}
+	assert.NoError(DeleteDeltaBlockBackupWithConfig(context.Background(),
+		EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL), &GCConfig{Progress: recorder.record}))
+	assert.Equal(GCProgress{Stage: GCStageRemove, Done: len(blockNames), Total: len(blockNames)}, recorder.last(GCStageRemove))
+	blockNames, err = getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Empty(blockNames)
+}
@@ -0,0 +1,190 @@
+package backupstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
+)
+
+// GCReport is what deleting a backup would do to the blocks of its volume, as
+// computed by DeleteDeltaBlockBackupDryRun.
+type GCReport struct {
+	BackupName string
+	VolumeName string
+	// SkipReason tells why the blocks wouldn't be deleted, if they wouldn't
+	SkipReason string `json:",omitempty"`
+
+	// BlocksToDelete are the checksums of the blocks that would be deleted,
+	// and ReclaimedSize the size they take in the backupstore
+	BlocksToDelete     []string
+	ReclaimedSize      int64 `json:",string"`
+	RetainedBlockCount int64 `json:",string"`
+	// PacksToRewrite are the packs that would be rewritten with their live
+	// blocks only and PacksToDelete the ones that would be deleted, for the
+	// volumes using pack files. The unused blocks of the other packs stay.
+	PacksToRewrite []string `json:",omitempty"`
+	PacksToDelete  []string `json:",omitempty"`
+
+	// BackupRanges are the ranges of the volume referenced by each of the
+	// remaining backups
+	BackupRanges map[string][]BlockRange
+	// UnknownBlocks are the blocks referenced by the remaining backups that
+	// aren't in the backupstore
+	UnknownBlocks []UnknownBlockReference `json:",omitempty"`
+}
+
+type BlockRange struct {
+	Offset int64 `json:",string"`
+	Size   int64 `json:",string"`
+}
+
+type UnknownBlockReference struct {
+	BackupName    string
+	Offset        int64 `json:",string"`
+	BlockChecksum string
+}
+
+func DeleteDeltaBlockBackupDryRun(backupURL string) (*GCReport, error) {
+	return DeleteDeltaBlockBackupDryRunWithConfig(context.Background(), backupURL, nil)
+}
+
+// DeleteDeltaBlockBackupDryRunWithConfig counts the references to the blocks
+// like DeleteDeltaBlockBackupWithConfig does, and reports what deleting the
+// backup would do without changing anything in the backupstore. It doesn't lock
+// the volume either, a backup or a deletion running meanwhile makes the report
+// stale. For the same reason the packs without an index aren't reported: they
+// may be written by a backup starting meanwhile, while GC deletes the ones
+// failed backups left.
+func DeleteDeltaBlockBackupDryRunWithConfig(ctx context.Context, backupURL string, gcConfig *GCConfig) (*GCReport, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	reportLog := log.WithFields(logrus.Fields{
+		LogFieldBackup: backupName,
+		LogFieldVolume: volumeName,
+	})
+
+	v, err := loadVolume(ctx, bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{
+		BackupName:   backupName,
+		VolumeName:   volumeName,
+		BackupRanges: map[string][]BlockRange{},
+	}
+	refs, err := countVolumeBlockRefs(ctx, bsDriver, v, backupName, false, gcConfig, reportLog, func(backup *Backup, blockInfos map[string]*BlockInfo) {
+		blockSize, err := backup.GetBlockSize()
+		if err != nil {
+			blockSize = DEFAULT_BLOCK_SIZE
+		}
+		report.BackupRanges[backup.Name] = getBackupRanges(backup, blockSize)
+		for _, blk := range backup.Blocks {
+			if !isBlockPresent(blockInfos[blk.BlockChecksum]) {
+				report.UnknownBlocks = append(report.UnknownBlocks, UnknownBlockReference{
+					BackupName:    backup.Name,
+					Offset:        blk.Offset,
+					BlockChecksum: blk.BlockChecksum,
+				})
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.SkipReason = refs.skipReason
+
+	if v.BlockPool && report.SkipReason == "" {
+		// The blocks referenced by the other volumes of the pool stay
+		otherChecksums, err := getOtherVolumesBlockReferences(ctx, bsDriver, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		for checksum := range otherChecksums {
+			if blk, ok := refs.blockInfos[checksum]; ok && !isBlockReferenced(blk) {
+				delete(refs.blockInfos, checksum)
+			}
+		}
+	}
+
+	var paths []string
+	for _, blk := range refs.blockInfos {
+		if isBlockReferenced(blk) && isBlockPresent(blk) {
+			report.RetainedBlockCount++
+		} else if isBlockSafeToDelete(blk) && report.SkipReason == "" && !v.PackFiles {
+			report.BlocksToDelete = append(report.BlocksToDelete, blk.checksum)
+			paths = append(paths, blk.path)
+		}
+	}
+	sort.Strings(report.BlocksToDelete)
+
+	if v.PackFiles {
+		if report.SkipReason == "" {
+			plan := planRepack(v.packs, refs.blockInfos)
+			report.BlocksToDelete = plan.deletedBlocks
+			report.ReclaimedSize = plan.reclaimedSize
+			report.PacksToRewrite = plan.rewrittenPacks
+			report.PacksToDelete = plan.deletedPacks
+		}
+	} else {
+		report.ReclaimedSize, err = getBlocksSize(ctx, bsDriver, paths, gcConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// getBackupRanges returns the ranges of the volume referenced by the backup,
+// the adjacent blocks being merged.
+func getBackupRanges(backup *Backup, blockSize int64) []BlockRange {
+	blocks := append([]BlockMapping{}, backup.Blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+
+	ranges := []BlockRange{}
+	for _, blk := range blocks {
+		size := blk.getSize(blockSize)
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Size == blk.Offset {
+			ranges[n-1].Size += size
+			continue
+		}
+		ranges = append(ranges, BlockRange{Offset: blk.Offset, Size: size})
+	}
+	return ranges
+}
+
+// getBlocksSize returns the total size of the block files, the missing ones
+// being ignored.
+func getBlocksSize(ctx context.Context, driver BackupStoreDriver, paths []string, gcConfig *GCConfig) (int64, error) {
+	d := NewDriverWithContext(driver)
+	var mutex sync.Mutex
+	var total int64
+	// The sizes aren't a stage of GC, the progress isn't reported
+	workers := newBoundedWorkers(gcConfig.concurrentLimit())
+	for _, path := range paths {
+		workers.submit(ctx, func() error {
+			if size := d.FileSizeWithContext(ctx, path); size > 0 {
+				mutex.Lock()
+				total += size
+				mutex.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return 0, err
+	}
+	return total, ctx.Err()
+}
@@ -0,0 +1,137 @@
+package backupstore
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteBackupDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(4*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, nil)
+	// The first half of the volume is shared by the backups
+	changed := append(append([]byte{}, content[:2*deltaBlockSize]...), randomData(2, int(2*deltaBlockSize))...)
+	createTestBackup(t, deltaVolumeName, "backup-2", changed, nil)
+
+	backup1, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	backup2, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	var expectedBlocks []string
+	var expectedSize int64
+	for _, blk := range backup1.Blocks[2:] {
+		expectedBlocks = append(expectedBlocks, blk.BlockChecksum)
+		info, err := m.fs.Stat(getBlockFilePath(deltaVolumeName, blk.BlockChecksum))
+		assert.NoError(err)
+		expectedSize += info.Size()
+	}
+	missing := backup2.Blocks[3]
+	assert.NoError(m.fs.Remove(getBlockFilePath(deltaVolumeName, missing.BlockChecksum)))
+	filesBefore := listFiles(t, m.fs)
+	assert.NotEmpty(filesBefore)
+
+	report, err := DeleteDeltaBlockBackupDryRun(EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL))
+	assert.NoError(err)
+	assert.Empty(report.SkipReason)
+	assert.ElementsMatch(expectedBlocks, report.BlocksToDelete)
+	assert.Equal(expectedSize, report.ReclaimedSize)
+	assert.Equal(int64(3), report.RetainedBlockCount)
+	assert.Equal(map[string][]BlockRange{
+		"backup-2": {{Offset: 0, Size: 4 * deltaBlockSize}},
+	}, report.BackupRanges)
+	assert.Equal([]UnknownBlockReference{{
+		BackupName:    "backup-2",
+		Offset:        missing.Offset,
+		BlockChecksum: missing.BlockChecksum,
+	}}, report.UnknownBlocks)
+
+	// Nothing changed, not even a lock was taken
+	assert.Equal(filesBefore, listFiles(t, m.fs))
+}
+
+func TestDeleteBackupDryRunPackFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	usePackFileSize(t, 4*deltaBlockSize)
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(12*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, packParameters)
+	packsBefore, err := loadPackStore(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	packNames := make([]string, 0, len(packsBefore.packs))
+	for name := range packsBefore.packs {
+		packNames = append(packNames, name)
+	}
+	sort.Strings(packNames)
+	assert.Len(packNames, 3)
+
+	// The first pack keeps one live block and is rewritten, the second one
+	// none and is deleted, the last one three and stays
+	changed := randomData(2, int(12*deltaBlockSize))
+	copy(changed, content[:deltaBlockSize])
+	copy(changed[8*deltaBlockSize:], content[8*deltaBlockSize:11*deltaBlockSize])
+	createTestBackup(t, deltaVolumeName, "backup-2", changed, packParameters)
+
+	backupURL := EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)
+	report, err := DeleteDeltaBlockBackupDryRun(backupURL)
+	assert.NoError(err)
+	assert.Empty(report.SkipReason)
+	assert.Equal(packNames[:1], report.PacksToRewrite)
+	assert.Equal(packNames[1:2], report.PacksToDelete)
+	assert.Len(report.BlocksToDelete, 7)
+
+	// The dry run reports what the deletion does
+	packSize := func() int64 {
+		size := int64(0)
+		for path, fileSize := range listFiles(t, m.fs) {
+			if strings.HasSuffix(path, PACK_SUFFIX) {
+				size += fileSize
+			}
+		}
+		return size
+	}
+	sizeBefore := packSize()
+	assert.NoError(DeleteDeltaBlockBackup(backupURL))
+	assert.Equal(report.ReclaimedSize, sizeBefore-packSize())
+
+	packsAfter, err := loadPackStore(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	for _, name := range append(report.PacksToRewrite, report.PacksToDelete...) {
+		assert.NotContains(packsAfter.packs, name)
+	}
+	assert.Contains(packsAfter.packs, packNames[2])
+	var deletedBlocks []string
+	for checksum := range packsBefore.locations {
+		if !packsAfter.has(checksum) {
+			deletedBlocks = append(deletedBlocks, checksum)
+		}
+	}
+	assert.ElementsMatch(report.BlocksToDelete, deletedBlocks)
+}
+
+func listFiles(t *testing.T, fs afero.Fs) map[string]int64 {
+	t.Helper()
+
+	files := map[string]int64{}
+	err := afero.Walk(fs, backupstoreBase, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[path] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to list the files: %v", err)
+	}
+	return files
+}
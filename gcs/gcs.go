@@ -0,0 +1,257 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "gcs"})
+)
+
+// BackupStoreDriver talks to Google Cloud Storage through its JSON API, so it
+// does not depend on the S3 interoperability of the service.
+type BackupStoreDriver struct {
+	destURL string
+	path    string
+	service *service
+}
+
+const (
+	KIND = "gs"
+)
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	b := &BackupStoreDriver{}
+	b.service, err = newService(u)
+	if err != nil {
+		return nil, err
+	}
+
+	b.path = u.Path
+	if b.service.Bucket == "" || b.path == "" {
+		return nil, fmt.Errorf("invalid URL. Must be gs://bucket/path/")
+	}
+
+	// Object names never start with '/'
+	b.path = strings.TrimLeft(b.path, "/")
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = KIND + "://" + b.service.Bucket + "/" + b.path
+
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func getCustomCerts() []byte {
+	// Certificates in PEM format (base64)
+	certs := os.Getenv("GCS_CERT")
+	if certs == "" {
+		return nil
+	}
+
+	return []byte(certs)
+}
+
+func (s *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *BackupStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *BackupStoreDriver) updatePath(path string) string {
+	joinedPath := filepath.Join(s.path, path)
+
+	// The filepath.Join removes the trailing slash when joining paths, so we
+	// need to check and add back the trailing slash if it exists in the input
+	// path.
+	if !strings.HasSuffix(path, "/") {
+		return joinedPath
+	}
+	return joinedPath + "/"
+}
+
+func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
+	return s.ListWithContext(context.Background(), listPath)
+}
+
+func (s *BackupStoreDriver) ListWithContext(ctx context.Context, listPath string) ([]string, error) {
+	var result []string
+
+	path := s.updatePath(listPath)
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	objects, prefixes, err := s.service.ListObjects(ctx, path, "/")
+	if err != nil {
+		log.WithError(err).Error("Failed to list gcs")
+		return result, err
+	}
+
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return result, nil
+	}
+	result = []string{}
+	for _, obj := range objects {
+		r := strings.TrimPrefix(obj.Name, path)
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+	for _, p := range prefixes {
+		r := strings.TrimPrefix(p, path)
+		r = strings.TrimSuffix(r, "/")
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *BackupStoreDriver) FileExists(filePath string) bool {
+	return s.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return s.FileSizeWithContext(ctx, filePath) >= 0
+}
+
+func (s *BackupStoreDriver) FileSize(filePath string) int64 {
+	return s.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	path := s.updatePath(filePath)
+	obj, err := s.service.GetObjectAttrs(ctx, path)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(obj.Size, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
+	return s.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	path := s.updatePath(filePath)
+	obj, err := s.service.GetObjectAttrs(ctx, path)
+	if err != nil {
+		return time.Time{}
+	}
+	return obj.Updated.UTC()
+}
+
+func (s *BackupStoreDriver) Remove(path string) error {
+	return s.RemoveWithContext(context.Background(), path)
+}
+
+func (s *BackupStoreDriver) RemoveWithContext(ctx context.Context, path string) error {
+	return s.service.DeleteObjects(ctx, s.updatePath(path))
+}
+
+func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return s.ReadWithContext(context.Background(), src)
+}
+
+func (s *BackupStoreDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	path := s.updatePath(src)
+	return s.service.GetObject(ctx, path)
+}
+
+func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return s.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (s *BackupStoreDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	path := s.updatePath(dst)
+	return s.service.PutObject(ctx, path, rs)
+}
+
+func (s *BackupStoreDriver) Upload(src, dst string) error {
+	return s.UploadWithContext(context.Background(), src, dst)
+}
+
+func (s *BackupStoreDriver) UploadWithContext(ctx context.Context, src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	path := s.updatePath(dst)
+	return s.service.PutObject(ctx, path, file)
+}
+
+func (s *BackupStoreDriver) Download(src, dst string) error {
+	return s.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (s *BackupStoreDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
+	if _, err := os.Stat(dst); err != nil {
+		_ = os.Remove(dst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	path := s.updatePath(src)
+	rc, err := s.service.GetObject(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
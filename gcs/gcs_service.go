@@ -0,0 +1,322 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+
+	bhttp "github.com/longhorn/backupstore/http"
+)
+
+const (
+	defaultEndpoint = "https://storage.googleapis.com"
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+
+	// storageScope allows listing, reading, creating and deleting objects, but
+	// not changing the bucket itself.
+	storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	listPageSize = 1000
+)
+
+type service struct {
+	Bucket   string
+	Endpoint string
+	Client   *http.Client
+}
+
+// object is the subset of the JSON API object resource the driver relies on.
+type object struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+type objectList struct {
+	Items         []object `json:"items"`
+	Prefixes      []string `json:"prefixes"`
+	NextPageToken string   `json:"nextPageToken"`
+}
+
+// serviceAccountKey is the JSON key file of a service account, as downloaded
+// from the Google Cloud console.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// apiError is the error returned by the JSON API for a failed request.
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("GCS Error: %d %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var ae *apiError
+	return errors.As(err, &ae) && ae.StatusCode == http.StatusNotFound
+}
+
+func newService(u *url.URL) (*service, error) {
+	s := service{
+		Bucket:   u.Host,
+		Endpoint: defaultEndpoint,
+	}
+
+	endpoint := os.Getenv("GCS_ENDPOINT")
+	if endpoint != "" {
+		s.Endpoint = strings.TrimRight(endpoint, "/")
+	}
+
+	// add custom ca to http client that is used by gcs service
+	client, err := bhttp.GetClientWithCustomCerts(getCustomCerts())
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := os.Getenv("GCS_CREDENTIALS")
+	if credentials == "" {
+		// Emulators like fake-gcs-server don't authenticate the requests,
+		// Google Cloud Storage itself always does.
+		if endpoint == "" {
+			return nil, fmt.Errorf("missing service account credentials GCS_CREDENTIALS for %v", s.Endpoint)
+		}
+		s.Client = client
+		return &s, nil
+	}
+
+	config, err := jwtConfigFromJSON([]byte(credentials))
+	if err != nil {
+		return nil, err
+	}
+	// The token source keeps the context around for refreshing the token, so
+	// it must not be bound to any single operation.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	s.Client = config.Client(ctx)
+
+	return &s, nil
+}
+
+func jwtConfigFromJSON(data []byte) (*jwt.Config, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errors.Wrap(err, "failed to parse GCS service account credentials")
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("unsupported GCS credentials type %q, only service_account is supported", key.Type)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("invalid GCS service account credentials: client_email and private_key are required")
+	}
+
+	tokenURL := key.TokenURI
+	if tokenURL == "" {
+		tokenURL = defaultTokenURL
+	}
+	return &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Scopes:       []string{storageScope},
+		TokenURL:     tokenURL,
+	}, nil
+}
+
+func (s *service) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.Endpoint, url.PathEscape(s.Bucket), url.PathEscape(name))
+}
+
+func (s *service) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	return nil, parseResponseError(resp)
+}
+
+func parseResponseError(resp *http.Response) error {
+	ae := &apiError{StatusCode: resp.StatusCode, Message: resp.Status}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return ae
+	}
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+		ae.Message = errResp.Error.Message
+	}
+	return ae
+}
+
+func (s *service) ListObjects(ctx context.Context, prefix, delimiter string) ([]object, []string, error) {
+	var (
+		objects  []object
+		prefixes []string
+	)
+
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("maxResults", strconv.Itoa(listPageSize))
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.Endpoint, url.PathEscape(s.Bucket), query.Encode())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to list objects with prefix %v", prefix)
+		}
+
+		var page objectList
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decode the objects with prefix %v", prefix)
+		}
+
+		objects = append(objects, page.Items...)
+		prefixes = append(prefixes, page.Prefixes...)
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	return objects, prefixes, nil
+}
+
+func (s *service) GetObjectAttrs(ctx context.Context, name string) (*object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get metadata for object %v", name)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	obj := &object{}
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the metadata for object %v", name)
+	}
+	return obj, nil
+}
+
+func (s *service) PutObject(ctx context.Context, name string, reader io.ReadSeeker) error {
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", name)
+	uploadURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", s.Endpoint, url.PathEscape(s.Bucket), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, io.NopCloser(reader))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put object %v", name)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *service) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get object %v", name)
+	}
+	return resp.Body, nil
+}
+
+func (s *service) DeleteObjects(ctx context.Context, prefix string) error {
+	objects, _, err := s.ListObjects(ctx, prefix, "")
+	if err != nil {
+		return errors.Wrapf(err, "failed to list objects with prefix %v before removing them", prefix)
+	}
+
+	var deletionFailures []string
+	for _, obj := range objects {
+		if err := s.deleteObject(ctx, obj.Name); err != nil {
+			log.WithError(err).Errorf("Failed to delete object: %v", obj.Name)
+			deletionFailures = append(deletionFailures, obj.Name)
+		}
+	}
+
+	if len(deletionFailures) > 0 {
+		return fmt.Errorf("failed to delete objects %v", deletionFailures)
+	}
+
+	return nil
+}
+
+func (s *service) deleteObject(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		// Someone else removed it in the meantime, which is what we wanted.
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,424 @@
+package gcs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+// fakeGCSServer fakes just enough of the Cloud Storage JSON API (objects
+// list/get/insert/delete and the OAuth2 token endpoint) to drive the driver
+// end to end without credentials or network access.
+type fakeGCSServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string]fakeObject
+	pageSize int
+
+	// authorizations records the Authorization header of every storage request.
+	authorizations []string
+	tokenRequests  int
+}
+
+type fakeObject struct {
+	data    []byte
+	updated time.Time
+}
+
+func newFakeGCSServer(bucket string) *fakeGCSServer {
+	f := &fakeGCSServer{
+		bucket:  bucket,
+		objects: map[string]fakeObject{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeGCSServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokenRequests++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"access_token":"fake-token","token_type":"Bearer","expires_in":3600}`)
+		return
+	}
+	f.authorizations = append(f.authorizations, r.Header.Get("Authorization"))
+
+	bucketPath := "/storage/v1/b/" + f.bucket + "/o"
+	uploadPath := "/upload" + bucketPath
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == uploadPath:
+		if r.URL.Query().Get("uploadType") != "media" {
+			writeError(w, http.StatusBadRequest, "unsupported upload type")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		name := r.URL.Query().Get("name")
+		f.objects[name] = fakeObject{data: data, updated: time.Now()}
+		writeJSON(w, f.objectResource(name))
+	case r.Method == http.MethodGet && r.URL.Path == bucketPath:
+		f.list(w, r.URL.Query())
+	case strings.HasPrefix(r.URL.Path, bucketPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, bucketPath+"/")
+		obj, ok := f.objects[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such object: "+f.bucket+"/"+name)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+			_, _ = w.Write(obj.data)
+		case r.Method == http.MethodGet:
+			writeJSON(w, f.objectResource(name))
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, r.Method)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (f *fakeGCSServer) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	var names []string
+	prefixSet := map[string]struct{}{}
+	for name := range f.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			prefixSet[prefix+rest[:i+1]] = struct{}{}
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Only the objects get paginated, which is enough to exercise the page token handling.
+	start := 0
+	if token := query.Get("pageToken"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := len(names)
+	nextPageToken := ""
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+		nextPageToken = strconv.Itoa(end)
+	}
+
+	resp := map[string]interface{}{}
+	items := []map[string]string{}
+	for _, name := range names[start:end] {
+		items = append(items, f.objectResource(name))
+	}
+	resp["items"] = items
+	if start == 0 {
+		prefixes := []string{}
+		for p := range prefixSet {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		resp["prefixes"] = prefixes
+	}
+	if nextPageToken != "" {
+		resp["nextPageToken"] = nextPageToken
+	}
+	writeJSON(w, resp)
+}
+
+func (f *fakeGCSServer) objectResource(name string) map[string]string {
+	obj := f.objects[name]
+	return map[string]string{
+		"name":    name,
+		"bucket":  f.bucket,
+		"size":    strconv.Itoa(len(obj.data)),
+		"updated": obj.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func (f *fakeGCSServer) put(name string, data []byte, updated time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[name] = fakeObject{data: data, updated: updated}
+}
+
+func (f *fakeGCSServer) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func newTestDriver(t *testing.T, server *fakeGCSServer) backupstore.BackupStoreDriver {
+	t.Helper()
+
+	t.Setenv("GCS_ENDPOINT", server.URL)
+	t.Setenv("GCS_CREDENTIALS", "")
+
+	driver, err := initFunc("gs://" + server.bucket + "/backupstore-root/")
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
+	return driver
+}
+
+func TestInitFuncValidatesURL(t *testing.T) {
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	t.Setenv("GCS_ENDPOINT", server.URL)
+
+	_, err := initFunc("s3://test-bucket/path")
+	assert.ErrorContains(t, err, "BUG")
+
+	_, err = initFunc("gs://test-bucket")
+	assert.ErrorContains(t, err, "invalid URL")
+
+	driver, err := initFunc("gs://test-bucket/path/")
+	assert.NoError(t, err)
+	assert.Equal(t, "gs://test-bucket/path/", driver.GetURL())
+	assert.Equal(t, KIND, driver.Kind())
+}
+
+func TestInitFuncRequiresCredentialsForGoogleCloudStorage(t *testing.T) {
+	t.Setenv("GCS_ENDPOINT", "")
+	t.Setenv("GCS_CREDENTIALS", "")
+
+	_, err := initFunc("gs://test-bucket/path/")
+	assert.ErrorContains(t, err, "GCS_CREDENTIALS")
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	driver := newTestDriver(t, server)
+
+	payload := []byte("backup block payload")
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", bytes.NewReader(payload)))
+	assert.Equal([]string{"backupstore-root/backupstore/volumes/vol-1/volume.cfg"}, server.names())
+
+	assert.True(driver.FileExists("backupstore/volumes/vol-1/volume.cfg"))
+	assert.Equal(int64(len(payload)), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+
+	rc, err := driver.Read("backupstore/volumes/vol-1/volume.cfg")
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal(payload, data)
+
+	assert.False(driver.FileExists("backupstore/volumes/vol-1/missing.cfg"))
+	assert.Equal(int64(-1), driver.FileSize("backupstore/volumes/vol-1/missing.cfg"))
+	assert.True(driver.FileTime("backupstore/volumes/vol-1/missing.cfg").IsZero())
+
+	_, err = driver.Read("backupstore/volumes/vol-1/missing.cfg")
+	assert.ErrorContains(err, "404")
+}
+
+func TestFileTimeIsServerTimeInUTC(t *testing.T) {
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	driver := newTestDriver(t, server)
+
+	updated := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("UTC+8", 8*60*60))
+	server.put("backupstore-root/locks/lock-1.lck", []byte("{}"), updated)
+
+	fileTime := driver.FileTime("locks/lock-1.lck")
+	assert.True(t, updated.Equal(fileTime))
+	assert.Equal(t, time.UTC, fileTime.Location())
+}
+
+func TestListBehavesLikeLs(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	driver := newTestDriver(t, server)
+	// Force the listing across several pages.
+	server.pageSize = 2
+
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/backups/backup_b.cfg",
+		"volumes/vol-1/backups/backup_c.cfg",
+		"volumes/vol-1/backups/backup_d.cfg",
+		"volumes/vol-1/backups/backup_e.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(filepath.Join("backupstore-root", name), []byte("x"), time.Now())
+	}
+
+	names, err := driver.List("volumes/vol-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	// A trailing slash must not change the result.
+	names, err = driver.List("volumes/vol-1/")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	names, err = driver.List("volumes/vol-1/backups")
+	assert.NoError(err)
+	assert.Equal([]string{"backup_a.cfg", "backup_b.cfg", "backup_c.cfg", "backup_d.cfg", "backup_e.cfg"}, names)
+
+	names, err = driver.List("volumes/missing")
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+func TestRemoveDeletesPrefixRecursively(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	driver := newTestDriver(t, server)
+
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(filepath.Join("backupstore-root", name), []byte("x"), time.Now())
+	}
+
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+	assert.Equal([]string{"backupstore-root/volumes/vol-2/volume.cfg"}, server.names())
+
+	// Removing something that is already gone is not an error, just like "rm -rf".
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+	driver := newTestDriver(t, server)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bak")
+	payload := bytes.Repeat([]byte("system backup "), 1024)
+	assert.NoError(os.WriteFile(src, payload, 0600))
+
+	assert.NoError(driver.Upload(src, "system-backups/sb-1.zip"))
+	assert.Error(driver.Upload(filepath.Join(dir, "missing"), "system-backups/sb-2.zip"))
+
+	dst := filepath.Join(dir, "nested", "dst.bak")
+	assert.NoError(driver.Download("system-backups/sb-1.zip", dst))
+	data, err := os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal(payload, data)
+}
+
+func TestServiceAccountCredentialsAuthorizeRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newFakeGCSServer("test-bucket")
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	credentials, err := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "backup@project.iam.gserviceaccount.com",
+		PrivateKey:   string(keyPEM),
+		PrivateKeyID: "key-1",
+		TokenURI:     server.URL + "/token",
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal the credentials: %v", err)
+	}
+
+	t.Setenv("GCS_ENDPOINT", server.URL)
+	t.Setenv("GCS_CREDENTIALS", string(credentials))
+
+	driver, err := initFunc("gs://test-bucket/path/")
+	assert.NoError(err)
+	assert.NoError(driver.Write("volume.cfg", bytes.NewReader([]byte("{}"))))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// The token is cached between requests.
+	assert.Equal(1, server.tokenRequests)
+	assert.NotEmpty(server.authorizations)
+	for _, authorization := range server.authorizations {
+		assert.Equal("Bearer fake-token", authorization)
+	}
+}
+
+func TestJWTConfigFromJSONRejectsInvalidCredentials(t *testing.T) {
+	_, err := jwtConfigFromJSON([]byte("not json"))
+	assert.Error(t, err)
+
+	_, err = jwtConfigFromJSON([]byte(`{"type":"authorized_user"}`))
+	assert.ErrorContains(t, err, "unsupported")
+
+	_, err = jwtConfigFromJSON([]byte(`{"type":"service_account","client_email":"a@b.c"}`))
+	assert.ErrorContains(t, err, "private_key")
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		server := newFakeGCSServer("test-bucket")
+		t.Cleanup(server.Close)
+		return newTestDriver(t, server)
+	})
+}
@@ -1,8 +1,10 @@
 package backupstore
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/cockroachdb/errors"
 	"github.com/sirupsen/logrus"
 
 	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
@@ -20,7 +22,7 @@ func InspectVolume(volumeURL string) (*VolumeInfo, error) {
 		return nil, err
 	}
 
-	volume, err := loadVolume(driver, volumeName)
+	volume, err := loadVolume(context.Background(), driver, volumeName)
 	if err != nil {
 		return nil, err
 	}
@@ -39,12 +41,13 @@ func InspectBackup(backupURL string) (*BackupInfo, error) {
 		return nil, err
 	}
 
-	volume, err := loadVolume(driver, volumeName)
+	ctx := context.Background()
+	volume, err := loadVolume(ctx, driver, volumeName)
 	if err != nil {
 		return nil, err
 	}
 
-	backup, err := loadBackup(driver, backupName, volumeName)
+	backup, err := loadBackup(ctx, driver, backupName, volumeName)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			LogFieldReason: LogReasonFallback,
@@ -58,6 +61,9 @@ func InspectBackup(backupURL string) (*BackupInfo, error) {
 		// for now we don't return in progress backups to the ui
 		return nil, fmt.Errorf("backup %v is still in progress", backup.Name)
 	}
+	if err := ValidateBlockFormatVersion(backup.BlockFormatVersion); err != nil {
+		return nil, errors.Wrapf(err, "cannot inspect backup %v", backup.Name)
+	}
 
 	return fillFullBackupInfo(backup, volume, driver.GetURL()), nil
 }
@@ -1,6 +1,7 @@
 package backupstore
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"runtime"
@@ -53,7 +54,7 @@ type BackupInfo struct {
 	Messages map[types.MessageType]string
 }
 
-func addListVolume(driver BackupStoreDriver, volumeName string, volumeOnly bool) (*VolumeInfo, error) {
+func addListVolume(ctx context.Context, driver BackupStoreDriver, volumeName string, volumeOnly bool) (*VolumeInfo, error) {
 	if volumeName == "" {
 		return nil, fmt.Errorf("invalid empty volume Name")
 	}
@@ -63,7 +64,7 @@ func addListVolume(driver BackupStoreDriver, volumeName string, volumeOnly bool)
 	}
 
 	volumeInfo := &VolumeInfo{Messages: make(map[types.MessageType]string)}
-	if !volumeExists(driver, volumeName) {
+	if !volumeExists(ctx, driver, volumeName) {
 		// If the backup volume folder exist but volume.cfg not exist
 		// save the error in Messages field
 		volumeInfo.Messages[types.MessageTypeError] = fmt.Sprintf("cannot find %v in backupstore", getVolumeFilePath(volumeName))
@@ -75,7 +76,7 @@ func addListVolume(driver BackupStoreDriver, volumeName string, volumeOnly bool)
 	}
 
 	// try to find all backups for this volume
-	backupNames, err := getBackupNamesForVolume(driver, volumeName)
+	backupNames, err := getBackupNamesForVolume(ctx, driver, volumeName)
 	if err != nil {
 		volumeInfo.Messages[types.MessageTypeError] = err.Error()
 		return volumeInfo, nil
@@ -96,10 +97,11 @@ func List(volumeName, destURL string, volumeOnly bool) (map[string]*VolumeInfo,
 	jobQueues := workerpool.New(runtime.NumCPU() * 16)
 	defer jobQueues.StopWait()
 
+	ctx := context.Background()
 	var resp = make(map[string]*VolumeInfo)
 	volumeNames := []string{volumeName}
 	if volumeName == "" {
-		volumeNames, err = getVolumeNames(jobQueues, driver)
+		volumeNames, err = getVolumeNames(ctx, jobQueues, driver)
 		if err != nil {
 			return nil, err
 		}
@@ -107,7 +109,7 @@ func List(volumeName, destURL string, volumeOnly bool) (map[string]*VolumeInfo,
 
 	var errs []string
 	for _, volumeName := range volumeNames {
-		volumeInfo, err := addListVolume(driver, volumeName, volumeOnly)
+		volumeInfo, err := addListVolume(ctx, driver, volumeName, volumeOnly)
 		if err != nil {
 			errs = append(errs, err.Error())
 			continue
@@ -1,6 +1,7 @@
 package backupstore
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -22,6 +23,13 @@ const (
 	LOCK_CHECK_WAIT_TIME  = time.Second * 2
 )
 
+// lockCheckWaiter is implemented by the drivers whose locks don't need to
+// wait LOCK_CHECK_WAIT_TIME for the other clients to write theirs, like the
+// ones of the tests sharing the process.
+type lockCheckWaiter interface {
+	lockCheckWaitTime() time.Duration
+}
+
 type LockType int
 
 const UNTYPED_LOCK LockType = 0
@@ -59,14 +67,21 @@ func (lock *FileLock) isExpired() bool {
 	return isExpired
 }
 
+func (lock *FileLock) checkWaitTime() time.Duration {
+	if waiter, ok := lock.driver.(lockCheckWaiter); ok {
+		return waiter.lockCheckWaitTime()
+	}
+	return LOCK_CHECK_WAIT_TIME
+}
+
 func (lock *FileLock) String() string {
 	return fmt.Sprintf("{ volume: %v, name: %v, type: %v, acquired: %v, serverTime: %v }",
 		lock.volume, lock.Name, lock.Type, lock.Acquired, lock.serverTime)
 }
 
-func (lock *FileLock) canAcquire() bool {
+func (lock *FileLock) canAcquire(ctx context.Context) bool {
 	canAcquire := true
-	locks := getLocksForVolume(lock.volume, lock.driver)
+	locks := getLocksForVolume(ctx, lock.volume, lock.driver)
 	file := getLockFilePath(lock.volume, lock.Name)
 	log.WithField("lock", lock).Infof("Trying to acquire lock %v", file)
 	log.Infof("backupstore volume %v contains locks %v", lock.volume, locks)
@@ -84,6 +99,13 @@ func (lock *FileLock) canAcquire() bool {
 }
 
 func (lock *FileLock) Lock() error {
+	return lock.LockWithContext(context.Background())
+}
+
+// LockWithContext acquires the lock, giving up as soon as ctx is done.
+// The lock is refreshed in the background until it is released by Unlock,
+// regardless of ctx.
+func (lock *FileLock) LockWithContext(ctx context.Context) error {
 	lock.mutex.Lock()
 	defer lock.mutex.Unlock()
 
@@ -97,7 +119,7 @@ func (lock *FileLock) Lock() error {
 
 	if lock.Acquired {
 		atomic.AddInt32(&lock.count, 1)
-		_ = saveLock(lock)
+		_ = saveLock(ctx, lock)
 		return nil
 	}
 
@@ -107,21 +129,29 @@ func (lock *FileLock) Lock() error {
 	// the servers modification time is only the initial lock creation time
 	// and we do not need to start lock refreshing till after we acquired the lock
 	// since lock expiration is based on the serverTime + LOCK_DURATION
-	if err := saveLock(lock); err != nil {
+	if err := saveLock(ctx, lock); err != nil {
 		return err
 	}
 
 	// since the node times might not be perfectly in sync and the servers file time has second precision
 	// we wait 2 seconds before retrieving the current set of locks, this eliminates a race condition
 	// where 2 processes request a lock at the same time
-	time.Sleep(LOCK_CHECK_WAIT_TIME)
+	select {
+	case <-ctx.Done():
+		_ = removeLock(context.Background(), lock)
+		return ctx.Err()
+	case <-time.After(lock.checkWaitTime()):
+	}
 
 	// we only try to acquire once, since backup operations generally take a long time
 	// there is no point in trying to wait for lock acquisition, better to throw an error
 	// and let the calling code retry with an exponential backoff.
-	if !lock.canAcquire() {
+	if !lock.canAcquire(ctx) {
 		file := getLockFilePath(lock.volume, lock.Name)
-		_ = removeLock(lock)
+		_ = removeLock(context.Background(), lock)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return fmt.Errorf("failed to acquire lock %v when performing backup %v, please try again later", file, operation)
 	}
 
@@ -129,8 +159,8 @@ func (lock *FileLock) Lock() error {
 	log.Infof("Acquired lock %v for backup %v on backupstore", file, operation)
 	lock.Acquired = true
 	atomic.AddInt32(&lock.count, 1)
-	if err := saveLock(lock); err != nil {
-		_ = removeLock(lock)
+	if err := saveLock(ctx, lock); err != nil {
+		_ = removeLock(context.Background(), lock)
 		return errors.Wrapf(err, "failed to store updated lock %v when performing backup %v, please try again later", file, operation)
 	}
 
@@ -146,7 +176,7 @@ func (lock *FileLock) Lock() error {
 			case <-refreshTimer.C:
 				lock.mutex.Lock()
 				if lock.Acquired {
-					if err := saveLock(lock); err != nil {
+					if err := saveLock(context.Background(), lock); err != nil {
 						// nothing we can do here, that's why the lock acquisition time is 2x lock refresh interval
 						log.WithError(err).Warnf("Failed to refresh acquired lock %v when performing backup %v, please try again later", file, operation)
 					}
@@ -167,7 +197,8 @@ func (lock *FileLock) Unlock() error {
 		if lock.keepAlive != nil {
 			close(lock.keepAlive)
 		}
-		if err := removeLock(lock); err != nil {
+		// The lock has to be released even if the operation holding it got cancelled.
+		if err := removeLock(context.Background(), lock); err != nil {
 			return err
 		}
 		return nil
@@ -176,32 +207,32 @@ func (lock *FileLock) Unlock() error {
 	return nil
 }
 
-func loadLock(volumeName string, name string, driver BackupStoreDriver) (*FileLock, error) {
+func loadLock(ctx context.Context, volumeName string, name string, driver BackupStoreDriver) (*FileLock, error) {
 	lock := &FileLock{}
 	file := getLockFilePath(volumeName, name)
-	if err := LoadConfigInBackupStore(driver, file, lock); err != nil {
+	if err := LoadConfigInBackupStoreWithContext(ctx, driver, file, lock); err != nil {
 		return nil, err
 	}
-	lock.serverTime = driver.FileTime(file)
+	lock.serverTime = NewDriverWithContext(driver).FileTimeWithContext(ctx, file)
 	log.Infof("Loaded lock %v type %v on backupstore", file, lock.Type)
 	return lock, nil
 }
 
-func removeLock(lock *FileLock) error {
+func removeLock(ctx context.Context, lock *FileLock) error {
 	file := getLockFilePath(lock.volume, lock.Name)
-	if err := lock.driver.Remove(file); err != nil {
+	if err := NewDriverWithContext(lock.driver).RemoveWithContext(ctx, file); err != nil {
 		return err
 	}
 	log.Infof("Removed lock %v type %v on backupstore", file, lock.Type)
 	return nil
 }
 
-func saveLock(lock *FileLock) error {
+func saveLock(ctx context.Context, lock *FileLock) error {
 	file := getLockFilePath(lock.volume, lock.Name)
-	if err := SaveConfigInBackupStore(lock.driver, file, lock); err != nil {
+	if err := SaveConfigInBackupStoreWithContext(ctx, lock.driver, file, lock); err != nil {
 		return err
 	}
-	lock.serverTime = lock.driver.FileTime(file)
+	lock.serverTime = NewDriverWithContext(lock.driver).FileTimeWithContext(ctx, file)
 	log.Infof("Stored lock %v type %v on backupstore", file, lock.Type)
 	return nil
 }
@@ -224,8 +255,8 @@ func compareLocks(a *FileLock, b *FileLock) int {
 	}
 }
 
-func getLockNamesForVolume(volumeName string, driver BackupStoreDriver) []string {
-	fileList, err := driver.List(getLockPath(volumeName))
+func getLockNamesForVolume(ctx context.Context, volumeName string, driver BackupStoreDriver) []string {
+	fileList, err := NewDriverWithContext(driver).ListWithContext(ctx, getLockPath(volumeName))
 	if err != nil {
 		// path doesn't exist
 		return []string{}
@@ -234,11 +265,11 @@ func getLockNamesForVolume(volumeName string, driver BackupStoreDriver) []string
 	return names
 }
 
-func getLocksForVolume(volumeName string, driver BackupStoreDriver) []*FileLock {
-	names := getLockNamesForVolume(volumeName, driver)
+func getLocksForVolume(ctx context.Context, volumeName string, driver BackupStoreDriver) []*FileLock {
+	names := getLockNamesForVolume(ctx, volumeName, driver)
 	locks := make([]*FileLock, 0, len(names))
 	for _, name := range names {
-		lock, err := loadLock(volumeName, name, driver)
+		lock, err := loadLock(ctx, volumeName, name, driver)
 		if err != nil {
 			file := getLockFilePath(volumeName, name)
 			log.WithError(err).Warnf("Failed to load lock %v on backupstore", file)
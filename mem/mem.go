@@ -0,0 +1,342 @@
+package mem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/fsops"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "mem"})
+
+	storesMutex sync.Mutex
+	stores      = map[string]*Store{}
+)
+
+const (
+	KIND = "mem"
+)
+
+// BackupStoreDriver keeps the backupstore in memory, which makes it useful for
+// tests and dry runs. All the drivers created for the same URL share the same
+// Store, the same way they would share a remote backup target.
+type BackupStoreDriver struct {
+	destURL string
+	store   *Store
+}
+
+// Store is the content of one in-memory backupstore. It behaves like the file
+// system based drivers: directories are created on write, removed once empty
+// and the file times come from the clock of the "server".
+type Store struct {
+	mutex sync.RWMutex
+	nodes map[string]*node
+	now   func() time.Time
+}
+
+type node struct {
+	isDir   bool
+	data    []byte
+	modTime time.Time
+}
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	store, err := GetStore(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BackupStoreDriver{
+		destURL: destURL,
+		store:   store,
+	}
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func storeName(destURL string) (string, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != KIND {
+		return "", fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	name := u.Host + path.Clean("/"+u.Path)
+	if name == "/" {
+		return "", fmt.Errorf("invalid URL. Must be mem://name/")
+	}
+	return name, nil
+}
+
+// GetStore returns the store behind the mem:// URL, creating an empty one if
+// there is none yet.
+func GetStore(destURL string) (*Store, error) {
+	name, err := storeName(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	store, exists := stores[name]
+	if !exists {
+		store = &Store{
+			nodes: map[string]*node{"/": {isDir: true, modTime: time.Now().UTC()}},
+			now:   time.Now,
+		}
+		stores[name] = store
+	}
+	return store, nil
+}
+
+// DeleteStore drops the store behind the mem:// URL along with its content.
+func DeleteStore(destURL string) error {
+	name, err := storeName(destURL)
+	if err != nil {
+		return err
+	}
+
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+	delete(stores, name)
+	return nil
+}
+
+// SetClock replaces the clock used for the modification time of the files
+// written from now on. It allows simulating a server whose clock is skewed
+// from the client, or files that were written long ago.
+func (s *Store) SetClock(now func() time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.now = now
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func notExist(op, p string) error {
+	return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+}
+
+// mkdirAll needs the write lock to be held.
+func (s *Store) mkdirAll(dir string) error {
+	if n, exists := s.nodes[dir]; exists {
+		if !n.isDir {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	}
+	if err := s.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	s.nodes[dir] = &node{isDir: true, modTime: s.now().UTC()}
+	return nil
+}
+
+func (s *Store) stat(p string) (*node, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, exists := s.nodes[cleanPath(p)]
+	return n, exists
+}
+
+func (s *Store) write(p string, data []byte) error {
+	p = cleanPath(p)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n, exists := s.nodes[p]; exists && n.isDir {
+		return &fs.PathError{Op: "write", Path: p, Err: fmt.Errorf("is a directory")}
+	}
+	if err := s.mkdirAll(path.Dir(p)); err != nil {
+		return err
+	}
+	s.nodes[p] = &node{data: data, modTime: s.now().UTC()}
+	return nil
+}
+
+func (s *Store) read(p string) ([]byte, error) {
+	n, exists := s.stat(p)
+	if !exists {
+		return nil, notExist("open", p)
+	}
+	if n.isDir {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: fmt.Errorf("is a directory")}
+	}
+	// The content is never modified in place, a write replaces the node
+	return n.data, nil
+}
+
+// list behaves like "ls -1": the names of the entries in a directory, the path
+// itself for a file and nothing for a path that doesn't exist.
+func (s *Store) list(p string) []string {
+	p = cleanPath(p)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n, exists := s.nodes[p]
+	if !exists {
+		return nil
+	}
+	if !n.isDir {
+		return []string{p}
+	}
+
+	var names []string
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for name := range s.nodes {
+		if name == p || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if !strings.Contains(rest, "/") {
+			names = append(names, rest)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// remove behaves like "rm -rf", followed by the cleanup of the emptied upper
+// level directories done by the file system based drivers.
+func (s *Store) remove(p string) {
+	p = cleanPath(p)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p != "/" {
+		delete(s.nodes, p)
+	}
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for name := range s.nodes {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.nodes, name)
+		}
+	}
+
+	dir := p
+	for i := 0; i < fsops.MaxCleanupLevel; i++ {
+		dir = path.Dir(dir)
+		// Don't clean above backupstore base
+		if dir == "/" || strings.HasSuffix(dir, backupstore.GetBackupstoreBase()) {
+			break
+		}
+		// If directory is not empty, then we don't need to continue
+		if !s.isEmptyDir(dir) {
+			break
+		}
+		delete(s.nodes, dir)
+	}
+}
+
+// isEmptyDir needs the lock to be held.
+func (s *Store) isEmptyDir(dir string) bool {
+	n, exists := s.nodes[dir]
+	if !exists || !n.isDir {
+		return false
+	}
+	prefix := dir + "/"
+	for name := range s.nodes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (b *BackupStoreDriver) GetURL() string {
+	return b.destURL
+}
+
+func (b *BackupStoreDriver) FileSize(filePath string) int64 {
+	n, exists := b.store.stat(filePath)
+	if !exists || n.isDir {
+		return -1
+	}
+	return int64(len(n.data))
+}
+
+func (b *BackupStoreDriver) FileTime(filePath string) time.Time {
+	n, exists := b.store.stat(filePath)
+	if !exists || n.isDir {
+		return time.Time{}
+	}
+	return n.modTime
+}
+
+func (b *BackupStoreDriver) FileExists(filePath string) bool {
+	return b.FileSize(filePath) >= 0
+}
+
+func (b *BackupStoreDriver) Remove(path string) error {
+	b.store.remove(path)
+	return nil
+}
+
+func (b *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	data, err := b.store.read(src)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	return b.store.write(dst, data)
+}
+
+func (b *BackupStoreDriver) List(path string) ([]string, error) {
+	return b.store.list(path), nil
+}
+
+func (b *BackupStoreDriver) Upload(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return b.store.write(dst, data)
+}
+
+func (b *BackupStoreDriver) Download(src, dst string) error {
+	data, err := b.store.read(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0600)
+}
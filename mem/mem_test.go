@@ -0,0 +1,230 @@
+package mem
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+func newTestDriver(t *testing.T) (backupstore.BackupStoreDriver, *Store) {
+	t.Helper()
+
+	destURL := "mem://" + strings.ReplaceAll(t.Name(), "/", "-") + "/"
+	t.Cleanup(func() {
+		_ = DeleteStore(destURL)
+	})
+
+	driver, err := backupstore.GetBackupStoreDriver(destURL)
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
+	store, err := GetStore(destURL)
+	if err != nil {
+		t.Fatalf("failed to get the store: %v", err)
+	}
+	return driver, store
+}
+
+func TestInitFuncValidatesURL(t *testing.T) {
+	_, err := initFunc("s3://bucket/path")
+	assert.ErrorContains(t, err, "BUG")
+
+	_, err = initFunc("mem://")
+	assert.ErrorContains(t, err, "invalid URL")
+}
+
+func TestDriversShareTheStoreOfTheirURL(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+	assert.NoError(driver.Write("backupstore/volume.cfg", strings.NewReader("{}")))
+
+	other, err := backupstore.GetBackupStoreDriver(driver.GetURL())
+	assert.NoError(err)
+	assert.True(other.FileExists("backupstore/volume.cfg"))
+
+	unrelated, err := backupstore.GetBackupStoreDriver("mem://unrelated/")
+	assert.NoError(err)
+	defer func() {
+		_ = DeleteStore("mem://unrelated/")
+	}()
+	assert.False(unrelated.FileExists("backupstore/volume.cfg"))
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+
+	payload := []byte("backup block payload")
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", bytes.NewReader(payload)))
+	assert.True(driver.FileExists("backupstore/volumes/vol-1/volume.cfg"))
+	assert.Equal(int64(len(payload)), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+
+	rc, err := driver.Read("backupstore/volumes/vol-1/volume.cfg")
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal(payload, data)
+
+	// Directories are not files
+	assert.False(driver.FileExists("backupstore/volumes/vol-1"))
+	assert.True(driver.FileTime("backupstore/volumes/vol-1").IsZero())
+	assert.Error(driver.Write("backupstore/volumes/vol-1", strings.NewReader("x")))
+
+	assert.Equal(int64(-1), driver.FileSize("backupstore/volumes/vol-1/missing.cfg"))
+	_, err = driver.Read("backupstore/volumes/vol-1/missing.cfg")
+	assert.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestFileTimeIsServerTimeInUTC(t *testing.T) {
+	driver, store := newTestDriver(t)
+
+	written := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("UTC+8", 8*60*60))
+	store.SetClock(func() time.Time { return written })
+	assert.NoError(t, driver.Write("backupstore/locks/lock-1.lck", strings.NewReader("{}")))
+	store.SetClock(time.Now)
+
+	fileTime := driver.FileTime("backupstore/locks/lock-1.lck")
+	assert.True(t, written.Equal(fileTime))
+	assert.Equal(t, time.UTC, fileTime.Location())
+
+	// Only writes move the file time
+	_, err := driver.Read("backupstore/locks/lock-1.lck")
+	assert.NoError(t, err)
+	assert.True(t, written.Equal(driver.FileTime("backupstore/locks/lock-1.lck")))
+}
+
+func TestListBehavesLikeLs(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_b.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-10/volume.cfg",
+	} {
+		assert.NoError(driver.Write(name, strings.NewReader("x")))
+	}
+
+	names, err := driver.List("volumes/vol-1")
+	assert.NoError(err)
+	assert.Equal([]string{"backups", "blocks", "volume.cfg"}, names)
+
+	names, err = driver.List("volumes/vol-1/")
+	assert.NoError(err)
+	assert.Equal([]string{"backups", "blocks", "volume.cfg"}, names)
+
+	names, err = driver.List("volumes/vol-1/backups")
+	assert.NoError(err)
+	assert.Equal([]string{"backup_a.cfg", "backup_b.cfg"}, names)
+
+	names, err = driver.List("volumes/missing")
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+func TestRemoveIsRecursive(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+	for _, name := range []string{
+		"backupstore/volumes/vol-1/volume.cfg",
+		"backupstore/volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"backupstore/volumes/vol-2/volume.cfg",
+	} {
+		assert.NoError(driver.Write(name, strings.NewReader("x")))
+	}
+
+	assert.NoError(driver.Remove("backupstore/volumes/vol-1/"))
+	names, err := driver.List("backupstore/volumes")
+	assert.NoError(err)
+	assert.Equal([]string{"vol-2"}, names)
+
+	// Removing something that is already gone is not an error, just like "rm -rf".
+	assert.NoError(driver.Remove("backupstore/volumes/vol-1/"))
+
+	// The emptied parent directories are cleaned up as well, up to the backupstore base
+	assert.NoError(driver.Remove("backupstore/volumes/vol-2/volume.cfg"))
+	names, err = driver.List("backupstore")
+	assert.NoError(err)
+	assert.Empty(names)
+	names, err = driver.List("")
+	assert.NoError(err)
+	assert.Equal([]string{"backupstore"}, names)
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NoError(os.WriteFile(src, []byte("file content"), 0600))
+	assert.NoError(driver.Upload(src, "backing-images/image.cfg"))
+
+	dst := filepath.Join(t.TempDir(), "nested", "dst")
+	assert.NoError(driver.Download("backing-images/image.cfg", dst))
+	data, err := os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal([]byte("file content"), data)
+
+	assert.Error(driver.Download("backing-images/missing.cfg", dst))
+}
+
+func TestExpiredLockDoesNotBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, store := newTestDriver(t)
+
+	// A deletion lock left behind by a client that went away long ago
+	store.SetClock(func() time.Time { return time.Now().Add(-2 * backupstore.LOCK_DURATION) })
+	staleLock, err := backupstore.New(driver, "vol-1", backupstore.DELETION_LOCK)
+	assert.NoError(err)
+	assert.NoError(staleLock.Lock())
+	defer func() {
+		_ = staleLock.Unlock()
+	}()
+	store.SetClock(time.Now)
+
+	backupLock, err := backupstore.New(driver, "vol-1", backupstore.BACKUP_LOCK)
+	assert.NoError(err)
+	assert.NoError(backupLock.Lock())
+	assert.NoError(backupLock.Unlock())
+}
+
+func TestActiveLockBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+
+	deletionLock, err := backupstore.New(driver, "vol-1", backupstore.DELETION_LOCK)
+	assert.NoError(err)
+	assert.NoError(deletionLock.Lock())
+	defer func() {
+		_ = deletionLock.Unlock()
+	}()
+
+	backupLock, err := backupstore.New(driver, "vol-1", backupstore.BACKUP_LOCK)
+	assert.NoError(err)
+	assert.ErrorContains(backupLock.Lock(), "failed to acquire lock")
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		driver, _ := newTestDriver(t)
+		return driver
+	})
+}
@@ -0,0 +1,476 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// The volumes using pack files append their blocks to larger pack objects
+// under volumes/.../<volume>/packs instead of storing each of them in its own
+// object, so that the number of objects to check, list and delete doesn't grow
+// with the number of blocks. Each <pack>.pack comes with a <pack>.idx listing
+// the offset and the length of the blocks in it. The index is written after the
+// pack, a pack without an index is garbage left by a failed backup.
+//
+// The pack and its index are each written at once. As the index is written
+// last, a crash between the two writes leaves no index pointing to missing
+// data, only a pack nobody reads until GC deletes it.
+//
+// A block of a pack is deleted by repacking the live blocks of the pack into a
+// new one during GC, once less than half of the pack is live.
+const (
+	PACKS_DIRECTORY = "packs"
+	PACK_SUFFIX     = ".pack"
+	PACK_IDX_SUFFIX = ".idx"
+
+	packRepackThreshold = 0.5
+)
+
+// packFileSize is the size a pack is filled up to before it's written, unless
+// BackupParameterPackFileSize sets another one for the backup.
+var packFileSize = int64(32 * 1024 * 1024)
+
+type packEntry struct {
+	Checksum string
+	Offset   int64
+	Length   int64
+}
+
+type packIndex struct {
+	Blocks []packEntry
+}
+
+type packLocation struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+// packStore holds the pack indexes of a volume and the pack being filled by a
+// backup.
+type packStore struct {
+	sync.Mutex
+	driver     BackupStoreDriver
+	volumeName string
+	// size is the size the pack being filled is written at
+	size int64
+
+	// The location of each block, the ones of the pack being filled included
+	locations map[string]packLocation
+	// The blocks of each written pack as its index lists them
+	packs map[string][]packEntry
+
+	pendingName    string
+	pendingData    []byte
+	pendingEntries []packEntry
+}
+
+func getPackPath(volumeName string) string {
+	return filepath.Join(getVolumePath(volumeName), PACKS_DIRECTORY) + "/"
+}
+
+func getPackFilePath(volumeName, packName string) string {
+	return filepath.Join(getPackPath(volumeName), packName+PACK_SUFFIX)
+}
+
+func getPackIndexFilePath(volumeName, packName string) string {
+	return filepath.Join(getPackPath(volumeName), packName+PACK_IDX_SUFFIX)
+}
+
+// newPackName returns a new pack name, the names sort in the order the packs
+// are created.
+func newPackName() string {
+	return util.GenerateName(fmt.Sprintf("pack-%016x", time.Now().UnixNano()))
+}
+
+// prepareVolumePackFiles decides whether a new backup volume uses pack files,
+// given by BackupParameterPackFiles. The existing volumes keep their layout.
+func prepareVolumePackFiles(ctx context.Context, driver BackupStoreDriver, volume *Volume, parameters map[string]string) error {
+	usePackFiles := false
+	if value := parameters[BackupParameterPackFiles]; value != "" {
+		var err error
+		if usePackFiles, err = strconv.ParseBool(value); err != nil {
+			return errors.Wrapf(err, "invalid value %v of parameter %v", value, BackupParameterPackFiles)
+		}
+	}
+
+	if volumeExists(ctx, driver, volume.Name) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if usePackFiles && volume.BlockPool {
+		return fmt.Errorf("backup volume %v cannot use both the block pool and pack files", volume.Name)
+	}
+	volume.PackFiles = usePackFiles
+	return nil
+}
+
+// loadVolumePacks loads the pack indexes of the volume if it uses pack files.
+func loadVolumePacks(ctx context.Context, driver BackupStoreDriver, volume *Volume) error {
+	if !volume.PackFiles {
+		return nil
+	}
+	packs, err := loadPackStore(ctx, driver, volume.Name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the packs of volume %v", volume.Name)
+	}
+	volume.packs = packs
+	return nil
+}
+
+func loadPackStore(ctx context.Context, driver BackupStoreDriver, volumeName string) (*packStore, error) {
+	p := &packStore{
+		driver:     driver,
+		volumeName: volumeName,
+		size:       packFileSize,
+		locations:  map[string]packLocation{},
+		packs:      map[string][]packEntry{},
+	}
+
+	names, err := listPackNames(ctx, driver, volumeName, PACK_IDX_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	// The latest copy of a block wins, see newPackName
+	sort.Strings(names)
+	for _, name := range names {
+		index := &packIndex{}
+		if err := LoadConfigInBackupStoreWithContext(ctx, driver, getPackIndexFilePath(volumeName, name), index); err != nil {
+			return nil, errors.Wrapf(err, "failed to load the index of pack %v", name)
+		}
+		p.packs[name] = index.Blocks
+		for _, entry := range index.Blocks {
+			p.locations[entry.Checksum] = packLocation{
+				pack:   name,
+				offset: entry.Offset,
+				length: entry.Length,
+			}
+		}
+	}
+	return p, nil
+}
+
+func listPackNames(ctx context.Context, driver BackupStoreDriver, volumeName, suffix string) ([]string, error) {
+	fileList, err := NewDriverWithContext(driver).ListWithContext(ctx, getPackPath(volumeName))
+	if err != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// path doesn't exist
+		return []string{}, nil
+	}
+	return util.ExtractNames(fileList, "", suffix), nil
+}
+
+func (p *packStore) has(checksum string) bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.locations[checksum]
+	return ok
+}
+
+// add appends the block to the pack being filled, the pack is written once it
+// reaches the pack size.
+func (p *packStore) add(ctx context.Context, checksum string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block %v", checksum)
+	}
+
+	p.Lock()
+	if p.pendingName == "" {
+		p.pendingName = newPackName()
+	}
+	entry := packEntry{
+		Checksum: checksum,
+		Offset:   int64(len(p.pendingData)),
+		Length:   int64(len(data)),
+	}
+	p.pendingData = append(p.pendingData, data...)
+	p.pendingEntries = append(p.pendingEntries, entry)
+	p.locations[checksum] = packLocation{
+		pack:   p.pendingName,
+		offset: entry.Offset,
+		length: entry.Length,
+	}
+	if int64(len(p.pendingData)) < p.size {
+		p.Unlock()
+		return nil
+	}
+	name, data, entries := p.takePending()
+	p.Unlock()
+
+	return p.writePack(ctx, name, data, entries)
+}
+
+// flush writes the pack being filled.
+func (p *packStore) flush(ctx context.Context) error {
+	p.Lock()
+	name, data, entries := p.takePending()
+	p.Unlock()
+
+	if name == "" {
+		return nil
+	}
+	return p.writePack(ctx, name, data, entries)
+}
+
+// takePending returns the pack being filled and starts a new one. The caller
+// holds the lock.
+func (p *packStore) takePending() (string, []byte, []packEntry) {
+	name, data, entries := p.pendingName, p.pendingData, p.pendingEntries
+	p.pendingName = ""
+	p.pendingData = nil
+	p.pendingEntries = nil
+	return name, data, entries
+}
+
+// writePack writes the pack, then its index which makes its blocks readable.
+func (p *packStore) writePack(ctx context.Context, name string, data []byte, entries []packEntry) error {
+	packFile := getPackFilePath(p.volumeName, name)
+	if err := NewDriverWithContext(p.driver).WriteWithContext(ctx, packFile, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "failed to write pack %v", packFile)
+	}
+	if err := SaveConfigInBackupStoreWithContext(ctx, p.driver, getPackIndexFilePath(p.volumeName, name), &packIndex{Blocks: entries}); err != nil {
+		return errors.Wrapf(err, "failed to write the index of pack %v", packFile)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.packs[name] = entries
+	return nil
+}
+
+// read returns the stored block, as it would be read from its block file.
+func (p *packStore) read(ctx context.Context, checksum string) ([]byte, error) {
+	p.Lock()
+	loc, ok := p.locations[checksum]
+	p.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot find block %v in the packs of volume %v", checksum, p.volumeName)
+	}
+	return readPackRange(ctx, p.driver, getPackFilePath(p.volumeName, loc.pack), loc.offset, loc.length)
+}
+
+// readPackRange reads length bytes at offset of the pack.
+func readPackRange(ctx context.Context, driver BackupStoreDriver, packFile string, offset, length int64) ([]byte, error) {
+	rc, err := ReadRangeWithContext(ctx, driver, packFile, offset, length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pack %v", packFile)
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(rc, data); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %v bytes at offset %v of pack %v", length, offset, packFile)
+	}
+	return data, nil
+}
+
+// decompressAndVerifyVolumeBlock is DecompressAndVerifyWithFallback for a block
+// of the volume, read from its pack or from its block file.
+func decompressAndVerifyVolumeBlock(ctx context.Context, driver BackupStoreDriver, volume *Volume, decompression, checksum string) (io.Reader, error) {
+	if volume.packs.has(checksum) {
+		read := func() ([]byte, error) {
+			return volume.packs.read(ctx, checksum)
+		}
+		return decompressAndVerifyWithFallback(ctx, "packed block "+checksum, read, decompression, checksum)
+	}
+	return DecompressAndVerifyWithFallback(ctx, driver, getVolumeBlockFilePath(volume, checksum), decompression, checksum)
+}
+
+// readVolumeBlock reads the stored block of the volume, from its pack or from
+// its block file, without retrying.
+func readVolumeBlock(ctx context.Context, driver BackupStoreDriver, volume *Volume, checksum string) ([]byte, error) {
+	if volume.packs.has(checksum) {
+		return volume.packs.read(ctx, checksum)
+	}
+	return readBlockFile(ctx, driver, getVolumeBlockFilePath(volume, checksum))
+}
+
+// volumeBlockExists tells whether the block of the volume is stored, in a pack
+// or in its block file. A block isn't reported missing once ctx is done, the
+// error of ctx is returned instead.
+func volumeBlockExists(ctx context.Context, driver BackupStoreDriver, volume *Volume, checksum string) (bool, error) {
+	if volume.packs.has(checksum) {
+		return true, nil
+	}
+	if !NewDriverWithContext(driver).FileExistsWithContext(ctx, getVolumeBlockFilePath(volume, checksum)) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// packRepackPlan is what GC does to the packs of a volume, see planRepack.
+type packRepackPlan struct {
+	// rewrittenPacks are repacked with their live blocks only, the blocks of
+	// deletedPacks are all unused
+	rewrittenPacks []string
+	deletedPacks   []string
+	liveEntries    map[string][]packEntry
+
+	// deletedBlocks are the unused blocks of these packs, and reclaimedSize the
+	// size of the packs minus the one of their live blocks
+	deletedBlocks []string
+	reclaimedSize int64
+}
+
+// planRepack decides which packs GC rewrites or deletes. The packs whose live
+// blocks make less than packRepackThreshold of them are rewritten with their
+// live blocks only, the unused blocks of the other packs stay until then.
+func planRepack(p *packStore, blockMap map[string]*BlockInfo) *packRepackPlan {
+	plan := &packRepackPlan{
+		liveEntries: map[string][]packEntry{},
+	}
+
+	packNames := make([]string, 0, len(p.packs))
+	for name := range p.packs {
+		packNames = append(packNames, name)
+	}
+	sort.Strings(packNames)
+
+	for _, name := range packNames {
+		entries := p.packs[name]
+		liveEntries := []packEntry{}
+		unusedBlocks := []string{}
+		liveBytes, totalBytes := int64(0), int64(0)
+		for _, entry := range entries {
+			totalBytes += entry.Length
+			if p.locations[entry.Checksum].pack != name {
+				// A newer pack has a copy of the block
+				continue
+			}
+			if isBlockReferenced(blockMap[entry.Checksum]) {
+				liveEntries = append(liveEntries, entry)
+				liveBytes += entry.Length
+			} else {
+				unusedBlocks = append(unusedBlocks, entry.Checksum)
+			}
+		}
+		if len(liveEntries) > 0 && float64(liveBytes) >= packRepackThreshold*float64(totalBytes) {
+			continue
+		}
+
+		if len(liveEntries) > 0 {
+			plan.rewrittenPacks = append(plan.rewrittenPacks, name)
+			plan.liveEntries[name] = liveEntries
+		} else {
+			plan.deletedPacks = append(plan.deletedPacks, name)
+		}
+		plan.deletedBlocks = append(plan.deletedBlocks, unusedBlocks...)
+		plan.reclaimedSize += totalBytes - liveBytes
+	}
+	sort.Strings(plan.deletedBlocks)
+	return plan
+}
+
+// cleanupPackedBlocks is cleanupBlocks for the volumes using pack files. The
+// packs are rewritten or deleted as planned by planRepack, the packs left
+// without an index by failed backups are deleted.
+func cleanupPackedBlocks(ctx context.Context, driver BackupStoreDriver, blockMap map[string]*BlockInfo, volume *Volume) error {
+	p := volume.packs
+	activeBlockCount := int64(0)
+	for _, blk := range blockMap {
+		if isBlockReferenced(blk) && isBlockPresent(blk) {
+			activeBlockCount++
+		}
+	}
+
+	plan := planRepack(p, blockMap)
+	d := NewDriverWithContext(driver)
+	for _, name := range plan.rewrittenPacks {
+		packFile := getPackFilePath(volume.Name, name)
+		rc, err := d.ReadWithContext(ctx, packFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read pack %v", packFile)
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read pack %v", packFile)
+		}
+		for _, entry := range plan.liveEntries[name] {
+			if entry.Offset+entry.Length > int64(len(data)) {
+				return fmt.Errorf("block %v is out of the range of pack %v", entry.Checksum, packFile)
+			}
+			if err := p.add(ctx, entry.Checksum, bytes.NewReader(data[entry.Offset:entry.Offset+entry.Length])); err != nil {
+				return err
+			}
+		}
+	}
+	obsoletePacks := append(append([]string{}, plan.rewrittenPacks...), plan.deletedPacks...)
+	for _, name := range obsoletePacks {
+		for _, entry := range p.packs[name] {
+			if p.locations[entry.Checksum].pack == name {
+				delete(p.locations, entry.Checksum)
+			}
+		}
+	}
+	// The live blocks are in the new packs before the old ones are deleted
+	if err := p.flush(ctx); err != nil {
+		return err
+	}
+
+	var deletionFailures []string
+	for _, name := range obsoletePacks {
+		if err := d.RemoveWithContext(ctx, getPackIndexFilePath(volume.Name, name)); err != nil {
+			deletionFailures = append(deletionFailures, name)
+			continue
+		}
+		delete(p.packs, name)
+		if err := d.RemoveWithContext(ctx, getPackFilePath(volume.Name, name)); err != nil {
+			deletionFailures = append(deletionFailures, name)
+		}
+	}
+	packFileNames, err := listPackNames(ctx, driver, volume.Name, PACK_SUFFIX)
+	if err != nil {
+		return err
+	}
+	for _, name := range packFileNames {
+		if _, ok := p.packs[name]; ok {
+			continue
+		}
+		if err := d.RemoveWithContext(ctx, getPackFilePath(volume.Name, name)); err != nil {
+			deletionFailures = append(deletionFailures, name)
+		}
+	}
+
+	if len(deletionFailures) > 0 {
+		return fmt.Errorf("failed to delete packs: %v", deletionFailures)
+	}
+
+	log.Infof("Retained %v blocks in %v packs for volume %v", activeBlockCount, len(p.packs), volume.Name)
+	log.Infof("Removed %v unused blocks, repacked %v packs and deleted %v packs for volume %v",
+		len(plan.deletedBlocks), len(plan.rewrittenPacks), len(plan.deletedPacks), volume.Name)
+	log.Info("GC completed")
+
+	v, err := loadVolume(ctx, driver, volume.Name)
+	if err != nil {
+		return err
+	}
+
+	// update the block count to what we actually have on disk that is in use
+	v.BlockCount = activeBlockCount
+	return saveVolume(ctx, driver, v)
+}
@@ -0,0 +1,207 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+func usePackFileSize(t *testing.T, size int64) {
+	t.Helper()
+
+	original := packFileSize
+	packFileSize = size
+	t.Cleanup(func() {
+		packFileSize = original
+	})
+}
+
+var packParameters = map[string]string{BackupParameterPackFiles: "true"}
+
+func TestPackFilesBackupAndRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	usePackFileSize(t, 4*deltaBlockSize)
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(16*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, packParameters)
+
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.True(volume.PackFiles)
+	assert.Equal(int64(16), volume.BlockCount)
+	exists, err := afero.DirExists(m.fs, getBlockPath(deltaVolumeName))
+	assert.NoError(err)
+	assert.False(exists)
+	packNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packNames, 4)
+
+	assert.True(bytes.Equal(content, restoreTestBackup(t, "backup-1")))
+
+	// The blocks found in the packs aren't uploaded again
+	createTestBackup(t, deltaVolumeName, "backup-2", content, packParameters)
+	backup, err := loadBackup(context.Background(), m, "backup-2", deltaVolumeName)
+	assert.NoError(err)
+	assert.Zero(backup.NewlyUploadedDataSize)
+}
+
+func TestPackFilesRepackedByGC(t *testing.T) {
+	assert := assert.New(t)
+
+	usePackFileSize(t, 4*deltaBlockSize)
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(8*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, packParameters)
+
+	// Only the first block is shared by the backups
+	changed := append(append([]byte{}, content[:deltaBlockSize]...), randomData(2, int(7*deltaBlockSize))...)
+	createTestBackup(t, deltaVolumeName, "backup-2", changed, packParameters)
+	packNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packNames, 4)
+
+	// A pack left without an index by a failed backup
+	orphanPack := getPackFilePath(deltaVolumeName, newPackName())
+	assert.NoError(afero.WriteFile(m.fs, orphanPack, []byte("orphan"), 0644))
+
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)))
+
+	// The first pack of backup-1 is repacked for its shared block, the other
+	// one is deleted
+	newPackNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(newPackNames, 3)
+	assert.Subset(newPackNames, packNames[2:])
+	exists, err := afero.Exists(m.fs, orphanPack)
+	assert.NoError(err)
+	assert.False(exists)
+
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(int64(8), volume.BlockCount)
+
+	assert.True(bytes.Equal(changed, restoreTestBackup(t, "backup-2")))
+}
+
+func TestPackFilesRejectBlockPool(t *testing.T) {
+	newDeltaMockStoreDriver(t)
+	config := newDeltaBackupConfig(newMockDeltaOps())
+	config.Parameters[BackupParameterBlockPool] = "true"
+	config.Parameters[BackupParameterPackFiles] = "true"
+
+	_, err := CreateDeltaBlockBackup("backup-1", config)
+	assert.ErrorContains(t, err, "cannot use both the block pool and pack files")
+}
+
+// indexFailingFs fails the writes of the pack indexes once failIndexes is set,
+// as if the backup crashed after writing a pack.
+type indexFailingFs struct {
+	afero.Fs
+	failIndexes atomic.Bool
+}
+
+func (fs *indexFailingFs) Create(name string) (afero.File, error) {
+	if fs.failIndexes.Load() && strings.HasSuffix(name, PACK_IDX_SUFFIX) {
+		return nil, fmt.Errorf("failed to create %v", name)
+	}
+	return fs.Fs.Create(name)
+}
+
+func TestPackFilesCrashBetweenWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := &indexFailingFs{Fs: afero.NewMemMapFs()}
+	m := registerDeltaMockStoreDriver(t, deltaDriverName, fs)
+	parameters := map[string]string{
+		BackupParameterPackFiles:    "true",
+		BackupParameterPackFileSize: fmt.Sprint(4 * deltaBlockSize),
+	}
+	content := randomData(1, int(8*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, parameters)
+	packNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_IDX_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packNames, 2)
+
+	fs.failIndexes.Store(true)
+	changed := randomData(2, int(8*deltaBlockSize))
+	ops := newMockDeltaOps()
+	ops.content = changed
+	ops.mappings = &types.Mappings{
+		BlockSize: deltaBlockSize,
+		Mappings:  []types.Mapping{{Offset: 0, Size: int64(len(changed))}},
+	}
+	config := newDeltaBackupConfig(ops)
+	config.Snapshot.Name = "backup-2"
+	config.Volume.Size = int64(len(changed))
+	for k, v := range parameters {
+		config.Parameters[k] = v
+	}
+	_, err = CreateDeltaBlockBackup("backup-2", config)
+	assert.NoError(err)
+	ops.waitForSnapshotClosed(t)
+	assert.Contains(ops.getLastStatus(t).errMessage, "failed to write the index of pack")
+	fs.failIndexes.Store(false)
+
+	// The pack written without its index isn't read
+	packFileNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packFileNames, 3)
+	packs, err := loadPackStore(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(packs.packs, 2)
+
+	// So its blocks are uploaded again by the next backup
+	createTestBackup(t, deltaVolumeName, "backup-3", changed, parameters)
+	backup, err := loadBackup(context.Background(), m, "backup-3", deltaVolumeName)
+	assert.NoError(err)
+	assert.NotZero(backup.NewlyUploadedDataSize)
+	packNames, err = listPackNames(context.Background(), m, deltaVolumeName, PACK_IDX_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packNames, 4)
+	assert.True(bytes.Equal(changed, restoreTestBackup(t, "backup-3")))
+
+	// And GC deletes it along with the failed backup
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-2", deltaVolumeName, deltaDriverURL)))
+	packFileNames, err = listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Equal(packNames, packFileNames)
+}
+
+func TestGetPackFileSizeFromParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	size, err := getPackFileSizeFromParameters(nil)
+	assert.NoError(err)
+	assert.Equal(packFileSize, size)
+	size, err = getPackFileSizeFromParameters(map[string]string{BackupParameterPackFileSize: "8Mi"})
+	assert.NoError(err)
+	assert.Equal(int64(8*1024*1024), size)
+	for _, value := range []string{"0", "-1Mi", "big"} {
+		_, err = getPackFileSizeFromParameters(map[string]string{BackupParameterPackFileSize: value})
+		assert.ErrorContains(err, "invalid pack file size", value)
+	}
+}
+
+func TestPackFilesRejectBlockPoolMigration(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", randomData(1, int(4*deltaBlockSize)), packParameters)
+	filesBefore := listFiles(t, m.fs)
+
+	err := MigrateVolumeToBlockPool(EncodeBackupURL("", deltaVolumeName, deltaDriverURL))
+	assert.ErrorContains(err, "using pack files cannot use the block pool")
+	volume, err := loadVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.False(volume.BlockPool)
+	assert.Equal(filesBefore, listFiles(t, m.fs))
+}
@@ -0,0 +1,351 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gammazero/workerpool"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
+	"github.com/longhorn/backupstore/types"
+)
+
+// RepairConfig configures the repair of the blocks of a backup volume.
+type RepairConfig struct {
+	DestURL    string
+	VolumeName string
+	// SourceURLs are the other backup targets the blocks are looked up in,
+	// after the other volumes of the backup target of the volume
+	SourceURLs []string
+	// CheckBlockData reads each block referenced by the backups to repair the
+	// corrupted ones too, only the missing ones are repaired otherwise
+	CheckBlockData bool
+	// ConcurrentLimit bounds the requests in flight, DefaultGCConcurrentLimit
+	// if not set
+	ConcurrentLimit int32
+}
+
+// RepairReport is what Repair did to the damaged blocks of the volume.
+type RepairReport struct {
+	VolumeName string
+
+	RepairedBlocks []RepairedBlock `json:",omitempty"`
+	// UnrecoverableBlocks are the damaged blocks found intact nowhere
+	UnrecoverableBlocks []string `json:",omitempty"`
+}
+
+// RepairedBlock is a damaged block replaced by the copy of the source volume.
+type RepairedBlock struct {
+	BlockChecksum string
+	SourceURL     string
+	SourceVolume  string
+}
+
+func Repair(config *RepairConfig) (*RepairReport, error) {
+	return RepairWithContext(context.Background(), config)
+}
+
+// RepairWithContext replaces the blocks of the volume found missing or
+// corrupted by the verification of its backups with an intact copy found in
+// another volume of its backup target or of the source ones. The blocks are
+// content addressed, any block with the same checksum will do. The copies are
+// stored the way a backup of the volume would, in a new pack for the volumes
+// using pack files.
+//
+// The volume is locked like for a deletion, so that no backup trusts the
+// damaged blocks meanwhile. Its block index is removed once damaged blocks are
+// found, and the unrecoverable blocks are recorded in its damaged blocks file:
+// the next backups upload them again whenever they find them in the volume,
+// the last backup referencing them or not.
+func RepairWithContext(ctx context.Context, config *RepairConfig) (*RepairReport, error) {
+	if config.VolumeName == "" {
+		return nil, fmt.Errorf("invalid empty volume name for repair")
+	}
+	volumeName := config.VolumeName
+	repairLog := log.WithField(LogFieldVolume, volumeName)
+
+	driver, err := GetBackupStoreDriver(config.DestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := New(driver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			repairLog.WithError(unlockErr).Warn("Failed to unlock")
+		}
+	}()
+	if err := lock.LockWithContext(ctx); err != nil {
+		return nil, err
+	}
+
+	verifyReport, err := verifyVolume(ctx, driver, volumeName, &VerifyConfig{
+		CheckBlockData:  config.CheckBlockData,
+		ConcurrentLimit: config.ConcurrentLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	damaged := map[string]bool{}
+	for _, blk := range verifyReport.MissingBlocks {
+		damaged[blk.BlockChecksum] = true
+	}
+	for _, blk := range verifyReport.CorruptedBlocks {
+		damaged[blk.BlockChecksum] = true
+	}
+
+	report := &RepairReport{
+		VolumeName: volumeName,
+	}
+	if len(damaged) == 0 {
+		return report, nil
+	}
+	if err := removeBlockIndex(ctx, driver, volumeName); err != nil {
+		return nil, err
+	}
+
+	v, err := loadVolume(ctx, driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadVolumePacks(ctx, driver, v); err != nil {
+		return nil, err
+	}
+
+	r := &blockRepairer{
+		driver:          driver,
+		volume:          v,
+		damaged:         damaged,
+		concurrentLimit: config.ConcurrentLimit,
+		report:          report,
+	}
+	for _, sourceURL := range append([]string{config.DestURL}, config.SourceURLs...) {
+		if err := r.repairFromTarget(ctx, sourceURL, sourceURL == config.DestURL); err != nil {
+			return nil, err
+		}
+	}
+	if v.PackFiles {
+		if err := v.packs.flush(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	for checksum := range r.damaged {
+		report.UnrecoverableBlocks = append(report.UnrecoverableBlocks, checksum)
+	}
+	sort.Strings(report.UnrecoverableBlocks)
+	sort.Slice(report.RepairedBlocks, func(i, j int) bool {
+		return report.RepairedBlocks[i].BlockChecksum < report.RepairedBlocks[j].BlockChecksum
+	})
+	if err := updateDamagedBlocks(ctx, driver, volumeName, func(checksums map[string]bool) {
+		for _, blk := range report.RepairedBlocks {
+			delete(checksums, blk.BlockChecksum)
+		}
+		for _, checksum := range report.UnrecoverableBlocks {
+			checksums[checksum] = true
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	repairLog.WithFields(logrus.Fields{
+		"repaired_blocks":      len(report.RepairedBlocks),
+		"unrecoverable_blocks": len(report.UnrecoverableBlocks),
+	}).Info("Repaired backup volume")
+	return report, nil
+}
+
+// blockRepairer looks up the damaged blocks of the volume in the source
+// volumes one after the other, until they're all repaired.
+type blockRepairer struct {
+	mutex sync.Mutex
+
+	driver          BackupStoreDriver
+	volume          *Volume
+	damaged         map[string]bool
+	concurrentLimit int32
+	report          *RepairReport
+}
+
+// repairFromTarget repairs the blocks from the volumes of the backup target,
+// the one with the name of the volume first.
+func (r *blockRepairer) repairFromTarget(ctx context.Context, sourceURL string, isDest bool) error {
+	if r.remaining() == 0 {
+		return nil
+	}
+
+	sourceDriver := r.driver
+	if !isDest {
+		var err error
+		if sourceDriver, err = GetBackupStoreDriver(sourceURL); err != nil {
+			log.WithError(err).Warnf("Failed to get the driver of repair source %v", sourceURL)
+			return nil
+		}
+	}
+
+	jobQueues := workerpool.New(runtime.NumCPU() * 16)
+	volumeNames, err := getVolumeNames(ctx, jobQueues, sourceDriver)
+	jobQueues.StopWait()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		log.WithError(err).Warnf("Failed to list the volumes of repair source %v", sourceURL)
+		return nil
+	}
+	sort.SliceStable(volumeNames, func(i, j int) bool {
+		return volumeNames[i] == r.volume.Name && volumeNames[j] != r.volume.Name
+	})
+
+	for _, name := range volumeNames {
+		if isDest && name == r.volume.Name {
+			continue
+		}
+		if r.remaining() == 0 {
+			return nil
+		}
+		source, err := loadVolume(ctx, sourceDriver, name)
+		if err == nil {
+			err = loadVolumePacks(ctx, sourceDriver, source)
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			log.WithError(err).Warnf("Failed to load volume %v of repair source %v", name, sourceURL)
+			continue
+		}
+		if isDest && r.volume.BlockPool && source.BlockPool {
+			// The volumes of the block pool share the blocks
+			continue
+		}
+		if err := r.repairFromVolume(ctx, sourceURL, sourceDriver, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairFromVolume replaces the damaged blocks stored intact by the source
+// volume. Only failing to store a copy is an error, the blocks the source fails
+// to provide are left for the next ones.
+func (r *blockRepairer) repairFromVolume(ctx context.Context, sourceURL string, sourceDriver BackupStoreDriver, source *Volume) error {
+	workers := newBoundedWorkers(r.concurrentLimit)
+	for _, checksum := range r.damagedBlocks() {
+		workers.submit(ctx, func() error {
+			exists, err := volumeBlockExists(ctx, sourceDriver, source, checksum)
+			if err != nil || !exists {
+				return err
+			}
+			block, err := readIntactBlock(ctx, sourceDriver, source, checksum)
+			if err != nil {
+				log.WithError(err).Debugf("Failed to read block %v of volume %v of repair source %v", checksum, source.Name, sourceURL)
+				return nil
+			}
+
+			rs, _, err := encodeBlock(block, checksum, r.volume.CompressionMethod, 0, r.volume.Encryption)
+			if err != nil {
+				return errors.Wrapf(err, "failed to encode block %v", checksum)
+			}
+			if r.volume.PackFiles {
+				err = r.volume.packs.add(ctx, checksum, rs)
+			} else {
+				err = NewDriverWithContext(r.driver).WriteWithContext(ctx, getVolumeBlockFilePath(r.volume, checksum), rs)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to write repaired block %v", checksum)
+			}
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			delete(r.damaged, checksum)
+			r.report.RepairedBlocks = append(r.report.RepairedBlocks, RepairedBlock{
+				BlockChecksum: checksum,
+				SourceURL:     sourceURL,
+				SourceVolume:  source.Name,
+			})
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (r *blockRepairer) remaining() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.damaged)
+}
+
+func (r *blockRepairer) damagedBlocks() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	checksums := make([]string, 0, len(r.damaged))
+	for checksum := range r.damaged {
+		checksums = append(checksums, checksum)
+	}
+	return checksums
+}
+
+// readIntactBlock returns the decoded block of the volume once its checksum is
+// verified. The block is read once, a source failing to provide it is skipped.
+func readIntactBlock(ctx context.Context, driver BackupStoreDriver, volume *Volume, checksum string) ([]byte, error) {
+	buf, err := readVolumeBlock(ctx, driver, volume, checksum)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decodeAndVerifyBlock(buf, checksum, volume.CompressionMethod, checksum)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// addDamagedBlockMappings adds the blocks of the volume where the last backup
+// references damaged blocks to the mappings to back up, so that the backup
+// uploads them again if the snapshot still has them.
+func addDamagedBlockMappings(delta *types.Mappings, lastBackup *Backup, damagedBlocks map[string]bool, lastBlockSize, volumeSize int64) *types.Mappings {
+	blockSize := delta.BlockSize
+	mappings := append([]types.Mapping{}, delta.Mappings...)
+	for _, blk := range lastBackup.Blocks {
+		if !damagedBlocks[blk.BlockChecksum] {
+			continue
+		}
+		start := blk.Offset - blk.Offset%blockSize
+		end := blk.Offset + blk.getSize(lastBlockSize)
+		end = min(end+(blockSize-end%blockSize)%blockSize, volumeSize)
+		if start < end {
+			mappings = append(mappings, types.Mapping{Offset: start, Size: end - start})
+		}
+	}
+	if len(mappings) == len(delta.Mappings) {
+		return delta
+	}
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Offset < mappings[j].Offset
+	})
+	merged := []types.Mapping{}
+	for _, mapping := range mappings {
+		if n := len(merged); n > 0 && mapping.Offset <= merged[n-1].Offset+merged[n-1].Size {
+			merged[n-1].Size = max(merged[n-1].Size, mapping.Offset+mapping.Size-merged[n-1].Offset)
+			continue
+		}
+		merged = append(merged, mapping)
+	}
+	return &types.Mappings{
+		Mappings:  merged,
+		BlockSize: blockSize,
+	}
+}
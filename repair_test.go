@@ -0,0 +1,159 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+const secondaryDriverURL = "deltamock-secondary://localhost"
+
+func TestRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	blockNames, err := getBlockNamesForVolume(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Len(blockNames, 2)
+
+	// The secondary backup target holds a copy of the volume
+	secondary := m.clone(t, "deltamock-secondary")
+
+	otherVolumeName := "pvc-delta-2"
+	createTestBackup(t, otherVolumeName, "backup-2", nil, nil)
+
+	// The first block is only intact in the secondary backup target, the
+	// second one in the other volume
+	for _, volumeName := range []string{deltaVolumeName, otherVolumeName} {
+		assert.NoError(m.fs.Remove(getBlockFilePath(volumeName, blockNames[0])))
+	}
+	data, err := afero.ReadFile(secondary.fs, getBlockFilePath(deltaVolumeName, blockNames[0]))
+	assert.NoError(err)
+	assert.NoError(afero.WriteFile(m.fs, getBlockFilePath(deltaVolumeName, blockNames[1]), data, 0644))
+
+	report, err := Repair(&RepairConfig{
+		DestURL:        deltaDriverURL,
+		VolumeName:     deltaVolumeName,
+		SourceURLs:     []string{secondaryDriverURL},
+		CheckBlockData: true,
+	})
+	assert.NoError(err)
+	expected := []RepairedBlock{
+		{BlockChecksum: blockNames[0], SourceURL: secondaryDriverURL, SourceVolume: deltaVolumeName},
+		{BlockChecksum: blockNames[1], SourceURL: deltaDriverURL, SourceVolume: otherVolumeName},
+	}
+	if blockNames[0] > blockNames[1] {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	assert.Equal(expected, report.RepairedBlocks)
+	assert.Empty(report.UnrecoverableBlocks)
+
+	verifyReport, err := VerifyDeltaBlockBackup(context.Background(), EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL), 1, nil)
+	assert.NoError(err)
+	assert.True(verifyReport.Restorable())
+
+	// Without the secondary backup target the first block can't be repaired,
+	// the next backup mustn't trust the block index about it
+	assert.NoError(m.fs.Remove(getBlockFilePath(deltaVolumeName, blockNames[0])))
+	report, err = Repair(&RepairConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName})
+	assert.NoError(err)
+	assert.Empty(report.RepairedBlocks)
+	assert.Equal([]string{blockNames[0]}, report.UnrecoverableBlocks)
+	assert.False(m.FileExists(getBlockIndexFilePath(deltaVolumeName)))
+}
+
+func TestRepairPackFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	usePackFileSize(t, 4*deltaBlockSize)
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(4*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, packParameters)
+	m.clone(t, "deltamock-secondary")
+
+	// The packed blocks are overwritten in place
+	packNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(packNames, 1)
+	packFile := getPackFilePath(deltaVolumeName, packNames[0])
+	data, err := afero.ReadFile(m.fs, packFile)
+	assert.NoError(err)
+	assert.NoError(afero.WriteFile(m.fs, packFile, bytes.Repeat([]byte{0xff}, len(data)), 0644))
+
+	report, err := Repair(&RepairConfig{
+		DestURL:        deltaDriverURL,
+		VolumeName:     deltaVolumeName,
+		SourceURLs:     []string{secondaryDriverURL},
+		CheckBlockData: true,
+	})
+	assert.NoError(err)
+	assert.Len(report.RepairedBlocks, 4)
+	assert.Empty(report.UnrecoverableBlocks)
+
+	// The repaired blocks are in a new pack, the latest copy of a block wins
+	newPackNames, err := listPackNames(context.Background(), m, deltaVolumeName, PACK_SUFFIX)
+	assert.NoError(err)
+	assert.Len(newPackNames, 2)
+	assert.True(bytes.Equal(content, restoreTestBackup(t, "backup-1")))
+}
+
+func TestRepairExcludesBackups(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	createTestBackup(t, deltaVolumeName, "backup-1", nil, nil)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	damaged := backup.Blocks[0]
+	assert.NoError(afero.WriteFile(m.fs, getBlockFilePath(deltaVolumeName, damaged.BlockChecksum), randomData(1, 100), 0644))
+
+	// The repair waits for the incremental backup running meanwhile, which
+	// trusts the damaged block
+	ops := newStoppableDeltaOps()
+	config := newDeltaBackupConfig(ops.mockDeltaOps)
+	config.DeltaOps = ops
+	config.Snapshot.Name = "snap-3"
+	isIncremental, err := CreateDeltaBlockBackup("backup-2", config)
+	assert.NoError(err)
+	assert.True(isIncremental)
+	repairConfig := &RepairConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName, CheckBlockData: true}
+	_, err = Repair(repairConfig)
+	assert.ErrorContains(err, "failed to acquire lock")
+	close(ops.release)
+	ops.waitForSnapshotClosed(t)
+	assert.Empty(ops.getLastStatus(t).errMessage)
+
+	report, err := Repair(repairConfig)
+	assert.NoError(err)
+	assert.Equal([]string{damaged.BlockChecksum}, report.UnrecoverableBlocks)
+	damagedBlocks, err := loadDamagedBlocks(context.Background(), m, deltaVolumeName)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{damaged.BlockChecksum: true}, damagedBlocks)
+
+	// The next backup uploads the unrecoverable block again, though it's
+	// unchanged since the last backup
+	nextOps := newMockDeltaOps()
+	nextOps.localSnapshots["snap-3"] = true
+	nextOps.mappings = &types.Mappings{
+		BlockSize: deltaBlockSize,
+		Mappings:  []types.Mapping{{Offset: 2 * deltaBlockSize, Size: deltaBlockSize}},
+	}
+	config = newDeltaBackupConfig(nextOps)
+	config.Snapshot.Name = "snap-4"
+	isIncremental, err = CreateDeltaBlockBackup("backup-3", config)
+	assert.NoError(err)
+	assert.True(isIncremental)
+	nextOps.waitForSnapshotClosed(t)
+	assert.Empty(nextOps.getLastStatus(t).errMessage)
+
+	verifyReport, err := Verify(&VerifyConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName, CheckBlockData: true})
+	assert.NoError(err)
+	assert.True(verifyReport.Volumes[deltaVolumeName].Healthy())
+	assert.False(m.FileExists(getDamagedBlocksFilePath(deltaVolumeName)))
+}
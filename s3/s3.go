@@ -106,6 +106,10 @@ func (s *BackupStoreDriver) updatePath(path string) string {
 }
 
 func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
+	return s.ListWithContext(context.Background(), listPath)
+}
+
+func (s *BackupStoreDriver) ListWithContext(ctx context.Context, listPath string) ([]string, error) {
 	var result []string
 
 	path := s.updatePath(listPath)
@@ -113,7 +117,7 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 		path += "/"
 	}
 
-	contents, prefixes, err := s.service.ListObjects(context.Background(), path, "/")
+	contents, prefixes, err := s.service.ListObjects(ctx, path, "/")
 	if err != nil {
 		log.WithError(err).Error("Failed to list s3")
 		return result, err
@@ -143,12 +147,20 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 }
 
 func (s *BackupStoreDriver) FileExists(filePath string) bool {
-	return s.FileSize(filePath) >= 0
+	return s.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return s.FileSizeWithContext(ctx, filePath) >= 0
 }
 
 func (s *BackupStoreDriver) FileSize(filePath string) int64 {
+	return s.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
 	path := s.updatePath(filePath)
-	head, err := s.service.HeadObject(context.Background(), path)
+	head, err := s.service.HeadObject(ctx, path)
 	if err != nil || head.ContentLength == nil {
 		return -1
 	}
@@ -156,8 +168,12 @@ func (s *BackupStoreDriver) FileSize(filePath string) int64 {
 }
 
 func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
+	return s.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (s *BackupStoreDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
 	path := s.updatePath(filePath)
-	head, err := s.service.HeadObject(context.Background(), path)
+	head, err := s.service.HeadObject(ctx, path)
 	if err != nil || head.ContentLength == nil {
 		return time.Time{}
 	}
@@ -165,13 +181,60 @@ func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
 }
 
 func (s *BackupStoreDriver) Remove(path string) error {
-	ctx := context.Background()
+	return s.RemoveWithContext(context.Background(), path)
+}
+
+func (s *BackupStoreDriver) RemoveWithContext(ctx context.Context, path string) error {
 	return s.service.DeleteObjects(ctx, s.updatePath(path))
 }
 
+func (s *BackupStoreDriver) RemoveMany(paths []string) error {
+	return s.RemoveManyWithContext(context.Background(), paths)
+}
+
+func (s *BackupStoreDriver) RemoveManyWithContext(ctx context.Context, paths []string) error {
+	keys := make([]string, 0, len(paths))
+	keyPaths := make(map[string]string, len(paths))
+	for _, path := range paths {
+		key := s.updatePath(path)
+		keys = append(keys, key)
+		keyPaths[key] = path
+	}
+	failures, err := s.service.DeleteObjectKeys(ctx, keys)
+	if err != nil {
+		return err
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	removeErr := &backupstore.RemoveManyError{Failures: map[string]error{}}
+	for key, err := range failures {
+		removeErr.Failures[keyPaths[key]] = err
+	}
+	return removeErr
+}
+
 func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return s.ReadWithContext(context.Background(), src)
+}
+
+func (s *BackupStoreDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	path := s.updatePath(src)
+	rc, err := s.service.GetObject(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (s *BackupStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	return s.ReadRangeWithContext(context.Background(), src, offset, length)
+}
+
+func (s *BackupStoreDriver) ReadRangeWithContext(ctx context.Context, src string, offset, length int64) (io.ReadCloser, error) {
 	path := s.updatePath(src)
-	rc, err := s.service.GetObject(context.Background(), path)
+	rc, err := s.service.GetObjectRange(ctx, path, offset, length)
 	if err != nil {
 		return nil, err
 	}
@@ -179,6 +242,10 @@ func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
 }
 
 func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return s.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (s *BackupStoreDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
 	path := s.updatePath(dst)
 	// Driver.Write only carries backup metadata (backup_*.cfg, volume.cfg) and
 	// individual data blocks, all well under the 5 GiB single-PutObject limit.
@@ -188,10 +255,23 @@ func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
 	// Google Cloud Storage) reject with SignatureDoesNotMatch. Driver.Upload
 	// (single-file backups) still uses the multipart-capable path so genuinely
 	// large payloads keep their parallel-upload performance.
-	return s.service.PutObjectAsSinglePart(context.Background(), path, rs)
+	return s.service.PutObjectAsSinglePart(ctx, path, rs)
+}
+
+func (s *BackupStoreDriver) WriteStream(dst string, r io.Reader, size int64) error {
+	return s.WriteStreamWithContext(context.Background(), dst, r, size)
+}
+
+func (s *BackupStoreDriver) WriteStreamWithContext(ctx context.Context, dst string, r io.Reader, size int64) error {
+	path := s.updatePath(dst)
+	return s.service.PutObjectStream(ctx, path, r, size)
 }
 
 func (s *BackupStoreDriver) Upload(src, dst string) error {
+	return s.UploadWithContext(context.Background(), src, dst)
+}
+
+func (s *BackupStoreDriver) UploadWithContext(ctx context.Context, src, dst string) error {
 	file, err := os.Open(src)
 	if err != nil {
 		return nil
@@ -200,10 +280,14 @@ func (s *BackupStoreDriver) Upload(src, dst string) error {
 		_ = file.Close()
 	}()
 	path := s.updatePath(dst)
-	return s.service.PutObject(context.Background(), path, file)
+	return s.service.PutObject(ctx, path, file)
 }
 
 func (s *BackupStoreDriver) Download(src, dst string) error {
+	return s.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (s *BackupStoreDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
 	if _, err := os.Stat(dst); err != nil {
 		_ = os.Remove(dst)
 	}
@@ -221,7 +305,7 @@ func (s *BackupStoreDriver) Download(src, dst string) error {
 	}()
 
 	path := s.updatePath(src)
-	rc, err := s.service.GetObject(context.Background(), path)
+	rc, err := s.service.GetObject(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,161 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	bhttp "github.com/longhorn/backupstore/http"
+)
+
+// The S3 clients are shared by the operations of all the services, building
+// one loads the AWS configuration and sets up a new transport, which is
+// expensive and defeats the connection reuse.
+//
+// A client is cached per HTTP client (i.e. set of custom certificates), region
+// and retry mode. The endpoint and the credentials come from the environment,
+// the client is rebuilt once they change.
+
+// clientEnvs are the environment variables the S3 clients are built from.
+var clientEnvs = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_REGION",
+	"AWS_DEFAULT_REGION",
+	"AWS_PROFILE",
+	"AWS_CONFIG_FILE",
+	"AWS_SHARED_CREDENTIALS_FILE",
+	"AWS_WEB_IDENTITY_TOKEN_FILE",
+	"AWS_ROLE_ARN",
+	"AWS_ENDPOINTS",
+	VirtualHostedStyle,
+	AWSSignAcceptEncoding,
+}
+
+type clientCacheKey struct {
+	httpClient   *http.Client
+	region       string
+	retryBackoff bool
+}
+
+type cachedClient struct {
+	fingerprint string
+	client      *s3.Client
+}
+
+// maxCachedHTTPClients bounds the HTTP clients kept for the sets of custom
+// certificates seen so far, the certificates of a backup target may change
+// over time.
+const maxCachedHTTPClients = 8
+
+var (
+	clientCacheLock sync.Mutex
+	clientCache     = map[clientCacheKey]*cachedClient{}
+	// httpClientCache is keyed by the hash of the custom certificates, the
+	// least recently used client is evicted first, see httpClientOrder
+	httpClientCache = map[string]*http.Client{}
+	httpClientOrder []string
+)
+
+// clientEnvFingerprint hashes the environment the S3 clients are built from,
+// so that the credentials don't stay in memory as a cache key.
+func clientEnvFingerprint() string {
+	h := sha256.New()
+	for _, env := range clientEnvs {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			_, _ = h.Write([]byte{0})
+			continue
+		}
+		_, _ = h.Write([]byte{1})
+		_, _ = h.Write([]byte(value))
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func getCachedClient(key clientCacheKey, fingerprint string) *s3.Client {
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+
+	cached, ok := clientCache[key]
+	if !ok || cached.fingerprint != fingerprint {
+		return nil
+	}
+	return cached.client
+}
+
+func putCachedClient(key clientCacheKey, fingerprint string, client *s3.Client) {
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+
+	clientCache[key] = &cachedClient{
+		fingerprint: fingerprint,
+		client:      client,
+	}
+}
+
+// getHTTPClient returns the HTTP client for the custom certificates, shared by
+// the services so that their S3 clients are shared too.
+func getHTTPClient(customCerts []byte) (*http.Client, error) {
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+
+	sum := sha256.Sum256(customCerts)
+	certsHash := hex.EncodeToString(sum[:])
+	if client, ok := httpClientCache[certsHash]; ok {
+		touchHTTPClient(certsHash)
+		return client, nil
+	}
+
+	client, err := bhttp.GetClientWithCustomCerts(customCerts)
+	if err != nil {
+		return nil, err
+	}
+	if tr, ok := client.Transport.(*http.Transport); ok {
+		transfermanager.WithRoundRobinDNS()(tr)
+	}
+	if len(httpClientOrder) >= maxCachedHTTPClients {
+		evictHTTPClient(httpClientOrder[0])
+	}
+	httpClientCache[certsHash] = client
+	httpClientOrder = append(httpClientOrder, certsHash)
+	return client, nil
+}
+
+// touchHTTPClient marks the HTTP client as the most recently used one. The
+// caller holds clientCacheLock.
+func touchHTTPClient(certsHash string) {
+	for i, hash := range httpClientOrder {
+		if hash == certsHash {
+			httpClientOrder = append(append(httpClientOrder[:i:i], httpClientOrder[i+1:]...), certsHash)
+			return
+		}
+	}
+}
+
+// evictHTTPClient drops the HTTP client along with the S3 clients built on it.
+// The services still using them keep working, their connections are just no
+// longer shared. The caller holds clientCacheLock.
+func evictHTTPClient(certsHash string) {
+	client := httpClientCache[certsHash]
+	delete(httpClientCache, certsHash)
+	for i, hash := range httpClientOrder {
+		if hash == certsHash {
+			httpClientOrder = append(httpClientOrder[:i:i], httpClientOrder[i+1:]...)
+			break
+		}
+	}
+	for key := range clientCache {
+		if key.httpClient == client {
+			delete(clientCache, key)
+		}
+	}
+	client.CloseIdleConnections()
+}
@@ -0,0 +1,219 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestClientCacheReusesClient(t *testing.T) {
+	server := newFakeS3Server()
+	defer server.Close()
+	svc := newTestService(t, server.URL)
+
+	client, err := svc.newInstance(context.Background(), false)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+	reused, err := svc.newInstance(context.Background(), false)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+	if client != reused {
+		t.Fatal("expected the client to be reused")
+	}
+
+	// The retry mode is part of the client
+	retrying, err := svc.newInstance(context.Background(), true)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+	if client == retrying {
+		t.Fatal("expected a different client for the retry backoff")
+	}
+
+	// So is the HTTP client
+	other := &service{Region: svc.Region, Bucket: svc.Bucket}
+	if other.Client, err = getHTTPClient(nil); err != nil {
+		t.Fatalf("failed to get the HTTP client: %v", err)
+	}
+	otherClient, err := other.newInstance(context.Background(), false)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+	if client == otherClient {
+		t.Fatal("expected a different client for the HTTP client")
+	}
+}
+
+func TestClientCacheInvalidatedOnCredentialChange(t *testing.T) {
+	server := newFakeS3Server()
+	defer server.Close()
+	svc := newTestService(t, server.URL)
+
+	client, err := svc.newInstance(context.Background(), false)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "rotated-secret-key")
+	rotated, err := svc.newInstance(context.Background(), false)
+	if err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+	if client == rotated {
+		t.Fatal("expected a new client after the credentials changed")
+	}
+	creds, err := rotated.Options().Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve the credentials: %v", err)
+	}
+	if creds.SecretAccessKey != "rotated-secret-key" {
+		t.Fatalf("expected the rotated secret key, got %q", creds.SecretAccessKey)
+	}
+
+	// The endpoint too
+	server2 := newFakeS3Server()
+	defer server2.Close()
+	t.Setenv("AWS_ENDPOINTS", server2.URL)
+	if err := svc.PutObjectAsSinglePart(context.Background(), "backups/volume.cfg", bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("PutObjectAsSinglePart failed: %v", err)
+	}
+	if len(server.recordedRequests()) != 0 || len(server2.recordedRequests()) != 1 {
+		t.Fatalf("expected the request to reach the new endpoint, got %d and %d requests",
+			len(server.recordedRequests()), len(server2.recordedRequests()))
+	}
+}
+
+func TestHTTPClientCacheIsBounded(t *testing.T) {
+	server := newFakeS3Server()
+	defer server.Close()
+
+	certs := make([][]byte, maxCachedHTTPClients+1)
+	for i := range certs {
+		certs[i] = newTestCertificate(t, i)
+	}
+	first, err := getHTTPClient(certs[0])
+	if err != nil {
+		t.Fatalf("failed to get the HTTP client: %v", err)
+	}
+	svc := newTestService(t, server.URL)
+	svc.Client = first
+	if _, err := svc.newInstance(context.Background(), false); err != nil {
+		t.Fatalf("failed to get the client: %v", err)
+	}
+
+	// Getting a client marks it as the most recently used one
+	second, err := getHTTPClient(certs[1])
+	if err != nil {
+		t.Fatalf("failed to get the HTTP client: %v", err)
+	}
+	for _, cert := range certs[2:] {
+		if _, err := getHTTPClient(cert); err != nil {
+			t.Fatalf("failed to get the HTTP client: %v", err)
+		}
+		if _, err := getHTTPClient(certs[1]); err != nil {
+			t.Fatalf("failed to get the HTTP client: %v", err)
+		}
+	}
+
+	clientCacheLock.Lock()
+	cached := len(httpClientCache)
+	clientCacheLock.Unlock()
+	if cached > maxCachedHTTPClients {
+		t.Fatalf("expected at most %d cached HTTP clients, got %d", maxCachedHTTPClients, cached)
+	}
+	if reused, err := getHTTPClient(certs[1]); err != nil || reused != second {
+		t.Fatalf("expected the recently used HTTP client to stay cached: %v", err)
+	}
+
+	// The least recently used one is evicted, along with its S3 clients
+	clientCacheLock.Lock()
+	_, ok := clientCache[clientCacheKey{httpClient: first, region: svc.Region}]
+	clientCacheLock.Unlock()
+	if ok {
+		t.Fatal("expected the S3 client of the evicted HTTP client to be evicted")
+	}
+	if rebuilt, err := getHTTPClient(certs[0]); err != nil || rebuilt == first {
+		t.Fatalf("expected the evicted HTTP client to be rebuilt: %v", err)
+	}
+}
+
+// newTestCertificate returns a self-signed CA certificate in PEM.
+func newTestCertificate(t *testing.T, serial int) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(int64(serial + 1)),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("test-ca-%d", serial)},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create the certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// BenchmarkHeadObject measures the overhead of an operation per block, i.e. a
+// HEAD request checking the existence of a block, with the S3 client built for
+// every operation and with the cached one.
+func BenchmarkHeadObject(b *testing.B) {
+	server := newFakeS3Bucket(b, "test-bucket")
+	b.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	b.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	b.Setenv("AWS_ENDPOINTS", server.URL)
+
+	svc := &service{Region: "us-east-1", Bucket: "test-bucket"}
+	var err error
+	if svc.Client, err = getHTTPClient(nil); err != nil {
+		b.Fatalf("failed to get the HTTP client: %v", err)
+	}
+	key := "backupstore/volumes/blocks/block.blk"
+	if err := svc.PutObjectAsSinglePart(context.Background(), key, bytes.NewReader([]byte("block"))); err != nil {
+		b.Fatalf("PutObjectAsSinglePart failed: %v", err)
+	}
+
+	headObject := func(b *testing.B, newClient func(ctx context.Context, retryBackoff bool) (*s3.Client, error)) {
+		ctx := context.Background()
+		for b.Loop() {
+			client, err := newClient(ctx, false)
+			if err != nil {
+				b.Fatalf("failed to get the client: %v", err)
+			}
+			if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(svc.Bucket),
+				Key:    aws.String(key),
+			}); err != nil {
+				b.Fatalf("HeadObject failed: %v", err)
+			}
+		}
+	}
+
+	b.Run("Uncached", func(b *testing.B) {
+		headObject(b, svc.newClient)
+	})
+	b.Run("Cached", func(b *testing.B) {
+		headObject(b, svc.newInstance)
+	})
+}
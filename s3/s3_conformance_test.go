@@ -0,0 +1,258 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+type fakeS3Object struct {
+	data         []byte
+	lastModified time.Time
+}
+
+// fakeS3Bucket fakes the subset of the S3 API used by the driver
+// (ListObjectsV2, HeadObject, GetObject, PutObject, DeleteObject and
+// DeleteObjects) on top of an in-memory bucket, so that the driver can be
+// checked end to end without a real S3-compatible backend.
+type fakeS3Bucket struct {
+	*httptest.Server
+	bucket string
+
+	mu           sync.Mutex
+	objects      map[string]*fakeS3Object
+	batchDeletes int
+	// noBatchDelete rejects DeleteObjects like some S3-compatible services
+	noBatchDelete bool
+	// deleteDenied are the objects DeleteObjects fails to delete
+	deleteDenied map[string]bool
+}
+
+func newFakeS3Bucket(t testing.TB, bucket string) *fakeS3Bucket {
+	t.Helper()
+
+	f := &fakeS3Bucket{
+		bucket:  bucket,
+		objects: map[string]*fakeS3Object{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	Size         int64
+}
+
+type fakeS3CommonPrefix struct {
+	Prefix string
+}
+
+type fakeS3ListBucketResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string `xml:",omitempty"`
+	EncodingType   string `xml:",omitempty"`
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Contents
+	CommonPrefixes []fakeS3CommonPrefix
+}
+
+func (f *fakeS3Bucket) handle(w http.ResponseWriter, r *http.Request) {
+	// Path-style requests only, as used with a custom endpoint
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(name, "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodHead:
+		f.mu.Lock()
+		obj, exists := f.objects[key]
+		f.mu.Unlock()
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.writeHeaders(w, obj)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet:
+		f.mu.Lock()
+		obj, exists := f.objects[key]
+		f.mu.Unlock()
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if start, end, ok := parseRange(r.Header.Get("Range"), len(obj.data)); ok {
+			w.Header().Set("Content-Length", fmt.Sprint(end-start))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(obj.data)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(obj.data[start:end])
+			return
+		}
+		f.writeHeaders(w, obj)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(obj.data)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.mu.Lock()
+		f.objects[key] = &fakeS3Object{data: data, lastModified: time.Now()}
+		f.mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && key == "" && r.URL.Query().Has("delete") && !f.noBatchDelete:
+		f.deleteObjects(w, r)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type fakeS3Delete struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+func (f *fakeS3Bucket) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var req fakeS3Delete
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var errs strings.Builder
+	f.mu.Lock()
+	for _, obj := range req.Objects {
+		if f.deleteDenied[obj.Key] {
+			fmt.Fprintf(&errs, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", obj.Key)
+			continue
+		}
+		delete(f.objects, obj.Key)
+	}
+	f.batchDeletes++
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><DeleteResult>%s</DeleteResult>`, errs.String())
+}
+
+// parseRange parses a "bytes=first-last" Range header into the [start, end)
+// range of the object it covers.
+func parseRange(header string, size int) (int, int, bool) {
+	var first, last int
+	if _, err := fmt.Sscanf(header, "bytes=%d-%d", &first, &last); err != nil || first > last || first >= size {
+		return 0, 0, false
+	}
+	return first, min(last+1, size), true
+}
+
+func (f *fakeS3Bucket) writeHeaders(w http.ResponseWriter, obj *fakeS3Object) {
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+	w.Header().Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func (f *fakeS3Bucket) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3Bucket) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	result := fakeS3ListBucketResult{
+		Name:         f.bucket,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		EncodingType: q.Get("encoding-type"),
+		MaxKeys:      1000,
+	}
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if !seen[commonPrefix] {
+					seen[commonPrefix] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, fakeS3CommonPrefix{Prefix: encode(commonPrefix)})
+				}
+				continue
+			}
+		}
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, fakeS3Contents{
+			Key:          encode(key),
+			LastModified: obj.lastModified.UTC().Format(time.RFC3339),
+			Size:         int64(len(obj.data)),
+		})
+	}
+	f.mu.Unlock()
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		server := newFakeS3Bucket(t, "test-bucket")
+		t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+		t.Setenv("AWS_ENDPOINTS", server.URL)
+
+		driver, err := initFunc("s3://test-bucket@us-east-1/backupstore-root/")
+		if err != nil {
+			t.Fatalf("failed to initialize the driver: %v", err)
+		}
+		return driver
+	})
+}
@@ -1,12 +1,14 @@
 package s3
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,14 +18,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/cockroachdb/errors"
 
 	smithyhttp "github.com/aws/smithy-go/transport/http"
-	bhttp "github.com/longhorn/backupstore/http"
 )
 
 type service struct {
@@ -57,6 +57,15 @@ const (
 	// request reach S3 and come back as a raw EntityTooLarge error.
 	// https://docs.aws.amazon.com/AmazonS3/latest/userguide/upload-objects.html
 	maxSinglePutObjectSize int64 = 5 * 1024 * 1024 * 1024
+
+	// maxBufferedStreamSize is the size up to which PutObjectStream buffers a
+	// stream to put it with a single PutObject request, like the objects
+	// written by Driver.Write. The larger streams are uploaded in parts.
+	maxBufferedStreamSize int64 = 64 * 1024 * 1024
+
+	// maxDeleteObjectsKeys is the maximum number of keys of a multi-object
+	// delete request.
+	maxDeleteObjectsKeys = 1000
 )
 
 // warnInvalidSignAcceptEncoding keeps the warning for a malformed
@@ -91,8 +100,8 @@ func ignoreAcceptEncodingSigning(endpoints string) bool {
 
 	sign, err := strconv.ParseBool(value)
 	if err != nil {
-		// Warn once rather than per request, because a new client is built for
-		// every S3 operation. Without this the user sees the same
+		// Warn once rather than per client, because a new client is built
+		// whenever the environment changes. Without this the user sees the same
 		// SignatureDoesNotMatch failure the setting is meant to fix, with no
 		// indication that the value was rejected.
 		warnInvalidSignAcceptEncoding.Do(func() {
@@ -115,22 +124,37 @@ func newService(u *url.URL) (*service, error) {
 	}
 
 	// add custom ca to http client that is used by s3 service
-	customCerts := getCustomCerts()
-	client, err := bhttp.GetClientWithCustomCerts(customCerts)
+	client, err := getHTTPClient(getCustomCerts())
 	if err != nil {
 		return nil, err
 	}
-
-	if tr, ok := client.Transport.(*http.Transport); ok {
-		transfermanager.WithRoundRobinDNS()(tr)
-	}
-
 	s.Client = client
 
 	return &s, nil
 }
 
+// newInstance returns the S3 client of the service, built once and reused
+// until the environment it is built from changes.
 func (s *service) newInstance(ctx context.Context, retryBackoff bool) (*s3.Client, error) {
+	key := clientCacheKey{
+		httpClient:   s.Client,
+		region:       s.Region,
+		retryBackoff: retryBackoff,
+	}
+	fingerprint := clientEnvFingerprint()
+	if client := getCachedClient(key, fingerprint); client != nil {
+		return client, nil
+	}
+
+	client, err := s.newClient(ctx, retryBackoff)
+	if err != nil {
+		return nil, err
+	}
+	putCachedClient(key, fingerprint, client)
+	return client, nil
+}
+
+func (s *service) newClient(ctx context.Context, retryBackoff bool) (*s3.Client, error) {
 	// Load AWS configuration
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(s.Region),
@@ -179,9 +203,6 @@ func (s *service) newInstance(ctx context.Context, retryBackoff bool) (*s3.Clien
 	}), nil
 }
 
-func (s *service) Close() {
-}
-
 func parseAwsError(err error) error {
 	var ae smithy.APIError
 	if errors.As(err, &ae) {
@@ -208,7 +229,6 @@ func (s *service) ListObjects(ctx context.Context, key, delimiter string) ([]typ
 	if err != nil {
 		return nil, nil, err
 	}
-	defer s.Close()
 	// WARNING: Directory must end in "/" in S3, otherwise it may match
 	// unintentionally
 	params := &s3.ListObjectsV2Input{
@@ -240,7 +260,6 @@ func (s *service) HeadObject(ctx context.Context, key string) (*s3.HeadObjectOut
 	if err != nil {
 		return nil, err
 	}
-	defer s.Close()
 	params := &s3.HeadObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
@@ -252,14 +271,8 @@ func (s *service) HeadObject(ctx context.Context, key string) (*s3.HeadObjectOut
 	return resp, nil
 }
 
-func (s *service) PutObject(ctx context.Context, key string, reader io.ReadSeeker) error {
-	svc, err := s.newInstance(ctx, true)
-	if err != nil {
-		return err
-	}
-	defer s.Close()
-
-	// Use the AWS S3 uploader which handles signing correctly
+// newUploader returns the AWS S3 uploader, which handles signing correctly.
+func newUploader(svc *s3.Client) *manager.Uploader {
 	// manager.NewUploader defaults RequestChecksumCalculation to
 	// aws.RequestChecksumCalculationWhenSupported, independent of the
 	// RequestChecksumCalculation set on the underlying s3.Client. That default
@@ -270,9 +283,18 @@ func (s *service) PutObject(ctx context.Context, key string, reader io.ReadSeeke
 	// encoding is not supported". Align the uploader with the client's
 	// WhenRequired setting so checksums (and aws-chunked encoding) are only
 	// used when required.
-	uploader := manager.NewUploader(svc, func(u *manager.Uploader) {
+	return manager.NewUploader(svc, func(u *manager.Uploader) {
 		u.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 	})
+}
+
+func (s *service) PutObject(ctx context.Context, key string, reader io.ReadSeeker) error {
+	svc, err := s.newInstance(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	uploader := newUploader(svc)
 
 	// Ensure reader is at the beginning
 	if _, err := reader.Seek(0, io.SeekStart); err != nil {
@@ -299,6 +321,39 @@ func (s *service) PutObject(ctx context.Context, key string, reader io.ReadSeeke
 	return nil
 }
 
+// PutObjectStream uploads an object from a stream, whose size is -1 if it's
+// unknown. The streams up to maxBufferedStreamSize are put with a single
+// PutObject request like PutObjectAsSinglePart does, so that the growing
+// backup metadata keeps avoiding the multipart upload path. The larger ones are
+// uploaded in parts as they're read, only the parts in flight are buffered.
+func (s *service) PutObjectStream(ctx context.Context, key string, reader io.Reader, size int64) error {
+	if size <= maxBufferedStreamSize {
+		data, err := io.ReadAll(io.LimitReader(reader, maxBufferedStreamSize+1))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read object: %v", key)
+		}
+		if int64(len(data)) <= maxBufferedStreamSize {
+			return s.PutObjectAsSinglePart(ctx, key, bytes.NewReader(data))
+		}
+		reader = io.MultiReader(bytes.NewReader(data), reader)
+	}
+
+	svc, err := s.newInstance(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	params := &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	}
+	if _, err := newUploader(svc).Upload(ctx, params); err != nil {
+		return errors.Wrapf(parseAwsError(err), "failed to put object: %v", key)
+	}
+	return nil
+}
+
 // PutObjectAsSinglePart uploads an object using a single PutObject request,
 // bypassing the manager.Uploader (which switches to a multipart upload path
 // whenever the payload exceeds the SDK's default 5 MiB PartSize).
@@ -330,7 +385,6 @@ func (s *service) PutObjectAsSinglePart(ctx context.Context, key string, reader
 	if err != nil {
 		return err
 	}
-	defer s.Close()
 
 	return s.PutObjectSinglePart(ctx, svc, key, reader)
 }
@@ -363,7 +417,6 @@ func (s *service) GetObject(ctx context.Context, key string) (io.ReadCloser, err
 	if err != nil {
 		return nil, err
 	}
-	defer s.Close()
 
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(s.Bucket),
@@ -378,6 +431,28 @@ func (s *service) GetObject(ctx context.Context, key string) (io.ReadCloser, err
 	return resp.Body, nil
 }
 
+// GetObjectRange gets length bytes of the object at offset, with a Range
+// header.
+func (s *service) GetObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	svc, err := s.newInstance(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+
+	resp, err := svc.GetObject(ctx, params)
+	if err != nil {
+		return nil, errors.Wrapf(parseAwsError(err), "failed to get range %v-%v of object: %v", offset, offset+length-1, key)
+	}
+
+	return resp.Body, nil
+}
+
 func (s *service) DeleteObjects(ctx context.Context, key string) error {
 
 	objects, _, err := s.ListObjects(ctx, key, "")
@@ -385,28 +460,105 @@ func (s *service) DeleteObjects(ctx context.Context, key string) error {
 		return errors.Wrapf(err, "failed to list objects with prefix %v before removing them", key)
 	}
 
-	svc, err := s.newInstance(ctx, false)
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	failures, err := s.DeleteObjectKeys(ctx, keys)
 	if err != nil {
-		return errors.Wrap(err, "failed to get a new s3 client instance before removing objects")
+		return err
 	}
-	defer s.Close()
 
-	var deletionFailures []string
-	for _, object := range objects {
-		_, err := svc.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: aws.String(s.Bucket),
-			Key:    object.Key,
-		})
+	if len(failures) > 0 {
+		deletionFailures := make([]string, 0, len(failures))
+		for key, err := range failures {
+			log.Errorf("Failed to delete object: %v error: %v", key, err)
+			deletionFailures = append(deletionFailures, key)
+		}
+		sort.Strings(deletionFailures)
+		return fmt.Errorf("failed to delete objects %v", deletionFailures)
+	}
 
-		if err != nil {
-			log.Errorf("Failed to delete object: %v error: %v", aws.ToString(object.Key), parseAwsError(err))
-			deletionFailures = append(deletionFailures, aws.ToString(object.Key))
+	return nil
+}
+
+// DeleteObjectKeys deletes the objects with multi-object delete requests, and
+// returns the errors of the objects that failed to be deleted. It falls back to
+// deleting the objects one by one for the endpoints without multi-object
+// delete.
+func (s *service) DeleteObjectKeys(ctx context.Context, keys []string) (map[string]error, error) {
+	failures := map[string]error{}
+	if len(keys) == 0 {
+		return failures, nil
+	}
+
+	svc, err := s.newInstance(ctx, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get a new s3 client instance before removing objects")
+	}
+
+	batchDelete := !strings.Contains(os.Getenv("AWS_ENDPOINTS"), "storage.googleapis.com")
+	for start := 0; start < len(keys); start += maxDeleteObjectsKeys {
+		batch := keys[start:min(start+maxDeleteObjectsKeys, len(keys))]
+		if batchDelete {
+			err := s.deleteObjectBatch(ctx, svc, batch, failures)
+			if err == nil {
+				continue
+			}
+			if !isBatchDeleteUnsupported(err) {
+				for _, key := range batch {
+					failures[key] = parseAwsError(err)
+				}
+				continue
+			}
+			log.WithError(err).Debug("Multi-object delete isn't supported, deleting the objects one by one")
+			batchDelete = false
+		}
+
+		for _, key := range batch {
+			if _, err := svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    aws.String(key),
+			}); err != nil {
+				failures[key] = parseAwsError(err)
+			}
 		}
 	}
+	return failures, nil
+}
 
-	if len(deletionFailures) > 0 {
-		return fmt.Errorf("failed to delete objects %v", deletionFailures)
+func (s *service) deleteObjectBatch(ctx context.Context, svc *s3.Client, keys []string, failures map[string]error) error {
+	objects := make([]types.ObjectIdentifier, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
 	}
 
+	output, err := svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s.Bucket),
+		Delete: &types.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range output.Errors {
+		failures[aws.ToString(e.Key)] = fmt.Errorf("AWS Error: %s %s", aws.ToString(e.Code), aws.ToString(e.Message))
+	}
 	return nil
 }
+
+// isBatchDeleteUnsupported reports whether the endpoint rejected the
+// multi-object delete request itself, as done by some S3-compatible services.
+func isBatchDeleteUnsupported(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "NotImplemented", "MethodNotAllowed":
+		return true
+	}
+	return false
+}
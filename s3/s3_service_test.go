@@ -130,7 +130,6 @@ func (s *TestSuite) TestPutObjectSinglePart(c *C) {
 	// Create an S3 client
 	svc, err := s.service.newInstance(ctx, false)
 	c.Assert(err, IsNil)
-	defer s.service.Close()
 
 	// Test successful single part upload
 	err = s.service.PutObjectSinglePart(ctx, svc, key, bytes.NewReader(body))
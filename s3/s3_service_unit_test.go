@@ -3,6 +3,7 @@ package s3
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,8 @@ import (
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/longhorn/backupstore"
 )
 
 // recordedRequest captures just enough information about an incoming request
@@ -247,3 +250,71 @@ func (f *fakeSizedReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	}
 	return f.pos, nil
 }
+
+func TestRemoveManyUsesMultiObjectDelete(t *testing.T) {
+	for _, noBatchDelete := range []bool{false, true} {
+		server := newFakeS3Bucket(t, "test-bucket")
+		server.noBatchDelete = noBatchDelete
+		t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+		t.Setenv("AWS_ENDPOINTS", server.URL)
+
+		driver, err := initFunc("s3://test-bucket@us-east-1/backupstore-root/")
+		if err != nil {
+			t.Fatalf("failed to initialize the driver: %v", err)
+		}
+		// More blocks than fit in a single request
+		var paths []string
+		for i := 0; i < maxDeleteObjectsKeys+10; i++ {
+			path := fmt.Sprintf("volumes/vol-1/blocks/%04d.blk", i)
+			server.objects["backupstore-root/"+path] = &fakeS3Object{data: []byte("x")}
+			paths = append(paths, path)
+		}
+
+		if err := backupstore.RemoveManyWithContext(context.Background(), driver, paths); err != nil {
+			t.Fatalf("RemoveMany failed: %v", err)
+		}
+		if len(server.objects) != 0 {
+			t.Fatalf("expected all the objects to be deleted, %d are left", len(server.objects))
+		}
+		expected := 2
+		if noBatchDelete {
+			expected = 0
+		}
+		if server.batchDeletes != expected {
+			t.Fatalf("expected %d multi-object delete requests, got %d", expected, server.batchDeletes)
+		}
+	}
+}
+
+func TestRemoveManyReportsPartialFailures(t *testing.T) {
+	server := newFakeS3Bucket(t, "test-bucket")
+	server.deleteDenied = map[string]bool{"backupstore-root/volumes/vol-1/blocks/0001.blk": true}
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	t.Setenv("AWS_ENDPOINTS", server.URL)
+
+	driver, err := initFunc("s3://test-bucket@us-east-1/backupstore-root/")
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
+	paths := []string{"volumes/vol-1/blocks/0000.blk", "volumes/vol-1/blocks/0001.blk"}
+	for _, path := range paths {
+		server.objects["backupstore-root/"+path] = &fakeS3Object{data: []byte("x")}
+	}
+
+	err = backupstore.RemoveManyWithContext(context.Background(), driver, paths)
+	var removeErr *backupstore.RemoveManyError
+	if !errors.As(err, &removeErr) {
+		t.Fatalf("expected a RemoveManyError, got %v", err)
+	}
+	if failed := removeErr.FailedPaths(); len(failed) != 1 || failed[0] != paths[1] {
+		t.Fatalf("expected %v to fail to be removed, got %v", paths[1], failed)
+	}
+	if !strings.Contains(removeErr.Failures[paths[1]].Error(), "AccessDenied") {
+		t.Fatalf("expected the AccessDenied error, got %v", removeErr.Failures[paths[1]])
+	}
+	if _, exists := server.objects["backupstore-root/"+paths[0]]; exists {
+		t.Fatalf("expected %v to be removed", paths[0])
+	}
+}
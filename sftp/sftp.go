@@ -0,0 +1,444 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "sftp"})
+)
+
+const (
+	KIND = "sftp"
+
+	defaultPort = "22"
+
+	dialTimeout = 30 * time.Second
+
+	// MaxCleanupLevel limits how many empty parent directories are removed
+	// after a remove, the same as the file system based drivers.
+	MaxCleanupLevel = 10
+)
+
+// BackupStoreDriver stores the backups on a remote server over SFTP. The SSH
+// connection is shared by all the operations and re-established on demand
+// once the server drops it.
+type BackupStoreDriver struct {
+	destURL string
+	path    string
+
+	addr   string
+	config *ssh.ClientConfig
+
+	mutex     sync.Mutex
+	sshClient *ssh.Client
+	client    *pkgsftp.Client
+}
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.User == nil || u.User.Username() == "" || u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid URL. Must be sftp://user@host:port/path")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	b := &BackupStoreDriver{
+		path: u.Path,
+		addr: net.JoinHostPort(u.Hostname(), port),
+	}
+	b.config, err = newClientConfig(u.User.Username())
+	if err != nil {
+		return nil, err
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = KIND + "://" + u.User.Username() + "@" + b.addr + b.path
+
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func newClientConfig(user string) (*ssh.ClientConfig, error) {
+	privateKey := os.Getenv("SFTP_PRIVATE_KEY")
+	if privateKey == "" {
+		return nil, fmt.Errorf("missing private key SFTP_PRIVATE_KEY for the sftp backup target")
+	}
+
+	var (
+		signer ssh.Signer
+		err    error
+	)
+	if passphrase := os.Getenv("SFTP_PRIVATE_KEY_PASSPHRASE"); passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SFTP_PRIVATE_KEY: %v", err)
+	}
+
+	hostKeyCallback, err := getHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}, nil
+}
+
+// getHostKeyCallback verifies the server against the known_hosts entries in
+// SFTP_KNOWN_HOSTS. There is no fallback to trusting any host key, since the
+// backups would otherwise be handed to whoever answers on the address.
+func getHostKeyCallback() (ssh.HostKeyCallback, error) {
+	knownHosts := os.Getenv("SFTP_KNOWN_HOSTS")
+	if knownHosts == "" {
+		return nil, fmt.Errorf("missing known hosts SFTP_KNOWN_HOSTS for the sftp backup target")
+	}
+
+	// knownhosts only reads files, and it is done with the file once the
+	// callback is created.
+	f, err := os.CreateTemp("", "sftp-known-hosts-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.WriteString(knownHosts + "\n"); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	callback, err := knownhosts.New(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SFTP_KNOWN_HOSTS: %v", err)
+	}
+	return callback, nil
+}
+
+func (b *BackupStoreDriver) getClient() (*pkgsftp.Client, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.client != nil {
+		return b.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", b.addr, b.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to sftp server %v: %v", b.addr, err)
+	}
+	client, err := pkgsftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, fmt.Errorf("failed to start sftp session with %v: %v", b.addr, err)
+	}
+
+	b.sshClient = sshClient
+	b.client = client
+
+	// Forget the connection once it's gone so the next operation reconnects
+	go func() {
+		_ = sshClient.Wait()
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.sshClient == sshClient {
+			_ = b.client.Close()
+			b.sshClient = nil
+			b.client = nil
+		}
+	}()
+
+	return client, nil
+}
+
+func (b *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (b *BackupStoreDriver) GetURL() string {
+	return b.destURL
+}
+
+func (b *BackupStoreDriver) remotePath(p string) string {
+	return path.Join(b.path, p)
+}
+
+func (b *BackupStoreDriver) preparePath(client *pkgsftp.Client, file string) error {
+	return client.MkdirAll(path.Dir(b.remotePath(file)))
+}
+
+func (b *BackupStoreDriver) FileSize(filePath string) int64 {
+	return b.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	if ctx.Err() != nil {
+		return -1
+	}
+	client, err := b.getClient()
+	if err != nil {
+		return -1
+	}
+	st, err := client.Stat(b.remotePath(filePath))
+	if err != nil || st.IsDir() {
+		return -1
+	}
+	return st.Size()
+}
+
+func (b *BackupStoreDriver) FileTime(filePath string) time.Time {
+	return b.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
+	client, err := b.getClient()
+	if err != nil {
+		return time.Time{}
+	}
+	st, err := client.Stat(b.remotePath(filePath))
+	if err != nil || st.IsDir() {
+		return time.Time{}
+	}
+	return st.ModTime().UTC()
+}
+
+func (b *BackupStoreDriver) FileExists(filePath string) bool {
+	return b.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return b.FileSizeWithContext(ctx, filePath) >= 0
+}
+
+func (b *BackupStoreDriver) Remove(path string) error {
+	return b.RemoveWithContext(context.Background(), path)
+}
+
+func (b *BackupStoreDriver) RemoveWithContext(ctx context.Context, p string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client, err := b.getClient()
+	if err != nil {
+		return err
+	}
+
+	target := b.remotePath(p)
+	if err := client.RemoveAll(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	//Also automatically cleanup upper level directories
+	dir := target
+	for i := 0; i < MaxCleanupLevel; i++ {
+		dir = path.Dir(dir)
+		// Don't clean above backupstore base
+		if strings.HasSuffix(dir, backupstore.GetBackupstoreBase()) {
+			break
+		}
+		// If directory is not empty, then we don't need to continue
+		if err := client.RemoveDirectory(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return b.ReadWithContext(context.Background(), src)
+}
+
+func (b *BackupStoreDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	client, err := b.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(b.remotePath(src))
+}
+
+func (b *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return b.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (b *BackupStoreDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	return b.write(ctx, dst, rs)
+}
+
+// write publishes the content under dst only once it's completely on the
+// server, so readers never observe a partially written file.
+func (b *BackupStoreDriver) write(ctx context.Context, dst string, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client, err := b.getClient()
+	if err != nil {
+		return err
+	}
+
+	// we append the timestamp to the tmp files so that we should never have 2 backups using the same tmp file
+	tmpFile := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+	if err := b.preparePath(client, dst); err != nil {
+		return err
+	}
+	file, err := client.Create(b.remotePath(tmpFile))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		_ = client.Remove(b.remotePath(tmpFile))
+		return err
+	}
+	if err := file.Close(); err != nil {
+		_ = client.Remove(b.remotePath(tmpFile))
+		return err
+	}
+
+	// don't publish the file if the write got cancelled in the meantime
+	if err := ctx.Err(); err != nil {
+		_ = client.Remove(b.remotePath(tmpFile))
+		return err
+	}
+
+	return b.rename(client, b.remotePath(tmpFile), b.remotePath(dst))
+}
+
+// rename replaces newname the way rename(2) does. The plain SFTP rename
+// refuses to overwrite an existing file, so it's only used when the server
+// doesn't support the posix-rename extension.
+func (b *BackupStoreDriver) rename(client *pkgsftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldname, newname)
+	}
+	if err := client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldname, newname)
+}
+
+func (b *BackupStoreDriver) List(path string) ([]string, error) {
+	return b.ListWithContext(context.Background(), path)
+}
+
+func (b *BackupStoreDriver) ListWithContext(ctx context.Context, path string) ([]string, error) {
+	client, err := b.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	infos, err := client.ReadDirContext(ctx, b.remotePath(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		result = append(result, info.Name())
+	}
+	return result, nil
+}
+
+func (b *BackupStoreDriver) Upload(src, dst string) error {
+	return b.UploadWithContext(context.Background(), src, dst)
+}
+
+func (b *BackupStoreDriver) UploadWithContext(ctx context.Context, src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return b.write(ctx, dst, file)
+}
+
+func (b *BackupStoreDriver) Download(src, dst string) error {
+	return b.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (b *BackupStoreDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
+	if _, err := os.Stat(dst); err != nil {
+		_ = os.Remove(dst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	rc, err := b.ReadWithContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
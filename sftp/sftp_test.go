@@ -0,0 +1,398 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+// testSSHServer serves the SFTP subsystem over an in-process SSH server, rooted
+// at a temporary directory, and only accepts the authorized client key.
+type testSSHServer struct {
+	listener net.Listener
+	root     string
+	hostKey  ssh.Signer
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newTestSSHServer(t *testing.T, authorizedKey ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{
+		listener: listener,
+		root:     t.TempDir(),
+		hostKey:  hostKey,
+	}
+	go s.serve(config)
+	t.Cleanup(func() {
+		_ = listener.Close()
+		s.dropConnections()
+	})
+	return s
+}
+
+func (s *testSSHServer) serve(config *ssh.ServerConfig) {
+	for {
+		nConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(nConn, config)
+	}
+}
+
+func (s *testSSHServer) handleConn(nConn net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+	if err != nil {
+		_ = nConn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := pkgsftp.NewServer(channel, pkgsftp.WithServerWorkingDirectory(s.root))
+				if err != nil {
+					_ = channel.Close()
+					return
+				}
+				_ = server.Serve()
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSSHServer) knownHosts() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.addr())}, s.hostKey.PublicKey())
+}
+
+// files returns the paths of all the regular files below the server root.
+func (s *testSSHServer) files(t *testing.T) []string {
+	var files []string
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(s.root, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (s *testSSHServer) put(t *testing.T, name string, data []byte) {
+	path := filepath.Join(s.root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generateClientKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block)), signer.PublicKey()
+}
+
+func newTestDriver(t *testing.T) (backupstore.BackupStoreDriver, *testSSHServer) {
+	t.Helper()
+
+	privateKey, publicKey := generateClientKey(t)
+	server := newTestSSHServer(t, publicKey)
+
+	t.Setenv("SFTP_PRIVATE_KEY", privateKey)
+	t.Setenv("SFTP_PRIVATE_KEY_PASSPHRASE", "")
+	t.Setenv("SFTP_KNOWN_HOSTS", server.knownHosts())
+
+	driver, err := initFunc("sftp://backup@" + server.addr() + server.root + "/backupstore-root")
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
+	return driver, server
+}
+
+func TestInitFuncValidatesURL(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, publicKey := generateClientKey(t)
+	server := newTestSSHServer(t, publicKey)
+	t.Setenv("SFTP_PRIVATE_KEY", privateKey)
+	t.Setenv("SFTP_KNOWN_HOSTS", server.knownHosts())
+
+	_, err := initFunc("s3://backup@" + server.addr() + "/path")
+	assert.ErrorContains(err, "BUG")
+
+	_, err = initFunc("sftp://" + server.addr() + "/path")
+	assert.ErrorContains(err, "invalid URL")
+
+	_, err = initFunc("sftp://backup@" + server.addr())
+	assert.ErrorContains(err, "invalid URL")
+
+	driver, err := initFunc("sftp://backup@" + server.addr() + server.root)
+	assert.NoError(err)
+	assert.Equal("sftp://backup@"+server.addr()+server.root, driver.GetURL())
+	assert.Equal(KIND, driver.Kind())
+}
+
+func TestInitFuncAuthenticatesBothEnds(t *testing.T) {
+	assert := assert.New(t)
+
+	privateKey, publicKey := generateClientKey(t)
+	server := newTestSSHServer(t, publicKey)
+	destURL := "sftp://backup@" + server.addr() + server.root
+
+	t.Setenv("SFTP_PRIVATE_KEY", "")
+	t.Setenv("SFTP_KNOWN_HOSTS", server.knownHosts())
+	_, err := initFunc(destURL)
+	assert.ErrorContains(err, "SFTP_PRIVATE_KEY")
+
+	t.Setenv("SFTP_PRIVATE_KEY", privateKey)
+	t.Setenv("SFTP_KNOWN_HOSTS", "")
+	_, err = initFunc(destURL)
+	assert.ErrorContains(err, "SFTP_KNOWN_HOSTS")
+
+	// The server presents a host key that is not the known one
+	otherPrivateKey, otherPublicKey := generateClientKey(t)
+	otherServer := newTestSSHServer(t, otherPublicKey)
+	t.Setenv("SFTP_KNOWN_HOSTS", knownhosts.Line([]string{knownhosts.Normalize(server.addr())}, otherServer.hostKey.PublicKey()))
+	_, err = initFunc(destURL)
+	assert.ErrorContains(err, "key mismatch")
+
+	// The server doesn't accept the client key
+	t.Setenv("SFTP_PRIVATE_KEY", otherPrivateKey)
+	t.Setenv("SFTP_KNOWN_HOSTS", server.knownHosts())
+	_, err = initFunc(destURL)
+	assert.ErrorContains(err, "unable to authenticate")
+
+	t.Setenv("SFTP_PRIVATE_KEY", privateKey)
+	_, err = initFunc(destURL)
+	assert.NoError(err)
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+
+	payload := []byte("backup block payload")
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", bytes.NewReader(payload)))
+	// The temporary file is renamed into place
+	assert.Equal([]string{"backupstore-root/backupstore/volumes/vol-1/volume.cfg"}, server.files(t))
+
+	assert.True(driver.FileExists("backupstore/volumes/vol-1/volume.cfg"))
+	assert.Equal(int64(len(payload)), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+	assert.False(driver.FileTime("backupstore/volumes/vol-1/volume.cfg").IsZero())
+
+	rc, err := driver.Read("backupstore/volumes/vol-1/volume.cfg")
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal(payload, data)
+
+	// Overwriting an existing file replaces it
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", strings.NewReader("updated")))
+	assert.Equal(int64(len("updated")), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+
+	// Directories are not files
+	assert.False(driver.FileExists("backupstore/volumes/vol-1"))
+
+	assert.False(driver.FileExists("backupstore/volumes/vol-1/missing.cfg"))
+	assert.Equal(int64(-1), driver.FileSize("backupstore/volumes/vol-1/missing.cfg"))
+	assert.True(driver.FileTime("backupstore/volumes/vol-1/missing.cfg").IsZero())
+
+	_, err = driver.Read("backupstore/volumes/vol-1/missing.cfg")
+	assert.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestListBehavesLikeLs(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/backups/backup_b.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(t, filepath.Join("backupstore-root", name), []byte("x"))
+	}
+
+	names, err := driver.List("volumes/vol-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	names, err = driver.List("volumes/vol-1/")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	names, err = driver.List("volumes/vol-1/backups")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup_a.cfg", "backup_b.cfg"}, names)
+
+	names, err = driver.List("volumes/missing")
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+func TestRemoveIsRecursive(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(t, filepath.Join("backupstore-root", name), []byte("x"))
+	}
+
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+	assert.Equal([]string{"backupstore-root/volumes/vol-2/volume.cfg"}, server.files(t))
+
+	// Removing something that is already gone is not an error, just like "rm -rf".
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+
+	// The emptied parent directories are cleaned up as well
+	assert.NoError(driver.Remove("volumes/vol-2/volume.cfg"))
+	_, err := os.Stat(filepath.Join(server.root, "backupstore-root", "volumes"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, _ := newTestDriver(t)
+
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NoError(os.WriteFile(src, []byte("file content"), 0600))
+	assert.NoError(driver.Upload(src, "backing-images/image.cfg"))
+
+	dst := filepath.Join(t.TempDir(), "nested", "dst")
+	assert.NoError(driver.Download("backing-images/image.cfg", dst))
+	data, err := os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal([]byte("file content"), data)
+
+	assert.Error(driver.Download("backing-images/missing.cfg", dst))
+}
+
+func TestReconnectsAfterConnectionLoss(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+	server.put(t, "backupstore-root/volumes/vol-1/volume.cfg", []byte("x"))
+
+	server.dropConnections()
+
+	// The first operation may still observe the dropped connection
+	assert.Eventually(func() bool {
+		names, err := driver.List("volumes")
+		return err == nil && len(names) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(driver.FileExists("volumes/vol-1/volume.cfg"))
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		driver, _ := newTestDriver(t)
+		return driver
+	})
+}
@@ -1,6 +1,7 @@
 package backupstore
 
 import (
+	"context"
 	"path/filepath"
 
 	"github.com/cockroachdb/errors"
@@ -29,11 +30,12 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 		return "", err
 	}
 
-	if err := addVolume(driver, volume); err != nil {
+	ctx := context.Background()
+	if err := addVolume(ctx, driver, volume); err != nil {
 		return "", err
 	}
 
-	loadedVolume, err := loadVolume(driver, volume.Name)
+	loadedVolume, err := loadVolume(ctx, driver, volume.Name)
 	if err != nil {
 		return "", err
 	}
@@ -61,7 +63,7 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 	}
 
 	backup.CreatedTime = util.Now()
-	if err := saveBackup(driver, backup); err != nil {
+	if err := saveBackup(ctx, driver, backup); err != nil {
 		return "", err
 	}
 
@@ -86,14 +88,15 @@ func RestoreSingleFileBackup(backupURL, path string) (string, error) {
 		return "", err
 	}
 
-	if _, err := loadVolume(driver, srcVolumeName); err != nil {
+	ctx := context.Background()
+	if _, err := loadVolume(ctx, driver, srcVolumeName); err != nil {
 		return "", generateError(logrus.Fields{
 			LogFieldVolume:    srcVolumeName,
 			LogFieldBackupURL: backupURL,
 		}, "Volume doesn't exist in backupstore: %v", err)
 	}
 
-	backup, err := loadBackup(driver, srcBackupName, srcVolumeName)
+	backup, err := loadBackup(ctx, driver, srcBackupName, srcVolumeName)
 	if err != nil {
 		return "", err
 	}
@@ -117,12 +120,13 @@ func DeleteSingleFileBackup(backupURL string) error {
 		return err
 	}
 
-	_, err = loadVolume(driver, volumeName)
+	ctx := context.Background()
+	_, err = loadVolume(ctx, driver, volumeName)
 	if err != nil {
 		return errors.Wrapf(err, "cannot find volume %v in backupstore", volumeName)
 	}
 
-	backup, err := loadBackup(driver, backupName, volumeName)
+	backup, err := loadBackup(ctx, driver, backupName, volumeName)
 	if err != nil {
 		return err
 	}
@@ -131,5 +135,5 @@ func DeleteSingleFileBackup(backupURL string) error {
 		return err
 	}
 
-	return removeBackup(backup, driver)
+	return removeBackup(ctx, backup, driver)
 }
@@ -2,6 +2,7 @@ package systembackup
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -54,6 +55,28 @@ func Upload(localFilePath string, cfg *Config) error {
 		return err
 	}
 
+	return saveConfig(driver, cfg)
+}
+
+// UploadStream is Upload for a system backup zip read from r, whose size is -1
+// if it's unknown, so that the zip doesn't have to be written to a local file
+// first. Download verifies the zip against cfg.Checksum as usual.
+func UploadStream(r io.Reader, size int64, cfg *Config) error {
+	driver, err := backupstore.GetBackupStoreDriver(cfg.BackupTargetURL)
+	if err != nil {
+		return err
+	}
+
+	remoteBackupURI := getSystemBackupZipURI(cfg)
+	err = backupstore.SaveStreamToBackupStore(r, size, remoteBackupURI, driver)
+	if err != nil {
+		return err
+	}
+
+	return saveConfig(driver, cfg)
+}
+
+func saveConfig(driver backupstore.BackupStoreDriver, cfg *Config) error {
 	cfgURI := getSystemBackupConfigURI(cfg)
 	if err := backupstore.SaveConfigInBackupStore(driver, cfgURI, cfg); err != nil {
 		log.WithError(err).Errorf("Failed to upload system backup config %v", cfg.Name)
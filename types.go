@@ -5,6 +5,28 @@ const (
 	DEFAULT_BLOCK_SIZE        = DEFAULT_BLOCK_SIZE_IN_MB * 1024 * 1024
 	LEGACY_COMPRESSION_METHOD = "gzip"
 
+	// BackupParameterCompressionLevel is the backup parameter setting the
+	// compression level of the new blocks, see util.ValidateCompressionLevel.
+	BackupParameterCompressionLevel = "backup-compression-level"
+	// BackupParameterChunkingMethod is the backup parameter choosing how the
+	// volume data is cut into blocks, see getChunkingMethodFromParameters.
+	BackupParameterChunkingMethod = "backup-chunking-method"
+
+	CHUNKING_METHOD_FIXED = "fixed"
+	CHUNKING_METHOD_CDC   = "cdc"
+
+	// BackupParameterBlockPool is the backup parameter making a new backup
+	// volume store its blocks in the block pool shared with the other volumes.
+	BackupParameterBlockPool = "backup-block-pool"
+
+	// BackupParameterPackFiles is the backup parameter making a new backup
+	// volume append its blocks to pack files instead of one file per block.
+	BackupParameterPackFiles = "backup-pack-files"
+	// BackupParameterPackFileSize is the backup parameter setting the size a
+	// pack is filled up to before it's written, see
+	// getPackFileSizeFromParameters.
+	BackupParameterPackFileSize = "backup-pack-file-size"
+
 	BLOCKS_DIRECTORY      = "blocks"
 	BLOCK_SEPARATE_LAYER1 = 2
 	BLOCK_SEPARATE_LAYER2 = 4
@@ -24,6 +24,21 @@ const (
 	AZBlobEndpoint    = "AZBLOB_ENDPOINT"
 	AZBlobCert        = "AZBLOB_CERT"
 
+	GCSCredentials = "GCS_CREDENTIALS"
+	GCSEndpoint    = "GCS_ENDPOINT"
+	GCSCert        = "GCS_CERT"
+
+	SFTPPrivateKey           = "SFTP_PRIVATE_KEY"
+	SFTPPrivateKeyPassphrase = "SFTP_PRIVATE_KEY_PASSPHRASE"
+	SFTPKnownHosts           = "SFTP_KNOWN_HOSTS"
+
+	WebDAVUsername = "WEBDAV_USERNAME"
+	WebDAVPassword = "WEBDAV_PASSWORD"
+	WebDAVCert     = "WEBDAV_CERT"
+
+	BackupEncryptionKey        = "BACKUP_ENCRYPTION_KEY"
+	BackupEncryptionPassphrase = "BACKUP_ENCRYPTION_PASSPHRASE"
+
 	HTTPSProxy = "HTTPS_PROXY"
 	HTTPProxy  = "HTTP_PROXY"
 	NOProxy    = "NO_PROXY"
@@ -62,6 +77,8 @@ const (
 	// To prevent Longhorn from accidentally considering it as another normal BackupVolume,
 	// we use uppercase here so it will be filtered out when listing.
 	BackupBackingImageLockName = "BACKINGIMAGE"
+	// The same applies to the lock of the block pool shared by the BackupVolumes.
+	BlockPoolLockName = "BLOCKPOOL"
 )
 
 const (
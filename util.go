@@ -2,10 +2,10 @@ package backupstore
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"io"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -81,7 +81,7 @@ func retryWithBackoff(ctx context.Context, f func() (io.Reader, error)) (io.Read
 		if err == nil {
 			return r, nil
 		}
-		if strings.Contains(err.Error(), "checksum verification failed") {
+		if strings.Contains(err.Error(), "checksum verification failed") || errors.Is(err, errBlockDecryption) || errors.Is(err, errUnsupportedBlockFormat) {
 			return nil, err
 		}
 		lastErr = err
@@ -97,48 +97,107 @@ func retryWithBackoff(ctx context.Context, f func() (io.Reader, error)) (io.Read
 }
 
 // DecompressAndVerifyWithFallback reads, decompresses, and verifies a block.
-// Retries with backoff on transient read/verify errors and falls back to gzip<->lz4
-// when header/magic suggests a mismatched method. Rationale: remote stores can be
-// transient; retries avoid spurious failures while checksum preserves integrity.
+// The blocks with a header are read as it describes, decompression only
+// applies to the legacy headerless ones.
+// Retries with backoff on transient read/verify errors and falls back to the
+// method given by the magic number of the block when it's not the expected one,
+// then to no compression at all. Rationale: remote stores can be transient;
+// retries avoid spurious failures while checksum preserves integrity.
+// Encrypted blocks are decrypted first, with the key loaded along with their
+// backup volume.
 func DecompressAndVerifyWithFallback(ctx context.Context, bsDriver BackupStoreDriver, blkFile, decompression, checksum string) (io.Reader, error) {
-	// Helper function to read block from backup store
-	readBlock := func() (io.ReadCloser, error) {
-		rc, err := bsDriver.Read(blkFile)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read block %v", blkFile)
-		}
-		return rc, nil
+	readBlock := func() ([]byte, error) {
+		return readBlockFile(ctx, bsDriver, blkFile)
 	}
+	return decompressAndVerifyWithFallback(ctx, blkFile, readBlock, decompression, checksum)
+}
 
+// decompressAndVerifyWithFallback is DecompressAndVerifyWithFallback for the
+// block returned by readBlock, blkName names it in the errors.
+func decompressAndVerifyWithFallback(ctx context.Context, blkName string, readBlock func() ([]byte, error), decompression, checksum string) (io.Reader, error) {
 	return retryWithBackoff(ctx, func() (io.Reader, error) {
-		rc, err := readBlock()
+		buf, err := readBlock()
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to read block %v", blkFile)
+			return nil, errors.Wrapf(err, "failed to read block %v", blkName)
 		}
-		buf, readErr := io.ReadAll(rc)
-		_ = rc.Close()
-		if readErr != nil {
-			return nil, errors.Wrapf(readErr, "failed to read block %v into buffer", blkFile)
+		return decodeAndVerifyBlock(buf, blkName, decompression, checksum)
+	})
+}
+
+// readBlockFile reads the block file as it's stored.
+func readBlockFile(ctx context.Context, bsDriver BackupStoreDriver, blkFile string) ([]byte, error) {
+	rc, err := NewDriverWithContext(bsDriver).ReadWithContext(ctx, blkFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read block %v", blkFile)
+	}
+	buf, err := io.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read block %v into buffer", blkFile)
+	}
+	return buf, nil
+}
+
+// decodeAndVerifyBlock decodes the stored block buf and verifies its checksum,
+// with the fallbacks described by DecompressAndVerifyWithFallback.
+func decodeAndVerifyBlock(buf []byte, blkName, decompression, checksum string) (io.Reader, error) {
+	if hasBlockHeader(buf) {
+		r, err := decodeBlock(buf, checksum)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read block %v", blkName)
 		}
-		r, err := util.DecompressAndVerify(decompression, bytes.NewReader(buf), checksum)
-		if err == nil {
-			return r, nil
+		return r, nil
+	}
+	r, err := util.DecompressAndVerify(decompression, bytes.NewReader(buf), checksum)
+	if err == nil {
+		return r, nil
+	}
+	// The block may have been compressed with another method than the one
+	// recorded for it, the magic number tells which one. Or it may have been
+	// stored uncompressed, the checksum tells.
+	for _, alternativeDecompression := range []string{util.DetectCompressionMethod(buf), "none"} {
+		if alternativeDecompression == "" || alternativeDecompression == decompression {
+			continue
 		}
-		alternativeDecompression := ""
-		if errors.Is(err, gzip.ErrHeader) {
-			alternativeDecompression = "lz4"
-		} else if strings.Contains(err.Error(), "lz4: bad magic number") {
-			alternativeDecompression = "gzip"
+		rAlt, errAlt := util.DecompressAndVerify(alternativeDecompression, bytes.NewReader(buf), checksum)
+		if errAlt == nil {
+			return rAlt, nil
 		}
-		if alternativeDecompression != "" {
-			rAlt, errAlt := util.DecompressAndVerify(alternativeDecompression, bytes.NewReader(buf), checksum)
-			if errAlt == nil {
-				return rAlt, nil
-			}
-			return nil, errors.Wrapf(errAlt, "fallback decompression also failed for block %v", blkFile)
+		if alternativeDecompression != "none" {
+			err = errors.Wrapf(errAlt, "fallback decompression %v also failed", alternativeDecompression)
 		}
-		return nil, errors.Wrapf(err, "decompression verification failed for block %v", blkFile)
-	})
+	}
+	return nil, errors.Wrapf(err, "decompression verification failed for block %v", blkName)
+}
+
+// GetCompressionLevelFromParameters returns the compression level given by
+// BackupParameterCompressionLevel, or 0 for the default level of the
+// compression method.
+func GetCompressionLevelFromParameters(parameters map[string]string) (int, error) {
+	levelVal := parameters[BackupParameterCompressionLevel]
+	if levelVal == "" {
+		return 0, nil
+	}
+	level, err := strconv.Atoi(levelVal)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid compression level %s from parameter %s", levelVal, BackupParameterCompressionLevel)
+	}
+	return level, nil
+}
+
+// getChunkingMethodFromParameters returns the chunking method given by
+// BackupParameterChunkingMethod. The volume data is cut into blocks of the
+// backup block size by default, CHUNKING_METHOD_CDC cuts it where its content
+// matches a pattern instead.
+func getChunkingMethodFromParameters(parameters map[string]string) (string, error) {
+	switch method := parameters[BackupParameterChunkingMethod]; method {
+	case "", CHUNKING_METHOD_FIXED:
+		return CHUNKING_METHOD_FIXED, nil
+	case CHUNKING_METHOD_CDC:
+		return method, nil
+	default:
+		return "", errors.Errorf("unsupported chunking method %v from parameter %v", method, BackupParameterChunkingMethod)
+	}
 }
 
 func getBlockSizeFromParameters(parameters map[string]string) (int64, error) {
@@ -158,3 +217,21 @@ func getBlockSizeFromParameters(parameters map[string]string) (int64, error) {
 	}
 	return quantity.Value(), nil
 }
+
+// getPackFileSizeFromParameters returns the size of the packs given by
+// BackupParameterPackFileSize, packFileSize by default. A backup holds up to two
+// packs in memory, the one being written and the one being filled.
+func getPackFileSizeFromParameters(parameters map[string]string) (int64, error) {
+	sizeVal := parameters[BackupParameterPackFileSize]
+	if sizeVal == "" {
+		return packFileSize, nil
+	}
+	quantity, err := resource.ParseQuantity(sizeVal)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid pack file size %s from parameter %s", sizeVal, BackupParameterPackFileSize)
+	}
+	if quantity.Sign() <= 0 {
+		return 0, errors.Errorf("invalid pack file size %s from parameter %s", sizeVal, BackupParameterPackFileSize)
+	}
+	return quantity.Value(), nil
+}
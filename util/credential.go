@@ -8,6 +8,8 @@ import (
 )
 
 func SetupCredential(backupType string, credential map[string]string) error {
+	setupEncryptionCredential(credential)
+
 	switch backupType {
 	case "s3":
 		return setupS3Credential(credential)
@@ -15,11 +17,35 @@ func SetupCredential(backupType string, credential map[string]string) error {
 		return setupCIFSCredential(credential)
 	case "azblob":
 		return setupAZBlobCredential(credential)
+	case "gs":
+		return setupGCSCredential(credential)
+	case "sftp":
+		return setupSFTPCredential(credential)
+	case "webdav", "webdavs":
+		return setupWebDAVCredential(credential)
 	default:
 		return nil
 	}
 }
 
+// setupEncryptionCredential sets up the secret the backups are encrypted with,
+// which is independent from the kind of backup target. The secret of the
+// previous backup target is unset if this one has none. Without a credential
+// the secret coming from the environment is left alone.
+func setupEncryptionCredential(credential map[string]string) {
+	if credential == nil {
+		return
+	}
+
+	for _, key := range []string{types.BackupEncryptionKey, types.BackupEncryptionPassphrase} {
+		if credential[key] != "" {
+			_ = os.Setenv(key, credential[key])
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+}
+
 func setupS3Credential(credential map[string]string) error {
 	if credential == nil {
 		return nil
@@ -88,7 +114,83 @@ func setupAZBlobCredential(credential map[string]string) error {
 	return nil
 }
 
+func setupGCSCredential(credential map[string]string) error {
+	if credential == nil {
+		return nil
+	}
+
+	_ = os.Setenv(types.GCSCredentials, credential[types.GCSCredentials])
+	_ = os.Setenv(types.GCSEndpoint, credential[types.GCSEndpoint])
+	_ = os.Setenv(types.HTTPSProxy, credential[types.HTTPSProxy])
+	_ = os.Setenv(types.HTTPProxy, credential[types.HTTPProxy])
+	_ = os.Setenv(types.NOProxy, credential[types.NOProxy])
+
+	if credential[types.GCSCert] != "" {
+		_ = os.Setenv(types.GCSCert, credential[types.GCSCert])
+	}
+
+	return nil
+}
+
+func setupSFTPCredential(credential map[string]string) error {
+	if credential == nil {
+		return nil
+	}
+
+	if credential[types.SFTPPrivateKey] == "" {
+		return errors.New("sftp credential private key not found")
+	}
+	if credential[types.SFTPKnownHosts] == "" {
+		return errors.New("sftp credential known hosts not found")
+	}
+
+	_ = os.Setenv(types.SFTPPrivateKey, credential[types.SFTPPrivateKey])
+	_ = os.Setenv(types.SFTPPrivateKeyPassphrase, credential[types.SFTPPrivateKeyPassphrase])
+	_ = os.Setenv(types.SFTPKnownHosts, credential[types.SFTPKnownHosts])
+
+	return nil
+}
+
+func setupWebDAVCredential(credential map[string]string) error {
+	if credential == nil {
+		return nil
+	}
+
+	if credential[types.WebDAVUsername] == "" && credential[types.WebDAVPassword] != "" {
+		return errors.New("webdav credential username not found")
+	}
+
+	_ = os.Setenv(types.WebDAVUsername, credential[types.WebDAVUsername])
+	_ = os.Setenv(types.WebDAVPassword, credential[types.WebDAVPassword])
+	_ = os.Setenv(types.HTTPSProxy, credential[types.HTTPSProxy])
+	_ = os.Setenv(types.HTTPProxy, credential[types.HTTPProxy])
+	_ = os.Setenv(types.NOProxy, credential[types.NOProxy])
+
+	if credential[types.WebDAVCert] != "" {
+		_ = os.Setenv(types.WebDAVCert, credential[types.WebDAVCert])
+	}
+
+	return nil
+}
+
 func getCredentialFromEnvVars(backupType string) (map[string]string, error) {
+	credential, err := getTargetCredentialFromEnvVars(backupType)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{types.BackupEncryptionKey, types.BackupEncryptionPassphrase} {
+		if value := os.Getenv(key); value != "" {
+			if credential == nil {
+				credential = map[string]string{}
+			}
+			credential[key] = value
+		}
+	}
+	return credential, nil
+}
+
+func getTargetCredentialFromEnvVars(backupType string) (map[string]string, error) {
 	switch backupType {
 	case "s3":
 		return getS3CredentialFromEnvVars()
@@ -96,6 +198,12 @@ func getCredentialFromEnvVars(backupType string) (map[string]string, error) {
 		return getCIFSCredentialFromEnvVars()
 	case "azblob":
 		return getAZBlobCredentialFromEnvVars()
+	case "gs":
+		return getGCSCredentialFromEnvVars()
+	case "sftp":
+		return getSFTPCredentialFromEnvVars()
+	case "webdav", "webdavs":
+		return getWebDAVCredentialFromEnvVars()
 	default:
 		return nil, nil
 	}
@@ -115,6 +223,42 @@ func getAZBlobCredentialFromEnvVars() (map[string]string, error) {
 	return credential, nil
 }
 
+func getGCSCredentialFromEnvVars() (map[string]string, error) {
+	credential := map[string]string{}
+
+	credential[types.GCSCredentials] = os.Getenv(types.GCSCredentials)
+	credential[types.GCSEndpoint] = os.Getenv(types.GCSEndpoint)
+	credential[types.GCSCert] = os.Getenv(types.GCSCert)
+	credential[types.HTTPSProxy] = os.Getenv(types.HTTPSProxy)
+	credential[types.HTTPProxy] = os.Getenv(types.HTTPProxy)
+	credential[types.NOProxy] = os.Getenv(types.NOProxy)
+
+	return credential, nil
+}
+
+func getSFTPCredentialFromEnvVars() (map[string]string, error) {
+	credential := map[string]string{}
+
+	credential[types.SFTPPrivateKey] = os.Getenv(types.SFTPPrivateKey)
+	credential[types.SFTPPrivateKeyPassphrase] = os.Getenv(types.SFTPPrivateKeyPassphrase)
+	credential[types.SFTPKnownHosts] = os.Getenv(types.SFTPKnownHosts)
+
+	return credential, nil
+}
+
+func getWebDAVCredentialFromEnvVars() (map[string]string, error) {
+	credential := map[string]string{}
+
+	credential[types.WebDAVUsername] = os.Getenv(types.WebDAVUsername)
+	credential[types.WebDAVPassword] = os.Getenv(types.WebDAVPassword)
+	credential[types.WebDAVCert] = os.Getenv(types.WebDAVCert)
+	credential[types.HTTPSProxy] = os.Getenv(types.HTTPSProxy)
+	credential[types.HTTPProxy] = os.Getenv(types.HTTPProxy)
+	credential[types.NOProxy] = os.Getenv(types.NOProxy)
+
+	return credential, nil
+}
+
 func getCIFSCredentialFromEnvVars() (map[string]string, error) {
 	credential := map[string]string{}
 
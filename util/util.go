@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,6 +26,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 
+	"github.com/klauspost/compress/zstd"
 	lz4 "github.com/pierrec/lz4/v4"
 
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -99,13 +102,101 @@ func GetFileChecksum(filePath string) (string, error) {
 
 // CompressData compresses the given data using the specified compression method
 func CompressData(method string, data []byte) (io.ReadSeeker, error) {
+	return CompressDataWithLevel(method, 0, data)
+}
+
+// CompressDataWithLevel compresses the given data using the specified
+// compression method and level. Level 0 is the default level of the method.
+func CompressDataWithLevel(method string, level int, data []byte) (io.ReadSeeker, error) {
+	compressed, err := compressData(method, level, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(compressed), nil
+}
+
+// CompressBlock compresses the block like CompressDataWithLevel, unless it
+// doesn't compress well, e.g. because the guest data is already compressed or
+// encrypted. Such a block is returned as is. It returns the compression method
+// actually used, "none" for the blocks left uncompressed.
+func CompressBlock(method string, level int, data []byte) (io.ReadSeeker, string, error) {
+	if err := ValidateCompressionLevel(method, level); err != nil {
+		return nil, "", err
+	}
+	if method == "none" || isIncompressible(data) {
+		return bytes.NewReader(data), "none", nil
+	}
+
+	compressed, err := compressData(method, level, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) > len(data)-len(data)/minCompressionSaving {
+		return bytes.NewReader(data), "none", nil
+	}
+	return bytes.NewReader(compressed), method, nil
+}
+
+const (
+	// minCompressionSaving is the fraction of a block, 1/32, that its
+	// compression has to save for the block to be stored compressed.
+	minCompressionSaving = 32
+
+	// Compressing a block whose sampled entropy is above
+	// incompressibleEntropy bits per byte is not even tried.
+	incompressibleEntropy = 7.8
+	entropySampleCount    = 16
+	entropySampleSize     = 4096
+)
+
+// isIncompressible estimates the entropy of the data from evenly spaced
+// samples of it, which is much cheaper than compressing it.
+func isIncompressible(data []byte) bool {
+	// Too small to tell, the compression is cheap anyway
+	if len(data) < entropySampleCount*entropySampleSize {
+		return false
+	}
+
+	var histogram [256]int
+	stride := len(data) / entropySampleCount
+	for i := 0; i < entropySampleCount; i++ {
+		for _, b := range data[i*stride : i*stride+entropySampleSize] {
+			histogram[b]++
+		}
+	}
+
+	total := float64(entropySampleCount * entropySampleSize)
+	entropy := 0.0
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy > incompressibleEntropy
+}
+
+func compressData(method string, level int, data []byte) ([]byte, error) {
 	if method == "none" {
-		return bytes.NewReader(data), nil
+		return data, nil
+	}
+	if err := ValidateCompressionLevel(method, level); err != nil {
+		return nil, err
+	}
+
+	if method == "zstd" {
+		// The encoders are shared, EncodeAll is safe for concurrent use
+		enc, err := getZstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
 	}
 
 	var buffer bytes.Buffer
 
-	w, err := newCompressionWriter(method, &buffer)
+	w, err := newCompressionWriter(method, level, &buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -115,7 +206,81 @@ func CompressData(method string, data []byte) (io.ReadSeeker, error) {
 		return nil, err
 	}
 	_ = w.Close()
-	return bytes.NewReader(buffer.Bytes()), nil
+	return buffer.Bytes(), nil
+}
+
+// ValidateCompressionLevel checks that the level is supported by the
+// compression method: 1 to 9 for gzip and lz4, 1 to 22 for zstd, or 0 for the
+// default level of the method.
+func ValidateCompressionLevel(method string, level int) error {
+	maxLevel := 0
+	switch method {
+	case "none":
+	case "gzip", "lz4":
+		maxLevel = 9
+	case "zstd":
+		maxLevel = 22
+	default:
+		return fmt.Errorf("unsupported compression method: %v", method)
+	}
+	if level < 0 || level > maxLevel {
+		return fmt.Errorf("invalid compression level %v for compression method %v", level, method)
+	}
+	return nil
+}
+
+// DetectCompressionMethod tells the compression method of the data from its
+// magic number. It returns an empty string if the data doesn't start with a
+// known one.
+func DetectCompressionMethod(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(data, lz4Magic):
+		return "lz4"
+	case bytes.HasPrefix(data, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	zstdEncodersMutex sync.Mutex
+	zstdEncoders      = map[int]*zstd.Encoder{}
+
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+func getZstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdEncodersMutex.Lock()
+	defer zstdEncodersMutex.Unlock()
+
+	if enc, ok := zstdEncoders[level]; ok {
+		return enc, nil
+	}
+	encoderLevel := zstd.SpeedDefault
+	if level != 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create zstd encoder")
+	}
+	zstdEncoders[level] = enc
+	return enc, nil
+}
+
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+	})
+	return zstdDecoder, zstdDecoderErr
 }
 
 // DecompressAndVerify decompresses the given data and verifies the data integrity
@@ -137,12 +302,22 @@ func DecompressAndVerify(method string, src io.Reader, checksum string) (io.Read
 	return bytes.NewReader(block), nil
 }
 
-func newCompressionWriter(method string, buffer io.Writer) (io.WriteCloser, error) {
+func newCompressionWriter(method string, level int, buffer io.Writer) (io.WriteCloser, error) {
 	switch method {
 	case "gzip":
-		return gzip.NewWriter(buffer), nil
+		if level == 0 {
+			return gzip.NewWriter(buffer), nil
+		}
+		return gzip.NewWriterLevel(buffer, level)
 	case "lz4":
-		return lz4.NewWriter(buffer), nil
+		w := lz4.NewWriter(buffer)
+		if level != 0 {
+			// lz4.Level1 to lz4.Level9
+			if err := w.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level)))); err != nil {
+				return nil, err
+			}
+		}
+		return w, nil
 	default:
 		return nil, fmt.Errorf("unsupported compression method: %v", method)
 	}
@@ -156,6 +331,20 @@ func newDecompressionReader(method string, r io.Reader) (io.ReadCloser, error) {
 		return gzip.NewReader(r)
 	case "lz4":
 		return io.NopCloser(lz4.NewReader(r)), nil
+	case "zstd":
+		dec, err := getZstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		block, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(block)), nil
 	default:
 		return nil, fmt.Errorf("unsupported decompression method: %v", method)
 	}
@@ -234,6 +423,14 @@ func ExecuteWithCustomTimeout(binary string, args []string, timeout time.Duratio
 	return execute(ctx, binary, args)
 }
 
+// ExecuteWithContext executes a command with the default timeout, aborting it early
+// when ctx is done
+func ExecuteWithContext(ctx context.Context, binary string, args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
+	defer cancel()
+	return execute(ctx, binary, args)
+}
+
 func execute(ctx context.Context, binary string, args []string) (string, error) {
 	var output []byte
 	var err error
@@ -1,15 +1,20 @@
 package util
 
 import (
+	"bytes"
 	"io"
 	"math/rand"
 	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
+
+	"github.com/longhorn/backupstore/types"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -58,7 +63,7 @@ func (s *TestSuite) TearDownSuite(c *C) {
 }
 
 func (s *TestSuite) TestCompress(c *C) {
-	compressionMethods := []string{"none", "gzip", "lz4"}
+	compressionMethods := []string{"none", "gzip", "lz4", "zstd"}
 
 	for _, compressionMethod := range compressionMethods {
 		var err error
@@ -78,6 +83,73 @@ func (s *TestSuite) TestCompress(c *C) {
 	}
 }
 
+func (s *TestSuite) TestCompressWithLevel(c *C) {
+	data := []byte(strings.Repeat("Some random string", 100))
+	checksum := GetChecksum(data)
+
+	for compressionMethod, levels := range map[string][]int{
+		"gzip": {0, 1, 9},
+		"lz4":  {0, 1, 9},
+		"zstd": {0, 1, 3, 19, 22},
+	} {
+		for _, level := range levels {
+			compressed, err := CompressDataWithLevel(compressionMethod, level, data)
+			c.Assert(err, IsNil)
+
+			buf, err := io.ReadAll(compressed)
+			c.Assert(err, IsNil)
+			c.Assert(DetectCompressionMethod(buf), Equals, compressionMethod)
+
+			decompressed, err := DecompressAndVerify(compressionMethod, bytes.NewReader(buf), checksum)
+			c.Assert(err, IsNil)
+			result, err := io.ReadAll(decompressed)
+			c.Assert(err, IsNil)
+			c.Assert(result, DeepEquals, data)
+		}
+	}
+
+	_, err := CompressDataWithLevel("gzip", 10, data)
+	c.Assert(err, ErrorMatches, "invalid compression level 10 for compression method gzip")
+	_, err = CompressDataWithLevel("zstd", -1, data)
+	c.Assert(err, ErrorMatches, "invalid compression level -1 for compression method zstd")
+	_, err = CompressDataWithLevel("bzip2", 0, data)
+	c.Assert(err, ErrorMatches, "unsupported compression method: bzip2")
+
+	c.Assert(DetectCompressionMethod(data), Equals, "")
+	c.Assert(DetectCompressionMethod(nil), Equals, "")
+}
+
+func (s *TestSuite) TestCompressBlock(c *C) {
+	random := make([]byte, 2<<20)
+	_, err := rand.Read(random)
+	c.Assert(err, IsNil)
+
+	for name, testCase := range map[string]struct {
+		data           []byte
+		expectedMethod string
+	}{
+		"compressible":              {[]byte(strings.Repeat("Some random string", 1000)), "zstd"},
+		"incompressible by entropy": {random, "none"},
+		"incompressible by ratio":   {random[:4096], "none"},
+		"compressible with noise":   {append([]byte(strings.Repeat("a", 1<<20)), random[:1<<20]...), "zstd"},
+	} {
+		compressed, method, err := CompressBlock("zstd", 0, testCase.data)
+		c.Assert(err, IsNil, Commentf(name))
+		c.Assert(method, Equals, testCase.expectedMethod, Commentf(name))
+
+		buf, err := io.ReadAll(compressed)
+		c.Assert(err, IsNil)
+		if method == "none" {
+			c.Assert(buf, DeepEquals, testCase.data, Commentf(name))
+		}
+		decompressed, err := DecompressAndVerify(method, bytes.NewReader(buf), GetChecksum(testCase.data))
+		c.Assert(err, IsNil, Commentf(name))
+		result, err := io.ReadAll(decompressed)
+		c.Assert(err, IsNil)
+		c.Assert(result, DeepEquals, testCase.data, Commentf(name))
+	}
+}
+
 func GenerateRandString() string {
 	r := make([]rune, nameLength)
 	r[0] = firstLetters[rand.Intn(len(firstLetters))]
@@ -137,6 +209,38 @@ func (s *TestSuite) TestValidateName(c *C) {
 	c.Assert(ValidateName("ubuntu14.04_v1 "), Equals, false)
 }
 
+func (s *TestSuite) TestSetupCredentialUnsetsEncryptionSecret(c *C) {
+	defer func() {
+		_ = os.Unsetenv(types.BackupEncryptionKey)
+		_ = os.Unsetenv(types.BackupEncryptionPassphrase)
+	}()
+
+	err := SetupCredential("nfs", map[string]string{types.BackupEncryptionPassphrase: "secret of target A"})
+	c.Assert(err, IsNil)
+	c.Assert(os.Getenv(types.BackupEncryptionPassphrase), Equals, "secret of target A")
+
+	// The secret of target A doesn't apply to the unencrypted target B
+	err = SetupCredential("nfs", map[string]string{})
+	c.Assert(err, IsNil)
+	_, ok := os.LookupEnv(types.BackupEncryptionPassphrase)
+	c.Assert(ok, Equals, false)
+	_, ok = os.LookupEnv(types.BackupEncryptionKey)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TestSuite) TestSetupCredentialKeepsEnvEncryptionSecret(c *C) {
+	defer func() {
+		_ = os.Unsetenv(types.BackupEncryptionPassphrase)
+	}()
+
+	// A target without a secret of its own, like NFS, keeps the one given by
+	// the environment
+	_ = os.Setenv(types.BackupEncryptionPassphrase, "secret from env")
+	err := SetupCredential("nfs", nil)
+	c.Assert(err, IsNil)
+	c.Assert(os.Getenv(types.BackupEncryptionPassphrase), Equals, "secret from env")
+}
+
 func (s *TestSuite) TestSplitMountOptions(c *C) {
 	testCases := []struct {
 		destURL          string
@@ -0,0 +1,461 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gammazero/workerpool"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging" // nolint: staticcheck
+)
+
+// VerifyConfig configures the verification of the backup volumes of a
+// backupstore.
+type VerifyConfig struct {
+	DestURL string
+	// VolumeName is the backup volume to verify, all of them if empty
+	VolumeName string
+	// CheckBlockData reads each referenced block and verifies its checksum,
+	// the blocks are only checked for existence otherwise
+	CheckBlockData bool
+	// ConcurrentLimit bounds the requests in flight, DefaultGCConcurrentLimit
+	// if not set
+	ConcurrentLimit int32
+}
+
+// VerifyReport is what Verify found in the backup volumes, by volume name.
+type VerifyReport struct {
+	Volumes map[string]*VolumeVerifyReport
+}
+
+type VolumeVerifyReport struct {
+	BackupCount       int
+	BlockCount        int
+	CheckedBlockCount int
+
+	// Error tells why the volume couldn't be verified, if it couldn't
+	Error string `json:",omitempty"`
+
+	InvalidBackups    []InvalidBackup         `json:",omitempty"`
+	InProgressBackups []string                `json:",omitempty"`
+	MissingBlocks     []UnknownBlockReference `json:",omitempty"`
+	CorruptedBlocks   []CorruptedBlock        `json:",omitempty"`
+	// OrphanBlocks are the stored blocks no backup references. They aren't
+	// looked for when a backup can't be loaded or is in progress, and in the
+	// block pool shared by the volumes.
+	OrphanBlocks []string    `json:",omitempty"`
+	StaleLocks   []StaleLock `json:",omitempty"`
+}
+
+type InvalidBackup struct {
+	BackupName string
+	Error      string
+}
+
+type CorruptedBlock struct {
+	BlockChecksum string
+	Error         string
+}
+
+type StaleLock struct {
+	Name       string
+	Type       LockType
+	ServerTime string
+}
+
+// Healthy tells whether the backups of the volume can all be restored. The
+// orphan blocks, stale locks and in progress backups are left for GC and the
+// next backups to clean up.
+func (r *VolumeVerifyReport) Healthy() bool {
+	return r.Error == "" && len(r.InvalidBackups) == 0 && len(r.MissingBlocks) == 0 && len(r.CorruptedBlocks) == 0
+}
+
+func Verify(config *VerifyConfig) (*VerifyReport, error) {
+	return VerifyWithContext(context.Background(), config)
+}
+
+// VerifyWithContext checks that the blocks referenced by the backups of the
+// volumes are stored, and optionally that they're intact. It doesn't lock the
+// volumes, the blocks of a backup or a deletion running meanwhile may be
+// reported missing or orphan. Nothing is changed in the backupstore but the
+// block index of the volumes found damaged, which is removed so that the next
+// backups don't trust it.
+func VerifyWithContext(ctx context.Context, config *VerifyConfig) (*VerifyReport, error) {
+	driver, err := GetBackupStoreDriver(config.DestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeNames := []string{config.VolumeName}
+	if config.VolumeName == "" {
+		jobQueues := workerpool.New(runtime.NumCPU() * 16)
+		defer jobQueues.StopWait()
+		if volumeNames, err = getVolumeNames(ctx, jobQueues, driver); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &VerifyReport{
+		Volumes: map[string]*VolumeVerifyReport{},
+	}
+	for _, volumeName := range volumeNames {
+		volumeReport, err := verifyVolume(ctx, driver, volumeName, config)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			log.WithError(err).WithField(LogFieldVolume, volumeName).Warn("Failed to verify backup volume")
+			volumeReport.Error = err.Error()
+		}
+		report.Volumes[volumeName] = volumeReport
+	}
+	return report, nil
+}
+
+// verifyVolume returns the report of the volume along with the error that
+// stopped its verification, if any.
+func verifyVolume(ctx context.Context, driver BackupStoreDriver, volumeName string, config *VerifyConfig) (*VolumeVerifyReport, error) {
+	report := &VolumeVerifyReport{}
+	verifyLog := log.WithField(LogFieldVolume, volumeName)
+
+	v, err := loadVolume(ctx, driver, volumeName)
+	if err != nil {
+		return report, err
+	}
+	gcConfig := &GCConfig{ConcurrentLimit: config.ConcurrentLimit}
+
+	storedBlocks := map[string]bool{}
+	var blockNames []string
+	if v.BlockPool {
+		blockNames, err = ListBlockNames(ctx, driver, getPoolBlockPath(), gcConfig)
+	} else if v.PackFiles {
+		if err = loadVolumePacks(ctx, driver, v); err == nil {
+			for checksum := range v.packs.locations {
+				blockNames = append(blockNames, checksum)
+			}
+		}
+	} else {
+		blockNames, err = ListBlockNames(ctx, driver, getBlockPath(volumeName), gcConfig)
+	}
+	if err != nil {
+		return report, err
+	}
+	for _, name := range blockNames {
+		storedBlocks[name] = true
+	}
+
+	backupNames, err := getBackupNamesForVolume(ctx, driver, volumeName)
+	if err != nil {
+		return report, err
+	}
+	report.BackupCount = len(backupNames)
+
+	// The compression method of the legacy blocks is recorded by the backups,
+	// the one of the first backup referencing a block is used to check it
+	referencedBlocks := map[string]string{}
+	for _, name := range backupNames {
+		backup, err := loadBackup(ctx, driver, name, volumeName)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return report, ctxErr
+			}
+			report.InvalidBackups = append(report.InvalidBackups, InvalidBackup{
+				BackupName: name,
+				Error:      err.Error(),
+			})
+			continue
+		}
+		if isBackupInProgress(backup) {
+			report.InProgressBackups = append(report.InProgressBackups, name)
+			continue
+		}
+
+		for _, blk := range backup.Blocks {
+			if !storedBlocks[blk.BlockChecksum] {
+				report.MissingBlocks = append(report.MissingBlocks, UnknownBlockReference{
+					BackupName:    name,
+					Offset:        blk.Offset,
+					BlockChecksum: blk.BlockChecksum,
+				})
+				continue
+			}
+			if _, ok := referencedBlocks[blk.BlockChecksum]; !ok {
+				referencedBlocks[blk.BlockChecksum] = blk.getCompressionMethod(backup.CompressionMethod)
+			}
+		}
+	}
+	report.BlockCount = len(referencedBlocks)
+
+	if config.CheckBlockData {
+		if report.CorruptedBlocks, err = verifyBlocks(ctx, driver, v, referencedBlocks, config.ConcurrentLimit); err != nil {
+			return report, err
+		}
+		report.CheckedBlockCount = len(referencedBlocks)
+	}
+
+	if !v.BlockPool && len(report.InvalidBackups) == 0 && len(report.InProgressBackups) == 0 {
+		for checksum := range storedBlocks {
+			if _, ok := referencedBlocks[checksum]; !ok {
+				report.OrphanBlocks = append(report.OrphanBlocks, checksum)
+			}
+		}
+		sort.Strings(report.OrphanBlocks)
+	}
+
+	for _, lock := range getLocksForVolume(ctx, volumeName, driver) {
+		if lock.isExpired() {
+			report.StaleLocks = append(report.StaleLocks, StaleLock{
+				Name:       lock.Name,
+				Type:       lock.Type,
+				ServerTime: lock.serverTime.Format(time.RFC3339),
+			})
+		}
+	}
+
+	if len(report.MissingBlocks) > 0 || len(report.CorruptedBlocks) > 0 {
+		// The block index may list the damaged blocks
+		if err := removeBlockIndex(ctx, driver, volumeName); err != nil {
+			verifyLog.WithError(err).Warn("Failed to remove the block index of the damaged volume")
+		}
+	}
+
+	verifyLog.WithFields(logrus.Fields{
+		"missing_blocks":   len(report.MissingBlocks),
+		"corrupted_blocks": len(report.CorruptedBlocks),
+		"orphan_blocks":    len(report.OrphanBlocks),
+	}).Info("Verified backup volume")
+	return report, nil
+}
+
+// verifyBlocks reads the blocks in parallel and returns the ones failing to
+// decode or to match their checksum. Each block is read once, without the
+// retries of a restore, so a block failing to be read is reported too.
+func verifyBlocks(ctx context.Context, driver BackupStoreDriver, v *Volume, blocks map[string]string, concurrentLimit int32) ([]CorruptedBlock, error) {
+	var mutex sync.Mutex
+	var corrupted []CorruptedBlock
+	workers := newBoundedWorkers(concurrentLimit)
+	for checksum, decompression := range blocks {
+		workers.submit(ctx, func() error {
+			buf, err := readVolumeBlock(ctx, driver, v, checksum)
+			if err == nil {
+				_, err = decodeAndVerifyBlock(buf, checksum, decompression, checksum)
+			}
+			if err != nil && ctx.Err() == nil {
+				mutex.Lock()
+				corrupted = append(corrupted, CorruptedBlock{
+					BlockChecksum: checksum,
+					Error:         err.Error(),
+				})
+				mutex.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(corrupted, func(i, j int) bool {
+		return corrupted[i].BlockChecksum < corrupted[j].BlockChecksum
+	})
+	return corrupted, nil
+}
+
+// BackupVerifyReport is what VerifyDeltaBlockBackup found in the blocks of a
+// backup.
+type BackupVerifyReport struct {
+	BackupName string
+	VolumeName string
+	BlockCount int
+
+	MissingBlocks   []InvalidBlock `json:",omitempty"`
+	CorruptedBlocks []InvalidBlock `json:",omitempty"`
+}
+
+// InvalidBlock is a block of the backup that can't be restored, at each offset
+// it's referenced at.
+type InvalidBlock struct {
+	Offset        int64 `json:",string"`
+	BlockChecksum string
+	Error         string
+}
+
+// Restorable tells whether the blocks of the backup can all be restored.
+func (r *BackupVerifyReport) Restorable() bool {
+	return len(r.MissingBlocks) == 0 && len(r.CorruptedBlocks) == 0
+}
+
+// VerifyStatusFunc is called with the progress of the verification of a
+// backup, like DeltaRestoreOperations.UpdateRestoreStatus with the one of a
+// restore. The calls are serialized, the last one reports the error that
+// stopped the verification, if any.
+type VerifyStatusFunc func(backupName string, verifyProgress int, err error)
+
+// VerifyDeltaBlockBackup reads every block referenced by the backup the way a
+// restore does, retries included, and reports the ones that are missing or
+// fail to be decoded and verified, without writing them anywhere. The volume is
+// locked as for a restore so that the blocks aren't deleted meanwhile.
+func VerifyDeltaBlockBackup(ctx context.Context, backupURL string, concurrentLimit int32, updateStatus VerifyStatusFunc) (report *BackupVerifyReport, err error) {
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	verifyLog := log.WithFields(logrus.Fields{
+		LogFieldBackup:          backupName,
+		LogFieldVolume:          volumeName,
+		LogFieldConcurrentLimit: concurrentLimit,
+	})
+
+	currentProgress := 0
+	defer func() {
+		if err != nil {
+			verifyLog.WithError(err).Error("Failed to verify delta block backup")
+		}
+		if updateStatus != nil {
+			updateStatus(backupName, currentProgress, err)
+		}
+	}()
+
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := New(bsDriver, volumeName, RESTORE_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			verifyLog.WithError(unlockErr).Warn("Failed to unlock")
+		}
+	}()
+	if err := lock.LockWithContext(ctx); err != nil {
+		return nil, err
+	}
+
+	vol, err := loadVolume(ctx, bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadVolumePacks(ctx, bsDriver, vol); err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(ctx, bsDriver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if isBackupInProgress(backup) {
+		return nil, fmt.Errorf("backup %v is still in progress", backupName)
+	}
+	if err := ValidateBlockFormatVersion(backup.BlockFormatVersion); err != nil {
+		return nil, errors.Wrapf(err, "cannot verify backup %v", backupName)
+	}
+	blockSize, err := backup.GetBlockSize()
+	if err != nil {
+		return nil, err
+	}
+
+	// A block is read once however many offsets reference it
+	offsets := map[string][]BlockMapping{}
+	for _, blk := range backup.Blocks {
+		offsets[blk.BlockChecksum] = append(offsets[blk.BlockChecksum], blk)
+	}
+
+	report = &BackupVerifyReport{
+		BackupName: backupName,
+		VolumeName: volumeName,
+		BlockCount: len(offsets),
+	}
+	// The status updates are serialized by the mutex
+	var mutex sync.Mutex
+	verified := 0
+	workers := newBoundedWorkers(concurrentLimit)
+	for checksum, blocks := range offsets {
+		workers.submit(ctx, func() error {
+			missing, err := verifyBackupBlock(ctx, bsDriver, vol, blocks[0], backup.CompressionMethod, blockSize)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			verified++
+			currentProgress = verified * PROGRESS_PERCENTAGE_BACKUP_TOTAL / len(offsets)
+			if updateStatus != nil {
+				updateStatus(backupName, currentProgress, nil)
+			}
+			if err == nil || ctx.Err() != nil {
+				return nil
+			}
+			for _, blk := range blocks {
+				invalid := InvalidBlock{
+					Offset:        blk.Offset,
+					BlockChecksum: checksum,
+					Error:         err.Error(),
+				}
+				if missing {
+					report.MissingBlocks = append(report.MissingBlocks, invalid)
+				} else {
+					report.CorruptedBlocks = append(report.CorruptedBlocks, invalid)
+				}
+			}
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, invalid := range [][]InvalidBlock{report.MissingBlocks, report.CorruptedBlocks} {
+		sort.Slice(invalid, func(i, j int) bool {
+			return invalid[i].Offset < invalid[j].Offset
+		})
+	}
+	if !report.Restorable() {
+		// The block index may list the damaged blocks
+		if err := removeBlockIndex(ctx, bsDriver, volumeName); err != nil {
+			verifyLog.WithError(err).Warn("Failed to remove the block index of the damaged volume")
+		}
+	}
+
+	verifyLog.WithFields(logrus.Fields{
+		"missing_blocks":   len(report.MissingBlocks),
+		"corrupted_blocks": len(report.CorruptedBlocks),
+	}).Info("Verified delta block backup")
+	return report, nil
+}
+
+// verifyBackupBlock checks that the block is stored and decodes to its size in
+// the backup, and tells whether it's missing if it isn't.
+func verifyBackupBlock(ctx context.Context, driver BackupStoreDriver, vol *Volume, blk BlockMapping, backupCompressionMethod string, blockSize int64) (bool, error) {
+	// The reads are retried, a missing block would be for minutes
+	exists, err := volumeBlockExists(ctx, driver, vol, blk.BlockChecksum)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, fmt.Errorf("block %v doesn't exist", blk.BlockChecksum)
+	}
+	r, err := decompressAndVerifyVolumeBlock(ctx, driver, vol, blk.getCompressionMethod(backupCompressionMethod), blk.BlockChecksum)
+	if err != nil {
+		return false, err
+	}
+	size, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read block %v", blk.BlockChecksum)
+	}
+	if expected := blk.getSize(blockSize); size != expected {
+		return false, fmt.Errorf("block %v has size %v instead of %v", blk.BlockChecksum, size, expected)
+	}
+	return false, nil
+}
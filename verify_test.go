@@ -0,0 +1,140 @@
+package backupstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	content := randomData(1, int(4*deltaBlockSize))
+	createTestBackup(t, deltaVolumeName, "backup-1", content, nil)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+
+	report, err := Verify(&VerifyConfig{DestURL: deltaDriverURL, CheckBlockData: true})
+	assert.NoError(err)
+	assert.Equal(map[string]*VolumeVerifyReport{
+		deltaVolumeName: {BackupCount: 1, BlockCount: 4, CheckedBlockCount: 4},
+	}, report.Volumes)
+	assert.True(report.Volumes[deltaVolumeName].Healthy())
+
+	missing := backup.Blocks[1]
+	assert.NoError(m.fs.Remove(getBlockFilePath(deltaVolumeName, missing.BlockChecksum)))
+	corrupted := backup.Blocks[2]
+	assert.NoError(afero.WriteFile(m.fs, getBlockFilePath(deltaVolumeName, corrupted.BlockChecksum), randomData(2, 100), 0644))
+	orphan := util.GetChecksum(randomData(3, int(deltaBlockSize)))
+	assert.NoError(afero.WriteFile(m.fs, getBlockFilePath(deltaVolumeName, orphan), randomData(3, 100), 0644))
+
+	lock, err := New(m, deltaVolumeName, BACKUP_LOCK)
+	assert.NoError(err)
+	assert.NoError(saveLock(context.Background(), lock))
+	expired := time.Now().Add(-2 * LOCK_DURATION)
+	assert.NoError(m.fs.Chtimes(getLockFilePath(deltaVolumeName, lock.Name), expired, expired))
+	filesBefore := listFiles(t, m.fs)
+
+	// The existence of the blocks is checked without reading them
+	report, err = Verify(&VerifyConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName})
+	assert.NoError(err)
+	volumeReport := report.Volumes[deltaVolumeName]
+	assert.False(volumeReport.Healthy())
+	assert.Equal(3, volumeReport.BlockCount)
+	assert.Zero(volumeReport.CheckedBlockCount)
+	assert.Equal([]UnknownBlockReference{{
+		BackupName:    "backup-1",
+		Offset:        missing.Offset,
+		BlockChecksum: missing.BlockChecksum,
+	}}, volumeReport.MissingBlocks)
+	assert.Empty(volumeReport.CorruptedBlocks)
+	assert.Equal([]string{orphan}, volumeReport.OrphanBlocks)
+	if assert.Len(volumeReport.StaleLocks, 1) {
+		assert.Equal(lock.Name, volumeReport.StaleLocks[0].Name)
+		assert.Equal(BACKUP_LOCK, volumeReport.StaleLocks[0].Type)
+	}
+
+	report, err = Verify(&VerifyConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName, CheckBlockData: true})
+	assert.NoError(err)
+	volumeReport = report.Volumes[deltaVolumeName]
+	assert.Equal(3, volumeReport.CheckedBlockCount)
+	if assert.Len(volumeReport.CorruptedBlocks, 1) {
+		assert.Equal(corrupted.BlockChecksum, volumeReport.CorruptedBlocks[0].BlockChecksum)
+	}
+
+	// The blocks of a backup in progress aren't orphans yet
+	m.seedBackup(t, &Backup{Name: "backup-2", VolumeName: deltaVolumeName})
+	report, err = Verify(&VerifyConfig{DestURL: deltaDriverURL, VolumeName: deltaVolumeName})
+	assert.NoError(err)
+	volumeReport = report.Volumes[deltaVolumeName]
+	assert.Equal(2, volumeReport.BackupCount)
+	assert.Equal([]string{"backup-2"}, volumeReport.InProgressBackups)
+	assert.Empty(volumeReport.OrphanBlocks)
+
+	// Nothing was repaired, the block index listing the damaged blocks is
+	// removed only
+	assert.NotContains(listFiles(t, m.fs), getBlockIndexFilePath(deltaVolumeName))
+	delete(filesBefore, getBlockIndexFilePath(deltaVolumeName))
+	delete(filesBefore, getBackupConfigPath("backup-2", deltaVolumeName))
+	files := listFiles(t, m.fs)
+	delete(files, getBackupConfigPath("backup-2", deltaVolumeName))
+	assert.Equal(filesBefore, files)
+}
+
+func TestVerifyDeltaBlockBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newDeltaMockStoreDriver(t)
+	// The first block is repeated at the end of the volume
+	content := randomData(1, int(4*deltaBlockSize))
+	copy(content[3*deltaBlockSize:], content[:deltaBlockSize])
+	createTestBackup(t, deltaVolumeName, "backup-1", content, nil)
+	backup, err := loadBackup(context.Background(), m, "backup-1", deltaVolumeName)
+	assert.NoError(err)
+	backupURL := EncodeBackupURL("backup-1", deltaVolumeName, deltaDriverURL)
+
+	var progress []int
+	var lastErr error
+	updateStatus := func(backupName string, verifyProgress int, err error) {
+		assert.Equal("backup-1", backupName)
+		progress = append(progress, verifyProgress)
+		lastErr = err
+	}
+	report, err := VerifyDeltaBlockBackup(context.Background(), backupURL, 2, updateStatus)
+	assert.NoError(err)
+	assert.NoError(lastErr)
+	assert.True(report.Restorable())
+	assert.Equal(3, report.BlockCount)
+	assert.Equal([]int{33, 66, 100, 100}, progress)
+
+	missing := backup.Blocks[0]
+	assert.NoError(m.fs.Remove(getBlockFilePath(deltaVolumeName, missing.BlockChecksum)))
+	// A valid block of another checksum fails the verification of the checksum
+	corrupted := backup.Blocks[2]
+	data, err := afero.ReadFile(m.fs, getBlockFilePath(deltaVolumeName, backup.Blocks[1].BlockChecksum))
+	assert.NoError(err)
+	assert.NoError(afero.WriteFile(m.fs, getBlockFilePath(deltaVolumeName, corrupted.BlockChecksum), data, 0644))
+
+	report, err = VerifyDeltaBlockBackup(context.Background(), backupURL, 2, nil)
+	assert.NoError(err)
+	assert.False(report.Restorable())
+	if assert.Len(report.MissingBlocks, 2) {
+		assert.Equal(int64(0), report.MissingBlocks[0].Offset)
+		assert.Equal(3*deltaBlockSize, report.MissingBlocks[1].Offset)
+		assert.Equal(missing.BlockChecksum, report.MissingBlocks[1].BlockChecksum)
+	}
+	if assert.Len(report.CorruptedBlocks, 1) {
+		assert.Equal(corrupted.Offset, report.CorruptedBlocks[0].Offset)
+		assert.Contains(report.CorruptedBlocks[0].Error, "checksum verification failed")
+	}
+	// The lock was released
+	assert.Empty(getLocksForVolume(context.Background(), deltaVolumeName, m))
+	// The block index listing the damaged blocks was removed
+	assert.False(m.FileExists(getBlockIndexFilePath(deltaVolumeName)))
+}
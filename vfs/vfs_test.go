@@ -0,0 +1,18 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		driver, err := initFunc("vfs://" + t.TempDir())
+		if err != nil {
+			t.Fatalf("failed to initialize the driver: %v", err)
+		}
+		return driver
+	})
+}
@@ -0,0 +1,264 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "webdav"})
+)
+
+// BackupStoreDriver talks to a WebDAV server, e.g. Nextcloud or ownCloud.
+// webdav:// is served over plain HTTP and webdavs:// over HTTPS.
+type BackupStoreDriver struct {
+	kind    string
+	destURL string
+	path    string
+	service *service
+}
+
+const (
+	KIND       = "webdav"
+	KIND_HTTPS = "webdavs"
+)
+
+func init() {
+	for _, kind := range []string{KIND, KIND_HTTPS} {
+		if err := backupstore.RegisterDriver(kind, initFunc); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND && u.Scheme != KIND_HTTPS {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Host == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid URL. Must be either webdav://host[:port]/path or webdavs://host[:port]/path")
+	}
+
+	b := &BackupStoreDriver{kind: u.Scheme}
+	b.service, err = newService(u)
+	if err != nil {
+		return nil, err
+	}
+	b.path = u.Path
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = b.kind + "://" + u.Host + b.path
+
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func getCustomCerts() []byte {
+	// Certificates in PEM format (base64)
+	certs := os.Getenv("WEBDAV_CERT")
+	if certs == "" {
+		return nil
+	}
+
+	return []byte(certs)
+}
+
+func (b *BackupStoreDriver) Kind() string {
+	return b.kind
+}
+
+func (b *BackupStoreDriver) GetURL() string {
+	return b.destURL
+}
+
+func (b *BackupStoreDriver) stat(ctx context.Context, filePath string) (*resource, error) {
+	resources, err := b.service.Propfind(ctx, filePath, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) != 1 {
+		return nil, fmt.Errorf("unexpected %v entries in the properties of %v", len(resources), filePath)
+	}
+	return &resources[0], nil
+}
+
+func (b *BackupStoreDriver) List(listPath string) ([]string, error) {
+	return b.ListWithContext(context.Background(), listPath)
+}
+
+func (b *BackupStoreDriver) ListWithContext(ctx context.Context, listPath string) ([]string, error) {
+	var result []string
+
+	resources, err := b.service.Propfind(ctx, listPath, 1)
+	if err != nil {
+		if isNotFound(err) {
+			return result, nil
+		}
+		log.WithError(err).Error("Failed to list webdav")
+		return result, err
+	}
+
+	for _, r := range resources {
+		result = append(result, r.Name)
+	}
+	return result, nil
+}
+
+func (b *BackupStoreDriver) FileExists(filePath string) bool {
+	return b.FileExistsWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileExistsWithContext(ctx context.Context, filePath string) bool {
+	return b.FileSizeWithContext(ctx, filePath) >= 0
+}
+
+func (b *BackupStoreDriver) FileSize(filePath string) int64 {
+	return b.FileSizeWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileSizeWithContext(ctx context.Context, filePath string) int64 {
+	r, err := b.stat(ctx, filePath)
+	if err != nil || r.IsCollection {
+		return -1
+	}
+	return r.Size
+}
+
+func (b *BackupStoreDriver) FileTime(filePath string) time.Time {
+	return b.FileTimeWithContext(context.Background(), filePath)
+}
+
+func (b *BackupStoreDriver) FileTimeWithContext(ctx context.Context, filePath string) time.Time {
+	r, err := b.stat(ctx, filePath)
+	if err != nil || r.IsCollection {
+		return time.Time{}
+	}
+	return r.LastModified.UTC()
+}
+
+// Remove deletes the file or the whole collection. The emptied parent
+// collections are left behind, since a DELETE of a collection is always
+// recursive and can't be limited to empty ones.
+func (b *BackupStoreDriver) Remove(path string) error {
+	return b.RemoveWithContext(context.Background(), path)
+}
+
+func (b *BackupStoreDriver) RemoveWithContext(ctx context.Context, path string) error {
+	return b.service.Delete(ctx, path)
+}
+
+func (b *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return b.ReadWithContext(context.Background(), src)
+}
+
+func (b *BackupStoreDriver) ReadWithContext(ctx context.Context, src string) (io.ReadCloser, error) {
+	return b.service.Get(ctx, src)
+}
+
+func (b *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return b.WriteWithContext(context.Background(), dst, rs)
+}
+
+func (b *BackupStoreDriver) WriteWithContext(ctx context.Context, dst string, rs io.ReadSeeker) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return b.write(ctx, dst, rs, size)
+}
+
+// write uploads the content to a temporary resource next to dst and moves it
+// into place afterwards, so readers never observe a partially written file.
+func (b *BackupStoreDriver) write(ctx context.Context, dst string, r io.Reader, size int64) error {
+	if err := b.service.MkcolAll(ctx, path.Dir(dst)); err != nil {
+		return err
+	}
+
+	// we append the timestamp to the tmp files so that we should never have 2 backups using the same tmp file
+	tmpFile := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+	if err := b.service.Put(ctx, tmpFile, r, size); err != nil {
+		return err
+	}
+	if err := b.service.Move(ctx, tmpFile, dst); err != nil {
+		// The context may be gone already, the cleanup must happen regardless
+		_ = b.service.Delete(context.Background(), tmpFile)
+		return err
+	}
+	return nil
+}
+
+func (b *BackupStoreDriver) Upload(src, dst string) error {
+	return b.UploadWithContext(context.Background(), src, dst)
+}
+
+func (b *BackupStoreDriver) UploadWithContext(ctx context.Context, src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return b.write(ctx, dst, file, st.Size())
+}
+
+func (b *BackupStoreDriver) Download(src, dst string) error {
+	return b.DownloadWithContext(context.Background(), src, dst)
+}
+
+func (b *BackupStoreDriver) DownloadWithContext(ctx context.Context, src, dst string) error {
+	if _, err := os.Stat(dst); err != nil {
+		_ = os.Remove(dst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	rc, err := b.service.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
@@ -0,0 +1,310 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	bhttp "github.com/longhorn/backupstore/http"
+)
+
+const (
+	methodPropfind = "PROPFIND"
+	methodMkcol    = "MKCOL"
+	methodMove     = "MOVE"
+
+	propfindBody = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>` +
+		`</D:prop></D:propfind>`
+)
+
+type service struct {
+	// Base is the URL of the collection holding the backupstore
+	Base     url.URL
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// resource is the subset of the WebDAV properties the driver relies on.
+type resource struct {
+	Name         string
+	IsCollection bool
+	Size         int64
+	LastModified time.Time
+}
+
+type multistatus struct {
+	Responses []propfindResponse `xml:"DAV: response"`
+}
+
+type propfindResponse struct {
+	Href      string     `xml:"DAV: href"`
+	Propstats []propstat `xml:"DAV: propstat"`
+}
+
+type propstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength int64  `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+	} `xml:"DAV: prop"`
+}
+
+// statusError is the error returned for a request the server refused.
+type statusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("WebDAV Error: %s", e.Status)
+}
+
+func hasStatus(err error, code int) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.StatusCode == code
+}
+
+func newService(u *url.URL) (*service, error) {
+	s := service{
+		Username: os.Getenv("WEBDAV_USERNAME"),
+		Password: os.Getenv("WEBDAV_PASSWORD"),
+	}
+
+	s.Base = url.URL{
+		Scheme: "http",
+		Host:   u.Host,
+		Path:   u.Path,
+	}
+	if u.Scheme == "webdavs" {
+		s.Base.Scheme = "https"
+	}
+
+	// add custom ca to http client that is used by webdav service
+	client, err := bhttp.GetClientWithCustomCerts(getCustomCerts())
+	if err != nil {
+		return nil, err
+	}
+	// The credentials must not follow a redirect to another host
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != s.Base.Host {
+			return fmt.Errorf("refusing redirect from %v to another host %v", s.Base.Host, req.URL.Host)
+		}
+		return nil
+	}
+	s.Client = client
+
+	return &s, nil
+}
+
+// resourceURL returns the URL of name relative to the base collection, with a
+// trailing slash if name refers to a collection.
+func (s *service) resourceURL(name string, collection bool) string {
+	u := s.Base
+	u.Path = path.Join(s.Base.Path, name)
+	if collection && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (s *service) newRequest(ctx context.Context, method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	return req, nil
+}
+
+func (s *service) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	return nil, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// Propfind returns the resource itself with depth 0, or the members of the
+// collection with depth 1.
+func (s *service) Propfind(ctx context.Context, name string, depth int) ([]resource, error) {
+	target := s.resourceURL(name, depth > 0)
+	req, err := s.newRequest(ctx, methodPropfind, target, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", fmt.Sprint(depth))
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get properties of %v", name)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the properties of %v", name)
+	}
+
+	self, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	var resources []resource
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid href %v in the properties of %v", r.Href, name)
+		}
+		// Depth 1 includes the collection itself
+		if depth > 0 && strings.TrimSuffix(href.Path, "/") == strings.TrimSuffix(self.Path, "/") {
+			continue
+		}
+		res := resource{Name: path.Base(strings.TrimSuffix(href.Path, "/"))}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			res.IsCollection = ps.Prop.ResourceType.Collection != nil
+			res.Size = ps.Prop.ContentLength
+			if ps.Prop.LastModified != "" {
+				if t, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+					res.LastModified = t
+				}
+			}
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// MkcolAll creates the collection along with any missing parents.
+func (s *service) MkcolAll(ctx context.Context, name string) error {
+	err := s.mkcol(ctx, name)
+	if err == nil || hasStatus(err, http.StatusMethodNotAllowed) {
+		// 405 means the collection exists already
+		return nil
+	}
+	// 409 means a parent is missing
+	if !hasStatus(err, http.StatusConflict) {
+		return err
+	}
+	parent := path.Dir(strings.TrimSuffix(name, "/"))
+	if parent == name {
+		return err
+	}
+	if err := s.MkcolAll(ctx, parent); err != nil {
+		return err
+	}
+	if err := s.mkcol(ctx, name); err != nil && !hasStatus(err, http.StatusMethodNotAllowed) {
+		return err
+	}
+	return nil
+}
+
+func (s *service) mkcol(ctx context.Context, name string) error {
+	req, err := s.newRequest(ctx, methodMkcol, s.resourceURL(name, true), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create collection %v", name)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *service) Put(ctx context.Context, name string, reader io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, s.resourceURL(name, false), io.NopCloser(reader))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put %v", name)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (s *service) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, s.resourceURL(name, false), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %v", name)
+	}
+	return resp.Body, nil
+}
+
+// Move renames src to dst, replacing dst if it exists.
+func (s *service) Move(ctx context.Context, src, dst string) error {
+	req, err := s.newRequest(ctx, methodMove, s.resourceURL(src, false), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", s.resourceURL(dst, false))
+	req.Header.Set("Overwrite", "T")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to move %v to %v", src, dst)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Delete removes the resource, which is recursive for collections.
+func (s *service) Delete(ctx context.Context, name string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, s.resourceURL(name, false), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		// Someone else removed it in the meantime, which is what we wanted.
+		if hasStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to delete %v", name)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// isNotFound also reports the 409 servers return when a parent collection of
+// the resource is missing.
+func isNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound) || hasStatus(err, http.StatusConflict)
+}
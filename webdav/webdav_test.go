@@ -0,0 +1,303 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/conformance"
+)
+
+const (
+	testUsername = "backup"
+	testPassword = "secret"
+)
+
+// testWebDAVServer serves a temporary directory through the reference WebDAV
+// handler, behind basic authentication.
+type testWebDAVServer struct {
+	*httptest.Server
+	root string
+
+	mu      sync.Mutex
+	methods []string
+}
+
+func newTestWebDAVServer(t *testing.T, tls bool) *testWebDAVServer {
+	t.Helper()
+
+	s := &testWebDAVServer{root: t.TempDir()}
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(s.root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != testUsername || password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		s.methods = append(s.methods, r.Method)
+		s.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	if tls {
+		s.StartTLS()
+	} else {
+		s.Start()
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testWebDAVServer) host() string {
+	return s.Listener.Addr().String()
+}
+
+func (s *testWebDAVServer) usedMethod(method string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// files returns the paths of all the regular files below the server root.
+func (s *testWebDAVServer) files(t *testing.T) []string {
+	var files []string
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(s.root, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (s *testWebDAVServer) put(t *testing.T, name string, data []byte) {
+	path := filepath.Join(s.root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestDriver(t *testing.T) (backupstore.BackupStoreDriver, *testWebDAVServer) {
+	t.Helper()
+
+	server := newTestWebDAVServer(t, false)
+	t.Setenv("WEBDAV_USERNAME", testUsername)
+	t.Setenv("WEBDAV_PASSWORD", testPassword)
+
+	driver, err := initFunc("webdav://" + server.host() + "/backupstore-root")
+	if err != nil {
+		t.Fatalf("failed to initialize the driver: %v", err)
+	}
+	return driver, server
+}
+
+func TestInitFuncValidatesURL(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestWebDAVServer(t, false)
+	t.Setenv("WEBDAV_USERNAME", testUsername)
+	t.Setenv("WEBDAV_PASSWORD", testPassword)
+
+	_, err := initFunc("s3://" + server.host() + "/path")
+	assert.ErrorContains(err, "BUG")
+
+	_, err = initFunc("webdav://" + server.host())
+	assert.ErrorContains(err, "invalid URL")
+
+	driver, err := initFunc("webdav://" + server.host() + "/path")
+	assert.NoError(err)
+	assert.Equal("webdav://"+server.host()+"/path", driver.GetURL())
+	assert.Equal(KIND, driver.Kind())
+}
+
+func TestInitFuncUsesBasicAuth(t *testing.T) {
+	server := newTestWebDAVServer(t, false)
+	t.Setenv("WEBDAV_USERNAME", testUsername)
+	t.Setenv("WEBDAV_PASSWORD", "wrong")
+
+	_, err := initFunc("webdav://" + server.host() + "/path")
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestWebDAVSTrustsCustomCerts(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestWebDAVServer(t, true)
+	t.Setenv("WEBDAV_USERNAME", testUsername)
+	t.Setenv("WEBDAV_PASSWORD", testPassword)
+	destURL := "webdavs://" + server.host() + "/path"
+
+	t.Setenv("WEBDAV_CERT", "")
+	_, err := initFunc(destURL)
+	assert.ErrorContains(err, "certificate")
+
+	t.Setenv("WEBDAV_CERT", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	driver, err := initFunc(destURL)
+	assert.NoError(err)
+	assert.Equal(KIND_HTTPS, driver.Kind())
+
+	assert.NoError(driver.Write("volume.cfg", strings.NewReader("{}")))
+	assert.True(driver.FileExists("volume.cfg"))
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+
+	payload := []byte("backup block payload")
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", bytes.NewReader(payload)))
+	// The temporary file is moved into place
+	assert.Equal([]string{"backupstore-root/backupstore/volumes/vol-1/volume.cfg"}, server.files(t))
+	assert.True(server.usedMethod("MOVE"))
+
+	assert.True(driver.FileExists("backupstore/volumes/vol-1/volume.cfg"))
+	assert.Equal(int64(len(payload)), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+
+	rc, err := driver.Read("backupstore/volumes/vol-1/volume.cfg")
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal(payload, data)
+
+	// Overwriting an existing file replaces it
+	assert.NoError(driver.Write("backupstore/volumes/vol-1/volume.cfg", strings.NewReader("updated")))
+	assert.Equal(int64(len("updated")), driver.FileSize("backupstore/volumes/vol-1/volume.cfg"))
+
+	// Collections are not files
+	assert.False(driver.FileExists("backupstore/volumes/vol-1"))
+
+	assert.False(driver.FileExists("backupstore/volumes/vol-1/missing.cfg"))
+	assert.Equal(int64(-1), driver.FileSize("backupstore/volumes/vol-1/missing.cfg"))
+	assert.True(driver.FileTime("backupstore/volumes/vol-1/missing.cfg").IsZero())
+
+	_, err = driver.Read("backupstore/volumes/vol-1/missing.cfg")
+	assert.ErrorContains(err, "404")
+}
+
+func TestFileTimeIsServerTimeInUTC(t *testing.T) {
+	driver, server := newTestDriver(t)
+
+	server.put(t, "backupstore-root/locks/lock-1.lck", []byte("{}"))
+	modified := time.Date(2026, 3, 1, 12, 30, 0, 0, time.FixedZone("UTC+8", 8*60*60))
+	assert.NoError(t, os.Chtimes(filepath.Join(server.root, "backupstore-root/locks/lock-1.lck"), modified, modified))
+
+	fileTime := driver.FileTime("locks/lock-1.lck")
+	assert.True(t, modified.Equal(fileTime))
+	assert.Equal(t, time.UTC, fileTime.Location())
+}
+
+func TestListBehavesLikeLs(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/backups/backup_a.cfg",
+		"volumes/vol-1/backups/backup b.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(t, filepath.Join("backupstore-root", name), []byte("x"))
+	}
+
+	names, err := driver.List("volumes/vol-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	names, err = driver.List("volumes/vol-1/")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"volume.cfg", "backups", "blocks"}, names)
+
+	// The names are unescaped
+	names, err = driver.List("volumes/vol-1/backups")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup_a.cfg", "backup b.cfg"}, names)
+
+	names, err = driver.List("volumes/missing")
+	assert.NoError(err)
+	assert.Empty(names)
+
+	names, err = driver.List("volumes/missing/deeper")
+	assert.NoError(err)
+	assert.Empty(names)
+}
+
+func TestRemoveIsRecursive(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+	for _, name := range []string{
+		"volumes/vol-1/volume.cfg",
+		"volumes/vol-1/blocks/aa/bb/aabb.blk",
+		"volumes/vol-2/volume.cfg",
+	} {
+		server.put(t, filepath.Join("backupstore-root", name), []byte("x"))
+	}
+
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+	assert.Equal([]string{"backupstore-root/volumes/vol-2/volume.cfg"}, server.files(t))
+
+	// Removing something that is already gone is not an error, just like "rm -rf".
+	assert.NoError(driver.Remove("volumes/vol-1/"))
+	assert.NoError(driver.Remove("volumes/vol-2/missing.cfg"))
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	assert := assert.New(t)
+
+	driver, server := newTestDriver(t)
+
+	src := filepath.Join(t.TempDir(), "src")
+	assert.NoError(os.WriteFile(src, []byte("file content"), 0600))
+	assert.NoError(driver.Upload(src, "backing-images/image.cfg"))
+	assert.Equal([]string{"backupstore-root/backing-images/image.cfg"}, server.files(t))
+
+	dst := filepath.Join(t.TempDir(), "nested", "dst")
+	assert.NoError(driver.Download("backing-images/image.cfg", dst))
+	data, err := os.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal([]byte("file content"), data)
+
+	assert.Error(driver.Download("backing-images/missing.cfg", dst))
+}
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) backupstore.BackupStoreDriver {
+		driver, _ := newTestDriver(t)
+		return driver
+	})
+}